@@ -0,0 +1,370 @@
+// Command storeinspect looks inside the files of a store.ValueStore or
+// store.GroupStore while the store isn't running, and can rewrite a damaged
+// toc file with just its valid entries.
+//
+// Files are told apart by their names, .value and .valuetoc files for a
+// ValueStore and .group and .grouptoc files for a GroupStore; directories
+// may hold either or both.
+//
+//	storeinspect list <tocdir>
+//	storeinspect dump [-format json|csv] <tocfile>
+//	storeinspect lookup <tocdir> <keyA> <keyB> [<childKeyA> <childKeyB>]
+//	storeinspect verify <valuesfile>...
+//	storeinspect stale <tocdir>
+//	storeinspect repair [-data <valuesfile>] <tocfile> <newtocfile>
+//
+// Keys may be given in decimal or, with a 0x prefix, in hex. The repaired
+// toc file is written to a new path so the original can be kept until the
+// store has been restarted with the new one in its place; the values file
+// defaults to the toc file's path without the "toc" suffix. Repair reports
+// the entries it kept, those it dropped as invalid, and those lost to
+// unreadable blocks of the damaged toc file.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gholt/store"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "list":
+		err = list(args)
+	case "dump":
+		err = dump(args)
+	case "lookup":
+		err = lookup(args)
+	case "verify":
+		err = verify(args)
+	case "stale":
+		err = stale(args)
+	case "repair":
+		err = repair(args)
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: %s <command> [args]
+  list <tocdir>
+        list the toc files with their format versions and entry counts
+  dump [-format json|csv] <tocfile>
+        print the entries of a toc file
+  lookup <tocdir> <keyA> <keyB> [<childKeyA> <childKeyB>]
+        print the entries for a key from all the toc files
+  verify <valuesfile>...
+        check the checksums of values files and print any corrupt ranges
+  stale <tocdir>
+        print how much of each toc file has been superseded by newer entries
+  repair [-data <valuesfile>] <tocfile> <newtocfile>
+        write a new toc file with only the valid entries of a damaged one
+`, path.Base(os.Args[0]))
+	os.Exit(2)
+}
+
+// entry is either kind of toc entry; the child keys are only used for group
+// stores.
+type entry struct {
+	KeyA          uint64
+	KeyB          uint64
+	ChildKeyA     uint64 `json:",omitempty"`
+	ChildKeyB     uint64 `json:",omitempty"`
+	TimestampBits uint64
+	Offset        uint32
+	Length        uint32
+	Checksum      uint32
+}
+
+// key keeps value and group store keys apart in a shared directory.
+type key struct {
+	group     bool
+	keyA      uint64
+	keyB      uint64
+	childKeyA uint64
+	childKeyB uint64
+}
+
+func isGroup(name string) (bool, error) {
+	switch {
+	case strings.HasSuffix(name, ".value"), strings.HasSuffix(name, ".valuetoc"):
+		return false, nil
+	case strings.HasSuffix(name, ".group"), strings.HasSuffix(name, ".grouptoc"):
+		return true, nil
+	}
+	return false, fmt.Errorf("%s is not a value or group store file", name)
+}
+
+// tocFiles returns the names of the toc files in the directory, in order.
+func tocFiles(dir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		if strings.HasSuffix(fi.Name(), ".valuetoc") || strings.HasSuffix(fi.Name(), ".grouptoc") {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func statTOC(fullPath string) (int, int, error) {
+	group, err := isGroup(fullPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	if group {
+		return store.StatGroupTOCFile(fullPath)
+	}
+	return store.StatValueTOCFile(fullPath)
+}
+
+// readTOC calls fn with each entry of the toc file and returns the number of
+// entries read and any errors.
+func readTOC(fullPath string, fn func(e *entry)) (int, []error) {
+	group, err := isGroup(fullPath)
+	if err != nil {
+		return 0, []error{err}
+	}
+	e := &entry{}
+	if group {
+		return store.ReadGroupTOCFile(fullPath, func(ge *store.GroupFileEntry) {
+			*e = entry{ge.KeyA, ge.KeyB, ge.ChildKeyA, ge.ChildKeyB, ge.TimestampBits, ge.Offset, ge.Length, ge.Checksum}
+			fn(e)
+		})
+	}
+	return store.ReadValueTOCFile(fullPath, func(ve *store.ValueFileEntry) {
+		*e = entry{ve.KeyA, ve.KeyB, 0, 0, ve.TimestampBits, ve.Offset, ve.Length, ve.Checksum}
+		fn(e)
+	})
+}
+
+func printErrors(name string, errs []error) {
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+	}
+}
+
+func list(args []string) error {
+	if len(args) != 1 {
+		usage()
+	}
+	names, err := tocFiles(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println("file\tversion\tentries")
+	for _, name := range names {
+		version, count, err := statTOC(path.Join(args[0], name))
+		if err != nil {
+			fmt.Printf("%s\terror\t%s\n", name, err)
+			continue
+		}
+		fmt.Printf("%s\tv%d\t%d\n", name, version, count)
+	}
+	return nil
+}
+
+func dump(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	format := flags.String("format", "json", "json or csv")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	fullPath := flags.Arg(0)
+	group, err := isGroup(fullPath)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		_, errs = readTOC(fullPath, func(e *entry) {
+			enc.Encode(e)
+		})
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		header := []string{"keyA", "keyB", "timestampBits", "offset", "length", "checksum"}
+		if group {
+			header = []string{"keyA", "keyB", "childKeyA", "childKeyB", "timestampBits", "offset", "length", "checksum"}
+		}
+		w.Write(header)
+		_, errs = readTOC(fullPath, func(e *entry) {
+			record := []string{strconv.FormatUint(e.KeyA, 10), strconv.FormatUint(e.KeyB, 10)}
+			if group {
+				record = append(record, strconv.FormatUint(e.ChildKeyA, 10), strconv.FormatUint(e.ChildKeyB, 10))
+			}
+			record = append(record, strconv.FormatUint(e.TimestampBits, 10), strconv.FormatUint(uint64(e.Offset), 10), strconv.FormatUint(uint64(e.Length), 10), strconv.FormatUint(uint64(e.Checksum), 10))
+			w.Write(record)
+		})
+		w.Flush()
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	printErrors(fullPath, errs)
+	return nil
+}
+
+func lookup(args []string) error {
+	if len(args) != 3 && len(args) != 5 {
+		usage()
+	}
+	var keys []uint64
+	for _, arg := range args[1:] {
+		k, err := strconv.ParseUint(arg, 0, 64)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, k)
+	}
+	names, err := tocFiles(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println("file\tchildKeyA\tchildKeyB\ttimestampBits\toffset\tlength")
+	for _, name := range names {
+		group, _ := isGroup(name)
+		// Child keys only narrow down group store lookups.
+		if !group && len(keys) > 2 {
+			continue
+		}
+		_, errs := readTOC(path.Join(args[0], name), func(e *entry) {
+			if e.KeyA != keys[0] || e.KeyB != keys[1] {
+				return
+			}
+			if len(keys) > 2 && (e.ChildKeyA != keys[2] || e.ChildKeyB != keys[3]) {
+				return
+			}
+			fmt.Printf("%s\t%d\t%d\t%d\t%d\t%d\n", name, e.ChildKeyA, e.ChildKeyB, e.TimestampBits, e.Offset, e.Length)
+		})
+		printErrors(name, errs)
+	}
+	return nil
+}
+
+func verify(args []string) error {
+	if len(args) < 1 {
+		usage()
+	}
+	corrupt := 0
+	for _, fullPath := range args {
+		group, err := isGroup(fullPath)
+		if err != nil {
+			return err
+		}
+		var ranges []store.AuditRange
+		var verified int64
+		var errs []error
+		if group {
+			ranges, verified, errs = store.VerifyGroupFile(fullPath)
+		} else {
+			ranges, verified, errs = store.VerifyValueFile(fullPath)
+		}
+		printErrors(fullPath, errs)
+		fmt.Printf("%s: %d bytes verified, %d corrupt ranges\n", fullPath, verified, len(ranges))
+		for _, r := range ranges {
+			fmt.Printf("\t%d-%d\n", r.Start, r.Stop)
+		}
+		if len(ranges) > 0 || len(errs) > 0 {
+			corrupt++
+		}
+	}
+	if corrupt > 0 {
+		return fmt.Errorf("%d of %d files failed verification", corrupt, len(args))
+	}
+	return nil
+}
+
+func stale(args []string) error {
+	if len(args) != 1 {
+		usage()
+	}
+	names, err := tocFiles(args[0])
+	if err != nil {
+		return err
+	}
+	// The first pass finds the newest timestamp for each key, as the store
+	// would on startup; the second counts the entries that aren't it.
+	newest := make(map[key]uint64)
+	for _, name := range names {
+		group, _ := isGroup(name)
+		_, errs := readTOC(path.Join(args[0], name), func(e *entry) {
+			k := key{group, e.KeyA, e.KeyB, e.ChildKeyA, e.ChildKeyB}
+			if e.TimestampBits > newest[k] {
+				newest[k] = e.TimestampBits
+			}
+		})
+		printErrors(name, errs)
+	}
+	fmt.Println("file\tentries\tstale\tratio")
+	for _, name := range names {
+		group, _ := isGroup(name)
+		var stale int
+		count, _ := readTOC(path.Join(args[0], name), func(e *entry) {
+			k := key{group, e.KeyA, e.KeyB, e.ChildKeyA, e.ChildKeyB}
+			if e.TimestampBits < newest[k] {
+				stale++
+			}
+		})
+		ratio := 0.0
+		if count > 0 {
+			ratio = float64(stale) / float64(count)
+		}
+		fmt.Printf("%s\t%d\t%d\t%.4f\n", name, count, stale, ratio)
+	}
+	return nil
+}
+
+func repair(args []string) error {
+	flags := flag.NewFlagSet("repair", flag.ExitOnError)
+	dataPath := flags.String("data", "", "the values file; defaults to the toc file's path without the \"toc\" suffix")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		usage()
+	}
+	fullPath := flags.Arg(0)
+	newPath := flags.Arg(1)
+	group, err := isGroup(fullPath)
+	if err != nil {
+		return err
+	}
+	if *dataPath == "" {
+		*dataPath = strings.TrimSuffix(fullPath, "toc")
+	}
+	var result *store.TOCRepairResult
+	if group {
+		result, err = store.RepairGroupTOCFile(fullPath, *dataPath, newPath)
+	} else {
+		result, err = store.RepairValueTOCFile(fullPath, *dataPath, newPath)
+	}
+	if err != nil {
+		return err
+	}
+	printErrors(fullPath, result.ReadErrors)
+	fmt.Printf("%s: %d entries kept, %d dropped, %d lost\n", newPath, result.Kept, result.Dropped, result.Lost)
+	return nil
+}
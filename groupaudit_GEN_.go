@@ -1,15 +1,19 @@
 package store
 
 import (
+	"encoding/json"
 	"errors"
 	"io"
+	"math"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/spaolacci/murmur3"
 	"go.uber.org/zap"
 	"golang.org/x/net/context"
 )
@@ -17,19 +21,35 @@ import (
 type groupAuditState struct {
 	interval     int
 	ageThreshold int64
+	historySize  int
+	deep         bool
+	throttle     ioThrottle
+
+	historyLock   sync.Mutex
+	historyLoaded bool
+	history       []AuditRecord
+	// historyChanged is set when records are added and cleared when the
+	// history is written to disk, once per pass.
+	historyChanged bool
 
 	startupShutdownLock sync.Mutex
 	notifyChan          chan *bgNotification
+	task                backgroundTask
 }
 
 func (store *defaultGroupStore) auditConfig(cfg *GroupStoreConfig) {
 	store.auditState.interval = cfg.AuditInterval
 	store.auditState.ageThreshold = int64(cfg.AuditAgeThreshold) * int64(time.Second)
+	store.auditState.deep = cfg.AuditDeep
+	store.auditState.historyLock.Lock()
+	store.auditState.historySize = cfg.AuditHistorySize
+	store.auditState.historyLock.Unlock()
 }
 
 func (store *defaultGroupStore) auditStartup() {
 	store.auditState.startupShutdownLock.Lock()
 	if store.auditState.notifyChan == nil {
+		store.auditState.throttle.start()
 		store.auditState.notifyChan = make(chan *bgNotification, 1)
 		go store.auditLauncher(store.auditState.notifyChan)
 	}
@@ -39,6 +59,8 @@ func (store *defaultGroupStore) auditStartup() {
 func (store *defaultGroupStore) auditShutdown() {
 	store.auditState.startupShutdownLock.Lock()
 	if store.auditState.notifyChan != nil {
+		// Otherwise a throttled pass would hold up the shutdown.
+		store.auditState.throttle.stop()
 		c := make(chan struct{}, 1)
 		store.auditState.notifyChan <- &bgNotification{
 			action:   _BG_DISABLE,
@@ -46,11 +68,14 @@ func (store *defaultGroupStore) auditShutdown() {
 		}
 		<-c
 		store.auditState.notifyChan = nil
+		store.auditState.task.stop()
 	}
 	store.auditState.startupShutdownLock.Unlock()
 }
 
 func (store *defaultGroupStore) AuditPass(ctx context.Context) error {
+	_, span := store.startSpan(ctx, "AuditPass")
+	defer span.End()
 	store.auditState.startupShutdownLock.Lock()
 	if store.auditState.notifyChan == nil {
 		store.auditPass(true, make(chan *bgNotification))
@@ -71,6 +96,7 @@ func (store *defaultGroupStore) auditLauncher(notifyChan chan *bgNotification) {
 	store.randMutex.Lock()
 	nextRun := time.Now().Add(time.Duration(interval + interval*store.rand.NormFloat64()*0.1))
 	store.randMutex.Unlock()
+	store.auditState.task.launch(nextRun)
 	var notification *bgNotification
 	running := true
 	for running {
@@ -91,6 +117,7 @@ func (store *defaultGroupStore) auditLauncher(notifyChan chan *bgNotification) {
 		store.randMutex.Lock()
 		nextRun = time.Now().Add(time.Duration(interval + interval*store.rand.NormFloat64()*0.1))
 		store.randMutex.Unlock()
+		store.auditState.task.schedule(nextRun)
 		if notification != nil {
 			var nextNotification *bgNotification
 			switch notification.action {
@@ -111,21 +138,39 @@ func (store *defaultGroupStore) auditLauncher(notifyChan chan *bgNotification) {
 	}
 }
 
-// NOTE: For now, there is no difference between speed=true and speed=false;
-// eventually the background audits will try to slow themselves down to finish
-// in approximately the store.auditState.interval.
+// auditPass audits the files as fast as it can with speed=true, as with
+// AuditPass; otherwise it's a background pass, throttled to the
+// AuditBytesPerSecond and pacing itself to finish in approximately the
+// store.auditState.interval.
 func (store *defaultGroupStore) auditPass(speed bool, notifyChan chan *bgNotification) *bgNotification {
+	store.auditState.task.begin()
 	begin := time.Now()
 	defer func() {
 		elapsed := time.Now().Sub(begin)
 		store.logger.Debug("pass completed", zap.String("name", store.loggerPrefix+"audit"), zap.Duration("elapsed", elapsed))
 		atomic.StoreInt64(&store.auditNanoseconds, elapsed.Nanoseconds())
+		store.auditPassDuration.observe(elapsed)
+		store.auditState.task.end()
+	}()
+	defer store.auditHistorySave()
+	ctx, span := store.tracer.Start(context.Background(), "GroupStore.auditPass")
+	defer span.End()
+	// fileSpan is the span of the file being audited, ended when moving on
+	// to the next file or returning.
+	var fileSpan Span
+	defer func() {
+		if fileSpan != nil {
+			fileSpan.End()
+		}
 	}()
 	names, err := store.readdirnames(store.pathtoc)
 	if err != nil {
 		store.logger.Warn("error with readdirnames", zap.String("name", store.loggerPrefix+"audit"), zap.String("path", store.pathtoc), zap.Error(err))
+		store.event(Event{Kind: EventAuditPass, Begin: begin, Err: err})
+		store.auditState.task.failed(err)
 		return nil
 	}
+	var audited int64
 	shuffledNames := make([]string, len(names))
 	store.randMutex.Lock()
 	for x, y := range store.rand.Perm(len(names)) {
@@ -133,7 +178,28 @@ func (store *defaultGroupStore) auditPass(speed bool, notifyChan chan *bgNotific
 	}
 	store.randMutex.Unlock()
 	names = shuffledNames
+	// Each file waits for its share of the interval, going by the bytes of
+	// the files before it.
+	var paceBefore []int64
+	var paceTotal int64
+	if !speed {
+		paceBefore = make([]int64, len(names))
+		for i, name := range names {
+			paceBefore[i] = paceTotal
+			if strings.HasSuffix(name, ".grouptoc") {
+				paceTotal += store.fileSetSize(name)
+			}
+		}
+	}
+	store.auditState.task.progress(0, int64(len(names)))
 	for i := 0; i < len(names); i++ {
+		if fileSpan != nil {
+			fileSpan.End()
+			fileSpan = nil
+		}
+		if i > 0 {
+			store.auditState.task.progress(1, 0)
+		}
 		select {
 		case notification := <-notifyChan:
 			return notification
@@ -159,131 +225,205 @@ func (store *defaultGroupStore) auditPass(speed bool, notifyChan chan *bgNotific
 			store.logger.Debug("skipping young", zap.String("name", store.loggerPrefix+"audit"), zap.String("name", names[i]))
 			continue
 		}
+		if paceTotal > 0 {
+			paced := time.Duration(float64(store.auditState.interval) * float64(time.Second) * float64(paceBefore[i]) / float64(paceTotal))
+			if wait := begin.Add(paced).Sub(time.Now()); wait > 0 {
+				select {
+				case notification := <-notifyChan:
+					return notification
+				case <-time.After(wait):
+				}
+			}
+		}
 		store.logger.Debug("checking", zap.String("name", store.loggerPrefix+"audit"), zap.String("name", names[i]))
-		failedAudit := uint32(0)
-		canceledAudit := uint32(0)
+		store.auditState.task.working(names[i])
+		audited++
+		var fileCtx context.Context
+		fileCtx, fileSpan = store.tracer.Start(ctx, "GroupStore.auditFile", TraceAttribute{Key: "filename", Value: names[i]})
+		blockID := store.locBlockIDFromTimestampnano(namets)
+		// tocFailed is set when the toc file itself could not be read, which
+		// is the one failure that still requires a restart.
+		tocFailed := uint32(0)
+		// corrupt are the entries with values in corrupted areas of the data
+		// file.
+		var corrupt []groupTOCEntry
+		// entries are the rest, kept for the cross-checks of a deep audit.
+		var entries []groupTOCEntry
+		corruptLock := &sync.Mutex{}
 		dataName := names[i][:len(names[i])-3]
+		var corruptions []*groupCorruptRange
+		var errs []error
+		record := AuditRecord{File: names[i]}
 		fpr, err := store.openReadSeeker(path.Join(store.path, dataName))
 		if err != nil {
-			atomic.AddUint32(&failedAudit, 1)
+			// Without the data file, every value is as good as corrupted.
+			corruptions = []*groupCorruptRange{&groupCorruptRange{0, math.MaxUint32}}
 			if store.isNotExist(err) {
 				store.logger.Debug("error opening", zap.String("name", store.loggerPrefix+"audit"), zap.String("filename", dataName), zap.Error(err))
 			} else {
 				store.logger.Warn("error opening", zap.String("name", store.loggerPrefix+"audit"), zap.String("filename", dataName), zap.Error(err))
 			}
 		} else {
-			corruptions, errs := groupChecksumVerify(fpr)
+			if !speed {
+				fpr = &throttledReadSeeker{fpr, &store.auditState.throttle}
+			}
+			corruptions, errs = groupChecksumVerify(fpr)
 			closeIfCloser(fpr)
 			for _, err := range errs {
 				if err != io.EOF && err != io.ErrUnexpectedEOF {
 					store.logger.Warn("ChecksumVerify error", zap.String("name", store.loggerPrefix+"audit"), zap.String("filename", dataName), zap.Error(err))
 				}
 			}
-			workers := uint64(1)
-			pendingBatchChans := make([]chan []groupTOCEntry, workers)
-			freeBatchChans := make([]chan []groupTOCEntry, len(pendingBatchChans))
-			for i := 0; i < len(pendingBatchChans); i++ {
-				pendingBatchChans[i] = make(chan []groupTOCEntry, 3)
-				freeBatchChans[i] = make(chan []groupTOCEntry, cap(pendingBatchChans[i]))
-				for j := 0; j < cap(freeBatchChans[i]); j++ {
-					freeBatchChans[i] <- make([]groupTOCEntry, store.recoveryBatchSize)
-				}
+		}
+		record.CorruptRanges, record.BytesVerified = groupAuditRanges(corruptions, errs)
+		workers := uint64(1)
+		pendingBatchChans := make([]chan []groupTOCEntry, workers)
+		freeBatchChans := make([]chan []groupTOCEntry, len(pendingBatchChans))
+		for i := 0; i < len(pendingBatchChans); i++ {
+			pendingBatchChans[i] = make(chan []groupTOCEntry, 3)
+			freeBatchChans[i] = make(chan []groupTOCEntry, cap(pendingBatchChans[i]))
+			for j := 0; j < cap(freeBatchChans[i]); j++ {
+				freeBatchChans[i] <- make([]groupTOCEntry, store.recoveryBatchSize)
 			}
-			nextNotificationChan := make(chan *bgNotification, 1)
-			controlChan := make(chan struct{})
-			go func() {
-				select {
-				case n := <-notifyChan:
-					if atomic.AddUint32(&canceledAudit, 1) == 0 {
-						close(controlChan)
+		}
+		nextNotificationChan := make(chan *bgNotification, 1)
+		controlChan := make(chan struct{})
+		controlChan2 := make(chan struct{})
+		go func() {
+			select {
+			case n := <-notifyChan:
+				close(controlChan)
+				nextNotificationChan <- n
+			case <-controlChan2:
+				nextNotificationChan <- nil
+			}
+		}()
+		wg := &sync.WaitGroup{}
+		wg.Add(len(pendingBatchChans))
+		for i := 0; i < len(pendingBatchChans); i++ {
+			go func(pendingBatchChan chan []groupTOCEntry, freeBatchChan chan []groupTOCEntry) {
+				for {
+					batch := <-pendingBatchChan
+					if batch == nil {
+						break
 					}
-					nextNotificationChan <- n
-				case <-controlChan:
-					nextNotificationChan <- nil
-				}
-			}()
-			wg := &sync.WaitGroup{}
-			wg.Add(len(pendingBatchChans))
-			for i := 0; i < len(pendingBatchChans); i++ {
-				go func(pendingBatchChan chan []groupTOCEntry, freeBatchChan chan []groupTOCEntry) {
-					for {
-						batch := <-pendingBatchChan
-						if batch == nil {
-							break
+					for j := 0; j < len(batch); j++ {
+						wr := &batch[j]
+						if wr.TimestampBits&_TSB_DELETION != 0 {
+							continue
 						}
-						if atomic.LoadUint32(&failedAudit) == 0 {
-							for j := 0; j < len(batch); j++ {
-								wr := &batch[j]
-								if wr.TimestampBits&_TSB_DELETION != 0 {
-									continue
-								}
-								if groupInCorruptRange(wr.Offset, wr.Length, corruptions) {
-									if atomic.AddUint32(&failedAudit, 1) == 0 {
-										close(controlChan)
-									}
-									break
-								}
-							}
+						if groupInCorruptRange(wr.Offset, wr.Length, corruptions) {
+							corruptLock.Lock()
+							corrupt = append(corrupt, *wr)
+							corruptLock.Unlock()
+						} else if store.auditState.deep {
+							corruptLock.Lock()
+							entries = append(entries, *wr)
+							corruptLock.Unlock()
 						}
-						freeBatchChan <- batch
-					}
-					wg.Done()
-				}(pendingBatchChans[i], freeBatchChans[i])
-			}
-			fpr, err = store.openReadSeeker(path.Join(store.pathtoc, names[i]))
-			if err != nil {
-				atomic.AddUint32(&failedAudit, 1)
-				if !store.isNotExist(err) {
-					store.logger.Warn("error opening", zap.String("name", store.loggerPrefix+"audit"), zap.String("filename", names[i]), zap.Error(err))
-				}
-			} else {
-				// NOTE: The block ID is unimportant in this context, so it's
-				// just set 1 and ignored elsewhere.
-				_, errs := groupReadTOCEntriesBatched(fpr, 1, freeBatchChans, pendingBatchChans, controlChan)
-				closeIfCloser(fpr)
-				if len(errs) > 0 {
-					atomic.AddUint32(&failedAudit, 1)
-					for _, err := range errs {
-						store.logger.Warn("ReadTOCEntriesBatched error", zap.String("name", store.loggerPrefix+"audit"), zap.String("filename", names[i]), zap.Error(err))
 					}
+					freeBatchChan <- batch
 				}
+				wg.Done()
+			}(pendingBatchChans[i], freeBatchChans[i])
+		}
+		fpr, err = store.openReadSeeker(path.Join(store.pathtoc, names[i]))
+		if err != nil {
+			if !store.isNotExist(err) {
+				atomic.AddUint32(&tocFailed, 1)
+				store.logger.Warn("error opening", zap.String("name", store.loggerPrefix+"audit"), zap.String("filename", names[i]), zap.Error(err))
 			}
-			for i := 0; i < len(pendingBatchChans); i++ {
-				pendingBatchChans[i] <- nil
+		} else {
+			if !speed {
+				fpr = &throttledReadSeeker{fpr, &store.auditState.throttle}
 			}
-			wg.Wait()
-			close(controlChan)
-			if n := <-nextNotificationChan; n != nil {
-				return n
+			_, errs := groupReadTOCEntriesBatched(fpr, blockID, freeBatchChans, pendingBatchChans, controlChan)
+			closeIfCloser(fpr)
+			if len(errs) > 0 {
+				atomic.AddUint32(&tocFailed, 1)
+				for _, err := range errs {
+					store.logger.Warn("ReadTOCEntriesBatched error", zap.String("name", store.loggerPrefix+"audit"), zap.String("filename", names[i]), zap.Error(err))
+				}
 			}
 		}
-		if atomic.LoadUint32(&canceledAudit) != 0 {
+		for i := 0; i < len(pendingBatchChans); i++ {
+			pendingBatchChans[i] <- nil
+		}
+		wg.Wait()
+		close(controlChan2)
+		if n := <-nextNotificationChan; n != nil {
 			store.logger.Debug("canceled during", zap.String("name", store.loggerPrefix+"audit"), zap.String("filename", names[i]))
-		} else if atomic.LoadUint32(&failedAudit) == 0 {
+			return n
+		}
+		if store.auditState.deep && atomic.LoadUint32(&tocFailed) == 0 {
+			invalid := groupAuditInvalidEntries(entries, record.BytesVerified)
+			if fl, ok := store.locBlock(blockID).(*groupStoreFile); ok && fl.version >= 1 {
+				mismatched, n := store.auditValueChecksums(speed, notifyChan, fl, entries, invalid)
+				if n != nil {
+					return n
+				}
+				invalid = append(invalid, mismatched...)
+			}
+			record.InvalidEntries = int64(len(invalid))
+			corrupt = append(corrupt, invalid...)
+		}
+		if atomic.LoadUint32(&tocFailed) == 0 && len(corrupt) == 0 {
 			store.logger.Debug("passed", zap.String("name", store.loggerPrefix+"audit"), zap.String("filename", names[i]))
+			store.auditRecord(record)
+			continue
+		}
+		fileSpan.SetAttributes(TraceAttribute{Key: "failed", Value: true})
+		store.auditState.task.failed(errors.New("audit failed for " + names[i]))
+		// Only the items the locmap still has from this file need removing;
+		// anything already superseded is just waste to be compacted away.
+		var removed int64
+		for j := range corrupt {
+			wr := &corrupt[j]
+			if store.locmapRemove(wr.KeyA, wr.KeyB, wr.ChildKeyA, wr.ChildKeyB, wr.TimestampBits, blockID) {
+				removed++
+			}
+		}
+		atomic.AddInt32(&store.auditItemsRemoved, int32(removed))
+		fileSpan.SetAttributes(TraceAttribute{Key: "corrupt", Value: uint64(len(corrupt))}, TraceAttribute{Key: "removed", Value: uint64(removed)})
+		record.AffectedKeys = int64(len(corrupt))
+		if atomic.LoadUint32(&tocFailed) == 0 {
+			store.logger.Warn("failed; removed corrupted items", zap.String("name", store.loggerPrefix+"audit"), zap.String("filename", names[i]), zap.Int("corrupt", len(corrupt)), zap.Int64("invalid", record.InvalidEntries), zap.Int64("removed", removed))
+			store.event(Event{Kind: EventAuditFailure, File: names[i], Count: int64(len(corrupt)), Changed: removed})
+			record.Action = AuditActionRepaired
 		} else {
-			store.logger.Warn("failed", zap.String("name", store.loggerPrefix+"audit"), zap.String("filename", names[i]))
-			nextNotificationChan := make(chan *bgNotification, 1)
-			controlChan := make(chan struct{})
-			controlChan2 := make(chan struct{})
-			go func() {
-				select {
-				case n := <-notifyChan:
-					close(controlChan)
-					nextNotificationChan <- n
-				case <-controlChan2:
-					nextNotificationChan <- nil
-				}
-			}()
-			store.compactFile(names[i], store.locBlockIDFromTimestampnano(namets), controlChan, "auditPass")
-			close(controlChan2)
-			if n := <-nextNotificationChan; n != nil {
-				return n
+			store.logger.Warn("failed; toc unreadable", zap.String("name", store.loggerPrefix+"audit"), zap.String("filename", names[i]))
+			store.event(Event{Kind: EventAuditFailure, File: names[i], Count: int64(len(corrupt)), Changed: removed, Err: errors.New("toc unreadable")})
+			record.Action = AuditActionRestart
+		}
+		store.auditRecord(record)
+		// The rest of the items are rewritten and the file removed, as with
+		// any compaction.
+		nextNotificationChan = make(chan *bgNotification, 1)
+		controlChan = make(chan struct{})
+		controlChan2 = make(chan struct{})
+		go func() {
+			select {
+			case n := <-notifyChan:
+				close(controlChan)
+				nextNotificationChan <- n
+			case <-controlChan2:
+				nextNotificationChan <- nil
 			}
+		}()
+		store.compactFile(fileCtx, names[i], blockID, controlChan, "auditPass", nil)
+		close(controlChan2)
+		if n := <-nextNotificationChan; n != nil {
+			return n
+		}
+		if atomic.LoadUint32(&tocFailed) != 0 {
+			name := names[i]
+			// Whatever the toc still had unread may be in the locmap from
+			// recovery with nothing left to find it by, so a restart is the
+			// only way to be sure.
 			go func() {
-				store.logger.Warn("all audit actions require store restarts at this time", zap.String("name", store.loggerPrefix+"audit"))
+				store.logger.Warn("toc audit failure requires a store restart", zap.String("name", store.loggerPrefix+"audit"), zap.String("filename", name))
 				store.Shutdown(context.Background())
-				store.restartChan <- errors.New("audit failure occurred requiring a restart")
+				store.requestRestart(errors.New("audit found an unreadable toc file requiring a restart"))
 			}()
 			return &bgNotification{
 				action:   _BG_DISABLE,
@@ -291,5 +431,235 @@ func (store *defaultGroupStore) auditPass(speed bool, notifyChan chan *bgNotific
 			}
 		}
 	}
+	store.event(Event{Kind: EventAuditPass, Begin: begin, Count: audited})
 	return nil
 }
+
+// groupAuditRanges converts the results of groupChecksumVerify into the
+// corrupt ranges to report and the number of bytes verified. The last range
+// is usually just the end of the file, past the last checksummed block, and
+// isn't reported as corruption.
+func groupAuditRanges(corruptions []*groupCorruptRange, errs []error) ([]AuditRange, int64) {
+	var verified int64
+	if n := len(corruptions); n > 0 && corruptions[n-1].start > 0 && len(errs) > 0 && (errs[len(errs)-1] == io.EOF || errs[len(errs)-1] == io.ErrUnexpectedEOF) {
+		verified = int64(corruptions[n-1].start)
+		corruptions = corruptions[:n-1]
+	}
+	var ranges []AuditRange
+	for _, r := range corruptions {
+		ranges = append(ranges, AuditRange{Start: r.start, Stop: r.stop})
+	}
+	return ranges, verified
+}
+
+// groupAuditInvalidEntries returns the entries that point into the file
+// header, past the dataLength if it's known, or at bytes another entry also
+// points at; each of the entries overlapping is returned. The entries are
+// sorted by offset in the process.
+func groupAuditInvalidEntries(entries []groupTOCEntry, dataLength int64) []groupTOCEntry {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Offset < entries[j].Offset
+	})
+	invalid := make([]bool, len(entries))
+	// reach is how far the entries so far reach into the file and
+	// reacher the index of the entry that reaches there.
+	var reach int64
+	reacher := -1
+	for i := range entries {
+		wr := &entries[i]
+		// Zero length values have no bytes to be wrong about.
+		if wr.Length == 0 {
+			continue
+		}
+		start := int64(wr.Offset)
+		stop := start + int64(wr.Length)
+		if start < _GROUP_FILE_HEADER_SIZE || (dataLength > 0 && stop > dataLength) {
+			invalid[i] = true
+		}
+		if reacher >= 0 && start < reach {
+			invalid[i] = true
+			invalid[reacher] = true
+		}
+		if stop > reach {
+			reach = stop
+			reacher = i
+		}
+	}
+	var rv []groupTOCEntry
+	for i := range entries {
+		if invalid[i] {
+			rv = append(rv, entries[i])
+		}
+	}
+	return rv
+}
+
+// auditValueChecksums reads the values of the entries from the v1 file,
+// skipping those already found invalid, and returns the entries whose values
+// can't be read or don't match their checksums. Any notification that
+// arrives in the meantime stops the checks and is returned.
+func (store *defaultGroupStore) auditValueChecksums(speed bool, notifyChan chan *bgNotification, fl *groupStoreFile, entries []groupTOCEntry, invalid []groupTOCEntry) ([]groupTOCEntry, *bgNotification) {
+	skip := make(map[uint32]bool, len(invalid))
+	for _, wr := range invalid {
+		skip[wr.Offset] = true
+	}
+	var mismatched []groupTOCEntry
+	var value []byte
+	for i := range entries {
+		select {
+		case notification := <-notifyChan:
+			return nil, notification
+		default:
+		}
+		wr := &entries[i]
+		if skip[wr.Offset] {
+			continue
+		}
+		var err error
+		_, value, err = fl.read(wr.KeyA, wr.KeyB, wr.ChildKeyA, wr.ChildKeyB, wr.TimestampBits, wr.Offset, wr.Length, value[:0])
+		if err != nil || murmur3.Sum32(value) != wr.Checksum {
+			mismatched = append(mismatched, *wr)
+		}
+		if !speed {
+			store.auditState.throttle.wait(int64(wr.Length))
+		}
+	}
+	return mismatched, nil
+}
+
+// AuditReport returns the audit history, loading it from disk the first time
+// if need be.
+func (store *defaultGroupStore) AuditReport(ctx context.Context) (*AuditReport, error) {
+	_, span := store.startSpan(ctx, "AuditReport")
+	defer span.End()
+	store.auditState.historyLock.Lock()
+	store.auditHistoryLoad()
+	report := &AuditReport{Records: make([]AuditRecord, len(store.auditState.history))}
+	copy(report.Records, store.auditState.history)
+	store.auditState.historyLock.Unlock()
+	for _, record := range report.Records {
+		if record.Action != AuditActionNone {
+			report.FilesFailed++
+		}
+	}
+	return report, nil
+}
+
+// auditRecord adds the record to the history, trimmed to the historySize
+// as with groupAuditHistoryTrim; the history is written back to disk at the
+// end of the pass.
+func (store *defaultGroupStore) auditRecord(record AuditRecord) {
+	if record.Action == AuditActionNone {
+		atomic.AddInt32(&store.auditFilesPassed, 1)
+	} else {
+		atomic.AddInt32(&store.auditFilesFailed, 1)
+	}
+	record.Time = time.Now()
+	store.auditState.historyLock.Lock()
+	defer store.auditState.historyLock.Unlock()
+	store.auditHistoryLoad()
+	store.auditState.history = groupAuditHistoryTrim(append(store.auditState.history, record), store.auditState.historySize)
+	store.auditState.historyChanged = true
+}
+
+// auditHistorySave writes the history back to disk if records were added
+// since it was last written.
+func (store *defaultGroupStore) auditHistorySave() {
+	store.auditState.historyLock.Lock()
+	defer store.auditState.historyLock.Unlock()
+	if !store.auditState.historyChanged {
+		return
+	}
+	if err := store.auditHistoryWrite(store.auditState.history); err != nil {
+		store.logger.Warn("error writing audit history", zap.String("name", store.loggerPrefix+"audit"), zap.String("path", store.auditHistoryPath()), zap.Error(err))
+		return
+	}
+	store.auditState.historyChanged = false
+}
+
+// groupAuditHistoryTrim returns the history with no more than size records,
+// dropping the oldest passed records first so a pass over many healthy files
+// doesn't push out the failures; failures are only dropped for newer
+// failures.
+func groupAuditHistoryTrim(history []AuditRecord, size int) []AuditRecord {
+	excess := len(history) - size
+	if excess <= 0 {
+		return history
+	}
+	var passed int
+	for _, record := range history {
+		if record.Action == AuditActionNone {
+			passed++
+		}
+	}
+	dropPassed := excess
+	if dropPassed > passed {
+		dropPassed = passed
+	}
+	dropFailed := excess - dropPassed
+	trimmed := make([]AuditRecord, 0, size)
+	for _, record := range history {
+		if record.Action == AuditActionNone {
+			if dropPassed > 0 {
+				dropPassed--
+				continue
+			}
+		} else if dropFailed > 0 {
+			dropFailed--
+			continue
+		}
+		trimmed = append(trimmed, record)
+	}
+	return trimmed
+}
+
+func (store *defaultGroupStore) auditHistoryPath() string {
+	return path.Join(store.pathtoc, "groupaudithistory.json")
+}
+
+// auditHistoryLoad reads the history from disk if it hasn't been already;
+// the historyLock must be held. A history that can't be read is started
+// over.
+func (store *defaultGroupStore) auditHistoryLoad() {
+	if store.auditState.historyLoaded {
+		return
+	}
+	store.auditState.historyLoaded = true
+	fullpath := store.auditHistoryPath()
+	fpr, err := store.openReadSeeker(fullpath)
+	if err != nil {
+		if !store.isNotExist(err) {
+			store.logger.Warn("error opening audit history", zap.String("name", store.loggerPrefix+"audit"), zap.String("path", fullpath), zap.Error(err))
+		}
+		return
+	}
+	var history []AuditRecord
+	err = json.NewDecoder(fpr).Decode(&history)
+	closeIfCloser(fpr)
+	if err != nil {
+		if err != io.EOF {
+			store.logger.Warn("error reading audit history", zap.String("name", store.loggerPrefix+"audit"), zap.String("path", fullpath), zap.Error(err))
+		}
+		return
+	}
+	store.auditState.history = groupAuditHistoryTrim(history, store.auditState.historySize)
+}
+
+// auditHistoryWrite writes the history to a temporary file and renames it
+// into place, so a failed write leaves the previous history intact.
+func (store *defaultGroupStore) auditHistoryWrite(history []AuditRecord) error {
+	fullpath := store.auditHistoryPath()
+	fp, err := store.createWriteCloser(fullpath + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(fp).Encode(history)
+	if cerr := fp.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		store.remove(fullpath + ".tmp")
+		return err
+	}
+	return store.rename(fullpath+".tmp", fullpath)
+}
@@ -0,0 +1,27 @@
+package store
+
+import (
+	"golang.org/x/net/context"
+)
+
+// BackgroundStatus returns what each of the background tasks is doing, in a
+// fixed order: tombstone discard, compaction, audit, out pull replication,
+// push replication, handoff, hinted handoff, the bulk-set and bulk-set-ack
+// workers, the flusher, and the watcher.
+func (store *defaultGroupStore) BackgroundStatus(ctx context.Context) ([]BackgroundTaskStatus, error) {
+	_, span := store.startSpan(ctx, "BackgroundStatus")
+	defer span.End()
+	return []BackgroundTaskStatus{
+		store.tombstoneDiscardState.task.snapshot("TombstoneDiscard"),
+		store.compactionState.task.snapshot("Compaction"),
+		store.auditState.task.snapshot("Audit"),
+		store.pullReplicationState.outTask.snapshot("OutPullReplication"),
+		store.pushReplicationState.task.snapshot("PushReplication"),
+		store.handoffState.task.snapshot("Handoff"),
+		store.hintedHandoffState.task.snapshot("HintedHandoff"),
+		store.bulkSetState.inTask.snapshot("InBulkSet"),
+		store.bulkSetAckState.inTask.snapshot("InBulkSetAck"),
+		store.flusherState.task.snapshot("Flusher"),
+		store.watcherState.task.snapshot("Watcher"),
+	}, nil
+}
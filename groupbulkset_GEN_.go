@@ -8,11 +8,13 @@ import (
 	"time"
 
 	"go.uber.org/zap"
+	"golang.org/x/net/context"
 )
 
 // bsm: senderNodeID:8 entries:n
 // bsm entry: keyA:8, keyB:8, childKeyA:8, childKeyB:8, timestampbits:8, length:4, value:n
 const _GROUP_BULK_SET_MSG_TYPE = 0xbe53367e1994c262
+const _GROUP_AUTH_BULK_SET_MSG_TYPE = 0xbc629eb97e31e2e0
 const _GROUP_BULK_SET_MSG_HEADER_LENGTH = 8
 const _GROUP_BULK_SET_MSG_ENTRY_HEADER_LENGTH = 44
 const _GROUP_BULK_SET_MSG_MIN_ENTRY_LENGTH = 44
@@ -23,9 +25,12 @@ type groupBulkSetState struct {
 	inResponseMsgTimeout time.Duration
 	inBulkSetMsgs        int
 	outBulkSetMsgs       int
+	inLimiter            rateLimiter
+	outLimiter           rateLimiter
 
 	startupShutdownLock sync.Mutex
 	inNotifyChan        chan *bgNotification
+	inTask              backgroundTask
 	inMsgChan           chan *groupBulkSetMsg
 	inFreeMsgChan       chan *groupBulkSetMsg
 	outFreeMsgChan      chan *groupBulkSetMsg
@@ -43,12 +48,19 @@ func (store *defaultGroupStore) bulkSetConfig(cfg *GroupStoreConfig) {
 	store.bulkSetState.inResponseMsgTimeout = time.Duration(cfg.InBulkSetResponseMsgTimeout) * time.Millisecond
 	store.bulkSetState.inBulkSetMsgs = cfg.InBulkSetMsgs
 	store.bulkSetState.outBulkSetMsgs = cfg.OutBulkSetMsgs
+	store.bulkSetState.inLimiter.set(cfg.InBulkSetBytesPerSecond, cfg.InBulkSetMsgsPerSecond)
+	store.bulkSetState.outLimiter.set(cfg.OutBulkSetBytesPerSecond, cfg.OutBulkSetMsgsPerSecond)
 	if store.msgRing != nil {
 		store.msgRing.SetMsgHandler(_GROUP_BULK_SET_MSG_TYPE, store.newInBulkSetMsg)
+		store.msgRing.SetMsgHandler(_GROUP_AUTH_BULK_SET_MSG_TYPE, store.newInAuthBulkSetMsg)
+		store.msgRing.SetMsgHandler(_GROUP_COMPRESSED_BULK_SET_MSG_TYPE, store.newInCompressedBulkSetMsg)
+		store.msgRing.SetMsgHandler(_GROUP_AUTH_COMPRESSED_BULK_SET_MSG_TYPE, store.newInAuthCompressedBulkSetMsg)
 	}
 }
 
 func (store *defaultGroupStore) bulkSetStartup() {
+	store.bulkSetState.inLimiter.start()
+	store.bulkSetState.outLimiter.start()
 	store.bulkSetState.startupShutdownLock.Lock()
 	if store.bulkSetState.inNotifyChan == nil {
 		store.bulkSetState.inNotifyChan = make(chan *bgNotification, 1)
@@ -69,12 +81,17 @@ func (store *defaultGroupStore) bulkSetStartup() {
 				body:   make([]byte, store.bulkSetState.msgCap),
 			}
 		}
+		store.bulkSetState.inTask.launch(time.Time{})
 		go store.inBulkSetLauncher(store.bulkSetState.inNotifyChan)
 	}
 	store.bulkSetState.startupShutdownLock.Unlock()
 }
 
 func (store *defaultGroupStore) bulkSetShutdown() {
+	// Stopping the limiters first keeps anything waiting on them from
+	// holding up the shutdown.
+	store.bulkSetState.inLimiter.stop()
+	store.bulkSetState.outLimiter.stop()
 	store.bulkSetState.startupShutdownLock.Lock()
 	if store.bulkSetState.inNotifyChan != nil {
 		c := make(chan struct{}, 1)
@@ -84,6 +101,7 @@ func (store *defaultGroupStore) bulkSetShutdown() {
 		}
 		<-c
 		store.bulkSetState.inNotifyChan = nil
+		store.bulkSetState.inTask.stop()
 		store.bulkSetState.inMsgChan = nil
 		store.bulkSetState.inFreeMsgChan = nil
 		store.bulkSetState.outFreeMsgChan = nil
@@ -114,95 +132,217 @@ func (store *defaultGroupStore) inBulkSetLauncher(notifyChan chan *bgNotificatio
 	}
 }
 
-// newInBulkSetMsg reads bulk-set messages from the MsgRing and puts them on
-// the inMsgChan for the inBulkSet workers to work on.
+// newInBulkSetMsg reads unauthenticated bulk-set messages from the MsgRing and
+// puts them on the inMsgChan for the inBulkSet workers to work on.
 func (store *defaultGroupStore) newInBulkSetMsg(r io.Reader, l uint64) (uint64, error) {
+	return store.receiveBulkSetMsg(r, l, false)
+}
+
+// newInCompressedBulkSetMsg is newInBulkSetMsg for compressed messages.
+func (store *defaultGroupStore) newInCompressedBulkSetMsg(r io.Reader, l uint64) (uint64, error) {
+	return store.receiveBulkSetMsg(r, l, true)
+}
+
+func (store *defaultGroupStore) receiveBulkSetMsg(r io.Reader, l uint64, compressed bool) (uint64, error) {
+	if store.msgAuthState.requireAuth {
+		n, err := tossRead(r, l)
+		if err != nil {
+			atomic.AddInt32(&store.inBulkSetInvalids, 1)
+			return n, err
+		}
+		atomic.AddInt32(&store.inBulkSetRejects, 1)
+		store.logger.Warn("rejected unauthenticated incoming message", zap.String("name", store.loggerPrefix+"inBulkSet"))
+		return n, nil
+	}
+	// Each chunk goes straight to the workers, which free it again, so
+	// waiting on the free messages for the next chunk is fine.
+	var queued bool
+	n, err := store.readInBulkSetMsgCompressed(r, l, compressed, true, func(bsm *groupBulkSetMsg) {
+		store.bulkSetState.inMsgChan <- bsm
+		queued = true
+	})
+	if queued {
+		atomic.AddInt32(&store.inBulkSets, 1)
+	}
+	return n, err
+}
+
+// newInAuthBulkSetMsg reads authenticated bulk-set messages from the MsgRing
+// and puts them on the inMsgChan for the inBulkSet workers to work on.
+func (store *defaultGroupStore) newInAuthBulkSetMsg(r io.Reader, l uint64) (uint64, error) {
+	return store.receiveAuthBulkSetMsg(r, l, false)
+}
+
+// newInAuthCompressedBulkSetMsg is newInAuthBulkSetMsg for compressed messages.
+func (store *defaultGroupStore) newInAuthCompressedBulkSetMsg(r io.Reader, l uint64) (uint64, error) {
+	return store.receiveAuthBulkSetMsg(r, l, true)
+}
+
+func (store *defaultGroupStore) receiveAuthBulkSetMsg(r io.Reader, l uint64, compressed bool) (uint64, error) {
+	// The chunks can't be worked on until the whole message has verified, so
+	// they're held here and reading doesn't wait on the free messages for
+	// more; these held chunks would never be freed to satisfy the wait.
+	var bsms []*groupBulkSetMsg
+	nodeID, ok, n, err := store.readInAuthMsg(r, l, func(r io.Reader, l uint64) (uint64, error) {
+		return store.readInBulkSetMsgCompressed(r, l, compressed, false, func(bsm *groupBulkSetMsg) {
+			bsms = append(bsms, bsm)
+		})
+	})
+	if ok {
+		for _, bsm := range bsms {
+			store.bulkSetState.inMsgChan <- bsm
+		}
+		if len(bsms) > 0 {
+			atomic.AddInt32(&store.inBulkSets, 1)
+		}
+		return n, err
+	}
+	for _, bsm := range bsms {
+		store.bulkSetState.inFreeMsgChan <- bsm
+	}
+	if err == nil {
+		atomic.AddInt32(&store.inBulkSetRejects, 1)
+		store.logger.Warn("rejected unverified incoming message", zap.String("name", store.loggerPrefix+"inBulkSet"), zap.Uint64("nodeID", nodeID))
+	}
+	return n, err
+}
+
+// readInBulkSetMsgCompressed is readInBulkSetMsg for possibly compressed
+// messages.
+func (store *defaultGroupStore) readInBulkSetMsgCompressed(r io.Reader, l uint64, compressed bool, wait bool, queue func(*groupBulkSetMsg)) (uint64, error) {
+	if !compressed {
+		return store.readInBulkSetMsg(r, l, wait, queue)
+	}
+	return store.readInCompressedMsg(r, l, func(r io.Reader, l uint64) (uint64, error) {
+		return store.readInBulkSetMsg(r, l, wait, queue)
+	})
+}
+
+// readInBulkSetMsg reads a bulk-set message, handing it to queue as one or
+// more chunks of whole entries.
+//
+// Each chunk is capped to the local msgCap so that a node with a
+// misconfigured, far too large cap can't cause memory issues on every node it
+// sends bulk-set messages to. An entry that would overflow the current chunk
+// starts the next one instead; only an entry too large for any chunk is
+// discarded. Senders rebuild the same messages each pass, so nothing else can
+// be left out without leaving a permanent hole.
+//
+// The first chunk is only taken if a free groupBulkSetMsg is available,
+// otherwise the whole message is discarded. Later chunks are waited for if
+// wait is true; otherwise the rest of the message is discarded if there are no
+// more free messages.
+func (store *defaultGroupStore) readInBulkSetMsg(r io.Reader, l uint64, wait bool, queue func(*groupBulkSetMsg)) (uint64, error) {
 	var bsm *groupBulkSetMsg
 	select {
 	case bsm = <-store.bulkSetState.inFreeMsgChan:
 	default:
 		// If there isn't a free groupBulkSetMsg, just read and discard the
 		// incoming bulk-set message.
-		left := l
-		var sn int
-		var err error
-		for left > 0 {
-			t := toss
-			if left < uint64(len(t)) {
-				t = t[:left]
-			}
-			sn, err = r.Read(t)
-			left -= uint64(sn)
-			if err != nil {
-				atomic.AddInt32(&store.inBulkSetInvalids, 1)
-				return l - left, err
-			}
+		n, err := tossRead(r, l)
+		if err != nil {
+			atomic.AddInt32(&store.inBulkSetInvalids, 1)
+			return n, err
 		}
 		atomic.AddInt32(&store.inBulkSetDrops, 1)
-		return l, nil
+		return n, nil
 	}
 	// If the message is obviously too short, just throw it away.
 	if l < _GROUP_BULK_SET_MSG_HEADER_LENGTH+_GROUP_BULK_SET_MSG_MIN_ENTRY_LENGTH {
 		store.bulkSetState.inFreeMsgChan <- bsm
-		left := l
-		var sn int
-		var err error
-		for left > 0 {
-			t := toss
-			if left < uint64(len(t)) {
-				t = t[:left]
-			}
-			sn, err = r.Read(t)
-			left -= uint64(sn)
+		n, err := tossRead(r, l)
+		atomic.AddInt32(&store.inBulkSetInvalids, 1)
+		return n, err
+	}
+	sn, err := readFull(r, bsm.header)
+	if err != nil {
+		store.bulkSetState.inFreeMsgChan <- bsm
+		atomic.AddInt32(&store.inBulkSetInvalids, 1)
+		return uint64(sn), err
+	}
+	left := l - uint64(len(bsm.header))
+	bsm.body = bsm.body[:0]
+	var entryHeader [_GROUP_BULK_SET_MSG_ENTRY_HEADER_LENGTH]byte
+	for left >= uint64(len(entryHeader)) {
+		sn, err = readFull(r, entryHeader[:])
+		left -= uint64(sn)
+		if err != nil {
+			break
+		}
+		el := uint64(binary.BigEndian.Uint32(entryHeader[len(entryHeader)-4:]))
+		if el > left {
+			// A truncated trailing entry; discarded with the rest below.
+			break
+		}
+		size := uint64(len(entryHeader)) + el
+		if size > uint64(cap(bsm.body)) {
+			var tn uint64
+			tn, err = tossRead(r, el)
+			left -= tn
 			if err != nil {
-				atomic.AddInt32(&store.inBulkSetInvalids, 1)
-				return l - left, err
+				break
 			}
+			atomic.AddInt32(&store.inBulkSetOversizes, 1)
+			store.logger.Warn("discarded oversized incoming entry", zap.String("name", store.loggerPrefix+"inBulkSet"), zap.Uint64("nodeID", bsm.nodeID()), zap.Uint64("length", size), zap.Int("cap", cap(bsm.body)))
+			continue
 		}
-		atomic.AddInt32(&store.inBulkSetInvalids, 1)
-		return l, nil
-	}
-	var n int
-	var sn int
-	var err error
-	for n != len(bsm.header) {
-		sn, err = r.Read(bsm.header[n:])
-		n += sn
+		if uint64(len(bsm.body))+size > uint64(cap(bsm.body)) {
+			// The full chunk is queued first as, with wait, freeing it may be
+			// the only way to get the next.
+			var header [_GROUP_BULK_SET_MSG_HEADER_LENGTH]byte
+			copy(header[:], bsm.header)
+			queue(bsm)
+			bsm = nil
+			if wait {
+				bsm = <-store.bulkSetState.inFreeMsgChan
+			} else {
+				select {
+				case bsm = <-store.bulkSetState.inFreeMsgChan:
+				default:
+				}
+			}
+			if bsm == nil {
+				var tn uint64
+				tn, err = tossRead(r, left)
+				left -= tn
+				if err == nil {
+					atomic.AddInt32(&store.inBulkSetDrops, 1)
+				}
+				break
+			}
+			copy(bsm.header, header[:])
+			bsm.body = bsm.body[:0]
+		}
+		start := len(bsm.body)
+		bsm.body = bsm.body[:uint64(start)+size]
+		copy(bsm.body[start:], entryHeader[:])
+		sn, err = readFull(r, bsm.body[start+len(entryHeader):])
+		left -= uint64(sn)
 		if err != nil {
-			store.bulkSetState.inFreeMsgChan <- bsm
+			bsm.body = bsm.body[:start]
+			break
+		}
+	}
+	if err == nil && left > 0 {
+		// Trailing bytes that can't be a whole entry.
+		var tn uint64
+		tn, err = tossRead(r, left)
+		left -= tn
+		if err == nil {
 			atomic.AddInt32(&store.inBulkSetInvalids, 1)
-			return uint64(n), err
 		}
 	}
-	l -= uint64(len(bsm.header))
-	// TODO: I think we should cap the body size to store.bulkSetState.msgCap
-	// but that also means that the inBulkSet worker will need to handle the
-	// likely trailing truncated entry. Once all this is done, the overall
-	// cluster should work even if the caps are set differently from node to
-	// node (definitely not recommended though), as the bulk-set messages would
-	// eventually start falling under the minimum cap as the front-end data is
-	// tranferred and acknowledged. Anyway, I think this is needed in case
-	// someone accidentally screws up the cap on one node, making it way too
-	// big. Rather just have that one node abuse/run-out-of memory instead of
-	// it causing every other node it sends bulk-set messages to also have
-	// memory issues.
-	if l > uint64(cap(bsm.body)) {
-		bsm.body = make([]byte, l)
+	if err != nil {
+		atomic.AddInt32(&store.inBulkSetInvalids, 1)
 	}
-	bsm.body = bsm.body[:l]
-	n = 0
-	for n != len(bsm.body) {
-		sn, err = r.Read(bsm.body[n:])
-		n += sn
-		if err != nil {
+	if bsm != nil {
+		if len(bsm.body) > 0 {
+			queue(bsm)
+		} else {
 			store.bulkSetState.inFreeMsgChan <- bsm
-			atomic.AddInt32(&store.inBulkSetInvalids, 1)
-			return uint64(len(bsm.header)) + uint64(n), err
 		}
 	}
-	store.bulkSetState.inMsgChan <- bsm
-	atomic.AddInt32(&store.inBulkSets, 1)
-	return uint64(len(bsm.header)) + l, nil
+	return l - left, err
 }
 
 // inBulkSet actually processes incoming bulk-set messages; there may be more
@@ -213,20 +353,38 @@ func (store *defaultGroupStore) inBulkSet(wg *sync.WaitGroup) {
 		if bsm == nil {
 			break
 		}
+		if store.bulkSetState.inLimiter.wait(bsm.MsgLength()) {
+			atomic.AddInt32(&store.inBulkSetRateLimitHits, 1)
+		}
+		// The node ID is zero for pull replication responses, which don't
+		// say who they're from.
+		store.bulkSetState.inTask.begin()
+		_, span := store.tracer.Start(context.Background(), "GroupStore.inBulkSet", TraceAttribute{Key: "length", Value: bsm.MsgLength()}, TraceAttribute{Key: "nodeID", Value: bsm.nodeID()})
 		body := bsm.body
 		var err error
 		ring := store.msgRing.Ring()
 		var rightwardPartitionShift uint64
 		var bsam *groupBulkSetAckMsg
 		var ptimestampbits uint64
+		// Pull replication responses are counted per partition for the
+		// replication status, a partition's run of items at a time.
+		var pulledPartition uint32
+		var pulledReceived, pulledApplied int64
 		if ring != nil {
 			rightwardPartitionShift = 64 - uint64(ring.PartitionBitCount())
 			// Only ack if there is someone to ack to.
 			if bsm.nodeID() != 0 {
 				bsam = store.newOutBulkSetAckMsg()
+				// Saying which node the ack is from lets the sender clear
+				// any hints it holds for this node.
+				if store.msgPeerFeatures(bsm.nodeID())&_GROUP_MSG_FEATURE_NODE_ACK != 0 {
+					if n := ring.LocalNode(); n != nil {
+						bsam.nodeID = n.ID()
+					}
+				}
 			}
 		}
-		for len(body) > _GROUP_BULK_SET_MSG_ENTRY_HEADER_LENGTH {
+		for len(body) >= _GROUP_BULK_SET_MSG_ENTRY_HEADER_LENGTH {
 
 			keyA := binary.BigEndian.Uint64(body)
 			keyB := binary.BigEndian.Uint64(body[8:])
@@ -235,6 +393,10 @@ func (store *defaultGroupStore) inBulkSet(wg *sync.WaitGroup) {
 			timestampbits := binary.BigEndian.Uint64(body[32:])
 			l := binary.BigEndian.Uint32(body[40:])
 
+			if uint64(len(body)) < _GROUP_BULK_SET_MSG_ENTRY_HEADER_LENGTH+uint64(l) {
+				// Incoming chunks only hold whole entries, but just in case.
+				break
+			}
 			atomic.AddInt32(&store.inBulkSetWrites, 1)
 			// Attempt to store everything received...
 			// Note that deletions are acted upon as internal requests (work
@@ -245,6 +407,28 @@ func (store *defaultGroupStore) inBulkSet(wg *sync.WaitGroup) {
 				atomic.AddInt32(&store.inBulkSetWriteErrors, 1)
 			} else if ptimestampbits >= timestampbits {
 				atomic.AddInt32(&store.inBulkSetWritesOverridden, 1)
+			} else if bsm.nodeID() == 0 && timestampbits <= atomic.LoadUint64(&store.pullReplicationState.outLateCutoff) {
+				// A pull replication response with an item that should have
+				// been replicated by the last pass; likely missed due to a
+				// bloom filter false positive.
+				atomic.AddUint64(&store.pullReplicationState.outLateValues, 1)
+			}
+			if err == nil && bsm.nodeID() == 0 && atomic.LoadInt32(&store.replicateState.active) > 0 {
+				store.replicateReceived(keyA, ptimestampbits < timestampbits)
+			}
+			if err == nil && bsm.nodeID() == 0 && ring != nil {
+				if partition := uint32(keyA >> rightwardPartitionShift); partition != pulledPartition {
+					if pulledReceived > 0 {
+						store.replicationReceived(ring.PartitionBitCount(), pulledPartition, pulledReceived, pulledApplied)
+					}
+					pulledPartition = partition
+					pulledReceived = 0
+					pulledApplied = 0
+				}
+				pulledReceived++
+				if ptimestampbits < timestampbits {
+					pulledApplied++
+				}
 			}
 			// But only ack on success, there is someone to ack to, and the
 			// local node is responsible for the data.
@@ -253,10 +437,15 @@ func (store *defaultGroupStore) inBulkSet(wg *sync.WaitGroup) {
 			}
 			body = body[_GROUP_BULK_SET_MSG_ENTRY_HEADER_LENGTH+l:]
 		}
+		if pulledReceived > 0 {
+			store.replicationReceived(ring.PartitionBitCount(), pulledPartition, pulledReceived, pulledApplied)
+		}
 		if bsam != nil {
 			atomic.AddInt32(&store.outBulkSetAcks, 1)
-			store.msgRing.MsgToNode(bsam, bsm.nodeID(), store.bulkSetState.inResponseMsgTimeout)
+			store.msgToNode(bsam, bsm.nodeID(), store.bulkSetState.inResponseMsgTimeout)
 		}
+		span.End()
+		store.bulkSetState.inTask.end()
 		store.bulkSetState.inFreeMsgChan <- bsm
 	}
 	wg.Done()
@@ -115,6 +115,91 @@ func TestGroupBulkSetReadLowSendCap(t *testing.T) {
 	}
 }
 
+func TestGroupBulkSetReadOversized(t *testing.T) {
+	cfg := newTestGroupStoreConfig()
+	cfg.MsgRing = &msgRingPlaceholder{}
+	cfg.BulkSetMsgCap = 100
+	cfg.InBulkSetWorkers = 1
+	cfg.InBulkSetMsgs = 1
+	store, _ := newTestGroupStore(cfg)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	// Build a message with two entries where only the first fits within the
+	// cap; the second should be discarded.
+	bsm := &groupBulkSetMsg{header: make([]byte, _GROUP_BULK_SET_MSG_HEADER_LENGTH), body: make([]byte, 0, 1000)}
+	binary.BigEndian.PutUint64(bsm.header, 123)
+	if !bsm.add(1, 2, 3, 4, 0x500, []byte("testing")) {
+		t.Fatal("")
+	}
+	if !bsm.add(5, 6, 7, 8, 0x500, make([]byte, 200)) {
+		t.Fatal("")
+	}
+	l := uint64(len(bsm.header) + len(bsm.body))
+	n, err := store.newInBulkSetMsg(bytes.NewBuffer(append(bsm.header, bsm.body...)), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != l {
+		t.Fatal(n, l)
+	}
+	// only one of these, so if we get it back we know the previous data was
+	// processed
+	<-store.bulkSetState.inFreeMsgChan
+	if _, v, err := store.Read(context.Background(), 1, 2, 3, 4, nil); err != nil || string(v) != "testing" {
+		t.Fatal(string(v), err)
+	}
+	if ts, _, err := store.Read(context.Background(), 5, 6, 7, 8, nil); !IsNotFound(err) || ts != 0 {
+		t.Fatal(ts, err)
+	}
+	if store.inBulkSetOversizes != 1 {
+		t.Fatal(store.inBulkSetOversizes)
+	}
+}
+
+func TestGroupBulkSetReadChunked(t *testing.T) {
+	cfg := newTestGroupStoreConfig()
+	cfg.MsgRing = &msgRingPlaceholder{}
+	cfg.BulkSetMsgCap = 100
+	cfg.InBulkSetWorkers = 1
+	cfg.InBulkSetMsgs = 1
+	store, _ := newTestGroupStore(cfg)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	// Build a message several times the cap; with just the one free message
+	// each chunk has to be worked on before the next can be read.
+	bsm := &groupBulkSetMsg{header: make([]byte, _GROUP_BULK_SET_MSG_HEADER_LENGTH), body: make([]byte, 0, 1000)}
+	binary.BigEndian.PutUint64(bsm.header, 123)
+	for i := uint64(1); i <= 5; i++ {
+		if !bsm.add(i, 2, 3, 4, 0x500, []byte("testing")) {
+			t.Fatal(i)
+		}
+	}
+	l := uint64(len(bsm.header) + len(bsm.body))
+	n, err := store.newInBulkSetMsg(bytes.NewBuffer(append(bsm.header, bsm.body...)), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != l {
+		t.Fatal(n, l)
+	}
+	<-store.bulkSetState.inFreeMsgChan
+	for i := uint64(1); i <= 5; i++ {
+		if _, v, err := store.Read(context.Background(), i, 2, 3, 4, nil); err != nil || string(v) != "testing" {
+			t.Fatal(i, string(v), err)
+		}
+	}
+	if store.inBulkSetOversizes != 0 {
+		t.Fatal(store.inBulkSetOversizes)
+	}
+	if store.inBulkSets != 1 {
+		t.Fatal(store.inBulkSets)
+	}
+}
+
 func TestGroupBulkSetMsgWithoutAck(t *testing.T) {
 	b := ring.NewBuilder(64)
 	n, err := b.AddNode(true, 1, nil, nil, "", nil)
@@ -0,0 +1,275 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gholt/brimio"
+	"github.com/spaolacci/murmur3"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+)
+
+// compactionMerge merges the small files, each group of neighbors up to the
+// merge target size, into a new file per group. A group of one is only
+// rewritten if it has more waste than the threshold or is to be upgraded. Any notification that
+// arrives between groups ends the merging early and is returned.
+func (store *defaultGroupStore) compactionMerge(ctx context.Context, notifyChan chan *bgNotification, jobs []*groupCompactionJob, threshold float64, result *CompactionResult) *bgNotification {
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].index < jobs[j].index
+	})
+	var groups [][]*groupCompactionJob
+	var group []*groupCompactionJob
+	var groupSize int64
+	for _, job := range jobs {
+		size := store.fileSetSize(job.nametoc)
+		if len(group) > 0 && (job.index != group[len(group)-1].index+1 || groupSize+size > store.compactionState.mergeTargetSize) {
+			groups = append(groups, group)
+			group = nil
+			groupSize = 0
+		}
+		group = append(group, job)
+		groupSize += size
+	}
+	if len(group) > 0 {
+		groups = append(groups, group)
+	}
+	for _, group := range groups {
+		select {
+		case notification := <-notifyChan:
+			return notification
+		default:
+		}
+		if len(group) == 1 && !group[0].upgrade && !store.needsCompaction(group[0].nametoc, group[0].candidateBlockID, threshold) {
+			continue
+		}
+		store.compactionMergeFiles(ctx, group, result)
+	}
+	return nil
+}
+
+// compactionMergeFiles streams the live items of the files into a new file
+// pair of their own, bypassing the memWriters, then points the locmap at the
+// new file and removes the old ones.
+func (store *defaultGroupStore) compactionMergeFiles(ctx context.Context, group []*groupCompactionJob, result *CompactionResult) {
+	begin := time.Now()
+	_, span := store.tracer.Start(ctx, "GroupStore.compactionMergeFiles", TraceAttribute{Key: "files", Value: uint64(len(group))})
+	defer span.End()
+	nameTimestamp := time.Now().UnixNano()
+	fullpath := path.Join(store.path, fmt.Sprintf("%019d.group", nameTimestamp))
+	fullpathtoc := path.Join(store.pathtoc, fmt.Sprintf("%019d.grouptoc", nameTimestamp))
+	store.compactionState.task.working(fmt.Sprintf("merging %d files into %019d.grouptoc", len(group), nameTimestamp))
+	fail := func(err error) {
+		store.logger.Warn("error merging", zap.String("name", store.loggerPrefix+"compactionMergeFiles"), zap.String("path", fullpathtoc), zap.Error(err))
+		span.RecordError(err)
+		store.compactionState.task.failed(err)
+		for _, job := range group {
+			store.event(Event{Kind: EventCompactionError, Begin: begin, File: job.nametoc, Message: "merging into " + path.Base(fullpathtoc), Err: err})
+		}
+	}
+	var oldSize int64
+	for _, job := range group {
+		oldSize += store.fileSetSize(job.nametoc)
+	}
+	entries := make([][]groupTOCEntry, len(group))
+	counts := make([]int, len(group))
+	live := 0
+	for i, job := range group {
+		var err error
+		entries[i], counts[i], err = store.compactionMergeLive(job)
+		if err != nil {
+			fail(err)
+			return
+		}
+		live += len(entries[i])
+	}
+	// With nothing live at all, there's no new file and the old ones are
+	// just removed.
+	var fl *groupStoreFile
+	if live > 0 {
+		if err := store.compactionMergeWrite(fullpath, fullpathtoc, group, entries); err != nil {
+			store.remove(fullpathtoc)
+			store.remove(fullpath)
+			fail(err)
+			return
+		}
+		var err error
+		if fl, err = store.newGroupReadFile(nameTimestamp); err != nil {
+			store.remove(fullpathtoc)
+			store.remove(fullpath)
+			fail(err)
+			return
+		}
+	}
+	var rewrote int64
+	for i, job := range group {
+		var changed int64
+		for j := range entries[i] {
+			wr := &entries[i][j]
+			atomic.AddInt64(&store.locBlockBytes[fl.id].total, store.locBlockItemBytes(fl.id, wr.Length))
+			// A newer write since the item was copied wins, leaving the copy
+			// as waste in the new file.
+			if store.locmapSet(wr.KeyA, wr.KeyB, wr.ChildKeyA, wr.ChildKeyB, wr.TimestampBits, fl.id, wr.Offset, wr.Length, true) == wr.TimestampBits {
+				changed++
+			}
+		}
+		rewrote += changed
+		store.compactionRemove(job.nametoc, job.candidateBlockID, "compactionMergeFiles")
+		store.event(Event{Kind: EventCompaction, Begin: begin, File: job.nametoc, Count: int64(counts[i]), Changed: changed, Stale: int64(counts[i]) - changed, Message: "merged into " + path.Base(fullpathtoc)})
+	}
+	atomic.AddInt32(&store.smallFileCompactions, int32(len(group)))
+	atomic.AddInt64(&result.FilesCompacted, int64(len(group)))
+	atomic.AddInt64(&result.ItemsRewritten, rewrote)
+	reclaimed := oldSize
+	if fl != nil {
+		reclaimed -= store.fileSetSize(path.Base(fullpathtoc))
+	}
+	if reclaimed > 0 {
+		atomic.AddInt64(&result.BytesReclaimed, reclaimed)
+	}
+	store.logger.Debug("merged", zap.String("name", store.loggerPrefix+"compactionMergeFiles"), zap.String("path", fullpathtoc), zap.Int("files", len(group)), zap.Int64("rewrote", rewrote))
+	span.SetAttributes(TraceAttribute{Key: "rewrote", Value: uint64(rewrote)})
+}
+
+// compactionMergeLive returns the entries of the file the locmap still
+// points to and how many entries the file has in all.
+func (store *defaultGroupStore) compactionMergeLive(job *groupCompactionJob) ([]groupTOCEntry, int, error) {
+	var live []groupTOCEntry
+	count := 0
+	freeBatchChans := []chan []groupTOCEntry{make(chan []groupTOCEntry, 1)}
+	pendingBatchChans := []chan []groupTOCEntry{make(chan []groupTOCEntry, 1)}
+	freeBatchChans[0] <- make([]groupTOCEntry, store.recoveryBatchSize)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		for {
+			batch := <-pendingBatchChans[0]
+			if batch == nil {
+				break
+			}
+			for j := 0; j < len(batch); j++ {
+				wr := &batch[j]
+				count++
+				timestampbits, blockID, _, _ := store.locmap.Get(wr.KeyA, wr.KeyB, wr.ChildKeyA, wr.ChildKeyB)
+				if blockID == wr.BlockID && timestampbits == wr.TimestampBits {
+					live = append(live, *wr)
+				}
+			}
+			freeBatchChans[0] <- batch
+		}
+		wg.Done()
+	}()
+	fpr, err := store.openReadSeeker(path.Join(store.pathtoc, job.nametoc))
+	if err != nil {
+		pendingBatchChans[0] <- nil
+		wg.Wait()
+		return nil, 0, err
+	}
+	fpr = &throttledReadSeeker{fpr, &store.compactionState.throttle}
+	_, errs := groupReadTOCEntriesBatched(fpr, job.candidateBlockID, freeBatchChans, pendingBatchChans, make(chan struct{}))
+	closeIfCloser(fpr)
+	pendingBatchChans[0] <- nil
+	wg.Wait()
+	if len(errs) > 0 {
+		return nil, 0, errs[0]
+	}
+	return live, count, nil
+}
+
+// compactionMergeWrite writes the entries' values, read from their original
+// files, and the entries themselves into the new v1 file pair, updating the
+// entries' offsets, lengths and checksums to their new locations.
+func (store *defaultGroupStore) compactionMergeWrite(fullpath string, fullpathtoc string, group []*groupCompactionJob, entries [][]groupTOCEntry) error {
+	fp, err := store.createWriteCloser(fullpath)
+	if err != nil {
+		return err
+	}
+	writer := brimio.NewMultiCoreChecksummedWriter(fp, int(store.checksumInterval), murmur3.New32, store.workers)
+	fptoc, err := store.createWriteCloser(fullpathtoc)
+	if err != nil {
+		writer.Close()
+		return err
+	}
+	writertoc := brimio.NewMultiCoreChecksummedWriter(fptoc, int(store.checksumInterval), murmur3.New32, store.workers)
+	term := groupTermBlock(store.checksumInterval)
+	write := func() error {
+		head := []byte("GROUPSTORE v1                   ")
+		binary.BigEndian.PutUint32(head[28:], store.checksumInterval)
+		if _, err := writer.Write(head); err != nil {
+			return err
+		}
+		headtoc := []byte("GROUPSTORETOC v1                ")
+		binary.BigEndian.PutUint32(headtoc[28:], store.checksumInterval)
+		if _, err := writertoc.Write(headtoc); err != nil {
+			return err
+		}
+		offset := uint32(len(head))
+		var value []byte
+		buf := make([]byte, _GROUP_FILE_ENTRY_SIZE_V1)
+		checksumBuf := make([]byte, _GROUP_FILE_VALUE_CHECKSUM_SIZE)
+		for i, job := range group {
+			block := store.locBlock(job.candidateBlockID)
+			for j := range entries[i] {
+				wr := &entries[i][j]
+				var length uint32
+				var checksum uint32
+				valueOffset := offset
+				if wr.TimestampBits&_TSB_DELETION == 0 {
+					var err error
+					if _, value, err = block.read(wr.KeyA, wr.KeyB, wr.ChildKeyA, wr.ChildKeyB, wr.TimestampBits, wr.Offset, wr.Length, value[:0]); err != nil {
+						return err
+					}
+					if uint64(offset)+uint64(len(value))+_GROUP_FILE_VALUE_CHECKSUM_SIZE > uint64(store.fileCap) {
+						return fmt.Errorf("merged file would exceed %d bytes", store.fileCap)
+					}
+					length = uint32(len(value))
+					checksum = murmur3.Sum32(value)
+					binary.BigEndian.PutUint32(checksumBuf, checksum)
+					if _, err = writer.Write(value); err != nil {
+						return err
+					}
+					if _, err = writer.Write(checksumBuf); err != nil {
+						return err
+					}
+					offset += length + _GROUP_FILE_VALUE_CHECKSUM_SIZE
+				}
+				wr.Offset = valueOffset
+				wr.Length = length
+				wr.Checksum = checksum
+				// Once for the read and once for the write.
+				store.compactionState.throttle.wait(2*int64(length) + _GROUP_FILE_ENTRY_SIZE)
+
+				binary.BigEndian.PutUint64(buf, wr.KeyA)
+				binary.BigEndian.PutUint64(buf[8:], wr.KeyB)
+				binary.BigEndian.PutUint64(buf[16:], wr.ChildKeyA)
+				binary.BigEndian.PutUint64(buf[24:], wr.ChildKeyB)
+				binary.BigEndian.PutUint64(buf[32:], wr.TimestampBits)
+				binary.BigEndian.PutUint32(buf[40:], wr.Offset)
+				binary.BigEndian.PutUint32(buf[44:], wr.Length)
+
+				binary.BigEndian.PutUint32(buf[_GROUP_FILE_ENTRY_SIZE:], wr.Checksum)
+				if _, err := writertoc.Write(buf); err != nil {
+					return err
+				}
+			}
+		}
+		if _, err := writer.Write(term); err != nil {
+			return err
+		}
+		_, err := writertoc.Write(term)
+		return err
+	}
+	err = write()
+	for _, w := range []io.WriteCloser{writer, writertoc} {
+		if cerr := w.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
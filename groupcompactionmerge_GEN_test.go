@@ -0,0 +1,76 @@
+package store
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestGroupCompactionMerge(t *testing.T) {
+	fs := newMemFS()
+	cfg := newTestGroupStoreConfigWithFS(fs)
+	store, _ := newTestGroupStore(cfg)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	// Each flush leaves a small file pair; the last overwrites the first
+	// item, leaving nothing live in the first file.
+	for i, value := range []string{"one", "two", "three"} {
+		keyB := uint64(2)
+		if i == 1 {
+			keyB = 3
+		}
+		if _, err := store.Write(context.Background(), 1, keyB, 3, 4, int64(0x500+i), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tocs := func() []string {
+		names, _ := fs.readdirnames(store.pathtoc)
+		var tocs []string
+		for _, name := range names {
+			if strings.HasSuffix(name, ".grouptoc") {
+				tocs = append(tocs, name)
+			}
+		}
+		return tocs
+	}
+	if names := tocs(); len(names) != 3 {
+		t.Fatal(names)
+	}
+	result, err := store.CompactionPass(context.Background(), &CompactionPassOptions{IgnoreAgeThreshold: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FilesExamined != 3 || result.FilesCompacted != 3 || result.ItemsRewritten != 2 {
+		t.Fatal(result)
+	}
+	if names := tocs(); len(names) != 1 {
+		t.Fatal(names)
+	}
+	for keyB, expected := range map[uint64]string{2: "three", 3: "two"} {
+		_, value, err := store.Read(context.Background(), 1, keyB, 3, 4, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != expected {
+			t.Fatal(keyB, string(value))
+		}
+	}
+	// The merged file is what a restart recovers from.
+	store.Shutdown(context.Background())
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	_, value, err := store.Read(context.Background(), 1, 2, 3, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "three" {
+		t.Fatal(string(value))
+	}
+}
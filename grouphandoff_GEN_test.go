@@ -0,0 +1,145 @@
+package store
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	ring "github.com/gholt/devicering"
+	"github.com/gholt/msgring"
+	"golang.org/x/net/context"
+)
+
+type msgRingGroupHandoffTester struct {
+	ring          ring.Ring
+	lock          sync.Mutex
+	toOtherBodies map[uint32][]byte
+}
+
+func (m *msgRingGroupHandoffTester) Ring() ring.Ring {
+	return m.ring
+}
+
+func (m *msgRingGroupHandoffTester) MaxMsgLength() uint64 {
+	return 65536
+}
+
+func (m *msgRingGroupHandoffTester) SetMsgHandler(msgType uint64, handler msgring.MsgUnmarshaller) {
+}
+
+func (m *msgRingGroupHandoffTester) MsgToNode(msg msgring.Msg, nodeID uint64, timeout time.Duration) {
+	msg.Free(0, 0)
+}
+
+func (m *msgRingGroupHandoffTester) MsgToOtherReplicas(msg msgring.Msg, partition uint32, timeout time.Duration) {
+	if bsm, ok := msg.(*groupBulkSetMsg); ok {
+		m.lock.Lock()
+		m.toOtherBodies[partition] = append(m.toOtherBodies[partition], bsm.body...)
+		m.lock.Unlock()
+	}
+	msg.Free(0, 0)
+}
+
+func TestGroupHandoff(t *testing.T) {
+	b := ring.NewBuilder(64)
+	n, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	r.SetLocalNode(n.ID())
+	m := &msgRingGroupHandoffTester{ring: r, toOtherBodies: make(map[uint32][]byte)}
+	cfg := newTestGroupStoreConfig()
+	cfg.MsgRing = m
+	cfg.HandoffInterval = 3600
+	store, _ := newTestGroupStore(cfg)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	pbc := r.PartitionBitCount()
+	var partition uint32
+	for r.Responsible(partition) {
+		partition++
+	}
+	keyA := uint64(partition) << (64 - pbc)
+	const count = 50
+	for i := uint64(0); i < count; i++ {
+		if _, err = store.write(keyA+i, 2, 3, 4, 0x500, []byte("testing"), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Data the local node is responsible for stays put.
+	if _, err = store.write(0, 2, 3, 4, 0x500, []byte("testing"), false); err != nil {
+		t.Fatal(err)
+	}
+	notifyChan := make(chan *bgNotification)
+	// The ring the store starts with is no ring change.
+	store.handoffPass(notifyChan)
+	status, err := store.HandoffStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Active || status.RingVersion != r.Version() || len(status.Partitions) != 0 {
+		t.Fatal(status)
+	}
+	m.lock.Lock()
+	if len(m.toOtherBodies) != 0 {
+		t.Fatal(len(m.toOtherBodies))
+	}
+	m.lock.Unlock()
+	// As if the ring had just changed to r from some other version.
+	store.handoffState.statusLock.Lock()
+	store.handoffState.ringVersion = r.Version() + 1
+	store.handoffState.statusLock.Unlock()
+	store.handoffPass(notifyChan)
+	status, _ = store.HandoffStatus(context.Background())
+	if !status.Active || status.RingVersion != r.Version() || len(status.Partitions) != 1 || status.Partitions[0].Partition != partition {
+		t.Fatal(status)
+	}
+	// Everything counted at the start of the pass has since been sent.
+	if status.RemainingKeys != 0 || status.RemainingBytes != 0 || status.SentKeys != count || status.SentBytes != count*7 {
+		t.Fatal(status.RemainingKeys, status.RemainingBytes, status.SentKeys, status.SentBytes)
+	}
+	m.lock.Lock()
+	if len(m.toOtherBodies) != 1 || len(m.toOtherBodies[partition]) != count*int(_GROUP_BULK_SET_MSG_ENTRY_HEADER_LENGTH+7) {
+		t.Fatal(len(m.toOtherBodies), len(m.toOtherBodies[partition]))
+	}
+	m.lock.Unlock()
+	// Push replication leaves the partition to the handoff meanwhile.
+	store.pushReplicationPass(notifyChan, nil)
+	if store.outBulkSetPushes != 0 {
+		t.Fatal(store.outBulkSetPushes)
+	}
+	// Acknowledge all but one; the next pass sends just that one.
+	for i := uint64(1); i < count; i++ {
+		if _, err = store.write(keyA+i, 2, 3, 4, 0x500|_TSB_LOCAL_REMOVAL, nil, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.handoffPass(notifyChan)
+	status, _ = store.HandoffStatus(context.Background())
+	if !status.Active || status.RemainingKeys != 0 || status.SentKeys != count+1 {
+		t.Fatal(status.Active, status.RemainingKeys, status.SentKeys)
+	}
+	if _, err = store.write(keyA, 2, 3, 4, 0x500|_TSB_LOCAL_REMOVAL, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	store.handoffPass(notifyChan)
+	status, _ = store.HandoffStatus(context.Background())
+	if status.Active || status.End.IsZero() || status.RemainingKeys != 0 {
+		t.Fatal(status.Active, status.End, status.RemainingKeys)
+	}
+	if store.handoffCompletions != 1 || store.outHandoffValues != count+1 {
+		t.Fatal(store.handoffCompletions, store.outHandoffValues)
+	}
+	// Nothing more to do until the ring changes.
+	store.handoffPass(notifyChan)
+	if store.handoffCompletions != 1 {
+		t.Fatal(store.handoffCompletions)
+	}
+}
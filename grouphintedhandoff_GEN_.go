@@ -0,0 +1,450 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+)
+
+// Hinted handoff is for writes destined to a replica that is known to be
+// down. WriteHint and DeleteHint store the write locally as usual and also
+// keep a hint, a copy of the write for the down node, tracked apart from the
+// locally stored data so push replication acknowledgements from the other
+// replicas don't remove it. Each HintedHandoffInterval the hints are sent to
+// their nodes with bulk-set messages; if the MsgRing implements
+// NodeReachability, only to nodes it reports reachable, so a node's hints are
+// drained as soon as it is back. A hint is kept until its node acknowledges
+// it, with a node bulk-set-ack message naming the node, and resent if not
+// acknowledged within PushReplicationMsgTimeout.
+//
+// Hints are kept in memory, up to HintedHandoffMaxBytes of values, and saved
+// to the grouphints.json file in the PathTOC after each pass that changed
+// them and at shutdown; they're reloaded at startup. Hints made since the last
+// save and lost to a crash, or dropped for space, are left to normal
+// replication.
+type groupHintedHandoffState struct {
+	interval   int
+	maxBytes   int64
+	msgTimeout time.Duration
+
+	startupShutdownLock sync.Mutex
+	notifyChan          chan *bgNotification
+	task                backgroundTask
+
+	lock  sync.Mutex
+	nodes map[uint64]map[groupHintKey]*groupHint
+	// count and bytes are only changed with the lock held but are also read
+	// atomically, such as to skip looking up acknowledgements when there are
+	// no hints.
+	count int64
+	bytes int64
+	// changed is set whenever the hints change and cleared when they're
+	// saved.
+	changed bool
+	// loaded is set once the saved hints have been read at startup.
+	loaded bool
+}
+
+type groupHintKey struct {
+	keyA uint64
+	keyB uint64
+
+	childKeyA uint64
+	childKeyB uint64
+}
+
+type groupHint struct {
+	timestampbits uint64
+	value         []byte
+	// sent is when the hint was last sent; zero if not yet.
+	sent time.Time
+}
+
+// groupHintRecord is how a hint is saved to disk.
+type groupHintRecord struct {
+	NodeID uint64
+	KeyA   uint64
+	KeyB   uint64
+
+	ChildKeyA uint64
+	ChildKeyB uint64
+
+	TimestampBits uint64
+	Value         []byte
+}
+
+func (store *defaultGroupStore) hintedHandoffConfig(cfg *GroupStoreConfig) {
+	store.hintedHandoffState.interval = cfg.HintedHandoffInterval
+	store.hintedHandoffState.maxBytes = int64(cfg.HintedHandoffMaxBytes)
+	store.hintedHandoffState.msgTimeout = time.Duration(cfg.PushReplicationMsgTimeout) * time.Millisecond
+	store.hintedHandoffState.nodes = make(map[uint64]map[groupHintKey]*groupHint)
+}
+
+func (store *defaultGroupStore) hintedHandoffStartup() {
+	store.hintedHandoffState.startupShutdownLock.Lock()
+	if store.hintedHandoffState.notifyChan == nil {
+		if !store.hintedHandoffState.loaded {
+			store.hintedHandoffState.loaded = true
+			store.hintsLoad()
+		}
+		store.hintedHandoffState.notifyChan = make(chan *bgNotification, 1)
+		go store.hintedHandoffLauncher(store.hintedHandoffState.notifyChan)
+	}
+	store.hintedHandoffState.startupShutdownLock.Unlock()
+}
+
+func (store *defaultGroupStore) hintedHandoffShutdown() {
+	store.hintedHandoffState.startupShutdownLock.Lock()
+	if store.hintedHandoffState.notifyChan != nil {
+		c := make(chan struct{}, 1)
+		store.hintedHandoffState.notifyChan <- &bgNotification{
+			action:   _BG_DISABLE,
+			doneChan: c,
+		}
+		<-c
+		store.hintedHandoffState.notifyChan = nil
+		store.hintedHandoffState.task.stop()
+		store.hintsSave()
+	}
+	store.hintedHandoffState.startupShutdownLock.Unlock()
+}
+
+func (store *defaultGroupStore) hintedHandoffLauncher(notifyChan chan *bgNotification) {
+	interval := float64(store.hintedHandoffState.interval) * float64(time.Second)
+	nextRun := time.Now().Add(time.Duration(interval))
+	store.hintedHandoffState.task.launch(nextRun)
+	var notification *bgNotification
+	running := true
+	for running {
+		if notification == nil {
+			sleep := nextRun.Sub(time.Now())
+			if sleep > 0 {
+				select {
+				case notification = <-notifyChan:
+				case <-time.After(sleep):
+				}
+			} else {
+				select {
+				case notification = <-notifyChan:
+				default:
+				}
+			}
+		}
+		nextRun = time.Now().Add(time.Duration(interval))
+		store.hintedHandoffState.task.schedule(nextRun)
+		if notification != nil {
+			var nextNotification *bgNotification
+			switch notification.action {
+			case _BG_PASS:
+				nextNotification = store.hintedHandoffPass(notifyChan)
+			case _BG_DISABLE:
+				running = false
+			default:
+				store.logger.Error("invalid action requested", zap.String("name", store.loggerPrefix+"hintedHandoff"), zap.Int("action", int(notification.action)))
+			}
+			notification.doneChan <- struct{}{}
+			notification = nextNotification
+		} else {
+			notification = store.hintedHandoffPass(notifyChan)
+		}
+		if running {
+			store.hintsSave()
+		}
+	}
+}
+
+// WriteHint is Write for a write whose replica nodeID is known to be down;
+// the write is stored locally and also kept as a hint to be sent to the node
+// once it is reachable again.
+func (store *defaultGroupStore) WriteHint(ctx context.Context, nodeID uint64, keyA uint64, keyB uint64, childKeyA uint64, childKeyB uint64, timestampmicro int64, value []byte) (int64, error) {
+	ctx, span := store.startSpan(ctx, "WriteHint", keyA, keyB, childKeyA, childKeyB)
+	defer span.End()
+	if err := store.hintNodeValid(nodeID); err != nil {
+		return 0, err
+	}
+	oldtimestampmicro, err := store.Write(ctx, keyA, keyB, childKeyA, childKeyB, timestampmicro, value)
+	if err != nil {
+		return oldtimestampmicro, err
+	}
+	store.hint(nodeID, groupHintKey{keyA: keyA, keyB: keyB, childKeyA: childKeyA, childKeyB: childKeyB}, uint64(timestampmicro)<<_TSB_UTIL_BITS, value)
+	return oldtimestampmicro, nil
+}
+
+// DeleteHint is Delete for a delete whose replica nodeID is known to be down;
+// see WriteHint.
+func (store *defaultGroupStore) DeleteHint(ctx context.Context, nodeID uint64, keyA uint64, keyB uint64, childKeyA uint64, childKeyB uint64, timestampmicro int64) (int64, error) {
+	ctx, span := store.startSpan(ctx, "DeleteHint", keyA, keyB, childKeyA, childKeyB)
+	defer span.End()
+	if err := store.hintNodeValid(nodeID); err != nil {
+		return 0, err
+	}
+	oldtimestampmicro, err := store.Delete(ctx, keyA, keyB, childKeyA, childKeyB, timestampmicro)
+	if err != nil {
+		return oldtimestampmicro, err
+	}
+	store.hint(nodeID, groupHintKey{keyA: keyA, keyB: keyB, childKeyA: childKeyA, childKeyB: childKeyB}, (uint64(timestampmicro)<<_TSB_UTIL_BITS)|_TSB_DELETION, nil)
+	return oldtimestampmicro, nil
+}
+
+// hintNodeValid returns an error if hints can't be kept for the node.
+func (store *defaultGroupStore) hintNodeValid(nodeID uint64) error {
+	if store.msgRing == nil {
+		return errors.New("no ring")
+	}
+	ring := store.msgRing.Ring()
+	if ring == nil {
+		return errors.New("no ring")
+	}
+	if ring.Node(nodeID) == nil {
+		return errors.New("unknown node")
+	}
+	if n := ring.LocalNode(); n != nil && n.ID() == nodeID {
+		return errors.New("hint for local node")
+	}
+	return nil
+}
+
+// hint keeps a hint for the node, replacing any older hint for the same key;
+// the hint is dropped if there isn't room for it or it is too large to ever
+// fit in a bulk-set message.
+func (store *defaultGroupStore) hint(nodeID uint64, key groupHintKey, timestampbits uint64, value []byte) {
+	store.hintedHandoffState.lock.Lock()
+	hints := store.hintedHandoffState.nodes[nodeID]
+	if hints == nil {
+		hints = make(map[groupHintKey]*groupHint)
+		store.hintedHandoffState.nodes[nodeID] = hints
+	}
+	if h := hints[key]; h != nil {
+		if h.timestampbits >= timestampbits {
+			store.hintedHandoffState.lock.Unlock()
+			return
+		}
+		delete(hints, key)
+		atomic.AddInt64(&store.hintedHandoffState.count, -1)
+		atomic.AddInt64(&store.hintedHandoffState.bytes, -int64(len(h.value)))
+		store.hintedHandoffState.changed = true
+	}
+	if store.hintedHandoffState.bytes+int64(len(value)) > store.hintedHandoffState.maxBytes || _GROUP_BULK_SET_MSG_ENTRY_HEADER_LENGTH+len(value) >= store.bulkSetState.msgCap {
+		if len(hints) == 0 {
+			delete(store.hintedHandoffState.nodes, nodeID)
+		}
+		store.hintedHandoffState.lock.Unlock()
+		atomic.AddInt32(&store.hintsDropped, 1)
+		return
+	}
+	hints[key] = &groupHint{timestampbits: timestampbits, value: append([]byte(nil), value...)}
+	atomic.AddInt64(&store.hintedHandoffState.count, 1)
+	atomic.AddInt64(&store.hintedHandoffState.bytes, int64(len(value)))
+	store.hintedHandoffState.changed = true
+	store.hintedHandoffState.lock.Unlock()
+}
+
+// hintAcked removes any sent hint held for the acknowledging node for the key
+// that the acknowledged timestampbits cover.
+func (store *defaultGroupStore) hintAcked(nodeID uint64, key groupHintKey, timestampbits uint64) {
+	store.hintedHandoffState.lock.Lock()
+	hints := store.hintedHandoffState.nodes[nodeID]
+	if h := hints[key]; h != nil && !h.sent.IsZero() && h.timestampbits <= timestampbits {
+		delete(hints, key)
+		if len(hints) == 0 {
+			delete(store.hintedHandoffState.nodes, nodeID)
+		}
+		atomic.AddInt64(&store.hintedHandoffState.count, -1)
+		atomic.AddInt64(&store.hintedHandoffState.bytes, -int64(len(h.value)))
+		store.hintedHandoffState.changed = true
+		atomic.AddInt32(&store.hintsAcked, 1)
+	}
+	store.hintedHandoffState.lock.Unlock()
+}
+
+// hintDrop removes the hint held for the node for the key, if it is still the
+// one for timestampbits, counting it as dropped.
+func (store *defaultGroupStore) hintDrop(nodeID uint64, key groupHintKey, timestampbits uint64) {
+	store.hintedHandoffState.lock.Lock()
+	hints := store.hintedHandoffState.nodes[nodeID]
+	if h := hints[key]; h != nil && h.timestampbits == timestampbits {
+		delete(hints, key)
+		if len(hints) == 0 {
+			delete(store.hintedHandoffState.nodes, nodeID)
+		}
+		atomic.AddInt64(&store.hintedHandoffState.count, -1)
+		atomic.AddInt64(&store.hintedHandoffState.bytes, -int64(len(h.value)))
+		store.hintedHandoffState.changed = true
+		atomic.AddInt32(&store.hintsDropped, 1)
+	}
+	store.hintedHandoffState.lock.Unlock()
+}
+
+func (store *defaultGroupStore) hintsPath() string {
+	return path.Join(store.pathtoc, "grouphints.json")
+}
+
+// hintsLoad adds the saved hints, as if just made; hints that can't be read
+// are left to normal replication.
+func (store *defaultGroupStore) hintsLoad() {
+	fullpath := store.hintsPath()
+	fpr, err := store.openReadSeeker(fullpath)
+	if err != nil {
+		if !store.isNotExist(err) {
+			store.logger.Warn("error opening hints", zap.String("name", store.loggerPrefix+"hintedHandoff"), zap.String("path", fullpath), zap.Error(err))
+		}
+		return
+	}
+	var records []groupHintRecord
+	err = json.NewDecoder(fpr).Decode(&records)
+	closeIfCloser(fpr)
+	if err != nil {
+		if err != io.EOF {
+			store.logger.Warn("error reading hints", zap.String("name", store.loggerPrefix+"hintedHandoff"), zap.String("path", fullpath), zap.Error(err))
+		}
+		return
+	}
+	for _, r := range records {
+		store.hint(r.NodeID, groupHintKey{keyA: r.KeyA, keyB: r.KeyB, childKeyA: r.ChildKeyA, childKeyB: r.ChildKeyB}, r.TimestampBits, r.Value)
+	}
+	store.hintedHandoffState.lock.Lock()
+	store.hintedHandoffState.changed = false
+	store.hintedHandoffState.lock.Unlock()
+}
+
+// hintsSave writes the hints to a temporary file and renames it into place,
+// if they've changed since last saved.
+func (store *defaultGroupStore) hintsSave() {
+	store.hintedHandoffState.lock.Lock()
+	if !store.hintedHandoffState.changed {
+		store.hintedHandoffState.lock.Unlock()
+		return
+	}
+	store.hintedHandoffState.changed = false
+	records := make([]groupHintRecord, 0, atomic.LoadInt64(&store.hintedHandoffState.count))
+	for nodeID, hints := range store.hintedHandoffState.nodes {
+		for key, h := range hints {
+			records = append(records, groupHintRecord{NodeID: nodeID, KeyA: key.keyA, KeyB: key.keyB, ChildKeyA: key.childKeyA, ChildKeyB: key.childKeyB, TimestampBits: h.timestampbits, Value: h.value})
+		}
+	}
+	store.hintedHandoffState.lock.Unlock()
+	fullpath := store.hintsPath()
+	err := func() error {
+		fp, err := store.createWriteCloser(fullpath + ".tmp")
+		if err != nil {
+			return err
+		}
+		err = json.NewEncoder(fp).Encode(records)
+		if cerr := fp.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		if err != nil {
+			store.remove(fullpath + ".tmp")
+			return err
+		}
+		return store.rename(fullpath+".tmp", fullpath)
+	}()
+	if err != nil {
+		store.logger.Warn("error writing hints", zap.String("name", store.loggerPrefix+"hintedHandoff"), zap.String("path", fullpath), zap.Error(err))
+		// Try again next time.
+		store.hintedHandoffState.lock.Lock()
+		store.hintedHandoffState.changed = true
+		store.hintedHandoffState.lock.Unlock()
+	}
+}
+
+func (store *defaultGroupStore) hintedHandoffPass(notifyChan chan *bgNotification) *bgNotification {
+	if store.msgRing == nil || atomic.LoadInt64(&store.hintedHandoffState.count) == 0 {
+		return nil
+	}
+	store.hintedHandoffState.task.begin()
+	begin := time.Now()
+	defer func() {
+		elapsed := time.Now().Sub(begin)
+		store.logger.Debug("pass completed", zap.String("name", store.loggerPrefix+"hintedHandoff"), zap.Duration("elapsed", elapsed))
+		atomic.StoreInt64(&store.hintedHandoffNanoseconds, elapsed.Nanoseconds())
+		store.hintedHandoffPassDuration.observe(elapsed)
+		store.hintedHandoffState.task.end()
+	}()
+	reachability, _ := store.msgRing.(NodeReachability)
+	store.hintedHandoffState.lock.Lock()
+	nodeIDs := make([]uint64, 0, len(store.hintedHandoffState.nodes))
+	for nodeID := range store.hintedHandoffState.nodes {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	store.hintedHandoffState.lock.Unlock()
+	sort.Slice(nodeIDs, func(i, j int) bool { return nodeIDs[i] < nodeIDs[j] })
+	for _, nodeID := range nodeIDs {
+		select {
+		case notification := <-notifyChan:
+			return notification
+		default:
+		}
+		if reachability != nil && !reachability.NodeReachable(nodeID) {
+			continue
+		}
+		store.hintedHandoffNode(nodeID)
+	}
+	return nil
+}
+
+// hintedHandoffNode sends the node its hints that haven't been sent or
+// weren't acknowledged in time.
+func (store *defaultGroupStore) hintedHandoffNode(nodeID uint64) {
+	type sendHint struct {
+		key           groupHintKey
+		timestampbits uint64
+		value         []byte
+	}
+	var sends []sendHint
+	now := time.Now()
+	store.hintedHandoffState.lock.Lock()
+	for key, h := range store.hintedHandoffState.nodes[nodeID] {
+		if h.sent.IsZero() || now.Sub(h.sent) >= store.hintedHandoffState.msgTimeout {
+			h.sent = now
+			sends = append(sends, sendHint{key: key, timestampbits: h.timestampbits, value: h.value})
+		}
+	}
+	store.hintedHandoffState.lock.Unlock()
+	// The hint values are never modified once stored, so they're safe to use
+	// without the lock.
+	var bsm *groupBulkSetMsg
+	send := func() {
+		atomic.AddInt32(&store.outHintedHandoffs, 1)
+		if store.bulkSetState.outLimiter.wait(bsm.MsgLength()) {
+			atomic.AddInt32(&store.outBulkSetRateLimitHits, 1)
+		}
+		store.msgToNode(bsm, nodeID, store.hintedHandoffState.msgTimeout)
+		bsm = nil
+	}
+	for _, s := range sends {
+		if bsm == nil {
+			bsm = store.newOutBulkSetMsg()
+		}
+		if !bsm.add(s.key.keyA, s.key.keyB, s.key.childKeyA, s.key.childKeyB, s.timestampbits, s.value) {
+			if len(bsm.body) > 0 {
+				send()
+				bsm = store.newOutBulkSetMsg()
+			}
+			if !bsm.add(s.key.keyA, s.key.keyB, s.key.childKeyA, s.key.childKeyB, s.timestampbits, s.value) {
+				// Too large for a bulk-set message, which hint already
+				// refuses, but the BulkSetMsgCap may have been lowered
+				// since. It would never be sent, so it's dropped rather than
+				// retried and left to hold up HintedHandoffMaxBytes.
+				store.hintDrop(nodeID, s.key, s.timestampbits)
+				continue
+			}
+		}
+		atomic.AddInt32(&store.outHintedHandoffValues, 1)
+	}
+	if bsm != nil {
+		if len(bsm.body) > 0 {
+			send()
+		} else {
+			bsm.Free(0, 0)
+		}
+	}
+}
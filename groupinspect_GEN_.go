@@ -0,0 +1,253 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/gholt/brimio"
+	"github.com/spaolacci/murmur3"
+)
+
+// These are for inspecting and repairing group store files offline, with the
+// store itself not running; cmd/storeinspect is built on them.
+
+// GroupFileEntry is an entry of a grouptoc file, as given by
+// ReadGroupTOCFile.
+type GroupFileEntry struct {
+	KeyA uint64
+	KeyB uint64
+
+	ChildKeyA uint64
+	ChildKeyB uint64
+
+	TimestampBits uint64
+	Offset        uint32
+	Length        uint32
+	// Checksum is the murmur3 of the value, from v1 toc files only.
+	Checksum uint32
+}
+
+// StatGroupTOCFile returns the format version of the grouptoc file at the
+// fullPath and the number of entries it has, going by its size.
+func StatGroupTOCFile(fullPath string) (int, int, error) {
+	fp, err := os.Open(fullPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	header, _, err := readGroupHeaderTOC(fp)
+	fp.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+	count, err := groupTOCStat(fullPath, os.Stat, osOpenReadSeeker)
+	return groupFileVersion(header), count, err
+}
+
+// ReadGroupTOCFile calls fn with each entry of the grouptoc file at the
+// fullPath, in file order, and returns the number of entries read along with
+// any errors; entries in blocks failing their checksums are skipped. The
+// entry given to fn is reused for each call.
+func ReadGroupTOCFile(fullPath string, fn func(entry *GroupFileEntry)) (int, []error) {
+	entries, errs := groupReadTOCFile(fullPath)
+	entry := &GroupFileEntry{}
+	for i := range entries {
+		wr := &entries[i]
+		entry.KeyA = wr.KeyA
+		entry.KeyB = wr.KeyB
+
+		entry.ChildKeyA = wr.ChildKeyA
+		entry.ChildKeyB = wr.ChildKeyB
+
+		entry.TimestampBits = wr.TimestampBits
+		entry.Offset = wr.Offset
+		entry.Length = wr.Length
+		entry.Checksum = wr.Checksum
+		fn(entry)
+	}
+	return len(entries), errs
+}
+
+// VerifyGroupFile checks the checksums of the group values file at the
+// fullPath and returns the corrupt ranges found, the number of bytes checked,
+// and any errors other than reaching the end of the file.
+func VerifyGroupFile(fullPath string) ([]AuditRange, int64, []error) {
+	fp, err := os.Open(fullPath)
+	if err != nil {
+		return nil, 0, []error{err}
+	}
+	corruptions, errs := groupChecksumVerify(fp)
+	fp.Close()
+	ranges, verified := groupAuditRanges(corruptions, errs)
+	var rerrs []error
+	for _, err := range errs {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			rerrs = append(rerrs, err)
+		}
+	}
+	return ranges, verified, rerrs
+}
+
+// RepairGroupTOCFile writes a new grouptoc file at newPath with just the
+// valid entries of the one at fullPath, checking them against the values file
+// at dataPath. Entries are dropped if they point into corrupt ranges of the
+// values file, past its end, or at bytes another entry also points at, and,
+// for v1 files, if their values don't match their checksums. Deletion entries
+// have no values and are always kept. Entries in blocks of the toc file that
+// fail their checksums can't be read and are counted as lost, along with the
+// read errors. The new file is written in the same format version as the old
+// one and newPath must not already exist.
+func RepairGroupTOCFile(fullPath string, dataPath string, newPath string) (*TOCRepairResult, error) {
+	fp, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	header, checksumInterval, err := readGroupHeaderTOC(fp)
+	fp.Close()
+	if err != nil {
+		return nil, err
+	}
+	count, err := groupTOCStat(fullPath, os.Stat, osOpenReadSeeker)
+	if err != nil {
+		return nil, err
+	}
+	entries, errs := groupReadTOCFile(fullPath)
+	result := &TOCRepairResult{ReadErrors: errs}
+	if len(entries) < count {
+		result.Lost = count - len(entries)
+	}
+	fpr, err := os.Open(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fpr.Close()
+	dataHeader, dataChecksumInterval, err := readGroupHeader(fpr)
+	if err != nil {
+		return nil, err
+	}
+	fpr.Seek(0, 0)
+	corruptions, verifyErrs := groupChecksumVerify(fpr)
+	_, verified := groupAuditRanges(corruptions, verifyErrs)
+	sorted := make([]groupTOCEntry, len(entries))
+	copy(sorted, entries)
+	drop := make(map[uint32]bool)
+	for _, wr := range groupAuditInvalidEntries(sorted, verified) {
+		drop[wr.Offset] = true
+	}
+	reader := brimio.NewChecksummedReader(fpr, int(dataChecksumInterval), murmur3.New32)
+	var value []byte
+	var kept []groupTOCEntry
+	for i := range entries {
+		wr := &entries[i]
+		if wr.TimestampBits&_TSB_DELETION == 0 {
+			if drop[wr.Offset] || groupInCorruptRange(wr.Offset, wr.Length, corruptions) {
+				continue
+			}
+			if groupFileVersion(dataHeader) >= 1 {
+				if cap(value) < int(wr.Length)+_GROUP_FILE_VALUE_CHECKSUM_SIZE {
+					value = make([]byte, int(wr.Length)+_GROUP_FILE_VALUE_CHECKSUM_SIZE)
+				}
+				value = value[:int(wr.Length)+_GROUP_FILE_VALUE_CHECKSUM_SIZE]
+				if _, err := reader.Seek(int64(wr.Offset), 0); err != nil {
+					continue
+				}
+				if _, err := io.ReadFull(reader, value); err != nil {
+					continue
+				}
+				checksum := murmur3.Sum32(value[:wr.Length])
+				if checksum != binary.BigEndian.Uint32(value[wr.Length:]) {
+					continue
+				}
+				if groupFileVersion(header) >= 1 && checksum != wr.Checksum {
+					continue
+				}
+			}
+		}
+		kept = append(kept, *wr)
+	}
+	if err = groupWriteTOCFile(newPath, header, checksumInterval, kept); err != nil {
+		return nil, err
+	}
+	result.Kept = len(kept)
+	result.Dropped = len(entries) - len(kept)
+	return result, nil
+}
+
+// groupReadTOCFile returns all the entries of the grouptoc file at the
+// fullPath, in file order, and any errors encountered.
+func groupReadTOCFile(fullPath string) ([]groupTOCEntry, []error) {
+	fp, err := os.Open(fullPath)
+	if err != nil {
+		return nil, []error{err}
+	}
+	defer fp.Close()
+	// A single worker keeps the entries in file order.
+	pendingBatchChans := []chan []groupTOCEntry{make(chan []groupTOCEntry, 3)}
+	freeBatchChans := []chan []groupTOCEntry{make(chan []groupTOCEntry, 3)}
+	for i := 0; i < cap(freeBatchChans[0]); i++ {
+		freeBatchChans[0] <- make([]groupTOCEntry, 1024)
+	}
+	var entries []groupTOCEntry
+	doneChan := make(chan struct{})
+	go func() {
+		for batch := range pendingBatchChans[0] {
+			entries = append(entries, batch...)
+			freeBatchChans[0] <- batch
+		}
+		close(doneChan)
+	}()
+	_, errs := groupReadTOCEntriesBatched(fp, 0, freeBatchChans, pendingBatchChans, make(chan struct{}))
+	close(pendingBatchChans[0])
+	<-doneChan
+	return entries, errs
+}
+
+// groupWriteTOCFile writes the entries to a new grouptoc file at the
+// fullPath with the header given, which also decides the format version of
+// the entries written.
+func groupWriteTOCFile(fullPath string, header []byte, checksumInterval uint32, entries []groupTOCEntry) error {
+	if len(header) != _GROUP_FILE_HEADER_SIZE {
+		return errors.New("invalid header")
+	}
+	fp, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	writer := brimio.NewMultiCoreChecksummedWriter(fp, int(checksumInterval), murmur3.New32, 1)
+	write := func() error {
+		if _, err := writer.Write(header); err != nil {
+			return err
+		}
+		entrySize := _GROUP_FILE_ENTRY_SIZE
+		if groupFileVersion(header) >= 1 {
+			entrySize = _GROUP_FILE_ENTRY_SIZE_V1
+		}
+		buf := make([]byte, entrySize)
+		for i := range entries {
+			wr := &entries[i]
+
+			binary.BigEndian.PutUint64(buf, wr.KeyA)
+			binary.BigEndian.PutUint64(buf[8:], wr.KeyB)
+			binary.BigEndian.PutUint64(buf[16:], wr.ChildKeyA)
+			binary.BigEndian.PutUint64(buf[24:], wr.ChildKeyB)
+			binary.BigEndian.PutUint64(buf[32:], wr.TimestampBits)
+			binary.BigEndian.PutUint32(buf[40:], wr.Offset)
+			binary.BigEndian.PutUint32(buf[44:], wr.Length)
+
+			if entrySize == _GROUP_FILE_ENTRY_SIZE_V1 {
+				binary.BigEndian.PutUint32(buf[_GROUP_FILE_ENTRY_SIZE:], wr.Checksum)
+			}
+			if _, err := writer.Write(buf); err != nil {
+				return err
+			}
+		}
+		_, err := writer.Write(groupTermBlock(checksumInterval))
+		return err
+	}
+	err = write()
+	if cerr := writer.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,194 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	ring "github.com/gholt/devicering"
+	"github.com/gholt/msgring"
+	"golang.org/x/net/context"
+)
+
+type msgRingGroupMerkleTester struct {
+	ring           ring.Ring
+	lock           sync.Mutex
+	toNodeHeaders  [][]byte
+	toNodeTypes    []uint64
+	toOtherHeaders [][]byte
+	toOtherBodies  [][]byte
+}
+
+func (m *msgRingGroupMerkleTester) Ring() ring.Ring {
+	return m.ring
+}
+
+func (m *msgRingGroupMerkleTester) MaxMsgLength() uint64 {
+	return 65536
+}
+
+func (m *msgRingGroupMerkleTester) SetMsgHandler(msgType uint64, handler msgring.MsgUnmarshaller) {
+}
+
+func (m *msgRingGroupMerkleTester) MsgToNode(msg msgring.Msg, nodeID uint64, timeout time.Duration) {
+	m.lock.Lock()
+	m.toNodeTypes = append(m.toNodeTypes, msg.MsgType())
+	if mkm, ok := msg.(*groupMerkleMsg); ok {
+		h := make([]byte, len(mkm.header))
+		copy(h, mkm.header)
+		m.toNodeHeaders = append(m.toNodeHeaders, h)
+	} else {
+		m.toNodeHeaders = append(m.toNodeHeaders, nil)
+	}
+	m.lock.Unlock()
+	msg.Free(0, 0)
+}
+
+func (m *msgRingGroupMerkleTester) MsgToOtherReplicas(msg msgring.Msg, partition uint32, timeout time.Duration) {
+	if mkm, ok := msg.(*groupMerkleMsg); ok {
+		m.lock.Lock()
+		h := make([]byte, len(mkm.header))
+		copy(h, mkm.header)
+		m.toOtherHeaders = append(m.toOtherHeaders, h)
+		b := make([]byte, len(mkm.body))
+		copy(b, mkm.body)
+		m.toOtherBodies = append(m.toOtherBodies, b)
+		m.lock.Unlock()
+	}
+	msg.Free(0, 0)
+}
+
+func TestGroupMerkleUpdate(t *testing.T) {
+	cfg := newTestGroupStoreConfig()
+	cfg.MerkleReplication = true
+	cfg.MerkleBits = 8
+	store, _ := newTestGroupStore(cfg)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	keyA := uint64(1) << 56
+	if _, err := store.write(keyA, 2, 3, 4, 0x500, []byte("testing"), false); err != nil {
+		t.Fatal(err)
+	}
+	if store.merkleState.leaves[1] != groupMerkleHash(keyA, 2, 3, 4, 0x500) {
+		t.Fatal(store.merkleState.leaves[1])
+	}
+	if _, err := store.write(keyA, 2, 3, 4, 0x600, []byte("testing"), false); err != nil {
+		t.Fatal(err)
+	}
+	if store.merkleState.leaves[1] != groupMerkleHash(keyA, 2, 3, 4, 0x600) {
+		t.Fatal(store.merkleState.leaves[1])
+	}
+	// Older writes should not change the tree.
+	if _, err := store.write(keyA, 2, 3, 4, 0x400, []byte("testing"), false); err != nil {
+		t.Fatal(err)
+	}
+	if store.merkleState.leaves[1] != groupMerkleHash(keyA, 2, 3, 4, 0x600) {
+		t.Fatal(store.merkleState.leaves[1])
+	}
+	if _, err := store.write(keyA+1, 2, 3, 4, 0x500, []byte("testing"), false); err != nil {
+		t.Fatal(err)
+	}
+	if store.merkleState.leaves[1] != groupMerkleHash(keyA, 2, 3, 4, 0x600)^groupMerkleHash(keyA+1, 2, 3, 4, 0x500) {
+		t.Fatal(store.merkleState.leaves[1])
+	}
+	// Local removals take the item out of the tree entirely.
+	if _, err := store.write(keyA+1, 2, 3, 4, 0x500|_TSB_LOCAL_REMOVAL, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if store.merkleState.leaves[1] != groupMerkleHash(keyA, 2, 3, 4, 0x600) {
+		t.Fatal(store.merkleState.leaves[1])
+	}
+	for i, h := range store.merkleState.leaves {
+		if i != 1 && h != 0 {
+			t.Fatal(i, h)
+		}
+	}
+}
+
+func TestGroupMerkleExchange(t *testing.T) {
+	b := ring.NewBuilder(64)
+	b.SetReplicaCount(2)
+	n, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	r.SetLocalNode(n.ID())
+	m := &msgRingGroupMerkleTester{ring: r}
+	cfg := newTestGroupStoreConfig()
+	cfg.MsgRing = m
+	cfg.MerkleReplication = true
+	cfg.MerkleBits = 8
+	store, _ := newTestGroupStore(cfg)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	keyA := uint64(1) << 56
+	if _, err = store.write(keyA, 2, 3, 4, 0x500, []byte("testing"), false); err != nil {
+		t.Fatal(err)
+	}
+	store.OutPullReplicationPass()
+	pbc := r.PartitionBitCount()
+	partition := uint32(keyA >> (64 - pbc))
+	found := false
+	m.lock.Lock()
+	for i, h := range m.toOtherHeaders {
+		mkm := &groupMerkleMsg{header: h, body: m.toOtherBodies[i]}
+		if mkm.partition() != partition {
+			continue
+		}
+		found = true
+		if mkm.depth() != 0 || len(mkm.body) != _GROUP_MERKLE_MSG_ENTRY_BYTES {
+			t.Fatal(mkm.depth(), len(mkm.body))
+		}
+		if binary.BigEndian.Uint64(mkm.body[4:]) != groupMerkleHash(keyA, 2, 3, 4, 0x500) {
+			t.Fatal(binary.BigEndian.Uint64(mkm.body[4:]))
+		}
+	}
+	m.lock.Unlock()
+	if !found {
+		t.Fatal("no root sent for partition", partition)
+	}
+	// Pretend the other node has nothing in the leaf; the store should send
+	// the item and its own leaf hash back.
+	leafDepth := 8 - pbc
+	msg := make([]byte, _GROUP_MERKLE_MSG_HEADER_BYTES+_GROUP_MERKLE_MSG_ENTRY_BYTES)
+	binary.BigEndian.PutUint64(msg, n2.ID())
+	binary.BigEndian.PutUint64(msg[8:], uint64(r.Version()))
+	binary.BigEndian.PutUint32(msg[16:], partition)
+	msg[20] = 8
+	msg[21] = byte(leafDepth)
+	binary.BigEndian.PutUint32(msg[_GROUP_MERKLE_MSG_HEADER_BYTES:], uint32(1-uint64(partition)<<leafDepth))
+	if _, err = store.newInMerkleMsg(bytes.NewReader(msg), uint64(len(msg))); err != nil {
+		t.Fatal(err)
+	}
+	var gotBulkSet, gotReply bool
+	for i := 0; i < 100 && !(gotBulkSet && gotReply); i++ {
+		time.Sleep(10 * time.Millisecond)
+		m.lock.Lock()
+		for j, typ := range m.toNodeTypes {
+			switch typ {
+			case _GROUP_BULK_SET_MSG_TYPE:
+				gotBulkSet = true
+			case _GROUP_MERKLE_MSG_TYPE:
+				if m.toNodeHeaders[j][22]&_GROUP_MERKLE_FLAG_NO_REPLY == 0 {
+					t.Fatal("reply without no-reply flag")
+				}
+				gotReply = true
+			}
+		}
+		m.lock.Unlock()
+	}
+	if !gotBulkSet || !gotReply {
+		t.Fatal(gotBulkSet, gotReply)
+	}
+}
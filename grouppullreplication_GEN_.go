@@ -4,29 +4,46 @@ import (
 	"encoding/binary"
 	"io"
 	"math"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gholt/brimtime"
 	"go.uber.org/zap"
+	"golang.org/x/net/context"
 )
 
 const _GROUP_PULL_REPLICATION_MSG_TYPE = 0x34bf87953e59e8d1
+const _GROUP_AUTH_PULL_REPLICATION_MSG_TYPE = 0xe09c0094b4bef0a8
 
 const _GROUP_PULL_REPLICATION_MSG_HEADER_BYTES = 44
 
 type groupPullReplicationState struct {
 	inWorkers            int
 	inMsgs               int
+	inMsgCap             int
 	inResponseMsgTimeout time.Duration
 	outInterval          int
 	outIteration         uint16
 	outWorkers           uint64
 	outMsgs              int
 	outMsgTimeout        time.Duration
+	outMsgCap            int
 	outBloomN            uint64
 	outBloomP            float64
+	outBloomAutoTune     bool
+	// outBloomPBits is the math.Float64bits of the P-factor currently in use;
+	// it only differs from outBloomP when outBloomAutoTune is on.
+	outBloomPBits uint64
+	// outLateCutoff is the cutoff from the start of the last completed out
+	// pull replication pass; any item older than this that still has to be
+	// replicated in was missed by that pass, most likely due to a bloom filter
+	// false positive. These items are counted in outLateValues.
+	outLateCutoff uint64
+	outLateValues uint64
+	outLastKeys   uint64
+	outLimiter    rateLimiter
 
 	inStartupShutdownLock sync.Mutex
 	inNotifyChan          chan *bgNotification
@@ -35,6 +52,7 @@ type groupPullReplicationState struct {
 
 	outStartupShutdownLock sync.Mutex
 	outNotifyChan          chan *bgNotification
+	outTask                backgroundTask
 	outMsgChan             chan *groupPullReplicationMsg
 	outKTBFs               []*groupKTBloomFilter
 }
@@ -48,6 +66,7 @@ type groupPullReplicationMsg struct {
 func (store *defaultGroupStore) pullReplicationConfig(cfg *GroupStoreConfig) {
 	store.pullReplicationState.inWorkers = cfg.InPullReplicationWorkers
 	store.pullReplicationState.inMsgs = cfg.InPullReplicationMsgs
+	store.pullReplicationState.inMsgCap = cfg.MsgCap
 	store.pullReplicationState.inResponseMsgTimeout = time.Duration(cfg.InPullReplicationResponseMsgTimeout) * time.Millisecond
 	store.pullReplicationState.outInterval = cfg.OutPullReplicationInterval
 	store.pullReplicationState.outIteration = uint16(cfg.Rand.Uint32())
@@ -56,17 +75,26 @@ func (store *defaultGroupStore) pullReplicationConfig(cfg *GroupStoreConfig) {
 	store.pullReplicationState.outMsgTimeout = time.Duration(cfg.OutPullReplicationMsgTimeout) * time.Millisecond
 	store.pullReplicationState.outBloomN = uint64(cfg.OutPullReplicationBloomN)
 	store.pullReplicationState.outBloomP = cfg.OutPullReplicationBloomP
+	store.pullReplicationState.outBloomAutoTune = cfg.OutPullReplicationBloomAutoTune
+	store.pullReplicationState.outBloomPBits = math.Float64bits(cfg.OutPullReplicationBloomP)
+	store.pullReplicationState.outMsgCap = cfg.MsgCap
+	store.pullReplicationState.outLimiter.set(cfg.OutPullReplicationBytesPerSecond, cfg.OutPullReplicationMsgsPerSecond)
 	if store.msgRing != nil {
 		store.msgRing.SetMsgHandler(_GROUP_PULL_REPLICATION_MSG_TYPE, store.newInPullReplicationMsg)
+		store.msgRing.SetMsgHandler(_GROUP_AUTH_PULL_REPLICATION_MSG_TYPE, store.newInAuthPullReplicationMsg)
+		store.msgRing.SetMsgHandler(_GROUP_COMPRESSED_PULL_REPLICATION_MSG_TYPE, store.newInCompressedPullReplicationMsg)
+		store.msgRing.SetMsgHandler(_GROUP_AUTH_COMPRESSED_PULL_REPLICATION_MSG_TYPE, store.newInAuthCompressedPullReplicationMsg)
 	}
 }
 
 func (store *defaultGroupStore) pullReplicationStartup() {
+	store.pullReplicationState.outLimiter.start()
 	store.inPullReplicationStartup()
 	store.outPullReplicationStartup()
 }
 
 func (store *defaultGroupStore) pullReplicationShutdown() {
+	store.pullReplicationState.outLimiter.stop()
 	store.inPullReplicationShutdown()
 	store.outPullReplicationShutdown()
 }
@@ -116,12 +144,13 @@ func (store *defaultGroupStore) outPullReplicationStartup() {
 func (store *defaultGroupStore) outPullReplicationStartupHelper() {
 	store.pullReplicationState.outNotifyChan = make(chan *bgNotification, 1)
 	store.pullReplicationState.outMsgChan = make(chan *groupPullReplicationMsg, store.pullReplicationState.outMsgs)
-	store.pullReplicationState.outKTBFs = []*groupKTBloomFilter{newGroupKTBloomFilter(store.pullReplicationState.outBloomN, store.pullReplicationState.outBloomP, 0)}
+	store.pullReplicationState.outKTBFs = []*groupKTBloomFilter{newGroupKTBloomFilter(1, store.pullReplicationState.outBloomP, 0)}
+	// The message bodies will grow as needed to hold the bloom filters, which
+	// are sized for each range scanned.
 	for i := 0; i < cap(store.pullReplicationState.outMsgChan); i++ {
 		store.pullReplicationState.outMsgChan <- &groupPullReplicationMsg{
 			store:  store,
 			header: make([]byte, _GROUP_KT_BLOOM_FILTER_HEADER_BYTES+_GROUP_PULL_REPLICATION_MSG_HEADER_BYTES),
-			body:   make([]byte, len(store.pullReplicationState.outKTBFs[0].bits)),
 		}
 	}
 }
@@ -136,6 +165,7 @@ func (store *defaultGroupStore) outPullReplicationShutdown() {
 		}
 		<-c
 		store.outPullReplicationShutdownHelper()
+		store.pullReplicationState.outTask.stop()
 	}
 	store.pullReplicationState.outStartupShutdownLock.Unlock()
 }
@@ -147,6 +177,8 @@ func (store *defaultGroupStore) outPullReplicationShutdownHelper() {
 }
 
 func (store *defaultGroupStore) OutPullReplicationPass() {
+	_, span := store.startSpan(context.Background(), "OutPullReplicationPass")
+	defer span.End()
 	store.pullReplicationState.outStartupShutdownLock.Lock()
 	if store.pullReplicationState.outNotifyChan == nil {
 		store.outPullReplicationStartupHelper()
@@ -186,9 +218,93 @@ func (store *defaultGroupStore) inPullReplicationLauncher(notifyChan chan *bgNot
 	}
 }
 
-// newInPullReplicationMsg reads pull-replication messages from the MsgRing and
-// puts them on the inMsgChan for the inPullReplication workers to work on.
+// newInPullReplicationMsg reads unauthenticated pull-replication messages from
+// the MsgRing and puts them on the inMsgChan for the inPullReplication workers
+// to work on.
 func (store *defaultGroupStore) newInPullReplicationMsg(r io.Reader, l uint64) (uint64, error) {
+	return store.receivePullReplicationMsg(r, l, false)
+}
+
+// newInCompressedPullReplicationMsg is newInPullReplicationMsg for compressed messages.
+func (store *defaultGroupStore) newInCompressedPullReplicationMsg(r io.Reader, l uint64) (uint64, error) {
+	return store.receivePullReplicationMsg(r, l, true)
+}
+
+func (store *defaultGroupStore) receivePullReplicationMsg(r io.Reader, l uint64, compressed bool) (uint64, error) {
+	if store.msgAuthState.requireAuth {
+		n, err := tossRead(r, l)
+		if err != nil {
+			atomic.AddInt32(&store.inPullReplicationInvalids, 1)
+			return n, err
+		}
+		atomic.AddInt32(&store.inPullReplicationRejects, 1)
+		store.logger.Warn("rejected unauthenticated incoming message", zap.String("name", store.loggerPrefix+"inPullReplication"))
+		return n, nil
+	}
+	prm, n, err := store.readInPullReplicationMsgCompressed(r, l, compressed)
+	if prm != nil {
+		store.pullReplicationState.inMsgChan <- prm
+		atomic.AddInt32(&store.inPullReplications, 1)
+	}
+	return n, err
+}
+
+// newInAuthPullReplicationMsg reads authenticated pull-replication messages
+// from the MsgRing and puts them on the inMsgChan for the inPullReplication
+// workers to work on.
+func (store *defaultGroupStore) newInAuthPullReplicationMsg(r io.Reader, l uint64) (uint64, error) {
+	return store.receiveAuthPullReplicationMsg(r, l, false)
+}
+
+// newInAuthCompressedPullReplicationMsg is newInAuthPullReplicationMsg for compressed messages.
+func (store *defaultGroupStore) newInAuthCompressedPullReplicationMsg(r io.Reader, l uint64) (uint64, error) {
+	return store.receiveAuthPullReplicationMsg(r, l, true)
+}
+
+func (store *defaultGroupStore) receiveAuthPullReplicationMsg(r io.Reader, l uint64, compressed bool) (uint64, error) {
+	var prm *groupPullReplicationMsg
+	nodeID, ok, n, err := store.readInAuthMsg(r, l, func(r io.Reader, l uint64) (uint64, error) {
+		var n uint64
+		var err error
+		prm, n, err = store.readInPullReplicationMsgCompressed(r, l, compressed)
+		return n, err
+	})
+	if ok {
+		if prm != nil {
+			store.pullReplicationState.inMsgChan <- prm
+			atomic.AddInt32(&store.inPullReplications, 1)
+		}
+		return n, err
+	}
+	if prm != nil {
+		store.pullReplicationState.inFreeMsgChan <- prm
+	}
+	if err == nil {
+		atomic.AddInt32(&store.inPullReplicationRejects, 1)
+		store.logger.Warn("rejected unverified incoming message", zap.String("name", store.loggerPrefix+"inPullReplication"), zap.Uint64("nodeID", nodeID))
+	}
+	return n, err
+}
+
+// readInPullReplicationMsgCompressed is readInPullReplicationMsg for possibly compressed
+// messages.
+func (store *defaultGroupStore) readInPullReplicationMsgCompressed(r io.Reader, l uint64, compressed bool) (*groupPullReplicationMsg, uint64, error) {
+	if !compressed {
+		return store.readInPullReplicationMsg(r, l)
+	}
+	var prm *groupPullReplicationMsg
+	n, err := store.readInCompressedMsg(r, l, func(r io.Reader, l uint64) (uint64, error) {
+		var n uint64
+		var err error
+		prm, n, err = store.readInPullReplicationMsg(r, l)
+		return n, err
+	})
+	return prm, n, err
+}
+
+// readInPullReplicationMsg reads a pull-replication message, returning nil if
+// the message was discarded.
+func (store *defaultGroupStore) readInPullReplicationMsg(r io.Reader, l uint64) (*groupPullReplicationMsg, uint64, error) {
 	var prm *groupPullReplicationMsg
 	select {
 	case prm = <-store.pullReplicationState.inFreeMsgChan:
@@ -207,47 +323,86 @@ func (store *defaultGroupStore) newInPullReplicationMsg(r io.Reader, l uint64) (
 			left -= uint64(sn)
 			if err != nil {
 				atomic.AddInt32(&store.inPullReplicationInvalids, 1)
-				return l - left, err
+				return nil, l - left, err
 			}
 		}
 		atomic.AddInt32(&store.inPullReplicationDrops, 1)
-		return l, nil
-	}
-	// TODO: We need to cap this so memory isn't abused in case someone
-	// accidentally sets a crazy sized bloom filter on another node. Since a
-	// partial pull-replication message is pretty much useless as it would drop
-	// a chunk of the bloom filter bitspace, we should drop oversized messages
-	// but report the issue.
-	bl := l - _GROUP_PULL_REPLICATION_MSG_HEADER_BYTES - uint64(_GROUP_KT_BLOOM_FILTER_HEADER_BYTES)
-	if uint64(cap(prm.body)) < bl {
-		prm.body = make([]byte, bl)
+		return nil, l, nil
+	}
+	// If the message is obviously too short, just throw it away.
+	if l < uint64(len(prm.header)) {
+		store.pullReplicationState.inFreeMsgChan <- prm
+		left := l
+		var sn int
+		var err error
+		for left > 0 {
+			t := toss
+			if left < uint64(len(t)) {
+				t = t[:left]
+			}
+			sn, err = r.Read(t)
+			left -= uint64(sn)
+			if err != nil {
+				atomic.AddInt32(&store.inPullReplicationInvalids, 1)
+				return nil, l - left, err
+			}
+		}
+		atomic.AddInt32(&store.inPullReplicationInvalids, 1)
+		return nil, l, nil
 	}
-	prm.body = prm.body[:bl]
 	var n int
 	var sn int
 	var err error
 	for n != len(prm.header) {
+		sn, err = r.Read(prm.header[n:])
+		n += sn
 		if err != nil {
 			store.pullReplicationState.inFreeMsgChan <- prm
 			atomic.AddInt32(&store.inPullReplicationInvalids, 1)
-			return uint64(n), err
+			return nil, uint64(n), err
 		}
-		sn, err = r.Read(prm.header[n:])
-		n += sn
 	}
+	// Messages larger than the local MsgCap are dropped so memory isn't abused
+	// in case someone accidentally sets a crazy sized bloom filter on another
+	// node. Since a partial pull-replication message is pretty much useless
+	// as it would drop a chunk of the bloom filter bitspace, the whole message
+	// is discarded and the issue reported.
+	if l > uint64(store.pullReplicationState.inMsgCap) {
+		nodeID := prm.nodeID()
+		store.pullReplicationState.inFreeMsgChan <- prm
+		left := l - uint64(n)
+		for left > 0 {
+			t := toss
+			if left < uint64(len(t)) {
+				t = t[:left]
+			}
+			sn, err = r.Read(t)
+			left -= uint64(sn)
+			if err != nil {
+				atomic.AddInt32(&store.inPullReplicationInvalids, 1)
+				return nil, l - left, err
+			}
+		}
+		atomic.AddInt32(&store.inPullReplicationOversizes, 1)
+		store.logger.Warn("dropped oversized incoming message", zap.String("name", store.loggerPrefix+"inPullReplication"), zap.Uint64("nodeID", nodeID), zap.Uint64("length", l), zap.Int("cap", store.pullReplicationState.inMsgCap))
+		return nil, l, nil
+	}
+	bl := l - uint64(len(prm.header))
+	if uint64(cap(prm.body)) < bl {
+		prm.body = make([]byte, bl)
+	}
+	prm.body = prm.body[:bl]
 	n = 0
 	for n != len(prm.body) {
+		sn, err = r.Read(prm.body[n:])
+		n += sn
 		if err != nil {
 			store.pullReplicationState.inFreeMsgChan <- prm
 			atomic.AddInt32(&store.inPullReplicationInvalids, 1)
-			return uint64(len(prm.header)) + uint64(n), err
+			return nil, uint64(len(prm.header)) + uint64(n), err
 		}
-		sn, err = r.Read(prm.body[n:])
-		n += sn
 	}
-	store.pullReplicationState.inMsgChan <- prm
-	atomic.AddInt32(&store.inPullReplications, 1)
-	return l, nil
+	return prm, l, nil
 }
 
 // inPullReplication actually processes incoming pull-replication messages;
@@ -269,6 +424,7 @@ func (store *defaultGroupStore) inPullReplication(wg *sync.WaitGroup) {
 			store.pullReplicationState.inFreeMsgChan <- prm
 			continue
 		}
+		_, span := store.tracer.Start(context.Background(), "GroupStore.inPullReplication", TraceAttribute{Key: "length", Value: prm.MsgLength()}, TraceAttribute{Key: "nodeID", Value: prm.nodeID()})
 		k = k[:0]
 		// This is what the remote system used when making its bloom filter,
 		// computed via its config.ReplicationIgnoreRecent setting. We want to
@@ -337,9 +493,14 @@ func (store *defaultGroupStore) inPullReplication(wg *sync.WaitGroup) {
 			}
 			if len(bsm.body) > 0 {
 				atomic.AddInt32(&store.outBulkSets, 1)
-				store.msgRing.MsgToNode(bsm, nodeID, store.pullReplicationState.inResponseMsgTimeout)
+				atomic.AddInt64(&store.outBulkSetBytes, int64(bsm.MsgLength()))
+				if store.bulkSetState.outLimiter.wait(bsm.MsgLength()) {
+					atomic.AddInt32(&store.outBulkSetRateLimitHits, 1)
+				}
+				store.msgToNode(bsm, nodeID, store.pullReplicationState.inResponseMsgTimeout)
 			}
 		}
+		span.End()
 	}
 	wg.Done()
 }
@@ -349,6 +510,7 @@ func (store *defaultGroupStore) outPullReplicationLauncher(notifyChan chan *bgNo
 	store.randMutex.Lock()
 	nextRun := time.Now().Add(time.Duration(interval + interval*store.rand.NormFloat64()*0.1))
 	store.randMutex.Unlock()
+	store.pullReplicationState.outTask.launch(nextRun)
 	var notification *bgNotification
 	running := true
 	for running {
@@ -369,6 +531,7 @@ func (store *defaultGroupStore) outPullReplicationLauncher(notifyChan chan *bgNo
 		store.randMutex.Lock()
 		nextRun = time.Now().Add(time.Duration(interval + interval*store.rand.NormFloat64()*0.1))
 		store.randMutex.Unlock()
+		store.pullReplicationState.outTask.schedule(nextRun)
 		if notification != nil {
 			var nextNotification *bgNotification
 			switch notification.action {
@@ -395,12 +558,28 @@ func (store *defaultGroupStore) outPullReplicationPass(notifyChan chan *bgNotifi
 	if ring == nil || ring.ReplicaCount() < 2 || ring.NodeCount() < 2 {
 		return nil
 	}
+	store.msgHello()
+	store.pullReplicationState.outTask.begin()
 	begin := time.Now()
+	var bytes int64
 	defer func() {
 		elapsed := time.Now().Sub(begin)
-		store.logger.Debug("pass complete", zap.String("name", store.loggerPrefix+"outPullReplication"), zap.Duration("elapsed", elapsed))
+		store.logger.Debug("pass complete", zap.String("name", store.loggerPrefix+"outPullReplication"), zap.Duration("elapsed", elapsed), zap.Int64("bytes", atomic.LoadInt64(&bytes)))
 		atomic.StoreInt64(&store.outPullReplicationNanoseconds, elapsed.Nanoseconds())
+		store.outPullReplicationPassDuration.observe(elapsed)
+		store.pullReplicationState.outTask.end()
+		atomic.StoreInt64(&store.outPullReplicationPassBytes, atomic.LoadInt64(&bytes))
+		atomic.AddInt64(&store.outPullReplicationBytes, atomic.LoadInt64(&bytes))
 	}()
+	pass := atomic.AddUint64(&store.replicationStatusState.pullPass, 1)
+	if store.merkleState.leaves != nil {
+		if ring.PartitionBitCount() <= store.merkleState.bits {
+			var notification *bgNotification
+			notification, bytes = store.outMerklePass(notifyChan, pass)
+			return notification
+		}
+		store.logger.Warn("ring partition bit count exceeds merkle bits; using bloom filters", zap.String("name", store.loggerPrefix+"outPullReplication"), zap.Uint16("partitionBitCount", ring.PartitionBitCount()), zap.Uint16("merkleBits", store.merkleState.bits))
+	}
 	rightwardPartitionShift := 64 - ring.PartitionBitCount()
 	partitionCount := uint64(1) << ring.PartitionBitCount()
 	if store.pullReplicationState.outIteration == math.MaxUint16 {
@@ -410,11 +589,28 @@ func (store *defaultGroupStore) outPullReplicationPass(notifyChan chan *bgNotifi
 	}
 	ringVersion := ring.Version()
 	ws := store.pullReplicationState.outWorkers
+	bloomP := math.Float64frombits(atomic.LoadUint64(&store.pullReplicationState.outBloomPBits))
 	for uint64(len(store.pullReplicationState.outKTBFs)) < ws {
-		store.pullReplicationState.outKTBFs = append(store.pullReplicationState.outKTBFs, newGroupKTBloomFilter(store.pullReplicationState.outBloomN, store.pullReplicationState.outBloomP, 0))
+		store.pullReplicationState.outKTBFs = append(store.pullReplicationState.outKTBFs, newGroupKTBloomFilter(1, bloomP, 0))
+	}
+	// Each bloom filter is sized for the number of keys actually in its
+	// range, up to outBloomN keys and what will fit within outMsgCap.
+	bloomMaxN := groupKTBloomFilterMaxN(store.pullReplicationState.outMsgCap-_GROUP_PULL_REPLICATION_MSG_HEADER_BYTES-_GROUP_KT_BLOOM_FILTER_HEADER_BYTES, bloomP)
+	if bloomMaxN > store.pullReplicationState.outBloomN {
+		bloomMaxN = store.pullReplicationState.outBloomN
 	}
+	passCutoff := (uint64(brimtime.TimeToUnixMicro(begin)) << _TSB_UTIL_BITS) - store.replicationIgnoreRecent
+	var keys uint64
 	var abort uint32
+	var responsible int64
+	for p := uint64(0); p < partitionCount; p++ {
+		if ring.Responsible(uint32(p)) {
+			responsible++
+		}
+	}
+	store.pullReplicationState.outTask.progress(0, responsible*int64(ws))
 	f := func(p uint64, w uint64, ktbf *groupKTBloomFilter) {
+		store.pullReplicationState.outTask.working("partition " + strconv.FormatUint(p, 10))
 		pb := p << rightwardPartitionShift
 		rb := pb + ((uint64(1) << rightwardPartitionShift) / ws * w)
 		var re uint64
@@ -427,31 +623,17 @@ func (store *defaultGroupStore) outPullReplicationPass(notifyChan chan *bgNotifi
 		} else {
 			re = pb + ((uint64(1) << rightwardPartitionShift) / ws * (w + 1)) - 1
 		}
-		timestampbitsnow := uint64(brimtime.TimeToUnixMicro(time.Now())) << _TSB_UTIL_BITS
-		cutoff := timestampbitsnow - store.replicationIgnoreRecent
-		var more bool
-		for atomic.LoadUint32(&abort) == 0 {
-			rbThis := rb
-			ktbf.reset(store.pullReplicationState.outIteration)
-			rb, more = store.locmap.ScanCallback(rb, re, 0, _TSB_LOCAL_REMOVAL, cutoff, store.pullReplicationState.outBloomN, func(keyA uint64, keyB uint64, childKeyA uint64, childKeyB uint64, timestampbits uint64, length uint32) bool {
-				ktbf.add(keyA, keyB, childKeyA, childKeyB, timestampbits)
-				return true
-			})
-			ring2 := store.msgRing.Ring()
-			if ring2 == nil || ring2.Version() != ringVersion {
-				break
-			}
-			reThis := re
-			if more {
-				reThis = rb - 1
-			}
-			prm := store.newOutPullReplicationMsg(ringVersion, uint32(p), cutoff, rbThis, reThis, ktbf)
-			atomic.AddInt32(&store.outPullReplications, 1)
-			store.msgRing.MsgToOtherReplicas(prm, uint32(p), store.pullReplicationState.outMsgTimeout)
-			if !more {
-				break
+		store.replicationPullStarted(ring.PartitionBitCount(), uint32(p), pass)
+		n, b := store.outPullReplicationRange(ringVersion, uint32(p), rb, re, ktbf, bloomMaxN, bloomP, &abort)
+		atomic.AddUint64(&keys, n)
+		atomic.AddInt64(&bytes, b)
+		if atomic.LoadUint32(&abort) == 0 {
+			if ring2 := store.msgRing.Ring(); ring2 != nil && ring2.Version() == ringVersion {
+				// Each of the ws workers does its own part of the partition.
+				store.replicationPulled(ring.PartitionBitCount(), uint32(p), pass, ws)
 			}
 		}
+		store.pullReplicationState.outTask.progress(1, 0)
 	}
 	wg := &sync.WaitGroup{}
 	wg.Add(int(ws))
@@ -497,10 +679,100 @@ func (store *defaultGroupStore) outPullReplicationPass(notifyChan chan *bgNotifi
 		<-waitChan
 		return notification
 	case <-waitChan:
+		store.outPullReplicationTune(passCutoff, atomic.LoadUint64(&keys))
 		return nil
 	}
 }
 
+// outPullReplicationRange sends pull-replication messages for the range
+// rb:re of partition p to the other replicas, using the ktbf scratch bloom
+// filter, until done or abort is set. Returned are the number of keys
+// covered by the bloom filters sent and the bytes sent.
+func (store *defaultGroupStore) outPullReplicationRange(ringVersion int64, p uint32, rb uint64, re uint64, ktbf *groupKTBloomFilter, bloomMaxN uint64, bloomP float64, abort *uint32) (uint64, int64) {
+	timestampbitsnow := uint64(brimtime.TimeToUnixMicro(time.Now())) << _TSB_UTIL_BITS
+	cutoff := timestampbitsnow - store.replicationIgnoreRecent
+	var keys uint64
+	var bytes int64
+	var more bool
+	for atomic.LoadUint32(abort) == 0 {
+		rbThis := rb
+		// First just count the keys to know how big the bloom filter
+		// needs to be, then scan again to fill it.
+		var n uint64
+		rb, more = store.locmap.ScanCallback(rb, re, 0, _TSB_LOCAL_REMOVAL, cutoff, bloomMaxN, func(keyA uint64, keyB uint64, childKeyA uint64, childKeyB uint64, timestampbits uint64, length uint32) bool {
+			n++
+			return true
+		})
+		reThis := re
+		if more {
+			reThis = rb - 1
+		}
+		if n > 0 {
+			ktbf.resize(n, bloomP, store.pullReplicationState.outIteration)
+			store.locmap.ScanCallback(rbThis, reThis, 0, _TSB_LOCAL_REMOVAL, cutoff, math.MaxUint64, func(keyA uint64, keyB uint64, childKeyA uint64, childKeyB uint64, timestampbits uint64, length uint32) bool {
+				ktbf.add(keyA, keyB, childKeyA, childKeyB, timestampbits)
+				return true
+			})
+			keys += n
+		} else {
+			ktbf.resize(1, bloomP, store.pullReplicationState.outIteration)
+		}
+		ring2 := store.msgRing.Ring()
+		if ring2 == nil || ring2.Version() != ringVersion {
+			break
+		}
+		prm := store.newOutPullReplicationMsg(ringVersion, p, cutoff, rbThis, reThis, ktbf)
+		atomic.AddInt32(&store.outPullReplications, 1)
+		bytes += int64(prm.MsgLength())
+		if store.pullReplicationState.outLimiter.wait(prm.MsgLength()) {
+			atomic.AddInt32(&store.outPullReplicationRateLimitHits, 1)
+		}
+		store.msgToOtherReplicas(prm, p, store.pullReplicationState.outMsgTimeout)
+		if !more {
+			break
+		}
+	}
+	return keys, bytes
+}
+
+// outPullReplicationTune is called after each complete bloom filter pass with
+// the pass's cutoff and the number of keys put into its bloom filters. It
+// measures the false positive rate achieved by the previous pass from the
+// number of late values received since then, and, if outBloomAutoTune is on,
+// adjusts the P-factor so the achieved rate tracks it; the P-factor is never
+// raised above the configured outBloomP.
+func (store *defaultGroupStore) outPullReplicationTune(cutoff uint64, keys uint64) {
+	late := atomic.SwapUint64(&store.pullReplicationState.outLateValues, 0)
+	lastKeys := store.pullReplicationState.outLastKeys
+	store.pullReplicationState.outLastKeys = keys
+	atomic.StoreUint64(&store.pullReplicationState.outLateCutoff, cutoff)
+	if lastKeys == 0 {
+		return
+	}
+	rate := float64(late) / float64(lastKeys)
+	atomic.StoreUint64(&store.outPullReplicationBloomFPRate, math.Float64bits(rate))
+	if !store.pullReplicationState.outBloomAutoTune {
+		return
+	}
+	p := math.Float64frombits(atomic.LoadUint64(&store.pullReplicationState.outBloomPBits))
+	np := p
+	if rate > p {
+		np = p / 2
+	} else if rate < p/4 {
+		np = p * 2
+	}
+	if np < 0.000001 {
+		np = 0.000001
+	}
+	if np > store.pullReplicationState.outBloomP {
+		np = store.pullReplicationState.outBloomP
+	}
+	if np != p {
+		store.logger.Debug("bloom filter P-factor tuned", zap.String("name", store.loggerPrefix+"outPullReplication"), zap.Float64("fpRate", rate), zap.Float64("from", p), zap.Float64("to", np))
+		atomic.StoreUint64(&store.pullReplicationState.outBloomPBits, math.Float64bits(np))
+	}
+}
+
 // newOutPullReplicationMsg gives an initialized groupPullReplicationMsg for
 // filling out and eventually sending using the MsgRing. The MsgRing (or
 // someone else if the message doesn't end up with the MsgRing) will call
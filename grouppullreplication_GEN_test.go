@@ -1,6 +1,8 @@
 package store
 
 import (
+	"bytes"
+	"encoding/binary"
 	"sync"
 	"testing"
 	"time"
@@ -97,3 +99,78 @@ func TestGroupPullReplicationSimple(t *testing.T) {
 		t.Fatal("")
 	}
 }
+
+func TestGroupPullReplicationBloomAutoTune(t *testing.T) {
+	cfg := newTestGroupStoreConfig()
+	cfg.OutPullReplicationBloomP = 0.01
+	cfg.OutPullReplicationBloomAutoTune = true
+	store, _ := newTestGroupStore(cfg)
+	// No previous pass to measure against yet.
+	store.outPullReplicationTune(0x1000, 1000)
+	getP := func() float64 {
+		stats, err := store.Stats(context.Background(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats.(*GroupStoreStats).OutPullReplicationBloomP
+	}
+	if p := getP(); p != 0.01 {
+		t.Fatal(p)
+	}
+	// 50 late values over 1000 keys is well over the P-factor.
+	store.pullReplicationState.outLateValues = 50
+	store.outPullReplicationTune(0x2000, 1000)
+	if p := getP(); p != 0.005 {
+		t.Fatal(p)
+	}
+	if store.pullReplicationState.outLateCutoff != 0x2000 {
+		t.Fatal(store.pullReplicationState.outLateCutoff)
+	}
+	// No late values should loosen it again, but never past the configured
+	// P-factor.
+	store.outPullReplicationTune(0x3000, 1000)
+	if p := getP(); p != 0.01 {
+		t.Fatal(p)
+	}
+	store.outPullReplicationTune(0x4000, 1000)
+	if p := getP(); p != 0.01 {
+		t.Fatal(p)
+	}
+}
+
+func TestGroupPullReplicationReadOversized(t *testing.T) {
+	cfg := newTestGroupStoreConfig()
+	cfg.MsgRing = &msgRingPlaceholder{}
+	store, _ := newTestGroupStore(cfg)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	l := uint64(store.pullReplicationState.inMsgCap + 1)
+	msg := make([]byte, l)
+	binary.BigEndian.PutUint64(msg, 123)
+	n, err := store.newInPullReplicationMsg(bytes.NewBuffer(msg), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != l {
+		t.Fatal(n)
+	}
+	if store.inPullReplicationOversizes != 1 {
+		t.Fatal(store.inPullReplicationOversizes)
+	}
+	if store.inPullReplications != 0 {
+		t.Fatal(store.inPullReplications)
+	}
+	// Obviously too short.
+	n, err = store.newInPullReplicationMsg(bytes.NewBuffer(make([]byte, 10)), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 {
+		t.Fatal(n)
+	}
+	if store.inPullReplicationInvalids != 1 {
+		t.Fatal(store.inPullReplicationInvalids)
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/gholt/brimtime"
 	"go.uber.org/zap"
+	"golang.org/x/net/context"
 )
 
 type groupPushReplicationState struct {
@@ -17,6 +18,7 @@ type groupPushReplicationState struct {
 
 	startupShutdownLock sync.Mutex
 	notifyChan          chan *bgNotification
+	task                backgroundTask
 	lists               [][]uint64
 	valBufs             [][]byte
 }
@@ -48,6 +50,7 @@ func (store *defaultGroupStore) pushReplicationShutdown() {
 		}
 		<-c
 		store.pushReplicationState.notifyChan = nil
+		store.pushReplicationState.task.stop()
 		store.pushReplicationState.lists = nil
 		store.pushReplicationState.valBufs = nil
 	}
@@ -59,6 +62,7 @@ func (store *defaultGroupStore) pushReplicationLauncher(notifyChan chan *bgNotif
 	store.randMutex.Lock()
 	nextRun := time.Now().Add(time.Duration(interval + interval*store.rand.NormFloat64()*0.1))
 	store.randMutex.Unlock()
+	store.pushReplicationState.task.launch(nextRun)
 	var notification *bgNotification
 	running := true
 	for running {
@@ -79,11 +83,13 @@ func (store *defaultGroupStore) pushReplicationLauncher(notifyChan chan *bgNotif
 		store.randMutex.Lock()
 		nextRun = time.Now().Add(time.Duration(interval + interval*store.rand.NormFloat64()*0.1))
 		store.randMutex.Unlock()
+		store.pushReplicationState.task.schedule(nextRun)
 		if notification != nil {
 			var nextNotification *bgNotification
 			switch notification.action {
 			case _BG_PASS:
-				nextNotification = store.pushReplicationPass(notifyChan)
+				result, _ := notification.result.(*PushReplicationResult)
+				nextNotification = store.pushReplicationPass(notifyChan, result)
 			case _BG_DISABLE:
 				running = false
 			default:
@@ -92,26 +98,46 @@ func (store *defaultGroupStore) pushReplicationLauncher(notifyChan chan *bgNotif
 			notification.doneChan <- struct{}{}
 			notification = nextNotification
 		} else {
-			notification = store.pushReplicationPass(notifyChan)
+			notification = store.pushReplicationPass(notifyChan, nil)
 		}
 	}
 }
 
-func (store *defaultGroupStore) pushReplicationPass(notifyChan chan *bgNotification) *bgNotification {
+// PushReplicationPass runs a push replication pass now; see
+// Store.PushReplicationPass.
+func (store *defaultGroupStore) PushReplicationPass(ctx context.Context) (*PushReplicationResult, error) {
+	ctx, span := store.startSpan(ctx, "PushReplicationPass")
+	defer span.End()
+	result := &PushReplicationResult{}
+	if err := store.manualPass(ctx, &store.pushReplicationState.startupShutdownLock, &store.pushReplicationState.notifyChan, nil, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// pushReplicationPass adds what it sent to the result, which may be nil.
+func (store *defaultGroupStore) pushReplicationPass(notifyChan chan *bgNotification, result *PushReplicationResult) *bgNotification {
 	if store.msgRing == nil {
 		return nil
 	}
+	store.pushReplicationState.task.begin()
 	begin := time.Now()
 	defer func() {
 		elapsed := time.Now().Sub(begin)
 		store.logger.Debug("pass completed", zap.String("name", store.loggerPrefix+"pushReplication"), zap.Duration("elapsed", elapsed))
 		atomic.StoreInt64(&store.outPushReplicationNanoseconds, elapsed.Nanoseconds())
+		store.outPushReplicationPassDuration.observe(elapsed)
+		store.pushReplicationState.task.end()
 	}()
 	ring := store.msgRing.Ring()
 	if ring == nil {
 		return nil
 	}
 	ringVersion := ring.Version()
+	if store.handoffActive(ringVersion) {
+		// Handoff is already streaming out all the out of place data.
+		return nil
+	}
 	pbc := ring.PartitionBitCount()
 	partitionShift := uint64(64 - pbc)
 	partitionMax := (uint64(1) << pbc) - 1
@@ -125,6 +151,10 @@ func (store *defaultGroupStore) pushReplicationPass(notifyChan chan *bgNotificat
 	for len(store.pushReplicationState.valBufs) < int(workerMax+1) {
 		store.pushReplicationState.valBufs = append(store.pushReplicationState.valBufs, make([]byte, store.valueCap))
 	}
+	pass := atomic.AddUint64(&store.replicationStatusState.pushPass, 1)
+	if result == nil {
+		result = &PushReplicationResult{}
+	}
 	var abort uint32
 	work := func(partition uint64, worker uint64, list []uint64, valbuf []byte) {
 		partitionOnLeftBits := partition << partitionShift
@@ -162,17 +192,22 @@ func (store *defaultGroupStore) pushReplicationPass(notifyChan chan *bgNotificat
 			}
 			return true
 		})
-		if len(list) <= 0 || atomic.LoadUint32(&abort) != 0 {
+		if atomic.LoadUint32(&abort) != 0 {
 			return
 		}
 		ring2 := store.msgRing.Ring()
 		if ring2 == nil || ring2.Version() != ringVersion {
 			return
 		}
+		if len(list) <= 0 {
+			store.replicationPushed(pbc, uint32(partition), pass, 0)
+			return
+		}
 		// Then we build and send the actual message.
 		bsm := store.newOutBulkSetMsg()
 		var timestampbits uint64
 		var err error
+		var sent int64
 		for i := 0; i < len(list); i += 4 {
 			timestampbits, valbuf, err = store.read(list[i], list[i+1], list[i+2], list[i+3], valbuf[:0])
 			// This might mean we need to send a deletion or it might mean the
@@ -190,10 +225,23 @@ func (store *defaultGroupStore) pushReplicationPass(notifyChan chan *bgNotificat
 					break
 				}
 				atomic.AddInt32(&store.outBulkSetPushValues, 1)
+				sent++
 			}
 		}
+		store.replicationPushed(pbc, uint32(partition), pass, sent)
+		// Everything listed may have been removed or changed since.
+		if sent == 0 {
+			bsm.Free(0, 0)
+			return
+		}
 		atomic.AddInt32(&store.outBulkSetPushes, 1)
-		store.msgRing.MsgToOtherReplicas(bsm, uint32(partition), store.pushReplicationState.msgTimeout)
+		if store.bulkSetState.outLimiter.wait(bsm.MsgLength()) {
+			atomic.AddInt32(&store.outBulkSetRateLimitHits, 1)
+		}
+		atomic.AddInt64(&result.MsgsSent, 1)
+		atomic.AddInt64(&result.ItemsSent, sent)
+		atomic.AddInt64(&result.BytesSent, int64(bsm.MsgLength()))
+		store.msgToOtherReplicas(bsm, uint32(partition), store.pushReplicationState.msgTimeout)
 	}
 	wg := &sync.WaitGroup{}
 	wg.Add(int(workerMax + 1))
@@ -238,3 +286,69 @@ func (store *defaultGroupStore) pushReplicationPass(notifyChan chan *bgNotificat
 		return nil
 	}
 }
+
+// pushReplicationRange sends everything in the range rangeBegin:rangeEnd of
+// the partition to the partition's other replicas, a bulk-set message at a
+// time, until done or stop returns true. The list and valbuf are scratchpads
+// as with push replication passes. The sent function, if not nil, is called
+// with the number of values and value bytes of each message sent.
+func (store *defaultGroupStore) pushReplicationRange(partition uint32, rangeBegin uint64, rangeEnd uint64, list []uint64, valbuf []byte, timeout time.Duration, stop func() bool, sent func(int64, int64)) {
+	timestampbitsNow := uint64(brimtime.TimeToUnixMicro(time.Now())) << _TSB_UTIL_BITS
+	cutoff := timestampbitsNow - store.replicationIgnoreRecent
+	tombstoneCutoff := timestampbitsNow - store.tombstoneDiscardState.age
+	more := true
+	for more && !stop() {
+		availableBytes := int64(store.bulkSetState.msgCap)
+		list = list[:0]
+		rangeBegin, more = store.locmap.ScanCallback(rangeBegin, rangeEnd, 0, _TSB_LOCAL_REMOVAL, cutoff, math.MaxUint64, func(keyA uint64, keyB uint64, childKeyA uint64, childKeyB uint64, timestampbits uint64, length uint32) bool {
+			inMsgLength := _GROUP_BULK_SET_MSG_ENTRY_HEADER_LENGTH + int64(length)
+			if timestampbits&_TSB_DELETION == 0 || timestampbits >= tombstoneCutoff {
+				list = append(list, keyA, keyB, childKeyA, childKeyB)
+				availableBytes -= inMsgLength
+				if availableBytes < inMsgLength {
+					return false
+				}
+			}
+			return true
+		})
+		if len(list) <= 0 {
+			continue
+		}
+		bsm := store.newOutBulkSetMsg()
+		var timestampbits uint64
+		var err error
+		var keys, bytes int64
+		for i := 0; i < len(list); i += 4 {
+			timestampbits, valbuf, err = store.read(list[i], list[i+1], list[i+2], list[i+3], valbuf[:0])
+			// This might mean we need to send a deletion or it might mean
+			// the key has been completely removed from our records
+			// (timestampbits==0).
+			if IsNotFound(err) {
+				if timestampbits == 0 {
+					continue
+				}
+			} else if err != nil {
+				continue
+			}
+			if timestampbits&_TSB_LOCAL_REMOVAL == 0 && timestampbits < cutoff && (timestampbits&_TSB_DELETION == 0 || timestampbits >= tombstoneCutoff) {
+				if !bsm.add(list[i], list[i+1], list[i+2], list[i+3], timestampbits, valbuf) {
+					break
+				}
+				keys++
+				bytes += int64(len(valbuf))
+			}
+		}
+		// Everything listed may have been removed or changed since.
+		if keys == 0 {
+			bsm.Free(0, 0)
+			continue
+		}
+		if sent != nil {
+			sent(keys, bytes)
+		}
+		if store.bulkSetState.outLimiter.wait(bsm.MsgLength()) {
+			atomic.AddInt32(&store.outBulkSetRateLimitHits, 1)
+		}
+		store.msgToOtherReplicas(bsm, partition, timeout)
+	}
+}
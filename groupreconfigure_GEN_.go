@@ -0,0 +1,172 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// groupReconfigurable is a set of GroupStoreConfig settings Reconfigure
+// can change on a running store. The background task the settings belong to
+// is shut down, given the new settings with config, and started up again;
+// settings without startup and shutdown funcs take effect in place.
+type groupReconfigurable struct {
+	settings []string
+	config   func(cfg *GroupStoreConfig)
+	startup  func()
+	shutdown func()
+}
+
+func (store *defaultGroupStore) reconfigurables() []groupReconfigurable {
+	return []groupReconfigurable{
+		{
+			settings: []string{"TombstoneDiscardInterval", "TombstoneDiscardBatchSize", "TombstoneAge", "TombstoneDiscardWorkers"},
+			config:   store.tombstoneDiscardConfig,
+			startup:  store.tombstoneDiscardStartup,
+			shutdown: store.tombstoneDiscardShutdown,
+		},
+		{
+			settings: []string{"CompactionInterval", "CompactionWorkers", "CompactionThreshold", "CompactionAgeThreshold", "CompactionSmallFileThreshold", "CompactionMergeTargetSize", "CompactionUpgradesPerPass"},
+			config:   store.compactionConfig,
+			startup:  store.compactionStartup,
+			shutdown: store.compactionShutdown,
+		},
+		{
+			settings: []string{"AuditInterval", "AuditAgeThreshold", "AuditHistorySize", "AuditDeep"},
+			config:   store.auditConfig,
+			startup:  store.auditStartup,
+			shutdown: store.auditShutdown,
+		},
+		{
+			settings: []string{"OutPullReplicationInterval", "OutPullReplicationWorkers"},
+			// pullReplicationConfig also sets up the incoming side, which is
+			// left running, so just the outgoing settings are changed here.
+			config: func(cfg *GroupStoreConfig) {
+				store.pullReplicationState.outInterval = cfg.OutPullReplicationInterval
+				store.pullReplicationState.outWorkers = uint64(cfg.OutPullReplicationWorkers)
+			},
+			startup:  store.outPullReplicationStartup,
+			shutdown: store.outPullReplicationShutdown,
+		},
+		{
+			settings: []string{"PushReplicationInterval", "PushReplicationWorkers"},
+			config:   store.pushReplicationConfig,
+			startup:  store.pushReplicationStartup,
+			shutdown: store.pushReplicationShutdown,
+		},
+		{
+			settings: []string{"HandoffInterval", "HandoffWorkers"},
+			config:   store.handoffConfig,
+			startup:  store.handoffStartup,
+			shutdown: store.handoffShutdown,
+		},
+		{
+			settings: []string{"FlusherThreshold"},
+			config:   store.flusherConfig,
+			startup:  store.flusherStartup,
+			shutdown: store.flusherShutdown,
+		},
+		{
+			// The watcher isn't restarted as it would lose track of having
+			// automatically disabled writes.
+			settings: []string{"DiskFreeDisableThreshold", "DiskFreeReenableThreshold", "DiskUsageDisableThreshold", "DiskUsageReenableThreshold", "MemFreeDisableThreshold", "MemFreeReenableThreshold", "MemUsageDisableThreshold", "MemUsageReenableThreshold"},
+			config:   store.watcherConfig,
+		},
+		{
+			settings: []string{"CompactionBytesPerSecond", "AuditBytesPerSecond", "BackgroundIOLatencyTarget"},
+			config:   store.backgroundIOConfig,
+		},
+		{
+			settings: []string{"OutPullReplicationBytesPerSecond", "OutPullReplicationMsgsPerSecond", "OutBulkSetBytesPerSecond", "OutBulkSetMsgsPerSecond", "InBulkSetBytesPerSecond", "InBulkSetMsgsPerSecond"},
+			config: func(cfg *GroupStoreConfig) {
+				store.SetReplicationRateLimits(context.Background(), &ReplicationRateLimits{
+					OutPullReplicationBytesPerSecond: cfg.OutPullReplicationBytesPerSecond,
+					OutPullReplicationMsgsPerSecond:  cfg.OutPullReplicationMsgsPerSecond,
+					OutBulkSetBytesPerSecond:         cfg.OutBulkSetBytesPerSecond,
+					OutBulkSetMsgsPerSecond:          cfg.OutBulkSetMsgsPerSecond,
+					InBulkSetBytesPerSecond:          cfg.InBulkSetBytesPerSecond,
+					InBulkSetMsgsPerSecond:           cfg.InBulkSetMsgsPerSecond,
+				})
+			},
+		},
+	}
+}
+
+// Reconfigure applies the settings from c that can be changed while the
+// store is running, restarting just the background tasks they affect. Any
+// other changed settings are left as they were and listed in the returned
+// error; those require a new store.
+//
+// Only settings that are simple values are compared; the others, such as
+// Logger and MsgRing, are ignored. MsgSecrets can be changed with
+// SetMsgSecrets.
+func (store *defaultGroupStore) Reconfigure(ctx context.Context, c *GroupStoreConfig) error {
+	_, span := store.startSpan(ctx, "Reconfigure")
+	defer span.End()
+	cfg := resolveGroupStoreConfig(c)
+	store.runningLock.Lock()
+	defer store.runningLock.Unlock()
+	changed := make(map[string]bool)
+	for _, name := range groupConfigChanges(store.config, cfg) {
+		changed[name] = true
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	applied := *store.config
+	appliedValue := reflect.ValueOf(&applied).Elem()
+	cfgValue := reflect.ValueOf(cfg).Elem()
+	for _, r := range store.reconfigurables() {
+		apply := false
+		for _, name := range r.settings {
+			if changed[name] {
+				appliedValue.FieldByName(name).Set(cfgValue.FieldByName(name))
+				apply = true
+			}
+		}
+		if !apply {
+			continue
+		}
+		running := store.running == 1 && r.startup != nil
+		if running {
+			r.shutdown()
+		}
+		r.config(&applied)
+		if running {
+			r.startup()
+		}
+	}
+	store.config = &applied
+	if names := groupConfigChanges(store.config, cfg); len(names) > 0 {
+		return fmt.Errorf("settings can't be changed without a new store: %s", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// groupConfigChanges returns the names of the settings that differ between
+// a and b, in field order; only settings that are simple values are compared.
+// Scale is skipped as it only changes the defaults of other settings, which
+// are themselves compared.
+func groupConfigChanges(a *GroupStoreConfig, b *GroupStoreConfig) []string {
+	var names []string
+	av := reflect.ValueOf(a).Elem()
+	bv := reflect.ValueOf(b).Elem()
+	t := av.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Name == "Scale" {
+			continue
+		}
+		switch f.Type.Kind() {
+		case reflect.Bool, reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint64, reflect.Float64, reflect.String:
+		default:
+			continue
+		}
+		if av.Field(i).Interface() != bv.Field(i).Interface() {
+			names = append(names, f.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestGroupReconfigure(t *testing.T) {
+	cfg := newTestGroupStoreConfig()
+	store, _ := newTestGroupStore(cfg)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	if err := store.Reconfigure(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg2 := *cfg
+	cfg2.CompactionInterval = 1234
+	cfg2.CompactionWorkers = 3
+	cfg2.DiskFreeDisableThreshold = 5678
+	cfg2.InBulkSetMsgsPerSecond = 10
+	cfg2.FileCap = 2 * 1024 * 1024
+	cfg2.RecoveryBatchSize = 2048
+	err := store.Reconfigure(context.Background(), &cfg2)
+	if err == nil || !strings.HasSuffix(err.Error(), ": FileCap, RecoveryBatchSize") {
+		t.Fatal(err)
+	}
+	if store.compactionState.interval != 1234 || store.compactionState.workerCount != 3 || len(store.compactionState.compactionPendingBatchChans) != 3 {
+		t.Fatal(store.compactionState.interval, store.compactionState.workerCount, len(store.compactionState.compactionPendingBatchChans))
+	}
+	if store.watcherState.thresholds.diskFreeDisableThreshold != 5678 {
+		t.Fatal(store.watcherState.thresholds.diskFreeDisableThreshold)
+	}
+	if store.bulkSetState.inLimiter.msgsPerSecond != 10 {
+		t.Fatal(store.bulkSetState.inLimiter.msgsPerSecond)
+	}
+	if store.fileCap != 1024*1024 || store.recoveryBatchSize != 1024 {
+		t.Fatal(store.fileCap, store.recoveryBatchSize)
+	}
+	// The restart-only settings are still reported as not applied, but the
+	// live ones now match.
+	cfg2.FileCap = 1024 * 1024
+	err = store.Reconfigure(context.Background(), &cfg2)
+	if err == nil || !strings.HasSuffix(err.Error(), ": RecoveryBatchSize") {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,187 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+)
+
+// On demand replication runs pull and push replication for just a single
+// partition or key range, such as when an operator suspects a partition is
+// damaged, rather than waiting on or forcing full passes.
+type groupReplicateState struct {
+	// active is the number of trackers, checked atomically so incoming
+	// bulk-sets need not take the lock when there are none.
+	active   int32
+	lock     sync.RWMutex
+	trackers []*groupReplicateTracker
+}
+
+// groupReplicateTracker counts the pull replication responses applied for
+// an on demand replication's range.
+type groupReplicateTracker struct {
+	startKeyA uint64
+	stopKeyA  uint64
+	received  int64
+	applied   int64
+}
+
+// ReplicatePartition is ReplicateRange for the whole of a ring partition.
+func (store *defaultGroupStore) ReplicatePartition(ctx context.Context, partition uint32) (*ReplicateResult, error) {
+	ctx, span := store.startSpan(ctx, "ReplicatePartition")
+	defer span.End()
+	if store.msgRing == nil {
+		return nil, errors.New("no ring")
+	}
+	ring := store.msgRing.Ring()
+	if ring == nil {
+		return nil, errors.New("no ring")
+	}
+	pbc := ring.PartitionBitCount()
+	if uint64(partition) >= uint64(1)<<pbc {
+		return nil, errors.New("partition out of range")
+	}
+	partitionShift := uint64(64 - pbc)
+	startKeyA := uint64(partition) << partitionShift
+	stopKeyA := uint64(math.MaxUint64)
+	if uint64(partition) != (uint64(1)<<pbc)-1 {
+		stopKeyA = ((uint64(partition) + 1) << partitionShift) - 1
+	}
+	return store.ReplicateRange(ctx, startKeyA, stopKeyA)
+}
+
+// ReplicateRange runs pull and push replication for just the keys with
+// startKeyA <= keyA <= stopKeyA. Pull replication requests are only sent for
+// partitions the local node is responsible for; everything local in the
+// range is pushed to the other replicas. This blocks until the responses
+// stop arriving, or until the ctx is done, in which case the counts so far
+// are returned along with the ctx's error.
+func (store *defaultGroupStore) ReplicateRange(ctx context.Context, startKeyA uint64, stopKeyA uint64) (*ReplicateResult, error) {
+	ctx, span := store.startSpan(ctx, "ReplicateRange")
+	defer span.End()
+	if startKeyA > stopKeyA {
+		return nil, errors.New("startKeyA greater than stopKeyA")
+	}
+	if store.msgRing == nil {
+		return nil, errors.New("no ring")
+	}
+	ring := store.msgRing.Ring()
+	if ring == nil {
+		return nil, errors.New("no ring")
+	}
+	ringVersion := ring.Version()
+	tracker := &groupReplicateTracker{startKeyA: startKeyA, stopKeyA: stopKeyA}
+	store.replicateState.lock.Lock()
+	store.replicateState.trackers = append(store.replicateState.trackers, tracker)
+	atomic.AddInt32(&store.replicateState.active, 1)
+	store.replicateState.lock.Unlock()
+	defer func() {
+		store.replicateState.lock.Lock()
+		for i, t := range store.replicateState.trackers {
+			if t == tracker {
+				store.replicateState.trackers = append(store.replicateState.trackers[:i], store.replicateState.trackers[i+1:]...)
+				break
+			}
+		}
+		atomic.AddInt32(&store.replicateState.active, -1)
+		store.replicateState.lock.Unlock()
+	}()
+	store.msgHello()
+	result := &ReplicateResult{}
+	var abort uint32
+	stop := func() bool {
+		select {
+		case <-ctx.Done():
+			atomic.StoreUint32(&abort, 1)
+		default:
+		}
+		if atomic.LoadUint32(&abort) != 0 {
+			return true
+		}
+		ring2 := store.msgRing.Ring()
+		return ring2 == nil || ring2.Version() != ringVersion
+	}
+	pull := ring.ReplicaCount() > 1 && ring.NodeCount() > 1
+	bloomP := math.Float64frombits(atomic.LoadUint64(&store.pullReplicationState.outBloomPBits))
+	bloomMaxN := groupKTBloomFilterMaxN(store.pullReplicationState.outMsgCap-_GROUP_PULL_REPLICATION_MSG_HEADER_BYTES-_GROUP_KT_BLOOM_FILTER_HEADER_BYTES, bloomP)
+	if bloomMaxN > store.pullReplicationState.outBloomN {
+		bloomMaxN = store.pullReplicationState.outBloomN
+	}
+	ktbf := newGroupKTBloomFilter(1, bloomP, 0)
+	list := make([]uint64, store.bulkSetState.msgCap/_GROUP_BULK_SET_MSG_MIN_ENTRY_LENGTH*4)
+	valbuf := make([]byte, store.valueCap)
+	sent := func(keys int64, bytes int64) {
+		atomic.AddInt32(&store.outBulkSetPushes, 1)
+		atomic.AddInt32(&store.outBulkSetPushValues, int32(keys))
+		result.ItemsSent += keys
+	}
+	partitionShift := uint64(64 - ring.PartitionBitCount())
+	for partition := startKeyA >> partitionShift; partition <= stopKeyA>>partitionShift && !stop(); partition++ {
+		rangeBegin := partition << partitionShift
+		if rangeBegin < startKeyA {
+			rangeBegin = startKeyA
+		}
+		rangeEnd := uint64(math.MaxUint64)
+		if partition != math.MaxUint64>>partitionShift {
+			rangeEnd = ((partition + 1) << partitionShift) - 1
+		}
+		if rangeEnd > stopKeyA {
+			rangeEnd = stopKeyA
+		}
+		result.Partitions++
+		if pull && ring.Responsible(uint32(partition)) {
+			_, bytes := store.outPullReplicationRange(ringVersion, uint32(partition), rangeBegin, rangeEnd, ktbf, bloomMaxN, bloomP, &abort)
+			atomic.AddInt64(&store.outPullReplicationBytes, bytes)
+		}
+		store.pushReplicationRange(uint32(partition), rangeBegin, rangeEnd, list, valbuf, store.pushReplicationState.msgTimeout, stop, sent)
+	}
+	// Wait for the responses to stop arriving; each response has to be sent
+	// and applied within the pull replication timeouts.
+	quiet := store.pullReplicationState.outMsgTimeout + store.pullReplicationState.inResponseMsgTimeout
+	var err error
+	last := atomic.LoadInt64(&tracker.received)
+	lastChange := time.Now()
+	for time.Now().Sub(lastChange) < quiet {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+		if err != nil {
+			break
+		}
+		if received := atomic.LoadInt64(&tracker.received); received != last {
+			last = received
+			lastChange = time.Now()
+		}
+	}
+	if err == nil {
+		if ring2 := store.msgRing.Ring(); ring2 == nil || ring2.Version() != ringVersion {
+			err = errors.New("ring changed")
+		}
+	}
+	result.ItemsReceived = atomic.LoadInt64(&tracker.received)
+	result.ItemsApplied = atomic.LoadInt64(&tracker.applied)
+	store.logger.Debug("replicate range completed", zap.String("name", store.loggerPrefix+"replicateRange"), zap.Uint64("startKeyA", startKeyA), zap.Uint64("stopKeyA", stopKeyA), zap.Int64("received", result.ItemsReceived), zap.Int64("sent", result.ItemsSent))
+	return result, err
+}
+
+// replicateReceived records an item received in a pull replication response
+// with any on demand replications covering its keyA.
+func (store *defaultGroupStore) replicateReceived(keyA uint64, applied bool) {
+	store.replicateState.lock.RLock()
+	for _, t := range store.replicateState.trackers {
+		if keyA >= t.startKeyA && keyA <= t.stopKeyA {
+			if applied {
+				atomic.AddInt64(&t.applied, 1)
+			}
+			atomic.AddInt64(&t.received, 1)
+		}
+	}
+	store.replicateState.lock.RUnlock()
+}
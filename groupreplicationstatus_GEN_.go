@@ -0,0 +1,185 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Replication status tracks, for each ring partition, how far the local copy
+// is from the other replicas'. Items received in pull replication responses
+// are counted against the partition's latest pull replication pass; a
+// partition whose replicas agree receives nothing, so these counts dropping
+// to zero is the convergence signal. Items that were newer than the local
+// copy mark the partition as diverged. Push replication records how many
+// items it sent for each partition the local node is not responsible for;
+// those remain outstanding until the other replicas acknowledge them and the
+// local copies are removed. Each pass sends the unacknowledged items again,
+// so each pass starts the count over.
+//
+// Partitions are only tracked once replication has touched them, and the
+// tracking starts over if the ring's partition bit count changes.
+type groupReplicationStatusState struct {
+	lock              sync.Mutex
+	partitionBitCount uint16
+	// pullPass and pushPass number the passes so a partition's counts can be
+	// started over by the first worker of a new pass to reach it.
+	pullPass   uint64
+	pushPass   uint64
+	partitions map[uint32]*groupReplicationPartitionTracker
+}
+
+type groupReplicationPartitionTracker struct {
+	status   ReplicationPartitionStatus
+	pullPass uint64
+	pushPass uint64
+	// pullParts is how many parts of the partition the latest pull pass has
+	// completed; see replicationPulled.
+	pullParts uint64
+}
+
+// replicationTracker returns the partition's tracker, or nil if it isn't
+// tracked and create is false; the caller must hold the lock. The
+// partitionBitCount is that of the ring the partition is from.
+func (store *defaultGroupStore) replicationTracker(partitionBitCount uint16, partition uint32, create bool) *groupReplicationPartitionTracker {
+	if partitionBitCount != store.replicationStatusState.partitionBitCount || store.replicationStatusState.partitions == nil {
+		store.replicationStatusState.partitionBitCount = partitionBitCount
+		store.replicationStatusState.partitions = make(map[uint32]*groupReplicationPartitionTracker)
+	}
+	t := store.replicationStatusState.partitions[partition]
+	if t == nil && create {
+		t = &groupReplicationPartitionTracker{status: ReplicationPartitionStatus{Partition: partition}}
+		store.replicationStatusState.partitions[partition] = t
+	}
+	return t
+}
+
+// replicationPullStarted records that the pull pass is about to send pull
+// replication requests for the partition, starting the counts over if it is
+// the first to do so this pass.
+func (store *defaultGroupStore) replicationPullStarted(partitionBitCount uint16, partition uint32, pass uint64) {
+	store.replicationStatusState.lock.Lock()
+	t := store.replicationTracker(partitionBitCount, partition, true)
+	if t.pullPass != pass {
+		t.pullPass = pass
+		t.pullParts = 0
+		t.status.PreviousPullReceived = t.status.PullReceived
+		t.status.PreviousPullApplied = t.status.PullApplied
+		t.status.PullReceived = 0
+		t.status.PullApplied = 0
+	}
+	store.replicationStatusState.lock.Unlock()
+}
+
+// replicationPulled records that one of the parts the pull pass splits the
+// partition into was completed without the pass being interrupted; once all
+// of them are, the pass is the partition's LastPullReplication.
+func (store *defaultGroupStore) replicationPulled(partitionBitCount uint16, partition uint32, pass uint64, parts uint64) {
+	store.replicationStatusState.lock.Lock()
+	if t := store.replicationTracker(partitionBitCount, partition, false); t != nil && t.pullPass == pass {
+		t.pullParts++
+		if t.pullParts == parts {
+			t.status.LastPullReplication = time.Now()
+		}
+	}
+	store.replicationStatusState.lock.Unlock()
+}
+
+// replicationReceived records items for the partition received in pull
+// replication responses, applied of which were newer than the local copy.
+func (store *defaultGroupStore) replicationReceived(partitionBitCount uint16, partition uint32, received int64, applied int64) {
+	store.replicationStatusState.lock.Lock()
+	t := store.replicationTracker(partitionBitCount, partition, true)
+	t.status.PullReceived += received
+	t.status.PullApplied += applied
+	if applied > 0 {
+		t.status.LastDivergence = time.Now()
+	}
+	store.replicationStatusState.lock.Unlock()
+}
+
+// replicationPushed records items for the partition sent as part of the push
+// pass; partitions that had nothing to send are only updated if already
+// tracked.
+func (store *defaultGroupStore) replicationPushed(partitionBitCount uint16, partition uint32, pass uint64, sent int64) {
+	store.replicationStatusState.lock.Lock()
+	if t := store.replicationTracker(partitionBitCount, partition, sent > 0); t != nil {
+		if t.pushPass != pass {
+			t.pushPass = pass
+			t.status.PushOutstanding = 0
+		}
+		t.status.PushOutstanding += sent
+		t.status.LastPushReplication = time.Now()
+	}
+	store.replicationStatusState.lock.Unlock()
+}
+
+// replicationAcked records that acknowledged items for the partition were
+// removed locally and so are no longer outstanding.
+func (store *defaultGroupStore) replicationAcked(partitionBitCount uint16, partition uint32, acked int64) {
+	store.replicationStatusState.lock.Lock()
+	if t := store.replicationTracker(partitionBitCount, partition, false); t != nil {
+		t.status.PushOutstanding -= acked
+		// Items acknowledged before the pass got to them were never counted.
+		if t.status.PushOutstanding < 0 {
+			t.status.PushOutstanding = 0
+		}
+	}
+	store.replicationStatusState.lock.Unlock()
+}
+
+// replicationDivergedCount returns the number of partitions whose latest two
+// pull replication passes received items newer than the local copy.
+func (store *defaultGroupStore) replicationDivergedCount() int {
+	var n int
+	store.replicationStatusState.lock.Lock()
+	for _, t := range store.replicationStatusState.partitions {
+		if t.status.PullApplied > 0 || t.status.PreviousPullApplied > 0 {
+			n++
+		}
+	}
+	store.replicationStatusState.lock.Unlock()
+	return n
+}
+
+// ReplicationStatus returns the replication status of each partition
+// replication has touched, in partition order.
+func (store *defaultGroupStore) ReplicationStatus(ctx context.Context) ([]ReplicationPartitionStatus, error) {
+	_, span := store.startSpan(ctx, "ReplicationStatus")
+	defer span.End()
+	store.replicationStatusState.lock.Lock()
+	statuses := make([]ReplicationPartitionStatus, 0, len(store.replicationStatusState.partitions))
+	for _, t := range store.replicationStatusState.partitions {
+		statuses = append(statuses, t.status)
+	}
+	store.replicationStatusState.lock.Unlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Partition < statuses[j].Partition
+	})
+	return statuses, nil
+}
+
+// DivergedPartitions returns the replication status of up to max partitions
+// that have diverged from the other replicas, most recently diverged first;
+// max <= 0 returns them all.
+func (store *defaultGroupStore) DivergedPartitions(ctx context.Context, max int) ([]ReplicationPartitionStatus, error) {
+	_, span := store.startSpan(ctx, "DivergedPartitions")
+	defer span.End()
+	var statuses []ReplicationPartitionStatus
+	store.replicationStatusState.lock.Lock()
+	for _, t := range store.replicationStatusState.partitions {
+		if !t.status.LastDivergence.IsZero() {
+			statuses = append(statuses, t.status)
+		}
+	}
+	store.replicationStatusState.lock.Unlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].LastDivergence.After(statuses[j].LastDivergence)
+	})
+	if max > 0 && len(statuses) > max {
+		statuses = statuses[:max]
+	}
+	return statuses, nil
+}
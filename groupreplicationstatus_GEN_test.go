@@ -0,0 +1,179 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	ring "github.com/gholt/devicering"
+	"golang.org/x/net/context"
+)
+
+func TestGroupReplicationStatusPull(t *testing.T) {
+	b := ring.NewBuilder(64)
+	b.SetReplicaCount(2)
+	n, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	r.SetLocalNode(n.ID())
+	cfg := newTestGroupStoreConfig()
+	cfg.MsgRing = &msgRingGroupHandoffTester{ring: r, toOtherBodies: make(map[uint32][]byte)}
+	store, _ := newTestGroupStore(cfg)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	keyA := uint64(3) << (64 - r.PartitionBitCount())
+	if _, err = store.write(keyA, 2, 3, 4, 0x500, []byte("testing"), false); err != nil {
+		t.Fatal(err)
+	}
+	notifyChan := make(chan *bgNotification)
+	store.outPullReplicationPass(notifyChan)
+	statuses, err := store.ReplicationStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1<<r.PartitionBitCount() || statuses[3].Partition != 3 || statuses[3].LastPullReplication.IsZero() {
+		t.Fatal(statuses)
+	}
+	// A response with one item older than the local copy and one new item.
+	bsm := &groupBulkSetMsg{header: make([]byte, _GROUP_BULK_SET_MSG_HEADER_LENGTH), body: make([]byte, 0, 1000)}
+	if !bsm.add(keyA, 2, 3, 4, 0x400, []byte("testing")) {
+		t.Fatal("")
+	}
+	if !bsm.add(keyA+1, 2, 3, 4, 0x500, []byte("testing")) {
+		t.Fatal("")
+	}
+	buf := &bytes.Buffer{}
+	bsm.WriteContent(buf)
+	l := uint64(buf.Len())
+	if n, err := store.newInBulkSetMsg(buf, l); err != nil || n != l {
+		t.Fatal(n, err)
+	}
+	// The incoming bulk-set is applied asynchronously.
+	var diverged []ReplicationPartitionStatus
+	for i := 0; i < 100 && len(diverged) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		diverged, _ = store.DivergedPartitions(context.Background(), 0)
+	}
+	if len(diverged) != 1 || diverged[0].Partition != 3 || diverged[0].PullReceived != 2 || diverged[0].PullApplied != 1 || diverged[0].LastDivergence.IsZero() {
+		t.Fatal(diverged)
+	}
+	stats, _ := store.Stats(context.Background(), false)
+	if s := stats.(*GroupStoreStats); s.DivergedPartitions != 1 {
+		t.Fatal(s.DivergedPartitions)
+	}
+	// The next pass moves the counts to the previous ones; a pass after that
+	// with nothing received shows the partition has converged.
+	store.outPullReplicationPass(notifyChan)
+	statuses, _ = store.ReplicationStatus(context.Background())
+	if statuses[3].PullReceived != 0 || statuses[3].PreviousPullReceived != 2 || statuses[3].PreviousPullApplied != 1 {
+		t.Fatal(statuses[3])
+	}
+	store.outPullReplicationPass(notifyChan)
+	statuses, _ = store.ReplicationStatus(context.Background())
+	if statuses[3].PreviousPullReceived != 0 || statuses[3].LastDivergence.IsZero() {
+		t.Fatal(statuses[3])
+	}
+	stats, _ = store.Stats(context.Background(), false)
+	if s := stats.(*GroupStoreStats); s.DivergedPartitions != 0 {
+		t.Fatal(s.DivergedPartitions)
+	}
+	// A pass only counts once it has done all the parts of a partition.
+	last := statuses[3].LastPullReplication
+	store.replicationPullStarted(r.PartitionBitCount(), 3, 1000)
+	store.replicationPulled(r.PartitionBitCount(), 3, 1000, 2)
+	statuses, _ = store.ReplicationStatus(context.Background())
+	if !statuses[3].LastPullReplication.Equal(last) {
+		t.Fatal(statuses[3])
+	}
+	store.replicationPulled(r.PartitionBitCount(), 3, 1000, 2)
+	statuses, _ = store.ReplicationStatus(context.Background())
+	if !statuses[3].LastPullReplication.After(last) {
+		t.Fatal(statuses[3])
+	}
+}
+
+func TestGroupReplicationStatusPush(t *testing.T) {
+	b := ring.NewBuilder(64)
+	n, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	r.SetLocalNode(n.ID())
+	cfg := newTestGroupStoreConfig()
+	cfg.MsgRing = &msgRingGroupHandoffTester{ring: r, toOtherBodies: make(map[uint32][]byte)}
+	cfg.HandoffInterval = 3600
+	store, _ := newTestGroupStore(cfg)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	var partition uint32
+	for r.Responsible(partition) {
+		partition++
+	}
+	keyA := uint64(partition) << (64 - r.PartitionBitCount())
+	for i := uint64(0); i < 5; i++ {
+		if _, err = store.write(keyA+i, 2, 3, 4, 0x500, []byte("testing"), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	notifyChan := make(chan *bgNotification)
+	store.pushReplicationPass(notifyChan, nil)
+	statuses, err := store.ReplicationStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].Partition != partition || statuses[0].PushOutstanding != 5 || statuses[0].LastPushReplication.IsZero() {
+		t.Fatal(statuses)
+	}
+	// Acknowledged items are no longer outstanding, even before the next
+	// pass; a repeated ack changes nothing.
+	ack := func(keyAs ...uint64) {
+		bsam := store.newOutBulkSetAckMsg()
+		for _, k := range keyAs {
+			bsam.add(k, 2, 3, 4, 0x500)
+		}
+		buf := &bytes.Buffer{}
+		bsam.WriteContent(buf)
+		bsam.Free(0, 0)
+		l := uint64(buf.Len())
+		if n, err := store.newInBulkSetAckMsg(buf, l); err != nil || n != l {
+			t.Fatal(n, err)
+		}
+	}
+	outstanding := func(want int64) {
+		// The incoming bulk-set-ack is applied asynchronously.
+		for i := 0; i < 100; i++ {
+			statuses, _ = store.ReplicationStatus(context.Background())
+			if len(statuses) == 1 && statuses[0].PushOutstanding == want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal(statuses)
+	}
+	ack(keyA, keyA+1)
+	outstanding(3)
+	ack(keyA, keyA+1)
+	outstanding(3)
+	// The next pass sends just what is still unacknowledged.
+	store.pushReplicationPass(notifyChan, nil)
+	outstanding(3)
+	ack(keyA+2, keyA+3, keyA+4)
+	outstanding(0)
+	store.pushReplicationPass(notifyChan, nil)
+	outstanding(0)
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestGroupStatsMetrics(t *testing.T) {
+	store, _ := newTestGroupStore(nil)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	if _, err := store.Write(context.Background(), 1, 2, 3, 4, 0x500, []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	metric := func(name string) StatsMetric {
+		metrics, err := store.StatsMetrics(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range metrics {
+			if m.Name == name {
+				return m
+			}
+		}
+		t.Fatal(name, "not found")
+		return StatsMetric{}
+	}
+	if m := metric("Writes"); m.Gauge || m.Value != 1 {
+		t.Fatal(m)
+	}
+	// Stats resets its counters but the totals carry on.
+	stats, _ := store.Stats(context.Background(), false)
+	if s := stats.(*GroupStoreStats); s.Writes != 1 {
+		t.Fatal(s.Writes)
+	}
+	if _, err := store.Write(context.Background(), 1, 2, 3, 4, 0x600, []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	if m := metric("Writes"); m.Value != 2 {
+		t.Fatal(m)
+	}
+	stats, _ = store.Stats(context.Background(), false)
+	if s := stats.(*GroupStoreStats); s.Writes != 1 {
+		t.Fatal(s.Writes)
+	}
+	if m := metric("Writes"); m.Value != 2 {
+		t.Fatal(m)
+	}
+	if m := metric("Values"); !m.Gauge || m.Value != 1 {
+		t.Fatal(m)
+	}
+	if m := metric("ReadOnly"); !m.Gauge || m.Value != 0 {
+		t.Fatal(m)
+	}
+	// The latency histograms are cumulative too.
+	if m := metric("WriteLatency"); m.Gauge || m.Histogram == nil || m.Value != 2 || m.Histogram.Count != 2 {
+		t.Fatal(m)
+	}
+	if s := stats.(*GroupStoreStats); s.WriteLatency.Count != 2 || s.WriteQueueLatency.Count < 2 || s.ReadLatency.Count != 0 {
+		t.Fatal(s.WriteLatency, s.WriteQueueLatency, s.ReadLatency)
+	}
+}
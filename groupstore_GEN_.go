@@ -29,24 +29,34 @@ type defaultGroupStore struct {
 	runningLock sync.Mutex
 	// 0 = not running, 1 = running, 2 = can't run due to previous error
 	running int
+	// config is the resolved configuration the store was created with, as
+	// since changed by Reconfigure.
+	config *GroupStoreConfig
 
-	logger                  *zap.Logger
-	loggerPrefix            string
-	randMutex               sync.Mutex
-	rand                    *rand.Rand
-	freeableMemBlockChans   []chan *groupMemBlock
-	freeMemBlockChan        chan *groupMemBlock
-	freeWriteReqChans       []chan *groupWriteReq
-	pendingWriteReqChans    []chan *groupWriteReq
-	fileMemBlockChan        chan *groupMemBlock
-	freeTOCBlockChan        chan *groupTOCBlock
-	pendingTOCBlockChan     chan *groupTOCBlock
-	activeTOCA              uint64
-	activeTOCB              uint64
-	flushedChan             chan struct{}
-	shutdownChan            chan struct{}
-	locBlocks               []groupLocBlock
-	locBlockIDer            uint64
+	logger                *zap.Logger
+	loggerPrefix          string
+	tracer                Tracer
+	eventHandler          func(Event)
+	randMutex             sync.Mutex
+	rand                  *rand.Rand
+	freeableMemBlockChans []chan *groupMemBlock
+	freeMemBlockChan      chan *groupMemBlock
+	freeWriteReqChans     []chan *groupWriteReq
+	pendingWriteReqChans  []chan *groupWriteReq
+	fileMemBlockChan      chan *groupMemBlock
+	freeTOCBlockChan      chan *groupTOCBlock
+	pendingTOCBlockChan   chan *groupTOCBlock
+	activeTOCA            uint64
+	activeTOCB            uint64
+	flushedChan           chan struct{}
+	shutdownChan          chan struct{}
+	locBlocks             []groupLocBlock
+	locBlockIDer          uint64
+	// locBlockBytes are the byte counts of the locBlocks, by the same ids,
+	// kept up to date by locmapSet.
+	locBlockBytes []groupLocBlockBytes
+	// locmapSetLocks keep locmapSet calls for the same key from racing.
+	locmapSetLocks          [256]sync.Mutex
 	path                    string
 	pathtoc                 string
 	locmap                  locmap.GroupLocMap
@@ -64,10 +74,18 @@ type defaultGroupStore struct {
 	auditState              groupAuditState
 	replicationIgnoreRecent uint64
 	pullReplicationState    groupPullReplicationState
+	merkleState             groupMerkleState
 	pushReplicationState    groupPushReplicationState
+	handoffState            groupHandoffState
+	hintedHandoffState      groupHintedHandoffState
+	replicateState          groupReplicateState
+	replicationStatusState  groupReplicationStatusState
 	compactionState         groupCompactionState
 	bulkSetState            groupBulkSetState
 	bulkSetAckState         groupBulkSetAckState
+	msgAuthState            groupMsgAuthState
+	msgProtocolState        groupMsgProtocolState
+	compressionState        groupCompressionState
 	disableEnableWritesLock sync.Mutex
 	readOnly                bool
 	userDisabled            bool
@@ -75,7 +93,10 @@ type defaultGroupStore struct {
 	watcherState            groupWatcherState
 	restartChan             chan error
 
-	statsLock    sync.Mutex
+	statsLock sync.Mutex
+	// statsTotals are the counters already reset by Stats calls, by field
+	// name, for StatsMetrics.
+	statsTotals  map[string]int64
 	lookups      int32
 	lookupErrors int32
 
@@ -101,9 +122,20 @@ type defaultGroupStore struct {
 	outBulkSetPushes              int32
 	outBulkSetPushValues          int32
 	outPushReplicationNanoseconds int64
+	outHandoffs                   int32
+	outHandoffValues              int32
+	handoffNanoseconds            int64
+	handoffCompletions            int32
+	outHintedHandoffs             int32
+	outHintedHandoffValues        int32
+	hintedHandoffNanoseconds      int64
+	hintsAcked                    int32
+	hintsDropped                  int32
 	inBulkSets                    int32
 	inBulkSetDrops                int32
 	inBulkSetInvalids             int32
+	inBulkSetOversizes            int32
+	inBulkSetRejects              int32
 	inBulkSetWrites               int32
 	inBulkSetWriteErrors          int32
 	inBulkSetWritesOverridden     int32
@@ -111,20 +143,70 @@ type defaultGroupStore struct {
 	inBulkSetAcks                 int32
 	inBulkSetAckDrops             int32
 	inBulkSetAckInvalids          int32
+	inBulkSetAckRejects           int32
 	inBulkSetAckWrites            int32
 	inBulkSetAckWriteErrors       int32
 	inBulkSetAckWritesOverridden  int32
 	outPullReplications           int32
 	outPullReplicationNanoseconds int64
-	inPullReplications            int32
-	inPullReplicationDrops        int32
-	inPullReplicationInvalids     int32
-	expiredDeletions              int32
-	tombstoneDiscardNanoseconds   int64
-	compactionNanoseconds         int64
-	compactions                   int32
-	smallFileCompactions          int32
-	auditNanoseconds              int64
+	outPullReplicationBytes       int64
+	outPullReplicationPassBytes   int64
+	// outPullReplicationBloomFPRate is the math.Float64bits of the last
+	// measured bloom filter false positive rate.
+	outPullReplicationBloomFPRate   uint64
+	outBulkSetBytes                 int64
+	inPullReplications              int32
+	inPullReplicationDrops          int32
+	inPullReplicationInvalids       int32
+	inPullReplicationOversizes      int32
+	inPullReplicationRejects        int32
+	outMerkles                      int32
+	outMerkleBytes                  int64
+	inMerkles                       int32
+	inMerkleBytes                   int64
+	inMerkleDrops                   int32
+	inMerkleInvalids                int32
+	outPullReplicationRateLimitHits int32
+	outBulkSetRateLimitHits         int32
+	inBulkSetRateLimitHits          int32
+	outCompressionBytes             int64
+	outCompressedBytes              int64
+	outCompressionNanoseconds       int64
+	outCompressionSkips             int32
+	inDecompressionNanoseconds      int64
+	inDecompressionErrors           int32
+	expiredDeletions                int32
+	tombstoneDiscardNanoseconds     int64
+	compactionNanoseconds           int64
+	compactions                     int32
+	smallFileCompactions            int32
+	auditItemsRemoved               int32
+	auditFilesPassed                int32
+	auditFilesFailed                int32
+	auditNanoseconds                int64
+	lookupLatency                   latencyHistogram
+
+	lookupGroupLatency latencyHistogram
+
+	readLatency latencyHistogram
+	// backgroundIOBackoff slows compaction and audits while readLatency is
+	// over the BackgroundIOLatencyTarget.
+	backgroundIOBackoff latencyBackoff
+
+	readGroupLatency latencyHistogram
+
+	writeLatency                   latencyHistogram
+	deleteLatency                  latencyHistogram
+	writeQueueLatency              latencyHistogram
+	fileWriteLatency               latencyHistogram
+	tocWriteLatency                latencyHistogram
+	outPushReplicationPassDuration latencyHistogram
+	handoffPassDuration            latencyHistogram
+	hintedHandoffPassDuration      latencyHistogram
+	outPullReplicationPassDuration latencyHistogram
+	tombstoneDiscardPassDuration   latencyHistogram
+	compactionPassDuration         latencyHistogram
+	auditPassDuration              latencyHistogram
 
 	// Used by the flusher only
 	modifications int32
@@ -150,6 +232,8 @@ type groupWriteReq struct {
 	value         []byte
 	errChan       chan error
 	internal      bool
+	// queued is when the request was sent to the memWriter.
+	queued time.Time
 }
 
 var enableGroupWriteReq *groupWriteReq = &groupWriteReq{}
@@ -171,6 +255,14 @@ type groupLocBlock interface {
 	close() error
 }
 
+// groupLocBlockBytes counts the bytes, values plus toc entries, a loc block
+// holds and how many of those are still live, the rest being waste that
+// compaction can reclaim. Only file blocks track a total.
+type groupLocBlockBytes struct {
+	live  int64
+	total int64
+}
+
 // NewGroupStore creates a GroupStore for use in storing []byte values
 // referenced by 128 bit keys; returned are the store and restart channel (chan
 // error), or any error during construction.
@@ -197,8 +289,11 @@ func NewGroupStore(c *GroupStoreConfig) (GroupStore, chan error) {
 	}
 	lcmap.SetInactiveMask(_TSB_INACTIVE)
 	store := &defaultGroupStore{
+		config:                  cfg,
 		logger:                  cfg.Logger,
 		loggerPrefix:            cfg.LoggerName, // may add "." below
+		tracer:                  cfg.Tracer,
+		eventHandler:            cfg.EventHandler,
 		rand:                    cfg.Rand,
 		path:                    cfg.Path,
 		pathtoc:                 cfg.PathTOC,
@@ -215,6 +310,7 @@ func NewGroupStore(c *GroupStoreConfig) (GroupStore, chan error) {
 		checksumInterval:        uint32(cfg.ChecksumInterval),
 		msgRing:                 cfg.MsgRing,
 		restartChan:             make(chan error),
+		statsTotals:             make(map[string]int64),
 		openReadSeeker:          cfg.openReadSeeker,
 		openWriteSeeker:         cfg.openWriteSeeker,
 		readdirnames:            cfg.readdirnames,
@@ -234,23 +330,58 @@ func NewGroupStore(c *GroupStoreConfig) (GroupStore, chan error) {
 	if store.loggerPrefix != "" {
 		store.loggerPrefix += "."
 	}
+	if store.tracer == nil {
+		store.tracer = noopTracer{}
+	}
 	store.tombstoneDiscardConfig(cfg)
 	store.compactionConfig(cfg)
 	store.auditConfig(cfg)
+	store.msgAuthConfig(cfg)
+	store.compressionConfig(cfg)
+	store.msgProtocolConfig(cfg)
 	store.pullReplicationConfig(cfg)
+	store.merkleConfig(cfg)
 	store.pushReplicationConfig(cfg)
+	store.handoffConfig(cfg)
+	store.hintedHandoffConfig(cfg)
 	store.bulkSetConfig(cfg)
 	store.bulkSetAckConfig(cfg)
 	store.flusherConfig(cfg)
 	store.watcherConfig(cfg)
+	store.backgroundIOConfig(cfg)
 	return store, store.restartChan
 }
 
 func (store *defaultGroupStore) ValueCap(ctx context.Context) (uint32, error) {
+	_, span := store.startSpan(ctx, "ValueCap")
+	defer span.End()
 	return store.valueCap, nil
 }
 
+func (store *defaultGroupStore) SetReplicationRateLimits(ctx context.Context, limits *ReplicationRateLimits) error {
+	_, span := store.startSpan(ctx, "SetReplicationRateLimits")
+	defer span.End()
+	if limits == nil {
+		return errors.New("nil ReplicationRateLimits")
+	}
+	store.pullReplicationState.outLimiter.set(limits.OutPullReplicationBytesPerSecond, limits.OutPullReplicationMsgsPerSecond)
+	store.bulkSetState.outLimiter.set(limits.OutBulkSetBytesPerSecond, limits.OutBulkSetMsgsPerSecond)
+	store.bulkSetState.inLimiter.set(limits.InBulkSetBytesPerSecond, limits.InBulkSetMsgsPerSecond)
+	return nil
+}
+
+// backgroundIOConfig sets the budgets compaction and background audit I/O are
+// throttled to and, with a BackgroundIOLatencyTarget, how they back off for
+// slow Reads.
+func (store *defaultGroupStore) backgroundIOConfig(cfg *GroupStoreConfig) {
+	store.backgroundIOBackoff.set(time.Duration(cfg.BackgroundIOLatencyTarget)*time.Millisecond, &store.readLatency)
+	store.compactionState.throttle.set(cfg.CompactionBytesPerSecond, &store.backgroundIOBackoff)
+	store.auditState.throttle.set(cfg.AuditBytesPerSecond, &store.backgroundIOBackoff)
+}
+
 func (store *defaultGroupStore) Startup(ctx context.Context) error {
+	ctx, span := store.startSpan(ctx, "Startup")
+	defer span.End()
 	store.runningLock.Lock()
 	switch store.running {
 	case 0: // not running
@@ -263,6 +394,7 @@ func (store *defaultGroupStore) Startup(ctx context.Context) error {
 	}
 	store.locBlocks = make([]groupLocBlock, math.MaxUint16)
 	store.locBlockIDer = 0
+	store.locBlockBytes = make([]groupLocBlockBytes, len(store.locBlocks))
 	// freeableMemBlockChans is a slice of channels so that the individual
 	// memClearers can be communicated with later (flushes, etc.)
 	store.freeableMemBlockChans = make([]chan *groupMemBlock, store.workers)
@@ -328,8 +460,11 @@ func (store *defaultGroupStore) Startup(ctx context.Context) error {
 		store.compactionStartup,
 		store.watcherStartup,
 		store.flusherStartup,
+		store.merkleStartup,
 		store.pullReplicationStartup,
 		store.pushReplicationStartup,
+		store.handoffStartup,
+		store.hintedHandoffStartup,
 		store.tombstoneDiscardStartup,
 	} {
 		wg.Add(1)
@@ -346,6 +481,8 @@ func (store *defaultGroupStore) Startup(ctx context.Context) error {
 }
 
 func (store *defaultGroupStore) Shutdown(ctx context.Context) error {
+	ctx, span := store.startSpan(ctx, "Shutdown")
+	defer span.End()
 	store.runningLock.Lock()
 	if store.running != 1 { // running
 		store.runningLock.Unlock()
@@ -359,8 +496,11 @@ func (store *defaultGroupStore) Shutdown(ctx context.Context) error {
 		store.compactionShutdown,
 		store.watcherShutdown,
 		store.flusherShutdown,
+		store.merkleShutdown,
 		store.pullReplicationShutdown,
 		store.pushReplicationShutdown,
+		store.handoffShutdown,
+		store.hintedHandoffShutdown,
 		store.tombstoneDiscardShutdown,
 	} {
 		wg.Add(1)
@@ -376,7 +516,9 @@ func (store *defaultGroupStore) Shutdown(ctx context.Context) error {
 	}
 	<-store.shutdownChan
 	store.locmap.Clear()
+	store.merkleClear()
 	store.locBlocks = nil
+	store.locBlockBytes = nil
 	store.freeableMemBlockChans = nil
 	store.freeMemBlockChan = nil
 	store.freeWriteReqChans = nil
@@ -392,6 +534,8 @@ func (store *defaultGroupStore) Shutdown(ctx context.Context) error {
 }
 
 func (store *defaultGroupStore) EnableWrites(ctx context.Context) error {
+	_, span := store.startSpan(ctx, "EnableWrites")
+	defer span.End()
 	store.enableWrites(true)
 	return nil
 }
@@ -409,6 +553,8 @@ func (store *defaultGroupStore) enableWrites(userCall bool) {
 }
 
 func (store *defaultGroupStore) DisableWrites(ctx context.Context) error {
+	_, span := store.startSpan(ctx, "DisableWrites")
+	defer span.End()
 	store.disableWrites(true)
 	return nil
 }
@@ -425,7 +571,55 @@ func (store *defaultGroupStore) disableWrites(userCall bool) {
 	store.disableEnableWritesLock.Unlock()
 }
 
+// event gives the Event to the Config.EventHandler, if any, setting its Time.
+func (store *defaultGroupStore) event(e Event) {
+	if store.eventHandler == nil {
+		return
+	}
+	e.Time = time.Now()
+	store.eventHandler(e)
+}
+
+// requestRestart sends the err on the restart channel, with an
+// EventRestartRequest first. The send blocks until the channel is read, so
+// this is usually called in its own goroutine.
+func (store *defaultGroupStore) requestRestart(err error) {
+	store.event(Event{Kind: EventRestartRequest, Err: err})
+	store.restartChan <- err
+}
+
+// manualPass has the launcher listening on *notifyChan run a pass with the
+// options and result, for the manual pass calls such as CompactionPass, and
+// waits for the pass to finish or the ctx to be done. The lock is the
+// launcher's startupShutdownLock.
+func (store *defaultGroupStore) manualPass(ctx context.Context, lock *sync.Mutex, notifyChan *chan *bgNotification, options interface{}, result interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	lock.Lock()
+	if *notifyChan == nil {
+		lock.Unlock()
+		return errors.New("not running")
+	}
+	c := make(chan struct{}, 1)
+	select {
+	case *notifyChan <- &bgNotification{action: _BG_PASS, doneChan: c, options: options, result: result}:
+	case <-ctx.Done():
+		lock.Unlock()
+		return ctx.Err()
+	}
+	lock.Unlock()
+	select {
+	case <-c:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (store *defaultGroupStore) Flush(ctx context.Context) error {
+	_, span := store.startSpan(ctx, "Flush")
+	defer span.End()
 	for _, c := range store.pendingWriteReqChans {
 		c <- flushGroupWriteReq
 	}
@@ -433,11 +627,34 @@ func (store *defaultGroupStore) Flush(ctx context.Context) error {
 	return nil
 }
 
+// startSpan starts the span for a call such as Read, named
+// "GroupStore.Read", with the keys as attributes; the attributes are only
+// built when there is a Tracer to give them to.
+func (store *defaultGroupStore) startSpan(ctx context.Context, name string, keys ...uint64) (context.Context, Span) {
+	if _, ok := store.tracer.(noopTracer); ok {
+		return ctx, noopSpan{}
+	}
+	attrs := make([]TraceAttribute, len(keys))
+	for i, key := range keys {
+		attrs[i] = TraceAttribute{Key: groupSpanKeyNames[i], Value: key}
+	}
+	return store.tracer.Start(ctx, "GroupStore."+name, attrs...)
+}
+
+var groupSpanKeyNames = []string{"keyA", "keyB", "childKeyA", "childKeyB"}
+
 func (store *defaultGroupStore) Lookup(ctx context.Context, keyA uint64, keyB uint64, childKeyA uint64, childKeyB uint64) (int64, uint32, error) {
+	begin := time.Now()
+	defer store.lookupLatency.observeSince(begin)
+	ctx, span := store.startSpan(ctx, "Lookup", keyA, keyB, childKeyA, childKeyB)
+	defer span.End()
 	atomic.AddInt32(&store.lookups, 1)
+	_, getSpan := store.tracer.Start(ctx, "locmap.Get")
 	timestampbits, _, length, err := store.lookup(keyA, keyB, childKeyA, childKeyB)
+	getSpan.End()
 	if err != nil && err != errNotFound {
 		atomic.AddInt32(&store.lookupErrors, 1)
+		span.RecordError(err)
 	}
 	return int64(timestampbits >> _TSB_UTIL_BITS), length, err
 }
@@ -453,8 +670,14 @@ func (store *defaultGroupStore) lookup(keyA uint64, keyB uint64, childKeyA uint6
 func (store *defaultGroupStore) LookupGroup(ctx context.Context, keyA uint64, keyB uint64) ([]LookupGroupItem, error) {
 	// Returned []LookupGroupItem is not a []* for less garbage collection and
 	// is likely fine most use cases.
+	begin := time.Now()
+	defer store.lookupGroupLatency.observeSince(begin)
+	ctx, span := store.startSpan(ctx, "LookupGroup", keyA, keyB)
+	defer span.End()
 	atomic.AddInt32(&store.lookupGroups, 1)
+	_, getSpan := store.tracer.Start(ctx, "locmap.GetGroup")
 	items := store.locmap.GetGroup(keyA, keyB)
+	getSpan.End()
 	if len(items) == 0 {
 		return nil, nil
 	}
@@ -476,17 +699,24 @@ func (store *defaultGroupStore) LookupGroup(ctx context.Context, keyA uint64, ke
 func (store *defaultGroupStore) ReadGroup(ctx context.Context, keyA uint64, keyB uint64) ([]ReadGroupItem, error) {
 	// Returned []ReadGroupItem is not a []* for less garbage collection and
 	// is likely fine most use cases.
+	begin := time.Now()
+	defer store.readGroupLatency.observeSince(begin)
+	ctx, span := store.startSpan(ctx, "ReadGroup", keyA, keyB)
+	defer span.End()
 	atomic.AddInt32(&store.readGroups, 1)
+	_, getSpan := store.tracer.Start(ctx, "locmap.GetGroup")
 	items := store.locmap.GetGroup(keyA, keyB)
+	getSpan.End()
 	if len(items) == 0 {
 		return nil, nil
 	}
 	rv := make([]ReadGroupItem, len(items))
 	i := 0
 	for _, item := range items {
-		timestampMicro, value, err := store.read(keyA, keyB, item.ChildKeyA, item.ChildKeyB, nil)
+		timestampMicro, value, err := store.tracedRead(ctx, keyA, keyB, item.ChildKeyA, item.ChildKeyB, nil)
 		if err != nil && err != errNotFound {
 			atomic.AddInt32(&store.readGroupErrors, 1)
+			span.RecordError(err)
 		}
 		if err == nil && timestampMicro&_TSB_DELETION == 0 {
 			rv[i].ChildKeyA = item.ChildKeyA
@@ -501,10 +731,15 @@ func (store *defaultGroupStore) ReadGroup(ctx context.Context, keyA uint64, keyB
 }
 
 func (store *defaultGroupStore) Read(ctx context.Context, keyA uint64, keyB uint64, childKeyA uint64, childKeyB uint64, value []byte) (int64, []byte, error) {
+	begin := time.Now()
+	defer store.readLatency.observeSince(begin)
+	ctx, span := store.startSpan(ctx, "Read", keyA, keyB, childKeyA, childKeyB)
+	defer span.End()
 	atomic.AddInt32(&store.reads, 1)
-	timestampbits, value, err := store.read(keyA, keyB, childKeyA, childKeyB, value)
+	timestampbits, value, err := store.tracedRead(ctx, keyA, keyB, childKeyA, childKeyB, value)
 	if err != nil && err != errNotFound {
 		atomic.AddInt32(&store.readErrors, 1)
+		span.RecordError(err)
 	}
 	return int64(timestampbits >> _TSB_UTIL_BITS), value, err
 }
@@ -517,19 +752,53 @@ func (store *defaultGroupStore) read(keyA uint64, keyB uint64, childKeyA uint64,
 	return store.locBlock(id).read(keyA, keyB, childKeyA, childKeyB, timestampbits, offset, length, value)
 }
 
+// tracedRead is read with child spans of the one in ctx for the locmap lookup
+// and for reading from the memBlock or storeFile.
+func (store *defaultGroupStore) tracedRead(ctx context.Context, keyA uint64, keyB uint64, childKeyA uint64, childKeyB uint64, value []byte) (uint64, []byte, error) {
+	_, span := store.tracer.Start(ctx, "locmap.Get")
+	timestampbits, id, offset, length := store.locmap.Get(keyA, keyB, childKeyA, childKeyB)
+	span.End()
+	if id == 0 || timestampbits&_TSB_DELETION != 0 || timestampbits&_TSB_LOCAL_REMOVAL != 0 {
+		return timestampbits, value, errNotFound
+	}
+	block := store.locBlock(id)
+	name := "storeFile.read"
+	if _, ok := block.(*groupMemBlock); ok {
+		name = "memBlock.read"
+	}
+	_, span = store.tracer.Start(ctx, name)
+	timestampbits, value, err := block.read(keyA, keyB, childKeyA, childKeyB, timestampbits, offset, length, value)
+	if err != nil && err != errNotFound {
+		span.RecordError(err)
+	}
+	span.End()
+	return timestampbits, value, err
+}
+
 func (store *defaultGroupStore) Write(ctx context.Context, keyA uint64, keyB uint64, childKeyA uint64, childKeyB uint64, timestampmicro int64, value []byte) (int64, error) {
+	begin := time.Now()
+	defer store.writeLatency.observeSince(begin)
+	ctx, span := store.startSpan(ctx, "Write", keyA, keyB, childKeyA, childKeyB)
+	defer span.End()
 	atomic.AddInt32(&store.writes, 1)
 	if timestampmicro < TIMESTAMPMICRO_MIN {
 		atomic.AddInt32(&store.writeErrors, 1)
-		return 0, fmt.Errorf("timestamp %d < %d", timestampmicro, TIMESTAMPMICRO_MIN)
+		err := fmt.Errorf("timestamp %d < %d", timestampmicro, TIMESTAMPMICRO_MIN)
+		span.RecordError(err)
+		return 0, err
 	}
 	if timestampmicro > TIMESTAMPMICRO_MAX {
 		atomic.AddInt32(&store.writeErrors, 1)
-		return 0, fmt.Errorf("timestamp %d > %d", timestampmicro, TIMESTAMPMICRO_MAX)
+		err := fmt.Errorf("timestamp %d > %d", timestampmicro, TIMESTAMPMICRO_MAX)
+		span.RecordError(err)
+		return 0, err
 	}
+	_, writeSpan := store.tracer.Start(ctx, "memWriter.write")
 	timestampbits, err := store.write(keyA, keyB, childKeyA, childKeyB, uint64(timestampmicro)<<_TSB_UTIL_BITS, value, false)
+	writeSpan.End()
 	if err != nil {
 		atomic.AddInt32(&store.writeErrors, 1)
+		span.RecordError(err)
 	} else if timestampmicro <= int64(timestampbits>>_TSB_UTIL_BITS) {
 		atomic.AddInt32(&store.writesOverridden, 1)
 	}
@@ -548,6 +817,7 @@ func (store *defaultGroupStore) write(keyA uint64, keyB uint64, childKeyA uint64
 	writeReq.timestampbits = timestampbits
 	writeReq.value = value
 	writeReq.internal = internal
+	writeReq.queued = time.Now()
 	store.pendingWriteReqChans[i] <- writeReq
 	err := <-writeReq.errChan
 	ptimestampbits := writeReq.timestampbits
@@ -561,18 +831,29 @@ func (store *defaultGroupStore) write(keyA uint64, keyB uint64, childKeyA uint64
 }
 
 func (store *defaultGroupStore) Delete(ctx context.Context, keyA uint64, keyB uint64, childKeyA uint64, childKeyB uint64, timestampmicro int64) (int64, error) {
+	begin := time.Now()
+	defer store.deleteLatency.observeSince(begin)
+	ctx, span := store.startSpan(ctx, "Delete", keyA, keyB, childKeyA, childKeyB)
+	defer span.End()
 	atomic.AddInt32(&store.deletes, 1)
 	if timestampmicro < TIMESTAMPMICRO_MIN {
 		atomic.AddInt32(&store.deleteErrors, 1)
-		return 0, fmt.Errorf("timestamp %d < %d", timestampmicro, TIMESTAMPMICRO_MIN)
+		err := fmt.Errorf("timestamp %d < %d", timestampmicro, TIMESTAMPMICRO_MIN)
+		span.RecordError(err)
+		return 0, err
 	}
 	if timestampmicro > TIMESTAMPMICRO_MAX {
 		atomic.AddInt32(&store.deleteErrors, 1)
-		return 0, fmt.Errorf("timestamp %d > %d", timestampmicro, TIMESTAMPMICRO_MAX)
+		err := fmt.Errorf("timestamp %d > %d", timestampmicro, TIMESTAMPMICRO_MAX)
+		span.RecordError(err)
+		return 0, err
 	}
+	_, writeSpan := store.tracer.Start(ctx, "memWriter.write")
 	ptimestampbits, err := store.write(keyA, keyB, childKeyA, childKeyB, (uint64(timestampmicro)<<_TSB_UTIL_BITS)|_TSB_DELETION, nil, true)
+	writeSpan.End()
 	if err != nil {
 		atomic.AddInt32(&store.deleteErrors, 1)
+		span.RecordError(err)
 	} else if timestampmicro <= int64(ptimestampbits>>_TSB_UTIL_BITS) {
 		atomic.AddInt32(&store.deletesOverridden, 1)
 	}
@@ -612,9 +893,96 @@ func (store *defaultGroupStore) locBlockIDFromTimestampnano(tsn int64) uint32 {
 }
 
 func (store *defaultGroupStore) closeLocBlock(locBlockID uint32) error {
+	atomic.StoreInt64(&store.locBlockBytes[locBlockID].live, 0)
+	atomic.StoreInt64(&store.locBlockBytes[locBlockID].total, 0)
 	return store.locBlocks[locBlockID].close()
 }
 
+// fileSetSize returns the size of the toc file and its values file, or what
+// could be found of them.
+func (store *defaultGroupStore) fileSetSize(nametoc string) int64 {
+	var size int64
+	if fi, err := store.stat(path.Join(store.pathtoc, nametoc)); err == nil {
+		size += fi.Size()
+	}
+	if fi, err := store.stat(path.Join(store.path, nametoc[:len(nametoc)-3])); err == nil {
+		size += fi.Size()
+	}
+	return size
+}
+
+// locBlockItemBytes returns the bytes an item with a value of the length
+// takes up in the loc block's files: the value, its checksum and its toc
+// entry for v1 files, or just the value and its toc entry for v0 files. Mem
+// blocks are always written out as v1 files.
+func (store *defaultGroupStore) locBlockItemBytes(locBlockID uint32, length uint32) int64 {
+	if fl, ok := store.locBlock(locBlockID).(*groupStoreFile); ok && fl.version < 1 {
+		return int64(length) + _GROUP_FILE_ENTRY_SIZE
+	}
+	return int64(length) + _GROUP_FILE_VALUE_CHECKSUM_SIZE + _GROUP_FILE_ENTRY_SIZE_V1
+}
+
+// locBlockLiveAndTotal returns the live and total byte counts for the loc
+// block.
+func (store *defaultGroupStore) locBlockLiveAndTotal(locBlockID uint32) (int64, int64) {
+	return atomic.LoadInt64(&store.locBlockBytes[locBlockID].live), atomic.LoadInt64(&store.locBlockBytes[locBlockID].total)
+}
+
+// locmapSet is store.locmap.Set that also moves the item's bytes from the
+// live count of the loc block it was in to that of the loc block it is now
+// in, if the set took.
+func (store *defaultGroupStore) locmapSet(keyA uint64, keyB uint64, childKeyA uint64, childKeyB uint64, timestampbits uint64, blockID uint32, offset uint32, length uint32, evenIfSameTimestamp bool) uint64 {
+	lock := &store.locmapSetLocks[keyB%uint64(len(store.locmapSetLocks))]
+	lock.Lock()
+	_, pblockID, _, plength := store.locmap.Get(keyA, keyB, childKeyA, childKeyB)
+	ptimestampbits := store.locmap.Set(keyA, keyB, childKeyA, childKeyB, timestampbits, blockID, offset, length, evenIfSameTimestamp)
+	if ptimestampbits < timestampbits || (evenIfSameTimestamp && ptimestampbits == timestampbits) {
+		if pblockID != 0 {
+			atomic.AddInt64(&store.locBlockBytes[pblockID].live, -store.locBlockItemBytes(pblockID, plength))
+		}
+		if blockID != 0 {
+			atomic.AddInt64(&store.locBlockBytes[blockID].live, store.locBlockItemBytes(blockID, length))
+		}
+	}
+	lock.Unlock()
+	return ptimestampbits
+}
+
+// locmapRemove removes the item from the locmap if it's still the one at the
+// timestampbits in the blockID, returning whether it was. The merkle tree is
+// updated too, so replication will notice the item is missing.
+func (store *defaultGroupStore) locmapRemove(keyA uint64, keyB uint64, childKeyA uint64, childKeyB uint64, timestampbits uint64, blockID uint32) bool {
+	lock := &store.locmapSetLocks[keyB%uint64(len(store.locmapSetLocks))]
+	lock.Lock()
+	ptimestampbits, pblockID, _, plength := store.locmap.Get(keyA, keyB, childKeyA, childKeyB)
+	if ptimestampbits != timestampbits || pblockID != blockID || blockID == 0 {
+		lock.Unlock()
+		return false
+	}
+	store.locmap.Set(keyA, keyB, childKeyA, childKeyB, timestampbits, 0, 0, 0, true)
+	atomic.AddInt64(&store.locBlockBytes[blockID].live, -store.locBlockItemBytes(blockID, plength))
+	lock.Unlock()
+	store.merkleUpdate(keyA, keyB, childKeyA, childKeyB, timestampbits, _TSB_LOCAL_REMOVAL)
+	return true
+}
+
+// locmapDiscard removes the item from the locmap if it's still at the
+// timestampbits, taking its bytes from the live count of the loc block it was
+// in. This is for discarding _TSB_LOCAL_REMOVAL entries, which replication
+// already treats as missing, so the merkle tree is left as is.
+func (store *defaultGroupStore) locmapDiscard(keyA uint64, keyB uint64, childKeyA uint64, childKeyB uint64, timestampbits uint64) {
+	lock := &store.locmapSetLocks[keyB%uint64(len(store.locmapSetLocks))]
+	lock.Lock()
+	ptimestampbits, pblockID, _, plength := store.locmap.Get(keyA, keyB, childKeyA, childKeyB)
+	if ptimestampbits == timestampbits {
+		store.locmap.Set(keyA, keyB, childKeyA, childKeyB, timestampbits, 0, 0, 0, true)
+		if pblockID != 0 {
+			atomic.AddInt64(&store.locBlockBytes[pblockID].live, -store.locBlockItemBytes(pblockID, plength))
+		}
+	}
+	lock.Unlock()
+}
+
 func (store *defaultGroupStore) memClearer(freeableMemBlockChan chan *groupMemBlock) {
 	var tb *groupTOCBlock
 	var tbTS int64
@@ -649,17 +1017,24 @@ func (store *defaultGroupStore) memClearer(freeableMemBlockChan chan *groupMemBl
 			var blockID uint32
 			var offset uint32
 			var length uint32
+			var checksum uint32
 			if timestampbits&_TSB_LOCAL_REMOVAL == 0 {
 				blockID = memBlock.fileID
 
-				offset = memBlock.fileOffset + binary.BigEndian.Uint32(memBlock.toc[memBlockTOCOffset+40:])
+				memOffset := binary.BigEndian.Uint32(memBlock.toc[memBlockTOCOffset+40:])
 				length = binary.BigEndian.Uint32(memBlock.toc[memBlockTOCOffset+44:])
 
+				offset = memBlock.fileOffset + memOffset
+				checksum = binary.BigEndian.Uint32(memBlock.values[memOffset+length:])
 			}
-			if store.locmap.Set(keyA, keyB, childKeyA, childKeyB, timestampbits, blockID, offset, length, true) > timestampbits {
+			if store.locmapSet(keyA, keyB, childKeyA, childKeyB, timestampbits, blockID, offset, length, true) > timestampbits {
+				// Already superseded, so only its value and checksum are in
+				// the file.
+				atomic.AddInt64(&store.locBlockBytes[memBlock.fileID].total, int64(length)+_GROUP_FILE_VALUE_CHECKSUM_SIZE)
 				continue
 			}
-			if tb != nil && tbOffset+_GROUP_FILE_ENTRY_SIZE > cap(tb.data) {
+			atomic.AddInt64(&store.locBlockBytes[memBlock.fileID].total, store.locBlockItemBytes(memBlock.fileID, length))
+			if tb != nil && tbOffset+_GROUP_FILE_ENTRY_SIZE_V1 > cap(tb.data) {
 				store.pendingTOCBlockChan <- tb
 				tb = nil
 			}
@@ -670,8 +1045,8 @@ func (store *defaultGroupStore) memClearer(freeableMemBlockChan chan *groupMemBl
 				binary.BigEndian.PutUint64(tb.data, uint64(tbTS))
 				tbOffset = 8
 			}
-			tb.data = tb.data[:tbOffset+_GROUP_FILE_ENTRY_SIZE]
-			tbd := tb.data[tbOffset : tbOffset+_GROUP_FILE_ENTRY_SIZE]
+			tb.data = tb.data[:tbOffset+_GROUP_FILE_ENTRY_SIZE_V1]
+			tbd := tb.data[tbOffset : tbOffset+_GROUP_FILE_ENTRY_SIZE_V1]
 
 			binary.BigEndian.PutUint64(tbd, keyA)
 			binary.BigEndian.PutUint64(tbd[8:], keyB)
@@ -681,7 +1056,8 @@ func (store *defaultGroupStore) memClearer(freeableMemBlockChan chan *groupMemBl
 			binary.BigEndian.PutUint32(tbd[40:], offset)
 			binary.BigEndian.PutUint32(tbd[44:], length)
 
-			tbOffset += _GROUP_FILE_ENTRY_SIZE
+			binary.BigEndian.PutUint32(tbd[_GROUP_FILE_ENTRY_SIZE:], checksum)
+			tbOffset += _GROUP_FILE_ENTRY_SIZE_V1
 		}
 		memBlock.discardLock.Lock()
 		memBlock.fileID = 0
@@ -720,6 +1096,7 @@ func (store *defaultGroupStore) memWriter(pendingWriteReqChan chan *groupWriteRe
 			store.fileMemBlockChan <- shutdownGroupMemBlock
 			break
 		}
+		store.writeQueueLatency.observeSince(writeReq.queued)
 		if !enabled && !writeReq.internal {
 			writeReq.errChan <- errDisabled
 			continue
@@ -729,7 +1106,8 @@ func (store *defaultGroupStore) memWriter(pendingWriteReqChan chan *groupWriteRe
 			writeReq.errChan <- fmt.Errorf("value length of %d > %d", length, store.valueCap)
 			continue
 		}
-		alloc := length
+		// The value is followed by its checksum, as in v1 values files.
+		alloc := length + _GROUP_FILE_VALUE_CHECKSUM_SIZE
 		if alloc < store.minValueAlloc {
 			alloc = store.minValueAlloc
 		}
@@ -746,12 +1124,16 @@ func (store *defaultGroupStore) memWriter(pendingWriteReqChan chan *groupWriteRe
 		memBlock.values = memBlock.values[:memBlockMemOffset+alloc]
 		memBlock.discardLock.Unlock()
 		copy(memBlock.values[memBlockMemOffset:], writeReq.value)
-		if alloc > length {
-			for i, j := memBlockMemOffset+length, memBlockMemOffset+alloc; i < j; i++ {
+		binary.BigEndian.PutUint32(memBlock.values[memBlockMemOffset+length:], murmur3.Sum32(writeReq.value))
+		if alloc > length+_GROUP_FILE_VALUE_CHECKSUM_SIZE {
+			for i, j := memBlockMemOffset+length+_GROUP_FILE_VALUE_CHECKSUM_SIZE, memBlockMemOffset+alloc; i < j; i++ {
 				memBlock.values[i] = 0
 			}
 		}
-		ptimestampbits := store.locmap.Set(writeReq.keyA, writeReq.keyB, writeReq.childKeyA, writeReq.childKeyB, writeReq.timestampbits & ^uint64(_TSB_COMPACTION_REWRITE), memBlock.id, uint32(memBlockMemOffset), uint32(length), writeReq.timestampbits&_TSB_COMPACTION_REWRITE != 0)
+		ptimestampbits := store.locmapSet(writeReq.keyA, writeReq.keyB, writeReq.childKeyA, writeReq.childKeyB, writeReq.timestampbits & ^uint64(_TSB_COMPACTION_REWRITE), memBlock.id, uint32(memBlockMemOffset), uint32(length), writeReq.timestampbits&_TSB_COMPACTION_REWRITE != 0)
+		if ptimestampbits < writeReq.timestampbits & ^uint64(_TSB_COMPACTION_REWRITE) {
+			store.merkleUpdate(writeReq.keyA, writeReq.keyB, writeReq.childKeyA, writeReq.childKeyB, ptimestampbits, writeReq.timestampbits & ^uint64(_TSB_COMPACTION_REWRITE))
+		}
 		if ptimestampbits < writeReq.timestampbits {
 			memBlock.toc = memBlock.toc[:memBlockTOCOffset+_GROUP_FILE_ENTRY_SIZE]
 
@@ -848,11 +1230,12 @@ func (store *defaultGroupStore) fileWriter() {
 			fl, err = store.createGroupReadWriteFile()
 			if err != nil {
 				store.logger.Error("must shutdown because no new files can be opened", zap.String("name", store.loggerPrefix+"fileWriter"), zap.Error(err))
+				store.event(Event{Kind: EventFileWriterError, Err: err})
 				disabledDueToError = err
 				disabledDueToErrorLogTime = time.Now().Add(5 * time.Minute)
 				go func() {
 					store.Shutdown(context.Background())
-					store.restartChan <- errors.New("no new files can be opened")
+					store.requestRestart(errors.New("no new files can be opened"))
 				}()
 			}
 			tocLen = _GROUP_FILE_HEADER_SIZE
@@ -875,20 +1258,17 @@ func (store *defaultGroupStore) tocWriter() {
 	var writerB io.WriteCloser
 	var offsetB uint64
 	var err error
-	head := []byte("GROUPSTORETOC v0                ")
+	head := []byte("GROUPSTORETOC v1                ")
 	binary.BigEndian.PutUint32(head[28:], uint32(store.checksumInterval))
-	// Make sure any trailing data is covered by a checksum by writing an
-	// additional block of zeros (entry offsets of zero are ignored on
-	// recovery).
-	term := make([]byte, store.checksumInterval)
-	copy(term[len(term)-8:], []byte("TERM v0 "))
+	term := groupTermBlock(store.checksumInterval)
 	disabled := false
 	fatal := func(point int, err error) {
 		store.logger.Error("error while writing toc contents", zap.String("name", store.loggerPrefix+"tocWriter"), zap.Int("point", point), zap.Error(err))
+		store.event(Event{Kind: EventTOCWriterError, Message: fmt.Sprintf("point %d", point), Err: err})
 		disabled = true
 		go func() {
 			store.Shutdown(context.Background())
-			store.restartChan <- errors.New("tocWriter encountered a fatal error; restart required")
+			store.requestRestart(errors.New("tocWriter encountered a fatal error; restart required"))
 		}()
 	}
 OuterLoop:
@@ -945,6 +1325,7 @@ OuterLoop:
 			continue OuterLoop
 		}
 		if len(t.data) > 8 {
+			begin := time.Now()
 			bts := binary.BigEndian.Uint64(t.data)
 			switch bts {
 			case atomic.LoadUint64(&store.activeTOCA):
@@ -995,6 +1376,7 @@ OuterLoop:
 				}
 				offsetA = _GROUP_FILE_HEADER_SIZE + uint64(len(t.data)-8)
 			}
+			store.tocWriteLatency.observeSince(begin)
 		}
 		store.freeTOCBlockChan <- t
 	}
@@ -1031,16 +1413,20 @@ func (store *defaultGroupStore) recovery() error {
 				}
 				for j := 0; j < len(batch); j++ {
 					wr := &batch[j]
+					atomic.AddInt64(&store.locBlockBytes[wr.BlockID].total, store.locBlockItemBytes(wr.BlockID, wr.Length))
 					if wr.TimestampBits&_TSB_LOCAL_REMOVAL != 0 {
 						wr.BlockID = 0
 					}
 					atomic.AddInt64(&encounteredValues, 1)
 					if store.logger.Check(zap.DebugLevel, "debug?") != nil {
-						if store.locmap.Set(wr.KeyA, wr.KeyB, wr.ChildKeyA, wr.ChildKeyB, wr.TimestampBits, wr.BlockID, wr.Offset, wr.Length, true) < wr.TimestampBits {
+						if ptimestampbits := store.locmapSet(wr.KeyA, wr.KeyB, wr.ChildKeyA, wr.ChildKeyB, wr.TimestampBits, wr.BlockID, wr.Offset, wr.Length, true); ptimestampbits < wr.TimestampBits {
+							store.merkleUpdate(wr.KeyA, wr.KeyB, wr.ChildKeyA, wr.ChildKeyB, ptimestampbits, wr.TimestampBits)
 							atomic.AddInt64(&causedChangeCount, 1)
 						}
 					} else {
-						store.locmap.Set(wr.KeyA, wr.KeyB, wr.ChildKeyA, wr.ChildKeyB, wr.TimestampBits, wr.BlockID, wr.Offset, wr.Length, true)
+						if ptimestampbits := store.locmapSet(wr.KeyA, wr.KeyB, wr.ChildKeyA, wr.ChildKeyB, wr.TimestampBits, wr.BlockID, wr.Offset, wr.Length, true); ptimestampbits < wr.TimestampBits {
+							store.merkleUpdate(wr.KeyA, wr.KeyB, wr.ChildKeyA, wr.ChildKeyB, ptimestampbits, wr.TimestampBits)
+						}
 					}
 				}
 				freeBatchChan <- batch
@@ -1057,6 +1443,7 @@ func (store *defaultGroupStore) recovery() error {
 	names, err := store.readdirnames(store.pathtoc)
 	if err != nil {
 		spindown()
+		store.event(Event{Kind: EventRecovery, Begin: start, Err: err})
 		return err
 	}
 	sort.Strings(names)
@@ -1095,12 +1482,14 @@ func (store *defaultGroupStore) recovery() error {
 			// proactive and notify the auditor of the issue here.
 		}
 		if len(errs) != 0 {
+			store.event(Event{Kind: EventRecoveryFileError, File: names[i], Count: int64(fdc), Err: errs[0]})
 			compactNames = append(compactNames, names[i])
 			compactBlockIDs = append(compactBlockIDs, fl.id)
 		}
 		closeIfCloser(fpr)
 	}
 	spindown()
+	store.event(Event{Kind: EventRecovery, Begin: start, Count: int64(fromDiskCount), Changed: atomic.LoadInt64(&causedChangeCount)})
 	if cm := store.logger.Check(zap.DebugLevel, "stats"); cm != nil {
 		dur := time.Now().Sub(start)
 		stringerStats, err := store.Stats(context.Background(), false)
@@ -1114,7 +1503,7 @@ func (store *defaultGroupStore) recovery() error {
 	if len(compactNames) > 0 {
 		store.logger.Debug("secondary recovery started", zap.String("name", store.loggerPrefix+"recovery"), zap.Int("fileCount", len(compactNames)))
 		for i, name := range compactNames {
-			store.compactFile(name, compactBlockIDs[i], make(chan struct{}), "recovery")
+			store.compactFile(context.Background(), name, compactBlockIDs[i], make(chan struct{}), "recovery", nil)
 		}
 		store.logger.Debug("secondary recovery completed", zap.String("name", store.loggerPrefix+"recovery"))
 	}
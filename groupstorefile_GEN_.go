@@ -18,21 +18,41 @@ import (
 	"go.uber.org/zap"
 )
 
-//    "GROUPSTORETOC v0            ":28, checksumInterval:4
-// or "GROUPSTORE v0               ":28, checksumInterval:4
+//    "GROUPSTORETOC v1            ":28, checksumInterval:4
+// or "GROUPSTORE v1               ":28, checksumInterval:4
+// with v0 files still read as well.
 const _GROUP_FILE_HEADER_SIZE = 32
 
 // keyA:8, keyB:8, childKeyA:8, childKeyB:8, timestampbits:8, offset:4, length:4
 const _GROUP_FILE_ENTRY_SIZE = 48
 
-// "TERM v0 ":8
+// v1 toc entries add checksum:4, the murmur3 of the value, which v1 values
+// files also have right after each value, so reads can verify the value on
+// its own rather than just its checksum interval block.
+const _GROUP_FILE_ENTRY_SIZE_V1 = _GROUP_FILE_ENTRY_SIZE + _GROUP_FILE_VALUE_CHECKSUM_SIZE
+const _GROUP_FILE_VALUE_CHECKSUM_SIZE = 4
+
+// "TERM v0 ":8, for both v0 and v1 files
 const _GROUP_FILE_TRAILER_SIZE = 8
 
+// groupTermBlock returns a checksum interval's worth of zeros ending with the
+// file trailer. Writing it at the end of a values or toc file makes sure any
+// trailing data is covered by a checksum; the zeros are never referenced, so
+// they're ignored on reading.
+func groupTermBlock(checksumInterval uint32) []byte {
+	term := make([]byte, checksumInterval)
+	copy(term[len(term)-_GROUP_FILE_TRAILER_SIZE:], []byte("TERM v0 "))
+	return term
+}
+
 type groupStoreFile struct {
-	store                     *defaultGroupStore
-	fullPath                  string
-	id                        uint32
-	nameTimestamp             int64
+	store         *defaultGroupStore
+	fullPath      string
+	id            uint32
+	nameTimestamp int64
+	// version is the file format version; values in v1 files are followed
+	// by their checksums.
+	version                   int
 	readerFPs                 []brimio.ChecksummedReader
 	readerLocks               []sync.Mutex
 	readerLens                [][]byte
@@ -66,9 +86,11 @@ func (store *defaultGroupStore) newGroupReadFile(nameTimestamp int64) (*groupSto
 			return nil, err
 		}
 		if i == 0 {
-			if _, checksumInterval, err = readGroupHeader(fp); err != nil {
+			var header []byte
+			if header, checksumInterval, err = readGroupHeader(fp); err != nil {
 				return nil, err
 			}
+			fl.version = groupFileVersion(header)
 		}
 		fl.readerFPs[i] = brimio.NewChecksummedReader(fp, int(checksumInterval), murmur3.New32)
 		fl.readerLens[i] = make([]byte, 4)
@@ -83,7 +105,7 @@ func (store *defaultGroupStore) newGroupReadFile(nameTimestamp int64) (*groupSto
 }
 
 func (store *defaultGroupStore) createGroupReadWriteFile() (*groupStoreFile, error) {
-	fl := &groupStoreFile{store: store, nameTimestamp: time.Now().UnixNano()}
+	fl := &groupStoreFile{store: store, nameTimestamp: time.Now().UnixNano(), version: 1}
 	fl.fullPath = path.Join(store.path, fmt.Sprintf("%019d.group", fl.nameTimestamp))
 	fp, err := store.createWriteCloser(fl.fullPath)
 	if err != nil {
@@ -98,7 +120,7 @@ func (store *defaultGroupStore) createGroupReadWriteFile() (*groupStoreFile, err
 	fl.writerToDiskBufChan = make(chan *groupStoreFileWriteBuf, store.workers)
 	fl.writerDoneChan = make(chan struct{})
 	fl.writerCurrentBuf = <-fl.writerFreeBufChan
-	head := []byte("GROUPSTORE v0                   ")
+	head := []byte("GROUPSTORE v1                   ")
 	binary.BigEndian.PutUint32(head[28:], store.checksumInterval)
 	fl.writerCurrentBuf.offset = uint32(copy(fl.writerCurrentBuf.buf, head))
 	atomic.StoreUint32(&fl.writerOffset, fl.writerCurrentBuf.offset)
@@ -139,7 +161,14 @@ func (fl *groupStoreFile) read(keyA uint64, keyB uint64, childKeyA uint64, child
 	i := int(keyA>>1) % len(fl.readerFPs)
 	fl.readerLocks[i].Lock()
 	fl.readerFPs[i].Seek(int64(offset), 0)
-	end := len(value) + int(length)
+	// v1 values are read along with their checksums, which are then
+	// trimmed off.
+	readLength := int(length)
+	if fl.version >= 1 {
+		readLength += _GROUP_FILE_VALUE_CHECKSUM_SIZE
+	}
+	start := len(value)
+	end := start + readLength
 	if end <= cap(value) {
 		value = value[:end]
 	} else {
@@ -147,11 +176,17 @@ func (fl *groupStoreFile) read(keyA uint64, keyB uint64, childKeyA uint64, child
 		copy(value2, value)
 		value = value2
 	}
-	if _, err := io.ReadFull(fl.readerFPs[i], value[len(value)-int(length):]); err != nil {
+	if _, err := io.ReadFull(fl.readerFPs[i], value[start:]); err != nil {
 		fl.readerLocks[i].Unlock()
 		return timestampbits, value, err
 	}
 	fl.readerLocks[i].Unlock()
+	if fl.version >= 1 {
+		value = value[:start+int(length)]
+		if murmur3.Sum32(value[start:]) != binary.BigEndian.Uint32(value[len(value):end]) {
+			return timestampbits, value, fmt.Errorf("checksum mismatch for value at offset %d in %s", offset, fl.fullPath)
+		}
+	}
 	return timestampbits, value, nil
 }
 
@@ -204,11 +239,7 @@ func (fl *groupStoreFile) closeWriting() error {
 	}
 	fl.writerToDiskBufChan <- nil
 	<-fl.writerDoneChan
-	// Make sure any trailing data is covered by a checksum by writing an
-	// additional block of zeros (since this is a value file and the TOC won't
-	// reference these additional locations, they are effectively ignored).
-	term := make([]byte, fl.store.checksumInterval)
-	copy(term[len(term)-8:], []byte("TERM v0 "))
+	term := groupTermBlock(fl.store.checksumInterval)
 	left := len(term)
 	for left > 0 {
 		n := copy(fl.writerCurrentBuf.buf[fl.writerCurrentBuf.offset:fl.store.checksumInterval], term[len(term)-left:])
@@ -298,10 +329,12 @@ func (fl *groupStoreFile) writer() {
 			fl.writerToDiskBufChan <- buf
 			continue
 		}
+		begin := time.Now()
 		if _, err := fl.writerFP.Write(buf.buf); err != nil {
 			fl.store.logger.Error("write error", zap.String("name", fl.store.loggerPrefix+"storeFile"), zap.String("path", fl.fullPath), zap.Error(err))
 			break
 		}
+		fl.store.fileWriteLatency.observeSince(begin)
 		if len(buf.memBlocks) > 0 {
 			for _, memBlock := range buf.memBlocks {
 				fl.store.freeableMemBlockChans[fl.freeableMemBlockChanIndex] <- memBlock
@@ -336,13 +369,13 @@ func _readGroupHeader(fpr io.Reader, toc bool) ([]byte, uint32, error) {
 	if n, err := io.ReadFull(fpr, buf); err != nil {
 		return buf[:n], 0, err
 	}
-	var cmp []byte
+	var cmp [][]byte
 	if toc {
-		cmp = []byte("GROUPSTORETOC v0            ")
+		cmp = [][]byte{[]byte("GROUPSTORETOC v0            "), []byte("GROUPSTORETOC v1            ")}
 	} else {
-		cmp = []byte("GROUPSTORE v0               ")
+		cmp = [][]byte{[]byte("GROUPSTORE v0               "), []byte("GROUPSTORE v1               ")}
 	}
-	if !bytes.Equal(buf[:28], cmp) {
+	if !bytes.Equal(buf[:28], cmp[0]) && !bytes.Equal(buf[:28], cmp[1]) {
 		return buf, 0, errors.New("unknown file type in header")
 	}
 	checksumInterval := binary.BigEndian.Uint32(buf[28:])
@@ -352,6 +385,15 @@ func _readGroupHeader(fpr io.Reader, toc bool) ([]byte, uint32, error) {
 	return buf, checksumInterval, nil
 }
 
+// groupFileVersion returns the format version of a values or toc file from
+// its header.
+func groupFileVersion(header []byte) int {
+	if bytes.HasPrefix(header, []byte("GROUPSTORE v1")) || bytes.HasPrefix(header, []byte("GROUPSTORETOC v1")) {
+		return 1
+	}
+	return 0
+}
+
 type groupTOCEntry struct {
 	KeyA uint64
 	KeyB uint64
@@ -363,6 +405,8 @@ type groupTOCEntry struct {
 	BlockID       uint32
 	Offset        uint32
 	Length        uint32
+	// Checksum is the murmur3 of the value, from v1 toc files only.
+	Checksum uint32
 }
 
 func groupReadTOCEntriesBatched(fpr io.ReadSeeker, blockID uint32, freeBatchChans []chan []groupTOCEntry, pendingBatchChans []chan []groupTOCEntry, controlChan chan struct{}) (int, []error) {
@@ -371,13 +415,17 @@ func groupReadTOCEntriesBatched(fpr io.ReadSeeker, blockID uint32, freeBatchChan
 	// greater than the _GROUP_FILE_TRAILER_SIZE.
 	var errs []error
 	var checksumInterval int
-	if _, ci, err := readGroupHeaderTOC(fpr); err != nil {
+	entrySize := _GROUP_FILE_ENTRY_SIZE
+	if header, ci, err := readGroupHeaderTOC(fpr); err != nil {
 		return 0, append(errs, err)
 	} else {
 		checksumInterval = int(ci)
+		if groupFileVersion(header) >= 1 {
+			entrySize = _GROUP_FILE_ENTRY_SIZE_V1
+		}
 	}
 	fpr.Seek(0, 0)
-	buf := make([]byte, checksumInterval+4+_GROUP_FILE_ENTRY_SIZE)
+	buf := make([]byte, checksumInterval+4+entrySize)
 	rpos := 0
 	checksumErrors := 0
 	workers := uint64(len(freeBatchChans))
@@ -409,7 +457,7 @@ L1:
 			if binary.BigEndian.Uint32(cbuf) != murmur3.Sum32(rbuf) {
 				checksumErrors++
 				rbuf = buf[:rpos+len(rbuf)]
-				skipNext = _GROUP_FILE_ENTRY_SIZE - ((skipNext + len(rbuf)) % _GROUP_FILE_ENTRY_SIZE)
+				skipNext = entrySize - ((skipNext + len(rbuf)) % entrySize)
 				rpos = 0
 				continue
 			}
@@ -421,13 +469,13 @@ L1:
 			rbuf = buf[:rpos+len(rbuf)]
 		}
 		if !more {
-			if len(rbuf) >= _VALUE_FILE_TRAILER_SIZE && bytes.Equal(rbuf[len(rbuf)-_GROUP_FILE_TRAILER_SIZE:], []byte("TERM v0 ")) {
+			if len(rbuf) >= _GROUP_FILE_TRAILER_SIZE && bytes.Equal(rbuf[len(rbuf)-_GROUP_FILE_TRAILER_SIZE:], []byte("TERM v0 ")) {
 				rbuf = rbuf[:len(rbuf)-_GROUP_FILE_TRAILER_SIZE]
 			} else {
 				errs = append(errs, errors.New("no terminator found"))
 			}
 		}
-		for len(rbuf) >= _GROUP_FILE_ENTRY_SIZE {
+		for len(rbuf) >= entrySize {
 
 			offset := binary.BigEndian.Uint32(rbuf[40:])
 
@@ -451,13 +499,17 @@ L1:
 				wr.Offset = offset
 				wr.Length = binary.BigEndian.Uint32(rbuf[44:])
 
+				wr.Checksum = 0
+				if entrySize == _GROUP_FILE_ENTRY_SIZE_V1 {
+					wr.Checksum = binary.BigEndian.Uint32(rbuf[_GROUP_FILE_ENTRY_SIZE:])
+				}
 				batchesPos[k]++
 				if batchesPos[k] >= batchSize {
 					pendingBatchChans[k] <- batches[k]
 					batches[k] = nil
 				}
 			}
-			rbuf = rbuf[_GROUP_FILE_ENTRY_SIZE:]
+			rbuf = rbuf[entrySize:]
 		}
 		rpos = copy(buf, rbuf)
 	}
@@ -482,16 +534,20 @@ func groupTOCStat(fullPath string, statter func(fullPath string) (os.FileInfo, e
 	if err != nil {
 		return 0, err
 	}
-	_, checksumInterval, err := readGroupHeaderTOC(fpr)
+	header, checksumInterval, err := readGroupHeaderTOC(fpr)
 	closeIfCloser(fpr)
 	if err != nil {
 		return 0, err
 	}
+	entrySize := int64(_GROUP_FILE_ENTRY_SIZE)
+	if groupFileVersion(header) >= 1 {
+		entrySize = _GROUP_FILE_ENTRY_SIZE_V1
+	}
 	size := fileInfo.Size()
 	checksumsRemoved := size - size/(int64(checksumInterval)+4)*4
 	// NOTE: Store always writes the trailer as a full checksum interval block.
 	headerAndTrailerRemoved := checksumsRemoved - _GROUP_FILE_HEADER_SIZE - int64(checksumInterval)
-	return int(headerAndTrailerRemoved / _GROUP_FILE_ENTRY_SIZE), nil
+	return int(headerAndTrailerRemoved / entrySize), nil
 }
 
 type groupCorruptRange struct {
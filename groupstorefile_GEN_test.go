@@ -4,8 +4,13 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"os"
+	"path"
+	"strings"
 	"testing"
 
+	"github.com/gholt/brimio"
+	"github.com/spaolacci/murmur3"
 	"golang.org/x/net/context"
 )
 
@@ -126,7 +131,7 @@ func TestGroupValuesFileWritingEmpty(t *testing.T) {
 	if bl != _GROUP_FILE_HEADER_SIZE+cfg.ChecksumInterval+4 {
 		t.Fatal(bl)
 	}
-	if string(buf.buf[:28]) != "GROUPSTORE v0               " {
+	if string(buf.buf[:28]) != "GROUPSTORE v1               " {
 		t.Fatal(string(buf.buf[:28]))
 	}
 	if binary.BigEndian.Uint32(buf.buf[28:]) != store.checksumInterval {
@@ -170,7 +175,7 @@ func TestGroupValuesFileWritingEmpty2(t *testing.T) {
 	if bl != _GROUP_FILE_HEADER_SIZE+cfg.ChecksumInterval+4 {
 		t.Fatal(bl)
 	}
-	if string(buf.buf[:28]) != "GROUPSTORE v0               " {
+	if string(buf.buf[:28]) != "GROUPSTORE v1               " {
 		t.Fatal(string(buf.buf[:28]))
 	}
 	if binary.BigEndian.Uint32(buf.buf[28:]) != store.checksumInterval {
@@ -214,7 +219,7 @@ func TestGroupValuesFileWriting(t *testing.T) {
 	if bl != 1234+_GROUP_FILE_HEADER_SIZE+cfg.ChecksumInterval+4 {
 		t.Fatal(bl)
 	}
-	if string(buf.buf[:28]) != "GROUPSTORE v0               " {
+	if string(buf.buf[:28]) != "GROUPSTORE v1               " {
 		t.Fatal(string(buf.buf[:28]))
 	}
 	if binary.BigEndian.Uint32(buf.buf[28:]) != store.checksumInterval {
@@ -263,7 +268,7 @@ func TestGroupValuesFileWritingMore(t *testing.T) {
 	if bl != el {
 		t.Fatal(bl, el)
 	}
-	if string(buf.buf[:28]) != "GROUPSTORE v0               " {
+	if string(buf.buf[:28]) != "GROUPSTORE v1               " {
 		t.Fatal(string(buf.buf[:28]))
 	}
 	if binary.BigEndian.Uint32(buf.buf[28:]) != store.checksumInterval {
@@ -319,7 +324,7 @@ func TestGroupValuesFileWritingMultiple(t *testing.T) {
 	if bl != el {
 		t.Fatal(bl, el)
 	}
-	if string(buf.buf[:28]) != "GROUPSTORE v0               " {
+	if string(buf.buf[:28]) != "GROUPSTORE v1               " {
 		t.Fatal(string(buf.buf[:28]))
 	}
 	if binary.BigEndian.Uint32(buf.buf[28:]) != store.checksumInterval {
@@ -329,3 +334,99 @@ func TestGroupValuesFileWritingMultiple(t *testing.T) {
 		t.Fatal(string(buf.buf[bl-_GROUP_FILE_TRAILER_SIZE:]))
 	}
 }
+
+func TestGroupValuesFileReadingV1(t *testing.T) {
+	cfg := newTestGroupStoreConfig()
+	buf := &memBuf{buf: []byte("GROUPSTORE v1                   45678....")}
+	binary.BigEndian.PutUint32(buf.buf[28:], 65532)
+	binary.BigEndian.PutUint32(buf.buf[_GROUP_FILE_HEADER_SIZE+5:], murmur3.Sum32([]byte("45678")))
+	cfg.openReadSeeker = func(fullPath string) (io.ReadSeeker, error) {
+		return &memFile{buf: buf}, nil
+	}
+	store, _ := newTestGroupStore(cfg)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	fl, err := store.newGroupReadFile(12345)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fl.version != 1 {
+		t.Fatal(fl.version)
+	}
+	_, v, err := fl.read(1, 2, 0, 0, 0x300, _GROUP_FILE_HEADER_SIZE, 5, []byte("testing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "testing45678" {
+		t.Fatal(string(v))
+	}
+	// A value that no longer matches its checksum is an error.
+	buf.buf[_GROUP_FILE_HEADER_SIZE+1] = 'X'
+	if _, _, err = fl.read(1, 2, 0, 0, 0x300, _GROUP_FILE_HEADER_SIZE, 5, nil); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupFileUpgrade(t *testing.T) {
+	fs := newMemFS()
+	cfg := newTestGroupStoreConfigWithFS(fs)
+	store, _ := newTestGroupStore(cfg)
+	// A v0 file pair, as written before values had their own checksums.
+	write := func(fullPath string, data ...[]byte) {
+		fp, _ := fs.createWriteCloser(fullPath)
+		w := brimio.NewMultiCoreChecksummedWriter(fp, cfg.ChecksumInterval, murmur3.New32, 1)
+		for _, d := range data {
+			w.Write(d)
+		}
+		w.Write(groupTermBlock(uint32(cfg.ChecksumInterval)))
+		w.Close()
+	}
+	head := []byte("GROUPSTORE v0                   ")
+	binary.BigEndian.PutUint32(head[28:], uint32(cfg.ChecksumInterval))
+	write(path.Join(store.path, "0000000000000000001.group"), head, []byte("old"))
+	headtoc := []byte("GROUPSTORETOC v0                ")
+	binary.BigEndian.PutUint32(headtoc[28:], uint32(cfg.ChecksumInterval))
+	entry := make([]byte, _GROUP_FILE_ENTRY_SIZE)
+	binary.BigEndian.PutUint64(entry, 1)
+	binary.BigEndian.PutUint64(entry[8:], 2)
+
+	binary.BigEndian.PutUint64(entry[16:], 3)
+	binary.BigEndian.PutUint64(entry[24:], 4)
+	binary.BigEndian.PutUint64(entry[32:], 0x500)
+	binary.BigEndian.PutUint32(entry[40:], _GROUP_FILE_HEADER_SIZE)
+	binary.BigEndian.PutUint32(entry[44:], 3)
+
+	write(path.Join(store.pathtoc, "0000000000000000001.grouptoc"), headtoc, entry)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	read := func() {
+		_, value, err := store.Read(context.Background(), 1, 2, 3, 4, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != "old" {
+			t.Fatal(string(value))
+		}
+	}
+	read()
+	// The file has no waste but is rewritten in the current format anyway.
+	result, err := store.CompactionPass(context.Background(), &CompactionPassOptions{IgnoreAgeThreshold: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FilesCompacted != 1 || result.ItemsRewritten != 1 {
+		t.Fatal(result)
+	}
+	if _, err := fs.stat(path.Join(store.pathtoc, "0000000000000000001.grouptoc")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	_, blockID, _, _ := store.locmap.Get(1, 2, 3, 4)
+	if fl, ok := store.locBlock(blockID).(*groupStoreFile); !ok || fl.version != 1 {
+		t.Fatal(blockID)
+	}
+	read()
+}
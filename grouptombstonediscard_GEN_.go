@@ -8,6 +8,7 @@ import (
 
 	"github.com/gholt/brimtime"
 	"go.uber.org/zap"
+	"golang.org/x/net/context"
 )
 
 type groupTombstoneDiscardState struct {
@@ -18,6 +19,7 @@ type groupTombstoneDiscardState struct {
 
 	startupShutdownLock sync.Mutex
 	notifyChan          chan *bgNotification
+	task                backgroundTask
 	localRemovals       [][]groupLocalRemovalEntry
 }
 
@@ -36,6 +38,9 @@ func (store *defaultGroupStore) tombstoneDiscardConfig(cfg *GroupStoreConfig) {
 	store.tombstoneDiscardState.age = (uint64(cfg.TombstoneAge) * uint64(time.Second) / 1000) << _TSB_UTIL_BITS
 	store.tombstoneDiscardState.batchSize = cfg.TombstoneDiscardBatchSize
 	store.tombstoneDiscardState.workers = cfg.TombstoneDiscardWorkers
+	// The scratchpads are sized by batchSize, so any from before a
+	// Reconfigure are dropped.
+	store.tombstoneDiscardState.localRemovals = nil
 }
 
 func (store *defaultGroupStore) tombstoneDiscardStartup() {
@@ -57,6 +62,7 @@ func (store *defaultGroupStore) tombstoneDiscardShutdown() {
 		}
 		<-c
 		store.tombstoneDiscardState.notifyChan = nil
+		store.tombstoneDiscardState.task.stop()
 	}
 	store.tombstoneDiscardState.startupShutdownLock.Unlock()
 }
@@ -66,6 +72,7 @@ func (store *defaultGroupStore) tombstoneDiscardLauncher(notifyChan chan *bgNoti
 	store.randMutex.Lock()
 	nextRun := time.Now().Add(time.Duration(interval + interval*store.rand.NormFloat64()*0.1))
 	store.randMutex.Unlock()
+	store.tombstoneDiscardState.task.launch(nextRun)
 	var notification *bgNotification
 	running := true
 	for running {
@@ -86,11 +93,13 @@ func (store *defaultGroupStore) tombstoneDiscardLauncher(notifyChan chan *bgNoti
 		store.randMutex.Lock()
 		nextRun = time.Now().Add(time.Duration(interval + interval*store.rand.NormFloat64()*0.1))
 		store.randMutex.Unlock()
+		store.tombstoneDiscardState.task.schedule(nextRun)
 		if notification != nil {
 			var nextNotification *bgNotification
 			switch notification.action {
 			case _BG_PASS:
-				nextNotification = store.tombstoneDiscardPass(notifyChan)
+				result, _ := notification.result.(*TombstoneDiscardResult)
+				nextNotification = store.tombstoneDiscardPass(notifyChan, result)
 			case _BG_DISABLE:
 				running = false
 			default:
@@ -99,27 +108,52 @@ func (store *defaultGroupStore) tombstoneDiscardLauncher(notifyChan chan *bgNoti
 			notification.doneChan <- struct{}{}
 			notification = nextNotification
 		} else {
-			notification = store.tombstoneDiscardPass(notifyChan)
+			notification = store.tombstoneDiscardPass(notifyChan, nil)
 		}
 	}
 }
 
-func (store *defaultGroupStore) tombstoneDiscardPass(notifyChan chan *bgNotification) *bgNotification {
+// TombstoneDiscardPass runs a tombstone discard pass now; see
+// Store.TombstoneDiscardPass.
+func (store *defaultGroupStore) TombstoneDiscardPass(ctx context.Context) (*TombstoneDiscardResult, error) {
+	ctx, span := store.startSpan(ctx, "TombstoneDiscardPass")
+	defer span.End()
+	result := &TombstoneDiscardResult{}
+	if err := store.manualPass(ctx, &store.tombstoneDiscardState.startupShutdownLock, &store.tombstoneDiscardState.notifyChan, nil, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// tombstoneDiscardPass adds what it did to the result, which may be nil.
+func (store *defaultGroupStore) tombstoneDiscardPass(notifyChan chan *bgNotification, result *TombstoneDiscardResult) *bgNotification {
+	store.tombstoneDiscardState.task.begin()
 	begin := time.Now()
 	defer func() {
 		elapsed := time.Now().Sub(begin)
 		store.logger.Debug("pass completed", zap.String("name", store.loggerPrefix+"tombstoneDiscard"), zap.Duration("elapsed", elapsed))
 		atomic.StoreInt64(&store.tombstoneDiscardNanoseconds, elapsed.Nanoseconds())
+		store.tombstoneDiscardPassDuration.observe(elapsed)
+		store.tombstoneDiscardState.task.end()
 	}()
+	// To avoid memory churn, the localRemovals scratchpads are allocated just
+	// once and passed in to the workers of both passes.
+	for len(store.tombstoneDiscardState.localRemovals) < store.tombstoneDiscardState.workers {
+		store.tombstoneDiscardState.localRemovals = append(store.tombstoneDiscardState.localRemovals, make([]groupLocalRemovalEntry, store.tombstoneDiscardState.batchSize))
+	}
 	if n := store.tombstoneDiscardPassLocalRemovals(notifyChan); n != nil {
 		return n
 	}
-	return store.tombstoneDiscardPassExpiredDeletions(notifyChan)
+	if result == nil {
+		result = &TombstoneDiscardResult{}
+	}
+	return store.tombstoneDiscardPassExpiredDeletions(notifyChan, result)
 }
 
 // tombstoneDiscardPassLocalRemovals removes all entries marked with the
 // _TSB_LOCAL_REMOVAL bit. These are entries that other routines have indicated
-// are no longer needed in memory.
+// are no longer needed in memory. They're removed through locmapDiscard, a
+// batch at a time, so the live byte counts of their loc blocks are kept.
 func (store *defaultGroupStore) tombstoneDiscardPassLocalRemovals(notifyChan chan *bgNotification) *bgNotification {
 	// Each worker will perform a pass on a subsection of each partition's key
 	// space. Additionally, each worker will start their work on different
@@ -133,7 +167,7 @@ func (store *defaultGroupStore) tombstoneDiscardPassLocalRemovals(notifyChan cha
 	}
 	workerMax := uint64(store.tombstoneDiscardState.workers - 1)
 	workerPartitionPiece := (uint64(1) << partitionShift) / (workerMax + 1)
-	work := func(partition uint64, worker uint64) {
+	work := func(partition uint64, worker uint64, localRemovals []groupLocalRemovalEntry) {
 		partitionOnLeftBits := partition << partitionShift
 		rangeBegin := partitionOnLeftBits + (workerPartitionPiece * worker)
 		var rangeEnd uint64
@@ -148,7 +182,28 @@ func (store *defaultGroupStore) tombstoneDiscardPassLocalRemovals(notifyChan cha
 				rangeEnd = math.MaxUint64
 			}
 		}
-		store.locmap.Discard(rangeBegin, rangeEnd, _TSB_LOCAL_REMOVAL)
+		more := true
+		for more {
+			localRemovalsIndex := 0
+			// As with expired deletions, the removals are made after the scan
+			// rather than during it.
+			rangeBegin, more = store.locmap.ScanCallback(rangeBegin, rangeEnd, _TSB_LOCAL_REMOVAL, 0, math.MaxUint64, uint64(store.tombstoneDiscardState.batchSize), func(keyA uint64, keyB uint64, childKeyA uint64, childKeyB uint64, timestampbits uint64, length uint32) bool {
+				e := &localRemovals[localRemovalsIndex]
+				e.keyA = keyA
+				e.keyB = keyB
+
+				e.childKeyA = childKeyA
+				e.childKeyB = childKeyB
+
+				e.timestampbits = timestampbits
+				localRemovalsIndex++
+				return true
+			})
+			for i := 0; i < localRemovalsIndex; i++ {
+				e := &localRemovals[i]
+				store.locmapDiscard(e.keyA, e.keyB, e.childKeyA, e.childKeyB, e.timestampbits)
+			}
+		}
 	}
 	var abort uint32
 	wg := &sync.WaitGroup{}
@@ -156,18 +211,19 @@ func (store *defaultGroupStore) tombstoneDiscardPassLocalRemovals(notifyChan cha
 	workerPartitionOffset := (partitionMax + 1) / (workerMax + 1)
 	for worker := uint64(0); worker <= workerMax; worker++ {
 		go func(worker uint64) {
+			localRemovals := store.tombstoneDiscardState.localRemovals[worker]
 			partitionBegin := workerPartitionOffset * worker
 			for partition := partitionBegin; partition <= partitionMax; partition++ {
 				if atomic.LoadUint32(&abort) != 0 {
 					break
 				}
-				work(partition, worker)
+				work(partition, worker, localRemovals)
 			}
 			for partition := uint64(0); partition < partitionBegin; partition++ {
 				if atomic.LoadUint32(&abort) != 0 {
 					break
 				}
-				work(partition, worker)
+				work(partition, worker, localRemovals)
 			}
 			wg.Done()
 		}(worker)
@@ -189,8 +245,9 @@ func (store *defaultGroupStore) tombstoneDiscardPassLocalRemovals(notifyChan cha
 
 // tombstoneDiscardPassExpiredDeletions scans for entries marked with
 // _TSB_DELETION (but not _TSB_LOCAL_REMOVAL) that are older than the maximum
-// tombstone age and marks them for _TSB_LOCAL_REMOVAL.
-func (store *defaultGroupStore) tombstoneDiscardPassExpiredDeletions(notifyChan chan *bgNotification) *bgNotification {
+// tombstone age and marks them for _TSB_LOCAL_REMOVAL, adding the count to
+// the result.
+func (store *defaultGroupStore) tombstoneDiscardPassExpiredDeletions(notifyChan chan *bgNotification, result *TombstoneDiscardResult) *bgNotification {
 	// Each worker will perform a pass on a subsection of each partition's key
 	// space. Additionally, each worker will start their work on different
 	// partition. This reduces contention for a given section of the locmap.
@@ -238,6 +295,7 @@ func (store *defaultGroupStore) tombstoneDiscardPassExpiredDeletions(notifyChan
 				return true
 			})
 			atomic.AddInt32(&store.expiredDeletions, int32(localRemovalsIndex))
+			atomic.AddInt64(&result.TombstonesDiscarded, int64(localRemovalsIndex))
 			for i := 0; i < localRemovalsIndex; i++ {
 				e := &localRemovals[i]
 				// These writes go through the entire system, so they're
@@ -246,11 +304,6 @@ func (store *defaultGroupStore) tombstoneDiscardPassExpiredDeletions(notifyChan
 			}
 		}
 	}
-	// To avoid memory churn, the localRemovals scratchpads are allocated just
-	// once and passed in to the workers.
-	for len(store.tombstoneDiscardState.localRemovals) <= int(workerMax) {
-		store.tombstoneDiscardState.localRemovals = append(store.tombstoneDiscardState.localRemovals, make([]groupLocalRemovalEntry, store.tombstoneDiscardState.batchSize))
-	}
 	var abort uint32
 	wg := &sync.WaitGroup{}
 	wg.Add(int(workerMax + 1))
@@ -12,39 +12,49 @@ import (
 )
 
 type groupWatcherState struct {
-	interval                   int
+	interval int
+	// thresholds can be changed by Reconfigure while the watcher is running,
+	// so they're only accessed with the lock held.
+	lock        sync.Mutex
+	thresholds  groupWatcherThresholds
+	diskFree    uint64
+	diskUsed    uint64
+	diskSize    uint64
+	diskFreeTOC uint64
+	diskUsedTOC uint64
+	diskSizeTOC uint64
+	memFree     uint64
+	memUsed     uint64
+	memSize     uint64
+
+	startupShutdownLock sync.Mutex
+	notifyChan          chan *bgNotification
+	task                backgroundTask
+}
+
+type groupWatcherThresholds struct {
 	diskFreeDisableThreshold   uint64
 	diskFreeReenableThreshold  uint64
 	diskUsageDisableThreshold  float64
 	diskUsageReenableThreshold float64
-	diskFree                   uint64
-	diskUsed                   uint64
-	diskSize                   uint64
-	diskFreeTOC                uint64
-	diskUsedTOC                uint64
-	diskSizeTOC                uint64
 	memFreeDisableThreshold    uint64
 	memFreeReenableThreshold   uint64
 	memUsageDisableThreshold   float64
 	memUsageReenableThreshold  float64
-	memFree                    uint64
-	memUsed                    uint64
-	memSize                    uint64
-
-	startupShutdownLock sync.Mutex
-	notifyChan          chan *bgNotification
 }
 
 func (store *defaultGroupStore) watcherConfig(cfg *GroupStoreConfig) {
 	store.watcherState.interval = 60
-	store.watcherState.diskFreeDisableThreshold = cfg.DiskFreeDisableThreshold
-	store.watcherState.diskFreeReenableThreshold = cfg.DiskFreeReenableThreshold
-	store.watcherState.diskUsageDisableThreshold = cfg.DiskUsageDisableThreshold
-	store.watcherState.diskUsageReenableThreshold = cfg.DiskUsageReenableThreshold
-	store.watcherState.memFreeDisableThreshold = cfg.MemFreeDisableThreshold
-	store.watcherState.memFreeReenableThreshold = cfg.MemFreeReenableThreshold
-	store.watcherState.memUsageDisableThreshold = cfg.MemUsageDisableThreshold
-	store.watcherState.memUsageReenableThreshold = cfg.MemUsageReenableThreshold
+	store.watcherState.lock.Lock()
+	store.watcherState.thresholds.diskFreeDisableThreshold = cfg.DiskFreeDisableThreshold
+	store.watcherState.thresholds.diskFreeReenableThreshold = cfg.DiskFreeReenableThreshold
+	store.watcherState.thresholds.diskUsageDisableThreshold = cfg.DiskUsageDisableThreshold
+	store.watcherState.thresholds.diskUsageReenableThreshold = cfg.DiskUsageReenableThreshold
+	store.watcherState.thresholds.memFreeDisableThreshold = cfg.MemFreeDisableThreshold
+	store.watcherState.thresholds.memFreeReenableThreshold = cfg.MemFreeReenableThreshold
+	store.watcherState.thresholds.memUsageDisableThreshold = cfg.MemUsageDisableThreshold
+	store.watcherState.thresholds.memUsageReenableThreshold = cfg.MemUsageReenableThreshold
+	store.watcherState.lock.Unlock()
 }
 
 func (store *defaultGroupStore) watcherStartup() {
@@ -66,6 +76,7 @@ func (store *defaultGroupStore) watcherShutdown() {
 		}
 		<-c
 		store.watcherState.notifyChan = nil
+		store.watcherState.task.stop()
 	}
 	store.watcherState.startupShutdownLock.Unlock()
 }
@@ -75,6 +86,7 @@ func (store *defaultGroupStore) watcherLauncher(notifyChan chan *bgNotification)
 	store.randMutex.Lock()
 	nextRun := time.Now().Add(time.Duration(interval + interval*store.rand.NormFloat64()*0.1))
 	store.randMutex.Unlock()
+	store.watcherState.task.launch(nextRun)
 	const (
 		CLEAR = iota
 		DISK_FREE
@@ -101,6 +113,7 @@ func (store *defaultGroupStore) watcherLauncher(notifyChan chan *bgNotification)
 		store.randMutex.Lock()
 		nextRun = time.Now().Add(time.Duration(interval + interval*store.rand.NormFloat64()*0.1))
 		store.randMutex.Unlock()
+		store.watcherState.task.schedule(nextRun)
 		if notification != nil {
 			if notification.action == _BG_DISABLE {
 				running = false
@@ -110,6 +123,10 @@ func (store *defaultGroupStore) watcherLauncher(notifyChan chan *bgNotification)
 			notification.doneChan <- struct{}{}
 			continue
 		}
+		store.watcherState.task.begin()
+		store.watcherState.lock.Lock()
+		th := store.watcherState.thresholds
+		store.watcherState.lock.Unlock()
 		u := du.NewDiskUsage(store.path)
 		utoc := u
 		if store.pathtoc != store.path {
@@ -144,47 +161,48 @@ func (store *defaultGroupStore) watcherLauncher(notifyChan chan *bgNotification)
 		}
 		if state == CLEAR {
 			var msg string
-			if store.watcherState.diskFreeDisableThreshold > 1 && (diskFree <= store.watcherState.diskFreeDisableThreshold || diskFreeTOC <= store.watcherState.diskFreeDisableThreshold) {
-				msg = fmt.Sprintf("passed the disk free threshold %d for automatic disabling", store.watcherState.diskFreeDisableThreshold)
+			if th.diskFreeDisableThreshold > 1 && (diskFree <= th.diskFreeDisableThreshold || diskFreeTOC <= th.diskFreeDisableThreshold) {
+				msg = fmt.Sprintf("passed the disk free threshold %d for automatic disabling", th.diskFreeDisableThreshold)
 				state = DISK_FREE
 			}
-			if store.watcherState.diskUsageDisableThreshold > 0 && (diskUsage >= store.watcherState.diskUsageDisableThreshold || diskUsageTOC >= store.watcherState.diskUsageDisableThreshold) {
-				msg = fmt.Sprintf("passed the disk usage threshold %f for automatic disabling", store.watcherState.diskUsageDisableThreshold)
+			if th.diskUsageDisableThreshold > 0 && (diskUsage >= th.diskUsageDisableThreshold || diskUsageTOC >= th.diskUsageDisableThreshold) {
+				msg = fmt.Sprintf("passed the disk usage threshold %f for automatic disabling", th.diskUsageDisableThreshold)
 				state = DISK_USAGE
 			}
-			if store.watcherState.memFreeDisableThreshold > 1 && m != nil && m.ActualFree <= store.watcherState.memFreeDisableThreshold {
-				msg = fmt.Sprintf("passed the mem free threshold %d for automatic disabling", store.watcherState.memFreeDisableThreshold)
+			if th.memFreeDisableThreshold > 1 && m != nil && m.ActualFree <= th.memFreeDisableThreshold {
+				msg = fmt.Sprintf("passed the mem free threshold %d for automatic disabling", th.memFreeDisableThreshold)
 				state = MEM_FREE
 			}
-			if store.watcherState.memUsageDisableThreshold > 0 && m != nil && memUsage >= store.watcherState.memUsageDisableThreshold {
-				msg = fmt.Sprintf("passed the mem usage threshold %f for automatic disabling", store.watcherState.memUsageDisableThreshold)
+			if th.memUsageDisableThreshold > 0 && m != nil && memUsage >= th.memUsageDisableThreshold {
+				msg = fmt.Sprintf("passed the mem usage threshold %f for automatic disabling", th.memUsageDisableThreshold)
 				state = MEM_USAGE
 			}
 			if state != CLEAR {
 				store.logger.Error(msg, zap.String("name", store.loggerPrefix+"watcher"))
 				store.disableWrites(false) // false indicates non-user call
+				store.event(Event{Kind: EventWritesDisabled, Message: msg})
 			}
 		} else {
 			var msg string
 			switch state {
 			case DISK_FREE:
-				if store.watcherState.diskFreeReenableThreshold > 1 && diskFree >= store.watcherState.diskFreeReenableThreshold && diskFreeTOC >= store.watcherState.diskFreeReenableThreshold {
-					msg = fmt.Sprintf("passed the disk free threshold %d for automatic re-enabling", store.watcherState.diskFreeReenableThreshold)
+				if th.diskFreeReenableThreshold > 1 && diskFree >= th.diskFreeReenableThreshold && diskFreeTOC >= th.diskFreeReenableThreshold {
+					msg = fmt.Sprintf("passed the disk free threshold %d for automatic re-enabling", th.diskFreeReenableThreshold)
 					state = CLEAR
 				}
 			case DISK_USAGE:
-				if store.watcherState.diskUsageReenableThreshold > 0 && diskUsage <= store.watcherState.diskUsageReenableThreshold && diskUsageTOC <= store.watcherState.diskUsageReenableThreshold {
-					msg = fmt.Sprintf("passed the disk usage threshold %f for automatic re-enabling", store.watcherState.diskUsageReenableThreshold)
+				if th.diskUsageReenableThreshold > 0 && diskUsage <= th.diskUsageReenableThreshold && diskUsageTOC <= th.diskUsageReenableThreshold {
+					msg = fmt.Sprintf("passed the disk usage threshold %f for automatic re-enabling", th.diskUsageReenableThreshold)
 					state = CLEAR
 				}
 			case MEM_FREE:
-				if store.watcherState.memFreeReenableThreshold > 1 && m != nil && m.ActualFree >= store.watcherState.memFreeReenableThreshold {
-					msg = fmt.Sprintf("passed the mem free threshold %d for automatic re-enabling", store.watcherState.memFreeReenableThreshold)
+				if th.memFreeReenableThreshold > 1 && m != nil && m.ActualFree >= th.memFreeReenableThreshold {
+					msg = fmt.Sprintf("passed the mem free threshold %d for automatic re-enabling", th.memFreeReenableThreshold)
 					state = CLEAR
 				}
 			case MEM_USAGE:
-				if store.watcherState.memUsageReenableThreshold > 0 && m != nil && memUsage <= store.watcherState.memUsageReenableThreshold {
-					msg = fmt.Sprintf("passed the mem usage threshold %f for automatic re-enabling", store.watcherState.memUsageReenableThreshold)
+				if th.memUsageReenableThreshold > 0 && m != nil && memUsage <= th.memUsageReenableThreshold {
+					msg = fmt.Sprintf("passed the mem usage threshold %f for automatic re-enabling", th.memUsageReenableThreshold)
 					state = CLEAR
 				}
 			default:
@@ -193,7 +211,9 @@ func (store *defaultGroupStore) watcherLauncher(notifyChan chan *bgNotification)
 			if state == CLEAR {
 				store.logger.Error(msg, zap.String("name", store.loggerPrefix+"watcher"))
 				store.enableWrites(false)
+				store.event(Event{Kind: EventWritesEnabled, Message: msg})
 			}
 		}
+		store.watcherState.task.end()
 	}
 }
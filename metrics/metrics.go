@@ -0,0 +1,137 @@
+// Package metrics exports the statistics of a store.ValueStore or
+// store.GroupStore to Prometheus and expvar.
+//
+// The statistics come from Store.StatsMetrics, whose counters are running
+// totals that never reset, so any number of scrapers can read them without
+// stealing each other's numbers or disturbing what Store.Stats returns.
+//
+// Prometheus metric names are the snake_case statistic field names, such as
+// disk_free for DiskFree, with counters suffixed _total and latency
+// histograms suffixed _seconds; for example:
+//
+//	prometheus.MustRegister(metrics.NewCollector(vs, "valuestore"))
+//
+// The expvar view publishes the field names as they are, with each latency
+// histogram given as its count, sum and common quantiles in seconds:
+//
+//	expvar.Publish("valuestore", metrics.Expvar(vs))
+package metrics
+
+import (
+	"expvar"
+	"sync"
+	"unicode"
+
+	"github.com/gholt/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+// Collector is a prometheus.Collector for a Store's statistics.
+type Collector struct {
+	store     store.Store
+	namespace string
+	lock      sync.Mutex
+	descs     map[string]*prometheus.Desc
+}
+
+// NewCollector returns a Collector for the Store's statistics, with metric
+// names prefixed by the namespace, if not empty.
+func NewCollector(s store.Store, namespace string) *Collector {
+	return &Collector{
+		store:     s,
+		namespace: namespace,
+		descs:     make(map[string]*prometheus.Desc),
+	}
+}
+
+// Describe implements prometheus.Collector; the metrics depend on the type of
+// Store, so they are described by collecting them.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	metrics, err := c.store.StatsMetrics(context.Background())
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(prometheus.NewInvalidDesc(err), err)
+		return
+	}
+	for _, m := range metrics {
+		if h := m.Histogram; h != nil {
+			buckets := make(map[float64]uint64, len(h.UpperBounds))
+			for i, b := range h.UpperBounds {
+				buckets[b.Seconds()] = h.Counts[i]
+			}
+			ch <- prometheus.MustNewConstHistogram(c.desc(m), h.Count, h.Sum.Seconds(), buckets)
+			continue
+		}
+		valueType := prometheus.CounterValue
+		if m.Gauge {
+			valueType = prometheus.GaugeValue
+		}
+		ch <- prometheus.MustNewConstMetric(c.desc(m), valueType, m.Value)
+	}
+}
+
+func (c *Collector) desc(m store.StatsMetric) *prometheus.Desc {
+	c.lock.Lock()
+	d := c.descs[m.Name]
+	if d == nil {
+		name := snakeCase(m.Name)
+		if m.Histogram != nil {
+			name += "_seconds"
+		} else if !m.Gauge {
+			name += "_total"
+		}
+		d = prometheus.NewDesc(prometheus.BuildFQName(c.namespace, "", name), m.Name+" from the store statistics.", nil, nil)
+		c.descs[m.Name] = d
+	}
+	c.lock.Unlock()
+	return d
+}
+
+// Expvar returns an expvar.Func giving the Store's statistics as a map of
+// field name to value, for use with expvar.Publish. If the statistics can't
+// be read, the map just has an "error" entry.
+func Expvar(s store.Store) expvar.Func {
+	return func() interface{} {
+		metrics, err := s.StatsMetrics(context.Background())
+		if err != nil {
+			return map[string]string{"error": err.Error()}
+		}
+		values := make(map[string]interface{}, len(metrics))
+		for _, m := range metrics {
+			if h := m.Histogram; h != nil {
+				values[m.Name] = map[string]float64{
+					"Count": float64(h.Count),
+					"Sum":   h.Sum.Seconds(),
+					"P50":   h.Quantile(0.5).Seconds(),
+					"P90":   h.Quantile(0.9).Seconds(),
+					"P99":   h.Quantile(0.99).Seconds(),
+				}
+				continue
+			}
+			values[m.Name] = m.Value
+		}
+		return values
+	}
+}
+
+// snakeCase converts a field name such as OutPullReplicationBloomFPRate to
+// out_pull_replication_bloom_fp_rate.
+func snakeCase(name string) string {
+	rs := []rune(name)
+	var out []rune
+	for i, r := range rs {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := rs[i-1]
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && i+1 < len(rs) && unicode.IsLower(rs[i+1])) {
+				out = append(out, '_')
+			}
+		}
+		out = append(out, unicode.ToLower(r))
+	}
+	return string(out)
+}
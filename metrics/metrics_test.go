@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gholt/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+type testStore struct {
+	store.Store
+	metrics []store.StatsMetric
+	err     error
+}
+
+func (s *testStore) StatsMetrics(ctx context.Context) ([]store.StatsMetric, error) {
+	return s.metrics, s.err
+}
+
+func TestSnakeCase(t *testing.T) {
+	for in, out := range map[string]string{
+		"Values":                        "values",
+		"DiskFreeTOC":                   "disk_free_toc",
+		"OutPullReplicationBloomFPRate": "out_pull_replication_bloom_fp_rate",
+		"InBulkSetWrites":               "in_bulk_set_writes",
+	} {
+		if s := snakeCase(in); s != out {
+			t.Errorf("%s: %s != %s", in, s, out)
+		}
+	}
+}
+
+func TestCollector(t *testing.T) {
+	s := &testStore{metrics: []store.StatsMetric{
+		{Name: "Writes", Value: 12},
+		{Name: "DiskFree", Gauge: true, Value: 34},
+		{Name: "ReadLatency", Value: 1, Histogram: &store.LatencyHistogram{
+			UpperBounds: []time.Duration{time.Microsecond, 2 * time.Microsecond},
+			Counts:      []uint64{0, 1},
+			Count:       1,
+			Sum:         2 * time.Microsecond,
+		}},
+	}}
+	c := NewCollector(s, "valuestore")
+	ch := make(chan prometheus.Metric, 10)
+	c.Collect(ch)
+	close(ch)
+	var descs []string
+	for m := range ch {
+		descs = append(descs, m.Desc().String())
+	}
+	if len(descs) != 3 || !strings.Contains(descs[0], `"valuestore_writes_total"`) || !strings.Contains(descs[1], `"valuestore_disk_free"`) || !strings.Contains(descs[2], `"valuestore_read_latency_seconds"`) {
+		t.Fatal(descs)
+	}
+	// The descriptions are reused across collections.
+	if c.desc(s.metrics[0]) != c.desc(s.metrics[0]) {
+		t.Fatal("desc not reused")
+	}
+}
+
+func TestExpvar(t *testing.T) {
+	s := &testStore{metrics: []store.StatsMetric{
+		{Name: "Writes", Value: 12},
+		{Name: "DiskFree", Gauge: true, Value: 34},
+	}}
+	f := Expvar(s)
+	if str := f.String(); str != `{"DiskFree":34,"Writes":12}` {
+		t.Fatal(str)
+	}
+	s.metrics = append(s.metrics, store.StatsMetric{Name: "ReadLatency", Value: 1, Histogram: &store.LatencyHistogram{
+		UpperBounds: []time.Duration{time.Second, 2 * time.Second},
+		Counts:      []uint64{1, 1},
+		Count:       1,
+		Sum:         time.Second,
+	}})
+	if str := f.String(); !strings.Contains(str, `"ReadLatency":{"Count":1,"P50":0.5,"P90":0.9,"P99":0.99,"Sum":1}`) {
+		t.Fatal(str)
+	}
+	s.err = errors.New("test error")
+	if str := f.String(); str != `{"error":"test error"}` {
+		t.Fatal(str)
+	}
+}
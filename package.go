@@ -45,6 +45,10 @@
 // that a very small percentage of items may be missed each pass. A moving salt
 // is used with each bloom filter so that after a few passes there is an
 // exceptionally high probability that all items will be accounted for.
+// Alternatively, with Config.MerkleReplication, hash trees are maintained as
+// items change and replicas compare those instead, exchanging only the
+// subtrees that differ and then just the items in the differing leaves; this
+// is usually much less traffic when replicas are mostly in sync.
 //
 // * PushReplication: This will continually send out any data for any
 // partitions the ValueStore is *not* responsible for, as determined by the
@@ -63,6 +67,40 @@
 // shutdown and restarted; this restart will result in the affected keys being
 // missing and therefore replicated in by other stores.
 //
+// Replication traffic can be limited with token buckets of bytes and messages
+// per second for outgoing pull replication messages, outgoing bulk-set
+// messages (pull replication responses and push replication) and incoming
+// bulk-set processing; see Config.OutPullReplicationBytesPerSecond and
+// related settings, which can also be changed while running with
+// SetReplicationRateLimits.
+//
+// Replication messages can be authenticated with an HMAC keyed by a shared
+// cluster secret; see Config.MsgSecrets and Config.MsgRequireAuth. Nodes
+// negotiate whether to use authenticated messages with each other so that
+// mixed-version clusters keep working during upgrades.
+//
+// When the ring changes, out of place data is streamed to its new owners by
+// a dedicated handoff task rather than waiting on push replication; see
+// Store.HandoffStatus for its progress.
+//
+// Writes for a replica known to be down can be kept as hints with WriteHint
+// and DeleteHint, which are sent to the node once it is reachable again; see
+// Config.HintedHandoffInterval and NodeReachability.
+//
+// How far each partition is from the other replicas is tracked from the
+// pull replication responses received and the push replication items still
+// unacknowledged; see Store.ReplicationStatus and Store.DivergedPartitions.
+//
+// Outcomes of background work, such as compactions, audit failures and
+// restart requests, can be received as Events with Config.EventHandler.
+//
+// Store calls and background work can be traced by setting Config.Tracer;
+// see Tracer.
+//
+// Bulk-set and pull replication messages can also be compressed with flate;
+// see Config.MsgCompression. As with authentication, compressed messages are
+// only sent to nodes that have said they accept them.
+//
 // Note that if the disk gets filled past a configurable threshold, any
 // external writes other than deletes will result in error. Internal writes
 // such as compaction and removing successfully push-replicated data will
@@ -104,6 +142,36 @@ package store
 //go:generate got ktbloomfilter.got groupktbloomfilter_GEN_.go TT=GROUP T=Group t=group
 //go:generate got ktbloomfilter_test.got valuektbloomfilter_GEN_test.go TT=VALUE T=Value t=value
 //go:generate got ktbloomfilter_test.got groupktbloomfilter_GEN_test.go TT=GROUP T=Group t=group
+//go:generate got merkle.got valuemerkle_GEN_.go TT=VALUE T=Value t=value
+//go:generate got merkle.got groupmerkle_GEN_.go TT=GROUP T=Group t=group
+//go:generate got merkle_test.got valuemerkle_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got merkle_test.got groupmerkle_GEN_test.go TT=GROUP T=Group t=group
+//go:generate got msgauth.got valuemsgauth_GEN_.go TT=VALUE T=Value t=value
+//go:generate got msgauth.got groupmsgauth_GEN_.go TT=GROUP T=Group t=group
+//go:generate got msgauth_test.got valuemsgauth_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got msgauth_test.got groupmsgauth_GEN_test.go TT=GROUP T=Group t=group
+//go:generate got msgprotocol.got valuemsgprotocol_GEN_.go TT=VALUE T=Value t=value
+//go:generate got msgprotocol.got groupmsgprotocol_GEN_.go TT=GROUP T=Group t=group
+//go:generate got msgcompress.got valuemsgcompress_GEN_.go TT=VALUE T=Value t=value
+//go:generate got msgcompress.got groupmsgcompress_GEN_.go TT=GROUP T=Group t=group
+//go:generate got msgcompress_test.got valuemsgcompress_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got msgcompress_test.got groupmsgcompress_GEN_test.go TT=GROUP T=Group t=group
+//go:generate got handoff.got valuehandoff_GEN_.go TT=VALUE T=Value t=value
+//go:generate got handoff.got grouphandoff_GEN_.go TT=GROUP T=Group t=group
+//go:generate got handoff_test.got valuehandoff_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got handoff_test.got grouphandoff_GEN_test.go TT=GROUP T=Group t=group
+//go:generate got replicate.got valuereplicate_GEN_.go TT=VALUE T=Value t=value
+//go:generate got replicate.got groupreplicate_GEN_.go TT=GROUP T=Group t=group
+//go:generate got replicate_test.got valuereplicate_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got replicate_test.got groupreplicate_GEN_test.go TT=GROUP T=Group t=group
+//go:generate got replicationstatus.got valuereplicationstatus_GEN_.go TT=VALUE T=Value t=value
+//go:generate got replicationstatus.got groupreplicationstatus_GEN_.go TT=GROUP T=Group t=group
+//go:generate got replicationstatus_test.got valuereplicationstatus_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got replicationstatus_test.got groupreplicationstatus_GEN_test.go TT=GROUP T=Group t=group
+//go:generate got hintedhandoff.got valuehintedhandoff_GEN_.go TT=VALUE T=Value t=value
+//go:generate got hintedhandoff.got grouphintedhandoff_GEN_.go TT=GROUP T=Group t=group
+//go:generate got hintedhandoff_test.got valuehintedhandoff_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got hintedhandoff_test.got grouphintedhandoff_GEN_test.go TT=GROUP T=Group t=group
 //go:generate got pushreplication.got valuepushreplication_GEN_.go TT=VALUE T=Value t=value
 //go:generate got pushreplication.got grouppushreplication_GEN_.go TT=GROUP T=Group t=group
 //go:generate got tombstonediscard.got valuetombstonediscard_GEN_.go TT=VALUE T=Value t=value
@@ -116,14 +184,37 @@ package store
 //go:generate got watcher.got groupwatcher_GEN_.go TT=GROUP T=Group t=group
 //go:generate got flusher.got valueflusher_GEN_.go TT=VALUE T=Value t=value
 //go:generate got flusher.got groupflusher_GEN_.go TT=GROUP T=Group t=group
+//go:generate got backgroundstatus.got valuebackgroundstatus_GEN_.go TT=VALUE T=Value t=value
+//go:generate got backgroundstatus.got groupbackgroundstatus_GEN_.go TT=GROUP T=Group t=group
+//go:generate got backgroundstatus_test.got valuebackgroundstatus_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got backgroundstatus_test.got groupbackgroundstatus_GEN_test.go TT=GROUP T=Group t=group
+//go:generate got reconfigure.got valuereconfigure_GEN_.go TT=VALUE T=Value t=value
+//go:generate got reconfigure.got groupreconfigure_GEN_.go TT=GROUP T=Group t=group
+//go:generate got reconfigure_test.got valuereconfigure_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got reconfigure_test.got groupreconfigure_GEN_test.go TT=GROUP T=Group t=group
+//go:generate got compactionmerge.got valuecompactionmerge_GEN_.go TT=VALUE T=Value t=value
+//go:generate got compactionmerge.got groupcompactionmerge_GEN_.go TT=GROUP T=Group t=group
+//go:generate got compactionmerge_test.got valuecompactionmerge_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got compactionmerge_test.got groupcompactionmerge_GEN_test.go TT=GROUP T=Group t=group
+//go:generate got inspect.got valueinspect_GEN_.go TT=VALUE T=Value t=value
+//go:generate got inspect.got groupinspect_GEN_.go TT=GROUP T=Group t=group
+//go:generate got inspect_test.got valueinspect_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got inspect_test.got groupinspect_GEN_test.go TT=GROUP T=Group t=group
 //go:generate got stats.got valuestats_GEN_.go TT=VALUE T=Value t=value
 //go:generate got stats.got groupstats_GEN_.go TT=GROUP T=Group t=group
+//go:generate got stats_test.got valuestats_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got stats_test.got groupstats_GEN_test.go TT=GROUP T=Group t=group
 
 import (
 	"fmt"
 	"io"
 	"math"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -206,6 +297,69 @@ func (e _errDisabled) ErrDisabled() string { return "disabled" }
 
 var toss []byte = make([]byte, 65536)
 
+// tossRead reads and discards l bytes from r, returning the number of bytes
+// read and any error.
+func tossRead(r io.Reader, l uint64) (uint64, error) {
+	left := l
+	for left > 0 {
+		t := toss
+		if left < uint64(len(t)) {
+			t = t[:left]
+		}
+		n, err := r.Read(t)
+		left -= uint64(n)
+		if err != nil {
+			return l - left, err
+		}
+	}
+	return l, nil
+}
+
+// readFull reads len(b) bytes from r, much like io.ReadFull but returning the
+// reader's error as is rather than io.ErrUnexpectedEOF.
+func readFull(r io.Reader, b []byte) (int, error) {
+	var n int
+	for n != len(b) {
+		sn, err := r.Read(b[n:])
+		n += sn
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// dataBeforeEOFReader holds back an io.EOF returned along with data until
+// the next Read, for the message readers that treat any error as a failed
+// read.
+type dataBeforeEOFReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *dataBeforeEOFReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.r.Read(p)
+	if n > 0 && err == io.EOF {
+		r.err = err
+		err = nil
+	}
+	return n, err
+}
+
+// copyMsgSecrets returns a copy of the secrets, ignoring any empty ones.
+func copyMsgSecrets(secrets [][]byte) [][]byte {
+	var c [][]byte
+	for _, secret := range secrets {
+		if len(secret) > 0 {
+			c = append(c, append([]byte(nil), secret...))
+		}
+	}
+	return c
+}
+
 func osOpenReadSeeker(fullPath string) (io.ReadSeeker, error) {
 	return os.Open(fullPath)
 }
@@ -238,6 +392,10 @@ const (
 type bgNotification struct {
 	action   bgNotificationAction
 	doneChan chan struct{}
+	// options and result are set for a _BG_PASS from one of the manual pass
+	// calls, such as CompactionPass; the pass fills in the result.
+	options interface{}
+	result  interface{}
 }
 
 // Store is an interface shared by ValueStore and GroupStore containing basic
@@ -268,6 +426,22 @@ type Store interface {
 	// be stopped and restarted so that a call to this function ensures one
 	// complete pass occurs.
 	AuditPass(ctx context.Context) error
+	// AuditReport returns the latest audit outcomes, up to
+	// Config.AuditHistorySize of them with failures kept over passes, kept
+	// across restarts.
+	AuditReport(ctx context.Context) (*AuditReport, error)
+	// CompactionPass runs a compaction pass now, rather than waiting for the
+	// next interval, stopping and restarting any pass already executing. It
+	// blocks until the pass is done or the ctx is; a pass left when the ctx
+	// is done carries on as though it had been scheduled. The opts may be
+	// nil.
+	CompactionPass(ctx context.Context, opts *CompactionPassOptions) (*CompactionResult, error)
+	// TombstoneDiscardPass is CompactionPass for discarding expired
+	// tombstones [deletion markers].
+	TombstoneDiscardPass(ctx context.Context) (*TombstoneDiscardResult, error)
+	// PushReplicationPass is CompactionPass for push replication, sending
+	// data the local node is not responsible for to the nodes that are.
+	PushReplicationPass(ctx context.Context) (*PushReplicationResult, error)
 	// Stats returns overall information about the state of the Store. Note
 	// that this can be an expensive call; debug = true will make it even more
 	// expensive.
@@ -286,8 +460,285 @@ type Store interface {
 	// because they are subject to change. They are only emitted when the
 	// stats.String() is called.
 	Stats(ctx context.Context, debug bool) (fmt.Stringer, error)
+	// StatsMetrics returns the same statistics as Stats, other than the debug
+	// ones, but with the counters as running totals that never reset, for
+	// metrics systems that expect monotonically increasing counters. Calling
+	// it does not affect what Stats returns, nor the other way around.
+	StatsMetrics(ctx context.Context) ([]StatsMetric, error)
 	// ValueCap returns the maximum length of a value the Store can accept.
 	ValueCap(ctx context.Context) (uint32, error)
+	// SetReplicationRateLimits changes the limits on replication traffic
+	// while the Store is running; the new limits take effect immediately.
+	SetReplicationRateLimits(ctx context.Context, limits *ReplicationRateLimits) error
+	// SetMsgSecrets replaces the cluster secrets used to authenticate
+	// replication messages; see Config.MsgSecrets.
+	SetMsgSecrets(ctx context.Context, secrets [][]byte) error
+	// HandoffStatus returns the progress of handing off data the local node
+	// is no longer responsible for after the latest ring change.
+	HandoffStatus(ctx context.Context) (*HandoffStatus, error)
+	// ReplicatePartition is ReplicateRange for the whole of a ring
+	// partition.
+	ReplicatePartition(ctx context.Context, partition uint32) (*ReplicateResult, error)
+	// ReplicateRange runs pull and push replication for just the keys with
+	// startKeyA <= keyA <= stopKeyA, blocking until the responses have been
+	// applied or the ctx is done.
+	ReplicateRange(ctx context.Context, startKeyA uint64, stopKeyA uint64) (*ReplicateResult, error)
+	// ReplicationStatus returns the replication status of each partition
+	// replication has touched, in partition order.
+	ReplicationStatus(ctx context.Context) ([]ReplicationPartitionStatus, error)
+	// DivergedPartitions returns the replication status of up to max
+	// partitions that have diverged from the other replicas, most recently
+	// diverged first; max <= 0 returns them all.
+	DivergedPartitions(ctx context.Context, max int) ([]ReplicationPartitionStatus, error)
+	// BackgroundStatus returns what each of the background tasks is doing,
+	// such as whether compaction is mid-pass and on which file, and when the
+	// next pull replication pass is scheduled.
+	BackgroundStatus(ctx context.Context) ([]BackgroundTaskStatus, error)
+}
+
+// CompactionPassOptions changes which files a Store.CompactionPass compacts.
+type CompactionPassOptions struct {
+	// Threshold, if above zero, is used instead of Config.CompactionThreshold
+	// for how much waste a file may have before it is compacted.
+	Threshold float64
+	// IgnoreAgeThreshold includes files younger than
+	// Config.CompactionAgeThreshold; the files still being written to are
+	// always skipped.
+	IgnoreAgeThreshold bool
+}
+
+// CompactionResult reports what a Store.CompactionPass did.
+type CompactionResult struct {
+	// FilesExamined is the number of files checked for how much waste they
+	// have.
+	FilesExamined int64
+	// FilesCompacted is the number of files compacted and removed.
+	FilesCompacted int64
+	// ItemsRewritten is the number of items still in use that were copied
+	// from the compacted files to the current ones.
+	ItemsRewritten int64
+	// BytesReclaimed is the size of the files removed less the length of the
+	// values rewritten from them.
+	BytesReclaimed int64
+}
+
+// TombstoneDiscardResult reports what a Store.TombstoneDiscardPass did.
+type TombstoneDiscardResult struct {
+	// TombstonesDiscarded is the number of tombstones [deletion markers]
+	// found older than Config.TombstoneAge and marked to be discarded. They
+	// are removed from memory at the start of the next pass and from disk as
+	// their files are compacted.
+	TombstonesDiscarded int64
+}
+
+// PushReplicationResult reports what a Store.PushReplicationPass did.
+type PushReplicationResult struct {
+	// MsgsSent is the number of bulk-set messages sent to other nodes.
+	MsgsSent int64
+	// ItemsSent is the number of items in those messages.
+	ItemsSent int64
+	// BytesSent is the total length of those messages.
+	BytesSent int64
+}
+
+// ReplicateResult reports what an on demand replication with
+// Store.ReplicateRange or Store.ReplicatePartition did.
+type ReplicateResult struct {
+	// Partitions is the number of ring partitions the range covered.
+	Partitions int
+	// ItemsReceived is the number of items received from other replicas in
+	// response to the pull replication requests.
+	ItemsReceived int64
+	// ItemsApplied is the number of ItemsReceived that were newer than what
+	// the local node had.
+	ItemsApplied int64
+	// ItemsSent is the number of items pushed to other replicas.
+	ItemsSent int64
+}
+
+// ReplicationPartitionStatus is how far a partition's local copy is from the
+// other replicas', as returned by Store.ReplicationStatus and
+// Store.DivergedPartitions. Pull replication responses arrive after their
+// requests, so the counts for the latest pass may still be growing; the
+// previous pass's counts are kept for that reason.
+type ReplicationPartitionStatus struct {
+	Partition uint32
+	// LastPullReplication is when a pull replication pass last completed
+	// the partition without being interrupted, such as by a shutdown or ring
+	// change; zero if never.
+	LastPullReplication time.Time
+	// PullReceived is the number of items received in pull replication
+	// responses since the latest pass started on the partition; a partition
+	// whose replicas agree receives none.
+	PullReceived int64
+	// PullApplied is the number of PullReceived that were newer than the
+	// local copy.
+	PullApplied int64
+	// PreviousPullReceived is PullReceived for the pass before.
+	PreviousPullReceived int64
+	// PreviousPullApplied is PullApplied for the pass before.
+	PreviousPullApplied int64
+	// LastDivergence is when an item newer than the local copy was last
+	// received by pull replication; zero if never.
+	LastDivergence time.Time
+	// LastPushReplication is when push replication last ran for the
+	// partition; only partitions the local node is not responsible for are
+	// pushed.
+	LastPushReplication time.Time
+	// PushOutstanding is the number of items the latest push replication
+	// pass sent for the partition that the other replicas have yet to
+	// acknowledge. Each pass sends at most one bulk-set message's worth per
+	// worker, again including any items still unacknowledged.
+	PushOutstanding int64
+}
+
+// HandoffStatus is the progress of handing off out of place data to its new
+// owners after a ring change, as returned by Store.HandoffStatus. The
+// remaining counts are as of the start of the latest handoff pass; they drop
+// as the new owners acknowledge what was sent.
+type HandoffStatus struct {
+	// RingVersion is the ring version the handoff is for.
+	RingVersion int64
+	// Active is true until a handoff pass finds nothing left to hand off.
+	Active bool
+	// Begin is when the ring change was noticed and the handoff started.
+	Begin time.Time
+	// End is when the handoff completed; it is zero while Active.
+	End time.Time
+	// RemainingKeys is the total of Partitions' RemainingKeys.
+	RemainingKeys int64
+	// RemainingBytes is the total of Partitions' RemainingBytes.
+	RemainingBytes int64
+	// SentKeys is the total of Partitions' SentKeys.
+	SentKeys int64
+	// SentBytes is the total of Partitions' SentBytes.
+	SentBytes int64
+	// Partitions are the partitions that have had data to hand off, in
+	// partition order.
+	Partitions []HandoffPartitionStatus
+}
+
+// HandoffPartitionStatus is the handoff progress of a single partition.
+type HandoffPartitionStatus struct {
+	Partition uint32
+	// RemainingKeys is the number of keys still to be handed off, counted at
+	// the start of each pass and lowered as keys are sent; keys sent but not
+	// yet acknowledged are counted again by the next pass.
+	RemainingKeys int64
+	// RemainingBytes is the number of value bytes still to be handed off,
+	// kept like RemainingKeys.
+	RemainingBytes int64
+	// SentKeys is the number of keys sent, including resends of keys not
+	// yet acknowledged.
+	SentKeys int64
+	// SentBytes is the number of value bytes sent, including resends.
+	SentBytes int64
+}
+
+// AuditReport is the audit history returned by Store.AuditReport.
+type AuditReport struct {
+	// Records are the outcomes of the latest audits, one per file audited,
+	// oldest first.
+	Records []AuditRecord
+	// FilesFailed is the number of Records with an Action other than
+	// AuditActionNone.
+	FilesFailed int
+}
+
+// AuditRecord is the outcome of auditing a single file.
+type AuditRecord struct {
+	// Time is when the audit of the file finished.
+	Time time.Time
+	// File is the name of the toc file audited.
+	File string
+	// BytesVerified is how much of the data file was checked against its
+	// checksums, not counting the checksums themselves.
+	BytesVerified int64
+	// CorruptRanges are the areas of the data file that failed their
+	// checksums, as offsets not counting the checksums; a data file that
+	// could not be read at all is a single range covering everything.
+	CorruptRanges []AuditRange
+	// AffectedKeys is the number of items with values in the CorruptRanges
+	// or, with Config.AuditDeep, with InvalidEntries.
+	AffectedKeys int64
+	// InvalidEntries is the number of toc entries a deep audit found
+	// pointing outside the data file's values, at bytes another entry points
+	// at or, for v1 files, at a value not matching the entry's checksum.
+	InvalidEntries int64
+	// Action is what the audit did about the file.
+	Action AuditAction
+}
+
+// AuditRange is a range of bytes, Start through Stop inclusive.
+type AuditRange struct {
+	Start uint32
+	Stop  uint32
+}
+
+// TOCRepairResult is what RepairValueTOCFile or RepairGroupTOCFile did.
+type TOCRepairResult struct {
+	// Kept is the number of entries written to the new toc file.
+	Kept int
+	// Dropped is the number of entries read but left out as invalid.
+	Dropped int
+	// Lost is the number of entries that couldn't be read at all, going by
+	// the size of the old toc file, such as those in blocks failing their
+	// checksums.
+	Lost int
+	// ReadErrors are the errors encountered reading the old toc file.
+	ReadErrors []error
+}
+
+// AuditAction is what an audit did about a file, as in an AuditRecord.
+type AuditAction int
+
+const (
+	// AuditActionNone is a file that passed its audit.
+	AuditActionNone AuditAction = iota
+	// AuditActionRepaired is a file with corrupted values; the items still
+	// using them were removed, leaving replication to restore them, and the
+	// rest were compacted into the current files.
+	AuditActionRepaired
+	// AuditActionRestart is a file whose toc was unreadable; it was
+	// compacted as well as it could be and a restart requested.
+	AuditActionRestart
+)
+
+func (a AuditAction) String() string {
+	switch a {
+	case AuditActionNone:
+		return "None"
+	case AuditActionRepaired:
+		return "Repaired"
+	case AuditActionRestart:
+		return "Restart"
+	}
+	return fmt.Sprintf("AuditAction(%d)", int(a))
+}
+
+// ReplicationRateLimits are the token bucket limits for replication traffic
+// used with Store.SetReplicationRateLimits. Each limit is per second with
+// bursts of up to one second's worth allowed; zero or less means unlimited.
+type ReplicationRateLimits struct {
+	// OutPullReplicationBytesPerSecond limits the bytes of outgoing
+	// pull-replication messages.
+	OutPullReplicationBytesPerSecond int64
+	// OutPullReplicationMsgsPerSecond limits the number of outgoing
+	// pull-replication messages.
+	OutPullReplicationMsgsPerSecond int64
+	// OutBulkSetBytesPerSecond limits the bytes of outgoing bulk-set
+	// messages, both those in response to pull replication and those from
+	// push replication.
+	OutBulkSetBytesPerSecond int64
+	// OutBulkSetMsgsPerSecond limits the number of outgoing bulk-set
+	// messages.
+	OutBulkSetMsgsPerSecond int64
+	// InBulkSetBytesPerSecond limits the bytes of incoming bulk-set messages
+	// processed.
+	InBulkSetBytesPerSecond int64
+	// InBulkSetMsgsPerSecond limits the number of incoming bulk-set messages
+	// processed.
+	InBulkSetMsgsPerSecond int64
 }
 
 // ValueStore is an interface for a disk-backed data structure that stores
@@ -322,6 +773,18 @@ type ValueStore interface {
 	// already in place is not reported as an error. Note that with a Write and
 	// a Delete for the exact same timestampmicro, the Delete wins.
 	Delete(ctx context.Context, keyA uint64, keyB uint64, timestampmicro int64) (int64, error)
+	// WriteHint is Write for a write whose replica nodeID is known to be
+	// down; the write is stored locally and also kept as a hint to be sent to
+	// the node once it is reachable again.
+	WriteHint(ctx context.Context, nodeID uint64, keyA uint64, keyB uint64, timestampmicro int64, value []byte) (int64, error)
+	// DeleteHint is Delete for a delete whose replica nodeID is known to be
+	// down; see WriteHint.
+	DeleteHint(ctx context.Context, nodeID uint64, keyA uint64, keyB uint64, timestampmicro int64) (int64, error)
+	// Reconfigure applies the settings from cfg that can be changed while
+	// the store is running, restarting just the background tasks they
+	// affect. Any other changed settings are left as they were and listed in
+	// the returned error; those require a new store.
+	Reconfigure(ctx context.Context, cfg *ValueStoreConfig) error
 }
 
 // LookupGroupItem is returned by the GroupStore.LookupGroup call.
@@ -385,6 +848,759 @@ type GroupStore interface {
 	// error. Note that with a Write and a Delete for the exact same
 	// timestampmicro, the Delete wins.
 	Delete(ctx context.Context, parentKeyA, parentKeyB, childKeyA, childKeyB uint64, timestampmicro int64) (oldtimestampmicro int64, err error)
+	// WriteHint is Write for a write whose replica nodeID is known to be
+	// down; the write is stored locally and also kept as a hint to be sent to
+	// the node once it is reachable again.
+	WriteHint(ctx context.Context, nodeID uint64, parentKeyA, parentKeyB, childKeyA, childKeyB uint64, timestampmicro int64, value []byte) (oldtimestampmicro int64, err error)
+	// DeleteHint is Delete for a delete whose replica nodeID is known to be
+	// down; see WriteHint.
+	DeleteHint(ctx context.Context, nodeID uint64, parentKeyA, parentKeyB, childKeyA, childKeyB uint64, timestampmicro int64) (oldtimestampmicro int64, err error)
+	// Reconfigure applies the settings from cfg that can be changed while
+	// the store is running, restarting just the background tasks they
+	// affect. Any other changed settings are left as they were and listed in
+	// the returned error; those require a new store.
+	Reconfigure(ctx context.Context, cfg *GroupStoreConfig) error
+}
+
+// NodeReachability can be implemented by a MsgRing that knows whether nodes
+// are reachable. Hinted handoff then only sends hints to reachable nodes,
+// draining a node's hints as soon as it is reported reachable again;
+// otherwise hints are sent each Config.HintedHandoffInterval until
+// acknowledged.
+type NodeReachability interface {
+	NodeReachable(nodeID uint64) bool
+}
+
+// BackgroundTaskState is the state of a background task.
+type BackgroundTaskState int
+
+const (
+	// BackgroundTaskStopped is a task that isn't running at all, such as
+	// before Startup or after Shutdown.
+	BackgroundTaskStopped BackgroundTaskState = iota
+	// BackgroundTaskIdle is a task waiting for its next run or for work.
+	BackgroundTaskIdle
+	// BackgroundTaskRunning is a task in the middle of a pass or, for
+	// workers, in the middle of handling a message.
+	BackgroundTaskRunning
+)
+
+func (s BackgroundTaskState) String() string {
+	switch s {
+	case BackgroundTaskStopped:
+		return "Stopped"
+	case BackgroundTaskIdle:
+		return "Idle"
+	case BackgroundTaskRunning:
+		return "Running"
+	}
+	return fmt.Sprintf("BackgroundTaskState(%d)", int(s))
+}
+
+// BackgroundTaskStatus is what a background task is doing, as returned by
+// Store.BackgroundStatus.
+type BackgroundTaskStatus struct {
+	// Name is the task, such as "Compaction" or "InBulkSet".
+	Name  string
+	State BackgroundTaskState
+	// CurrentItem is what a running task is working on, such as the file
+	// being compacted or audited; it is empty for tasks that don't work
+	// through items.
+	CurrentItem string
+	// Done and Total are a running task's progress through its items; Total
+	// may grow as work is found and is zero for tasks that don't track
+	// progress.
+	Done  int64
+	Total int64
+	// LastStart and LastEnd are when the last pass, or message for workers,
+	// started and ended.
+	LastStart time.Time
+	LastEnd   time.Time
+	// LastError is the last error the task encountered, at LastErrorTime.
+	LastError     error
+	LastErrorTime time.Time
+	// NextRun is when the task is next scheduled to run; it is zero for
+	// tasks that run on demand, such as the message workers.
+	NextRun time.Time
+}
+
+// backgroundTask tracks the BackgroundTaskStatus of a task; it is safe for
+// concurrent use, with begin and end able to overlap for tasks with several
+// workers.
+type backgroundTask struct {
+	lock     sync.Mutex
+	launched bool
+	running  int
+	status   BackgroundTaskStatus
+}
+
+// launch records the task's launcher has started, with the next run time if
+// it is scheduled.
+func (t *backgroundTask) launch(nextRun time.Time) {
+	t.lock.Lock()
+	t.launched = true
+	t.status.NextRun = nextRun
+	t.lock.Unlock()
+}
+
+// stop records the task's launcher has exited.
+func (t *backgroundTask) stop() {
+	t.lock.Lock()
+	t.launched = false
+	t.status.NextRun = time.Time{}
+	t.lock.Unlock()
+}
+
+func (t *backgroundTask) schedule(nextRun time.Time) {
+	t.lock.Lock()
+	t.status.NextRun = nextRun
+	t.lock.Unlock()
+}
+
+// begin records the start of a pass, or of a message for workers, clearing
+// the progress of any previous pass.
+func (t *backgroundTask) begin() {
+	t.lock.Lock()
+	if t.running == 0 {
+		t.status.CurrentItem = ""
+		t.status.Done = 0
+		t.status.Total = 0
+	}
+	t.running++
+	t.status.LastStart = time.Now()
+	t.lock.Unlock()
+}
+
+func (t *backgroundTask) end() {
+	t.lock.Lock()
+	if t.running > 0 {
+		t.running--
+	}
+	if t.running == 0 {
+		t.status.CurrentItem = ""
+	}
+	t.status.LastEnd = time.Now()
+	t.lock.Unlock()
+}
+
+// working records the item the task has moved on to.
+func (t *backgroundTask) working(item string) {
+	t.lock.Lock()
+	t.status.CurrentItem = item
+	t.lock.Unlock()
+}
+
+// progress adds to the items done and the total items.
+func (t *backgroundTask) progress(done int64, total int64) {
+	t.lock.Lock()
+	t.status.Done += done
+	t.status.Total += total
+	t.lock.Unlock()
+}
+
+func (t *backgroundTask) failed(err error) {
+	t.lock.Lock()
+	t.status.LastError = err
+	t.status.LastErrorTime = time.Now()
+	t.lock.Unlock()
+}
+
+func (t *backgroundTask) snapshot(name string) BackgroundTaskStatus {
+	t.lock.Lock()
+	status := t.status
+	switch {
+	case t.running > 0:
+		status.State = BackgroundTaskRunning
+	case t.launched:
+		status.State = BackgroundTaskIdle
+	default:
+		status.State = BackgroundTaskStopped
+	}
+	t.lock.Unlock()
+	status.Name = name
+	if status.State != BackgroundTaskRunning {
+		status.Done = 0
+		status.Total = 0
+	}
+	return status
+}
+
+// EventKind identifies what an Event reports.
+type EventKind int
+
+const (
+	// EventCompaction is a file compacted and removed; Count entries were
+	// examined, Changed were rewritten and Stale were already superseded.
+	EventCompaction EventKind = iota + 1
+	// EventCompactionError is a file that could not be compacted and will be
+	// tried again later.
+	EventCompactionError
+	// EventAuditPass is a completed audit pass over Count files.
+	EventAuditPass
+	// EventAuditFailure is a file that failed its audit; Count entries had
+	// corrupted values and Changed of those were removed, leaving replication
+	// to restore them. With Err set, the toc itself was unreadable and a
+	// restart will be requested.
+	EventAuditFailure
+	// EventRecovery is the completion of reading the toc files at Startup;
+	// Count entries were read and Changed altered the in-memory locations.
+	EventRecovery
+	// EventRecoveryFileError is a toc file with errors during recovery; it
+	// will be compacted once recovery is done.
+	EventRecoveryFileError
+	// EventWritesDisabled is the watcher disabling writes, with Message
+	// saying which threshold was passed.
+	EventWritesDisabled
+	// EventWritesEnabled is the watcher re-enabling writes it had disabled.
+	EventWritesEnabled
+	// EventFileWriterError is a failure to create a new values file; the
+	// Store shuts down and requests a restart.
+	EventFileWriterError
+	// EventTOCWriterError is a failure writing a toc file; the Store shuts
+	// down and requests a restart.
+	EventTOCWriterError
+	// EventRestartRequest is the Err being sent on the restart channel
+	// returned when the Store was created.
+	EventRestartRequest
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventCompaction:
+		return "Compaction"
+	case EventCompactionError:
+		return "CompactionError"
+	case EventAuditPass:
+		return "AuditPass"
+	case EventAuditFailure:
+		return "AuditFailure"
+	case EventRecovery:
+		return "Recovery"
+	case EventRecoveryFileError:
+		return "RecoveryFileError"
+	case EventWritesDisabled:
+		return "WritesDisabled"
+	case EventWritesEnabled:
+		return "WritesEnabled"
+	case EventFileWriterError:
+		return "FileWriterError"
+	case EventTOCWriterError:
+		return "TOCWriterError"
+	case EventRestartRequest:
+		return "RestartRequest"
+	}
+	return fmt.Sprintf("EventKind(%d)", int(k))
+}
+
+// Event is an outcome of the Store's background work, given to
+// Config.EventHandler, so that it can be acted upon without scraping logs.
+// Fields that don't apply to the Kind are left zero.
+type Event struct {
+	Kind EventKind
+	// Time is when the event occurred.
+	Time time.Time
+	// Begin is when the work being reported on began.
+	Begin time.Time
+	// File is the name of the file involved.
+	File    string
+	Count   int64
+	Changed int64
+	Stale   int64
+	Message string
+	Err     error
+}
+
+// Tracer creates spans for the Store's calls, such as Read and Write, with
+// child spans for the steps within them, and for background work such as
+// compacting a file, auditing a file, and sending and receiving replication
+// messages; see Config.Tracer. An OpenTelemetry trace.Tracer can be adapted
+// with a few lines, turning the TraceAttributes into attribute.KeyValues.
+type Tracer interface {
+	// Start returns a new span, a child of any span in ctx, and a context
+	// carrying it.
+	Start(ctx context.Context, name string, attrs ...TraceAttribute) (context.Context, Span)
+}
+
+// Span is a single traced operation created by a Tracer.
+type Span interface {
+	SetAttributes(attrs ...TraceAttribute)
+	RecordError(err error)
+	End()
+}
+
+// TraceAttribute is a key and value attached to a Span. Values are int64,
+// uint64, string or bool.
+type TraceAttribute struct {
+	Key   string
+	Value interface{}
+}
+
+// noopTracer is the Tracer used when Config.Tracer is not set.
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string, attrs ...TraceAttribute) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(attrs ...TraceAttribute) {}
+
+func (noopSpan) RecordError(err error) {}
+
+func (noopSpan) End() {}
+
+// StatsMetric is a single statistic as returned by Store.StatsMetrics.
+type StatsMetric struct {
+	// Name is the name of the field in ValueStoreStats or GroupStoreStats.
+	Name string
+	// Gauge is true for readings, such as DiskFree, and false for counters,
+	// which only ever increase.
+	Gauge bool
+	// Value is the reading or counter total; for a histogram, it is the
+	// Histogram's Count.
+	Value float64
+	// Histogram is set for the LatencyHistogram fields, which are cumulative
+	// like the counters.
+	Histogram *LatencyHistogram
+}
+
+// statsAccumulate adds the counter fields of stats, a *ValueStoreStats or
+// *GroupStoreStats, to the totals by field name.
+func statsAccumulate(totals map[string]int64, stats interface{}) {
+	v := reflect.ValueOf(stats).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("stats") == "gauge" {
+			continue
+		}
+		switch f.Type.Kind() {
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			totals[f.Name] += v.Field(i).Int()
+		case reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			totals[f.Name] += int64(v.Field(i).Uint())
+		}
+	}
+}
+
+// statsMetrics returns the exported fields of stats, a *ValueStoreStats or
+// *GroupStoreStats, as StatsMetrics in field order, with the totals added to
+// the counters.
+func statsMetrics(totals map[string]int64, stats interface{}) []StatsMetric {
+	v := reflect.ValueOf(stats).Elem()
+	t := v.Type()
+	metrics := make([]StatsMetric, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		m := StatsMetric{Name: f.Name, Gauge: f.Tag.Get("stats") == "gauge"}
+		switch f.Type.Kind() {
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			m.Value = float64(v.Field(i).Int())
+		case reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			m.Value = float64(v.Field(i).Uint())
+		case reflect.Float64:
+			m.Value = v.Field(i).Float()
+		case reflect.Bool:
+			if v.Field(i).Bool() {
+				m.Value = 1
+			}
+		case reflect.Ptr:
+			h, ok := v.Field(i).Interface().(*LatencyHistogram)
+			if !ok || h == nil {
+				continue
+			}
+			m.Histogram = h
+			m.Value = float64(h.Count)
+			metrics = append(metrics, m)
+			continue
+		default:
+			continue
+		}
+		if !m.Gauge {
+			m.Value += float64(totals[f.Name])
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// _LATENCY_BUCKETS is the number of latencyHistogram buckets; the bounds
+// double from one microsecond, so the last is about 9.5 hours.
+const _LATENCY_BUCKETS = 36
+
+// latencyHistogram gathers durations into buckets with upper bounds doubling
+// from one microsecond, plus an overflow bucket. It is safe for concurrent
+// use and, unlike the counters, is never reset.
+type latencyHistogram struct {
+	counts [_LATENCY_BUCKETS + 1]uint64
+	sum    int64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	us := (int64(d) + 999) / 1000
+	i := 0
+	for i < _LATENCY_BUCKETS && us > int64(1)<<uint(i) {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	if d > 0 {
+		atomic.AddInt64(&h.sum, int64(d))
+	}
+}
+
+func (h *latencyHistogram) observeSince(begin time.Time) {
+	h.observe(time.Now().Sub(begin))
+}
+
+// totals returns the count and sum of all the observations so far.
+func (h *latencyHistogram) totals() (uint64, int64) {
+	var count uint64
+	for i := range h.counts {
+		count += atomic.LoadUint64(&h.counts[i])
+	}
+	return count, atomic.LoadInt64(&h.sum)
+}
+
+func (h *latencyHistogram) snapshot() *LatencyHistogram {
+	s := &LatencyHistogram{
+		UpperBounds: make([]time.Duration, _LATENCY_BUCKETS),
+		Counts:      make([]uint64, _LATENCY_BUCKETS),
+		Sum:         time.Duration(atomic.LoadInt64(&h.sum)),
+	}
+	for i := 0; i < _LATENCY_BUCKETS; i++ {
+		s.UpperBounds[i] = time.Duration(int64(1)<<uint(i)) * time.Microsecond
+		s.Count += atomic.LoadUint64(&h.counts[i])
+		s.Counts[i] = s.Count
+	}
+	s.Count += atomic.LoadUint64(&h.counts[_LATENCY_BUCKETS])
+	return s
+}
+
+// LatencyHistogram is a distribution of durations, such as the latencies of
+// Read calls, as found in ValueStoreStats and GroupStoreStats. The counts are
+// cumulative, in the form Prometheus histograms use, and are totals since the
+// Store was created rather than being reset with each Stats call.
+type LatencyHistogram struct {
+	// UpperBounds are the inclusive upper bounds of the buckets, doubling
+	// from one microsecond.
+	UpperBounds []time.Duration
+	// Counts are the number of durations no more than the matching
+	// UpperBounds; durations beyond the last bound are only in Count.
+	Counts []uint64
+	// Count is the total number of durations.
+	Count uint64
+	// Sum is the total of all the durations.
+	Sum time.Duration
+}
+
+// Quantile returns an estimate of the duration at the quantile q, such as 0.99
+// for the 99th percentile, interpolated within the bucket it falls in.
+// Durations beyond the last bucket are reported as the last bound.
+func (h *LatencyHistogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 || len(h.Counts) == 0 {
+		return 0
+	}
+	if q < 0 {
+		q = 0
+	} else if q > 1 {
+		q = 1
+	}
+	rank := q * float64(h.Count)
+	var lower time.Duration
+	var below uint64
+	for i, c := range h.Counts {
+		if float64(c) >= rank && c > below {
+			return lower + time.Duration(float64(h.UpperBounds[i]-lower)*(rank-float64(below))/float64(c-below))
+		}
+		lower = h.UpperBounds[i]
+		below = c
+	}
+	return h.UpperBounds[len(h.UpperBounds)-1]
+}
+
+// String returns the count, mean and common quantiles of the histogram.
+func (h *LatencyHistogram) String() string {
+	if h == nil || h.Count == 0 {
+		return "count=0"
+	}
+	parts := []string{
+		fmt.Sprintf("count=%d", h.Count),
+		fmt.Sprintf("mean=%s", h.Sum/time.Duration(h.Count)),
+	}
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		parts = append(parts, fmt.Sprintf("p%g=%s", q*100, h.Quantile(q)))
+	}
+	return strings.Join(parts, " ")
+}
+
+// merkleMix is the 64 bit finalizer from MurmurHash3, used to build hash tree
+// item hashes without allocations.
+func merkleMix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// stoppableSleep lets the sleeps of a limiter or throttle be cut short, so a
+// store shutting down doesn't wait on them. The zero value sleeps normally.
+type stoppableSleep struct {
+	sleepLock sync.Mutex
+	stopped   bool
+	stopChan  chan struct{}
+}
+
+// sleep sleeps for d or until stop is called, returning at once while
+// stopped.
+func (s *stoppableSleep) sleep(d time.Duration) {
+	s.sleepLock.Lock()
+	if s.stopped {
+		s.sleepLock.Unlock()
+		return
+	}
+	if s.stopChan == nil {
+		s.stopChan = make(chan struct{})
+	}
+	stopChan := s.stopChan
+	s.sleepLock.Unlock()
+	timer := time.NewTimer(d)
+	select {
+	case <-timer.C:
+	case <-stopChan:
+		timer.Stop()
+	}
+}
+
+// stop wakes any sleepers and has later sleeps return at once until start is
+// called.
+func (s *stoppableSleep) stop() {
+	s.sleepLock.Lock()
+	s.stopped = true
+	if s.stopChan != nil {
+		close(s.stopChan)
+		s.stopChan = nil
+	}
+	s.sleepLock.Unlock()
+}
+
+// start has sleeps sleep again after a stop.
+func (s *stoppableSleep) start() {
+	s.sleepLock.Lock()
+	s.stopped = false
+	s.sleepLock.Unlock()
+}
+
+// rateLimiter is a token bucket limiting both bytes and messages per second.
+// A rate of zero or less leaves that dimension unlimited and bursts of up to
+// one second's worth are allowed. The zero value is an unlimited rateLimiter.
+type rateLimiter struct {
+	stoppableSleep
+	lock           sync.Mutex
+	bytesPerSecond int64
+	msgsPerSecond  int64
+	byteTokens     float64
+	msgTokens      float64
+	last           time.Time
+}
+
+// set changes the rates, refilling the buckets.
+func (rl *rateLimiter) set(bytesPerSecond int64, msgsPerSecond int64) {
+	rl.lock.Lock()
+	rl.bytesPerSecond = bytesPerSecond
+	rl.msgsPerSecond = msgsPerSecond
+	rl.byteTokens = float64(bytesPerSecond)
+	rl.msgTokens = float64(msgsPerSecond)
+	rl.last = time.Now()
+	rl.lock.Unlock()
+}
+
+// wait blocks until a message of the given length is allowed through,
+// returning true if it had to wait because a limit was hit.
+func (rl *rateLimiter) wait(length uint64) bool {
+	rl.lock.Lock()
+	if rl.bytesPerSecond <= 0 && rl.msgsPerSecond <= 0 {
+		rl.lock.Unlock()
+		return false
+	}
+	now := time.Now()
+	elapsed := now.Sub(rl.last).Seconds()
+	rl.last = now
+	var delay float64
+	if rl.bytesPerSecond > 0 {
+		rl.byteTokens += elapsed * float64(rl.bytesPerSecond)
+		if rl.byteTokens > float64(rl.bytesPerSecond) {
+			rl.byteTokens = float64(rl.bytesPerSecond)
+		}
+		rl.byteTokens -= float64(length)
+		if rl.byteTokens < 0 {
+			delay = -rl.byteTokens / float64(rl.bytesPerSecond)
+		}
+	}
+	if rl.msgsPerSecond > 0 {
+		rl.msgTokens += elapsed * float64(rl.msgsPerSecond)
+		if rl.msgTokens > float64(rl.msgsPerSecond) {
+			rl.msgTokens = float64(rl.msgsPerSecond)
+		}
+		rl.msgTokens--
+		if rl.msgTokens < 0 {
+			if d := -rl.msgTokens / float64(rl.msgsPerSecond); d > delay {
+				delay = d
+			}
+		}
+	}
+	rl.lock.Unlock()
+	if delay <= 0 {
+		return false
+	}
+	rl.sleep(time.Duration(delay * float64(time.Second)))
+	return true
+}
+
+// ioThrottle paces background I/O, such as compaction's and audits', to a
+// bytes per second budget, zero being unlimited. The budget is scaled by the
+// backoff's factor, if there is a backoff; with no budget, a factor below 1
+// instead has the caller sleep for a matching share of the time it spent
+// working.
+type ioThrottle struct {
+	stoppableSleep
+	lock           sync.Mutex
+	bytesPerSecond int64
+	backoff        *latencyBackoff
+	tokens         float64
+	last           time.Time
+	// hits is how many times wait had to wait, for the stats.
+	hits int32
+}
+
+// set changes the budget and backoff, refilling the bucket.
+func (t *ioThrottle) set(bytesPerSecond int64, backoff *latencyBackoff) {
+	t.lock.Lock()
+	t.bytesPerSecond = bytesPerSecond
+	t.backoff = backoff
+	t.tokens = float64(bytesPerSecond)
+	t.last = time.Now()
+	t.lock.Unlock()
+}
+
+// wait blocks as needed after n bytes of I/O, returning true if it had to
+// wait.
+func (t *ioThrottle) wait(n int64) bool {
+	t.lock.Lock()
+	factor := 1.0
+	if t.backoff != nil {
+		factor = t.backoff.factor()
+	}
+	if t.bytesPerSecond <= 0 && factor >= 1 {
+		t.last = time.Now()
+		t.lock.Unlock()
+		return false
+	}
+	now := time.Now()
+	elapsed := now.Sub(t.last).Seconds()
+	t.last = now
+	var delay float64
+	if t.bytesPerSecond > 0 {
+		rate := float64(t.bytesPerSecond) * factor
+		t.tokens += elapsed * rate
+		if t.tokens > rate {
+			t.tokens = rate
+		}
+		t.tokens -= float64(n)
+		if t.tokens < 0 {
+			delay = -t.tokens / rate
+		}
+	} else {
+		// Time spent idle, such as between passes, isn't time spent
+		// working.
+		if elapsed > 1 {
+			elapsed = 1
+		}
+		delay = elapsed * (1/factor - 1)
+		t.last = now.Add(time.Duration(delay * float64(time.Second)))
+	}
+	t.lock.Unlock()
+	if delay <= 0 {
+		return false
+	}
+	atomic.AddInt32(&t.hits, 1)
+	t.sleep(time.Duration(delay * float64(time.Second)))
+	return true
+}
+
+// latencyBackoff is how far background work should back off to keep the
+// foreground latencies the histogram observes under the target: a factor
+// that halves, down to 1/64, each second the new observations average over
+// the target and doubles back, up to 1, each second they don't. A zero target
+// leaves the factor at 1.
+type latencyBackoff struct {
+	lock      sync.Mutex
+	target    time.Duration
+	histogram *latencyHistogram
+	count     uint64
+	sum       int64
+	last      time.Time
+	value     float64
+}
+
+// set changes the target and the histogram observed, resetting the factor.
+func (b *latencyBackoff) set(target time.Duration, histogram *latencyHistogram) {
+	b.lock.Lock()
+	b.target = target
+	b.histogram = histogram
+	b.count, b.sum = histogram.totals()
+	b.last = time.Now()
+	b.value = 1
+	b.lock.Unlock()
+}
+
+// factor returns the current factor, first updating it if a second has
+// passed.
+func (b *latencyBackoff) factor() float64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.target <= 0 {
+		return 1
+	}
+	now := time.Now()
+	if now.Sub(b.last) < time.Second {
+		return b.value
+	}
+	count, sum := b.histogram.totals()
+	if count > b.count && time.Duration((sum-b.sum)/int64(count-b.count)) > b.target {
+		b.value /= 2
+		if b.value < 1.0/64 {
+			b.value = 1.0 / 64
+		}
+	} else {
+		b.value *= 2
+		if b.value > 1 {
+			b.value = 1
+		}
+	}
+	b.count, b.sum, b.last = count, sum, now
+	return b.value
+}
+
+// throttledReadSeeker waits on the throttle after each read.
+type throttledReadSeeker struct {
+	io.ReadSeeker
+	throttle *ioThrottle
+}
+
+func (r *throttledReadSeeker) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	r.throttle.wait(int64(n))
+	return n, err
+}
+
+func (r *throttledReadSeeker) Close() error {
+	return closeIfCloser(r.ReadSeeker)
 }
 
 func closeIfCloser(thing interface{}) error {
@@ -3,11 +3,15 @@ package store
 import (
 	"io"
 	"os"
+	"path"
+	"sort"
 	"sync"
+	"testing"
 	"time"
 
 	ring "github.com/gholt/devicering"
 	"github.com/gholt/msgring"
+	"golang.org/x/net/context"
 )
 
 type memBuf struct {
@@ -59,6 +63,94 @@ func (f *memFile) Close() error {
 	return nil
 }
 
+// memFS is an in-memory file system, by full path, for tests that need
+// files to read back what was written to them.
+type memFS struct {
+	lock  sync.Mutex
+	files map[string]*memBuf
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: map[string]*memBuf{}}
+}
+
+func (fs *memFS) openReadSeeker(fullPath string) (io.ReadSeeker, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	buf := fs.files[fullPath]
+	if buf == nil {
+		return nil, os.ErrNotExist
+	}
+	return &memFile{buf: buf}, nil
+}
+
+func (fs *memFS) openWriteSeeker(fullPath string) (io.WriteSeeker, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	buf := fs.files[fullPath]
+	if buf == nil {
+		return nil, os.ErrNotExist
+	}
+	return &memFile{buf: buf}, nil
+}
+
+func (fs *memFS) createWriteCloser(fullPath string) (io.WriteCloser, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	buf := &memBuf{}
+	fs.files[fullPath] = buf
+	return &memFile{buf: buf}, nil
+}
+
+func (fs *memFS) readdirnames(fullPath string) ([]string, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	var names []string
+	for name := range fs.files {
+		if path.Dir(name) == path.Clean(fullPath) {
+			names = append(names, path.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (fs *memFS) stat(fullPath string) (os.FileInfo, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	buf := fs.files[fullPath]
+	if buf == nil {
+		return nil, os.ErrNotExist
+	}
+	return &memFileInfo{name: path.Base(fullPath), size: int64(len(buf.buf))}, nil
+}
+
+func (fs *memFS) remove(fullPath string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.files[fullPath] == nil {
+		return os.ErrNotExist
+	}
+	delete(fs.files, fullPath)
+	return nil
+}
+
+func (fs *memFS) rename(oldFullPath string, newFullPath string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	buf := fs.files[oldFullPath]
+	if buf == nil {
+		return os.ErrNotExist
+	}
+	delete(fs.files, oldFullPath)
+	fs.files[newFullPath] = buf
+	return nil
+}
+
+func (fs *memFS) isNotExist(err error) bool {
+	return os.IsNotExist(err)
+}
+
 type msgRingPlaceholder struct {
 	ring            ring.Ring
 	lock            sync.Mutex
@@ -140,3 +232,204 @@ func (m *memFileInfo) IsDir() bool {
 func (m *memFileInfo) Sys() interface{} {
 	return m.sys
 }
+
+func TestRateLimiter(t *testing.T) {
+	rl := &rateLimiter{}
+	if rl.wait(1 << 30) {
+		t.Fatal("zero value should be unlimited")
+	}
+	rl.set(1000, 0)
+	// The first second's worth is allowed as a burst.
+	if rl.wait(1000) {
+		t.Fatal("burst should not have waited")
+	}
+	begin := time.Now()
+	if !rl.wait(100) {
+		t.Fatal("should have waited")
+	}
+	if d := time.Now().Sub(begin); d < 50*time.Millisecond {
+		t.Fatal(d)
+	}
+	rl.set(0, 10)
+	for i := 0; i < 10; i++ {
+		if rl.wait(1 << 30) {
+			t.Fatal(i)
+		}
+	}
+	if !rl.wait(0) {
+		t.Fatal("should have waited")
+	}
+	rl.set(0, 0)
+	if rl.wait(1 << 30) {
+		t.Fatal("should be unlimited again")
+	}
+	// A stop cuts a long wait short.
+	rl.set(1, 0)
+	rl.wait(1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		rl.stop()
+	}()
+	begin = time.Now()
+	rl.wait(1000)
+	if d := time.Now().Sub(begin); d > time.Second {
+		t.Fatal(d)
+	}
+	rl.start()
+	rl.set(1000, 0)
+	rl.wait(1000)
+	begin = time.Now()
+	if !rl.wait(100) || time.Now().Sub(begin) < 50*time.Millisecond {
+		t.Fatal("should have waited again after start")
+	}
+}
+
+func TestIOThrottle(t *testing.T) {
+	th := &ioThrottle{}
+	if th.wait(1 << 30) {
+		t.Fatal("zero value should be unlimited")
+	}
+	th.set(1000, nil)
+	if th.wait(1000) {
+		t.Fatal("burst should not have waited")
+	}
+	begin := time.Now()
+	if !th.wait(100) {
+		t.Fatal("should have waited")
+	}
+	if d := time.Now().Sub(begin); d < 50*time.Millisecond {
+		t.Fatal(d)
+	}
+	h := &latencyHistogram{}
+	b := &latencyBackoff{}
+	b.set(time.Millisecond, h)
+	th.set(0, b)
+	if th.wait(1 << 30) {
+		t.Fatal("should be unlimited while not backed off")
+	}
+	h.observe(10 * time.Millisecond)
+	b.last = b.last.Add(-time.Second)
+	if f := b.factor(); f != 0.5 {
+		t.Fatal(f)
+	}
+	// Backed off by half with no budget, it sleeps as long as it worked.
+	th.last = time.Now().Add(-50 * time.Millisecond)
+	begin = time.Now()
+	if !th.wait(0) {
+		t.Fatal("should have waited")
+	}
+	if d := time.Now().Sub(begin); d < 40*time.Millisecond {
+		t.Fatal(d)
+	}
+	// With no slow observations since, it recovers.
+	b.last = b.last.Add(-time.Second)
+	if f := b.factor(); f != 1 {
+		t.Fatal(f)
+	}
+	if th.wait(1 << 30) {
+		t.Fatal("should be unlimited again")
+	}
+	// A stop cuts a long wait short.
+	th.set(1, nil)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		th.stop()
+	}()
+	begin = time.Now()
+	if !th.wait(1000) {
+		t.Fatal("should have waited")
+	}
+	if d := time.Now().Sub(begin); d > time.Second {
+		t.Fatal(d)
+	}
+	th.start()
+	th.set(1000, nil)
+	th.wait(1000)
+	begin = time.Now()
+	if !th.wait(100) || time.Now().Sub(begin) < 50*time.Millisecond {
+		t.Fatal("should have waited again after start")
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	h := &latencyHistogram{}
+	if s := h.snapshot(); s.Count != 0 || s.Quantile(0.5) != 0 || s.String() != "count=0" {
+		t.Fatal(s)
+	}
+	h.observe(0)
+	h.observe(time.Microsecond)
+	h.observe(3 * time.Microsecond)
+	h.observe(1000 * time.Microsecond)
+	h.observe(24 * time.Hour)
+	s := h.snapshot()
+	if s.Count != 5 || s.Sum != 24*time.Hour+1004*time.Microsecond {
+		t.Fatal(s.Count, s.Sum)
+	}
+	if s.Counts[0] != 2 || s.Counts[1] != 2 || s.Counts[2] != 3 || s.Counts[9] != 3 || s.Counts[10] != 4 || s.Counts[len(s.Counts)-1] != 4 {
+		t.Fatal(s.Counts)
+	}
+	if s.UpperBounds[10] != 1024*time.Microsecond {
+		t.Fatal(s.UpperBounds[10])
+	}
+	// The median falls in the 2µs to 4µs bucket, interpolated half way.
+	if q := s.Quantile(0.5); q != 3*time.Microsecond {
+		t.Fatal(q)
+	}
+	if q := s.Quantile(0.99); q != s.UpperBounds[len(s.UpperBounds)-1] {
+		t.Fatal(q)
+	}
+	if q := s.Quantile(0); q != 0 {
+		t.Fatal(q)
+	}
+}
+
+// testTracer records the spans started, as "parent/name" with the parent
+// being the name of the span in the context, if any.
+type testTracer struct {
+	lock  sync.Mutex
+	spans []string
+}
+
+type testTracerKey struct{}
+
+type testSpan struct {
+	tracer *testTracer
+	name   string
+	attrs  map[string]interface{}
+	err    error
+}
+
+func (t *testTracer) Start(ctx context.Context, name string, attrs ...TraceAttribute) (context.Context, Span) {
+	span := &testSpan{tracer: t, name: name, attrs: make(map[string]interface{})}
+	span.SetAttributes(attrs...)
+	parent, _ := ctx.Value(testTracerKey{}).(*testSpan)
+	t.lock.Lock()
+	if parent != nil {
+		t.spans = append(t.spans, parent.name+"/"+name)
+	} else {
+		t.spans = append(t.spans, name)
+	}
+	t.lock.Unlock()
+	return context.WithValue(ctx, testTracerKey{}, span), span
+}
+
+func (t *testTracer) started() []string {
+	t.lock.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.lock.Unlock()
+	return spans
+}
+
+func (s *testSpan) SetAttributes(attrs ...TraceAttribute) {
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *testSpan) RecordError(err error) {
+	s.err = err
+}
+
+func (s *testSpan) End() {
+}
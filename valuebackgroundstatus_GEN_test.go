@@ -0,0 +1,70 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestValueBackgroundStatus(t *testing.T) {
+	store, _ := newTestValueStore(nil)
+	statuses, err := store.BackgroundStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 11 || statuses[0].Name != "TombstoneDiscard" || statuses[10].Name != "Watcher" {
+		t.Fatal(statuses)
+	}
+	for _, s := range statuses {
+		if s.State != BackgroundTaskStopped || !s.NextRun.IsZero() {
+			t.Fatal(s)
+		}
+	}
+	if err = store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The launchers schedule their first runs as they start.
+	for i := 0; i < 100; i++ {
+		statuses, _ = store.BackgroundStatus(context.Background())
+		if !statuses[1].NextRun.IsZero() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := statuses[1]; s.Name != "Compaction" || s.State != BackgroundTaskIdle || s.NextRun.IsZero() || !s.LastStart.IsZero() {
+		t.Fatal(s)
+	}
+	if s := statuses[7]; s.Name != "InBulkSet" || s.State != BackgroundTaskIdle || !s.NextRun.IsZero() {
+		t.Fatal(s)
+	}
+	before := time.Now()
+	store.compactionPass(make(chan *bgNotification), nil, nil)
+	// The test files are empty, so the toc file can't be read.
+	store.compactFile(context.Background(), "12345.valuetoc", 0, make(chan struct{}), "test", nil)
+	statuses, _ = store.BackgroundStatus(context.Background())
+	if s := statuses[1]; s.State != BackgroundTaskIdle || s.LastStart.Before(before) || s.LastEnd.Before(s.LastStart) || s.LastError == nil || s.LastErrorTime.Before(s.LastEnd) || s.State.String() != "Idle" {
+		t.Fatal(s)
+	}
+	store.compactionState.task.begin()
+	store.compactionState.task.progress(0, 3)
+	store.compactionState.task.working("12345.valuetoc")
+	store.compactionState.task.progress(1, 0)
+	statuses, _ = store.BackgroundStatus(context.Background())
+	if s := statuses[1]; s.State != BackgroundTaskRunning || s.CurrentItem != "12345.valuetoc" || s.Done != 1 || s.Total != 3 {
+		t.Fatal(s)
+	}
+	store.compactionState.task.end()
+	if err = store.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	statuses, _ = store.BackgroundStatus(context.Background())
+	for _, s := range statuses {
+		if s.State != BackgroundTaskStopped || !s.NextRun.IsZero() {
+			t.Fatal(s)
+		}
+	}
+	if s := statuses[1]; s.CurrentItem != "" || s.Done != 0 || s.LastError == nil {
+		t.Fatal(s)
+	}
+}
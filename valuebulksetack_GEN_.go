@@ -5,16 +5,29 @@ import (
 	"io"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
+	"golang.org/x/net/context"
 )
 
 // bsam: entries:n
 // bsam entry: keyA:8, keyB:8, timestampbits:8
+//
+// Node bulk-set-ack messages are the same but start with the acknowledging
+// node's ID, so hints held for that node can be cleared; they're only sent to
+// nodes that have said they support them with a hello message.
+//
+// nbsam: senderNodeID:8 entries:n
 
 const _VALUE_BULK_SET_ACK_MSG_TYPE = 0x39589f4746844e3b
+const _VALUE_AUTH_BULK_SET_ACK_MSG_TYPE = 0x9761f0eb613a176e
+const _VALUE_NODE_BULK_SET_ACK_MSG_TYPE = 0x5f5cfc79158b5069
+const _VALUE_AUTH_NODE_BULK_SET_ACK_MSG_TYPE = 0x994d014d59dd0336
 const _VALUE_BULK_SET_ACK_MSG_ENTRY_LENGTH = 24
 
+const _VALUE_NODE_BULK_SET_ACK_MSG_HEADER_LENGTH = 8
+
 type valueBulkSetAckState struct {
 	msgCap            int
 	inWorkers         int
@@ -23,6 +36,7 @@ type valueBulkSetAckState struct {
 
 	startupShutdownLock sync.Mutex
 	inNotifyChan        chan *bgNotification
+	inTask              backgroundTask
 	inMsgChan           chan *valueBulkSetAckMsg
 	inFreeMsgChan       chan *valueBulkSetAckMsg
 	outFreeMsgChan      chan *valueBulkSetAckMsg
@@ -30,7 +44,10 @@ type valueBulkSetAckState struct {
 
 type valueBulkSetAckMsg struct {
 	store *defaultValueStore
-	body  []byte
+	// nodeID is the acknowledging node for node bulk-set-ack messages; zero
+	// for plain bulk-set-ack messages.
+	nodeID uint64
+	body   []byte
 }
 
 func (store *defaultValueStore) bulkSetAckConfig(cfg *ValueStoreConfig) {
@@ -40,6 +57,9 @@ func (store *defaultValueStore) bulkSetAckConfig(cfg *ValueStoreConfig) {
 	store.bulkSetAckState.outBulkSetAckMsgs = cfg.OutBulkSetAckMsgs
 	if store.msgRing != nil {
 		store.msgRing.SetMsgHandler(_VALUE_BULK_SET_ACK_MSG_TYPE, store.newInBulkSetAckMsg)
+		store.msgRing.SetMsgHandler(_VALUE_AUTH_BULK_SET_ACK_MSG_TYPE, store.newInAuthBulkSetAckMsg)
+		store.msgRing.SetMsgHandler(_VALUE_NODE_BULK_SET_ACK_MSG_TYPE, store.newInNodeBulkSetAckMsg)
+		store.msgRing.SetMsgHandler(_VALUE_AUTH_NODE_BULK_SET_ACK_MSG_TYPE, store.newInAuthNodeBulkSetAckMsg)
 	}
 }
 
@@ -62,6 +82,7 @@ func (store *defaultValueStore) bulkSetAckStartup() {
 				body:  make([]byte, store.bulkSetAckState.msgCap),
 			}
 		}
+		store.bulkSetAckState.inTask.launch(time.Time{})
 		go store.inBulkSetAckLauncher(store.bulkSetAckState.inNotifyChan)
 	}
 	store.bulkSetAckState.startupShutdownLock.Unlock()
@@ -77,6 +98,7 @@ func (store *defaultValueStore) bulkSetAckShutdown() {
 		}
 		<-c
 		store.bulkSetAckState.inNotifyChan = nil
+		store.bulkSetAckState.inTask.stop()
 		store.bulkSetAckState.inMsgChan = nil
 		store.bulkSetAckState.inFreeMsgChan = nil
 		store.bulkSetAckState.outFreeMsgChan = nil
@@ -107,9 +129,107 @@ func (store *defaultValueStore) inBulkSetAckLauncher(notifyChan chan *bgNotifica
 	}
 }
 
-// newInBulkSetAckMsg reads bulk-set-ack messages from the MsgRing and puts
-// them on the inMsgChan for the inBulkSetAck workers to work on.
+// newInBulkSetAckMsg reads unauthenticated bulk-set-ack messages from the
+// MsgRing and puts them on the inMsgChan for the inBulkSetAck workers to work
+// on.
 func (store *defaultValueStore) newInBulkSetAckMsg(r io.Reader, l uint64) (uint64, error) {
+	return store.receiveBulkSetAckMsg(r, l, false)
+}
+
+// newInNodeBulkSetAckMsg is newInBulkSetAckMsg for node bulk-set-ack
+// messages.
+func (store *defaultValueStore) newInNodeBulkSetAckMsg(r io.Reader, l uint64) (uint64, error) {
+	return store.receiveBulkSetAckMsg(r, l, true)
+}
+
+func (store *defaultValueStore) receiveBulkSetAckMsg(r io.Reader, l uint64, withNodeID bool) (uint64, error) {
+	if store.msgAuthState.requireAuth {
+		n, err := tossRead(r, l)
+		if err != nil {
+			atomic.AddInt32(&store.inBulkSetAckInvalids, 1)
+			return n, err
+		}
+		atomic.AddInt32(&store.inBulkSetAckRejects, 1)
+		store.logger.Warn("rejected unauthenticated incoming message", zap.String("name", store.loggerPrefix+"inBulkSetAck"))
+		return n, nil
+	}
+	bsam, n, err := store.readInBulkSetAckMsgNodeID(r, l, withNodeID)
+	if bsam != nil {
+		store.bulkSetAckState.inMsgChan <- bsam
+		atomic.AddInt32(&store.inBulkSetAcks, 1)
+	}
+	return n, err
+}
+
+// newInAuthBulkSetAckMsg reads authenticated bulk-set-ack messages from the
+// MsgRing and puts them on the inMsgChan for the inBulkSetAck workers to work
+// on.
+func (store *defaultValueStore) newInAuthBulkSetAckMsg(r io.Reader, l uint64) (uint64, error) {
+	return store.receiveAuthBulkSetAckMsg(r, l, false)
+}
+
+// newInAuthNodeBulkSetAckMsg is newInAuthBulkSetAckMsg for node bulk-set-ack
+// messages.
+func (store *defaultValueStore) newInAuthNodeBulkSetAckMsg(r io.Reader, l uint64) (uint64, error) {
+	return store.receiveAuthBulkSetAckMsg(r, l, true)
+}
+
+func (store *defaultValueStore) receiveAuthBulkSetAckMsg(r io.Reader, l uint64, withNodeID bool) (uint64, error) {
+	var bsam *valueBulkSetAckMsg
+	nodeID, ok, n, err := store.readInAuthMsg(r, l, func(r io.Reader, l uint64) (uint64, error) {
+		var n uint64
+		var err error
+		bsam, n, err = store.readInBulkSetAckMsgNodeID(r, l, withNodeID)
+		return n, err
+	})
+	// A node may only acknowledge for itself.
+	if ok && bsam != nil && withNodeID && bsam.nodeID != nodeID {
+		ok = false
+	}
+	if ok {
+		if bsam != nil {
+			store.bulkSetAckState.inMsgChan <- bsam
+			atomic.AddInt32(&store.inBulkSetAcks, 1)
+		}
+		return n, err
+	}
+	if bsam != nil {
+		store.bulkSetAckState.inFreeMsgChan <- bsam
+	}
+	if err == nil {
+		atomic.AddInt32(&store.inBulkSetAckRejects, 1)
+		store.logger.Warn("rejected unverified incoming message", zap.String("name", store.loggerPrefix+"inBulkSetAck"), zap.Uint64("nodeID", nodeID))
+	}
+	return n, err
+}
+
+// readInBulkSetAckMsgNodeID is readInBulkSetAckMsg for possibly node
+// bulk-set-ack messages.
+func (store *defaultValueStore) readInBulkSetAckMsgNodeID(r io.Reader, l uint64, withNodeID bool) (*valueBulkSetAckMsg, uint64, error) {
+	if !withNodeID {
+		return store.readInBulkSetAckMsg(r, l)
+	}
+	if l < _VALUE_NODE_BULK_SET_ACK_MSG_HEADER_LENGTH {
+		n, err := tossRead(r, l)
+		atomic.AddInt32(&store.inBulkSetAckInvalids, 1)
+		return nil, n, err
+	}
+	var header [_VALUE_NODE_BULK_SET_ACK_MSG_HEADER_LENGTH]byte
+	n, err := io.ReadFull(r, header[:])
+	if err != nil {
+		atomic.AddInt32(&store.inBulkSetAckInvalids, 1)
+		return nil, uint64(n), err
+	}
+	bsam, m, err := store.readInBulkSetAckMsg(r, l-_VALUE_NODE_BULK_SET_ACK_MSG_HEADER_LENGTH)
+	if bsam != nil {
+		bsam.nodeID = binary.BigEndian.Uint64(header[:])
+	}
+	return bsam, _VALUE_NODE_BULK_SET_ACK_MSG_HEADER_LENGTH + m, err
+}
+
+// readInBulkSetAckMsg reads a bulk-set-ack message, returning nil if the
+// message was discarded.
+func (store *defaultValueStore) readInBulkSetAckMsg(r io.Reader, l uint64) (*valueBulkSetAckMsg, uint64, error) {
 	var bsam *valueBulkSetAckMsg
 	select {
 	case bsam = <-store.bulkSetAckState.inFreeMsgChan:
@@ -128,11 +248,11 @@ func (store *defaultValueStore) newInBulkSetAckMsg(r io.Reader, l uint64) (uint6
 			left -= uint64(sn)
 			if err != nil {
 				atomic.AddInt32(&store.inBulkSetAckInvalids, 1)
-				return l - left, err
+				return nil, l - left, err
 			}
 		}
 		atomic.AddInt32(&store.inBulkSetAckDrops, 1)
-		return l, nil
+		return nil, l, nil
 	}
 	var n int
 	var sn int
@@ -141,6 +261,7 @@ func (store *defaultValueStore) newInBulkSetAckMsg(r io.Reader, l uint64) (uint6
 	if l > uint64(cap(bsam.body)) {
 		bsam.body = make([]byte, l)
 	}
+	bsam.nodeID = 0
 	bsam.body = bsam.body[:l]
 	n = 0
 	for n != len(bsam.body) {
@@ -149,12 +270,10 @@ func (store *defaultValueStore) newInBulkSetAckMsg(r io.Reader, l uint64) (uint6
 		if err != nil {
 			store.bulkSetAckState.inFreeMsgChan <- bsam
 			atomic.AddInt32(&store.inBulkSetAckInvalids, 1)
-			return uint64(n), err
+			return nil, uint64(n), err
 		}
 	}
-	store.bulkSetAckState.inMsgChan <- bsam
-	atomic.AddInt32(&store.inBulkSetAcks, 1)
-	return l, nil
+	return bsam, l, nil
 }
 
 // inBulkSetAck actually processes incoming bulk-set-ack messages; there may be
@@ -170,11 +289,20 @@ func (store *defaultValueStore) inBulkSetAck(wg *sync.WaitGroup) {
 		if ring != nil {
 			rightwardPartitionShift = 64 - uint64(ring.PartitionBitCount())
 		}
+		store.bulkSetAckState.inTask.begin()
+		_, span := store.tracer.Start(context.Background(), "ValueStore.inBulkSetAck", TraceAttribute{Key: "length", Value: bsam.MsgLength()})
 		b := bsam.body
 		// div mul just ensures any trailing bytes are dropped
 		l := len(b) / _VALUE_BULK_SET_ACK_MSG_ENTRY_LENGTH * _VALUE_BULK_SET_ACK_MSG_ENTRY_LENGTH
 		for o := 0; o < l; o += _VALUE_BULK_SET_ACK_MSG_ENTRY_LENGTH {
 			keyA := binary.BigEndian.Uint64(b[o:])
+			// Only acknowledgements saying which node they're from can clear
+			// hints, as the other replicas ack the same writes.
+			if bsam.nodeID != 0 && atomic.LoadInt64(&store.hintedHandoffState.count) > 0 {
+
+				store.hintAcked(bsam.nodeID, valueHintKey{keyA: keyA, keyB: binary.BigEndian.Uint64(b[o+8:])}, binary.BigEndian.Uint64(b[o+16:]))
+
+			}
 			if ring != nil && !ring.Responsible(uint32(keyA>>rightwardPartitionShift)) {
 				atomic.AddInt32(&store.inBulkSetAckWrites, 1)
 				timestampbits := binary.BigEndian.Uint64(b[o+16:]) | _TSB_LOCAL_REMOVAL
@@ -183,9 +311,13 @@ func (store *defaultValueStore) inBulkSetAck(wg *sync.WaitGroup) {
 					atomic.AddInt32(&store.inBulkSetAckWriteErrors, 1)
 				} else if ptimestampbits >= timestampbits {
 					atomic.AddInt32(&store.inBulkSetAckWritesOverridden, 1)
+				} else if ptimestampbits != 0 && ptimestampbits&_TSB_LOCAL_REMOVAL == 0 {
+					store.replicationAcked(ring.PartitionBitCount(), uint32(keyA>>rightwardPartitionShift), 1)
 				}
 			}
 		}
+		span.End()
+		store.bulkSetAckState.inTask.end()
 		store.bulkSetAckState.inFreeMsgChan <- bsam
 	}
 	wg.Done()
@@ -201,21 +333,38 @@ func (store *defaultValueStore) inBulkSetAck(wg *sync.WaitGroup) {
 // valueBulkSetAckMsg is available to return.
 func (store *defaultValueStore) newOutBulkSetAckMsg() *valueBulkSetAckMsg {
 	bsam := <-store.bulkSetAckState.outFreeMsgChan
+	bsam.nodeID = 0
 	bsam.body = bsam.body[:0]
 	return bsam
 }
 
 func (bsam *valueBulkSetAckMsg) MsgType() uint64 {
+	if bsam.nodeID != 0 {
+		return _VALUE_NODE_BULK_SET_ACK_MSG_TYPE
+	}
 	return _VALUE_BULK_SET_ACK_MSG_TYPE
 }
 
 func (bsam *valueBulkSetAckMsg) MsgLength() uint64 {
+	if bsam.nodeID != 0 {
+		return _VALUE_NODE_BULK_SET_ACK_MSG_HEADER_LENGTH + uint64(len(bsam.body))
+	}
 	return uint64(len(bsam.body))
 }
 
 func (bsam *valueBulkSetAckMsg) WriteContent(w io.Writer) (uint64, error) {
+	var l uint64
+	if bsam.nodeID != 0 {
+		var header [_VALUE_NODE_BULK_SET_ACK_MSG_HEADER_LENGTH]byte
+		binary.BigEndian.PutUint64(header[:], bsam.nodeID)
+		n, err := w.Write(header[:])
+		l = uint64(n)
+		if err != nil {
+			return l, err
+		}
+	}
 	n, err := w.Write(bsam.body)
-	return uint64(n), err
+	return l + uint64(n), err
 }
 
 func (bsam *valueBulkSetAckMsg) Free(successes int, failures int) {
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"fmt"
 	"path"
 	"sort"
 	"strconv"
@@ -10,16 +11,22 @@ import (
 	"time"
 
 	"go.uber.org/zap"
+	"golang.org/x/net/context"
 )
 
 type valueCompactionState struct {
-	interval     int
-	threshold    float64
-	ageThreshold int64
-	workerCount  int
+	interval           int
+	threshold          float64
+	ageThreshold       int64
+	workerCount        int
+	smallFileThreshold int
+	mergeTargetSize    int64
+	upgradesPerPass    int
+	throttle           ioThrottle
 
 	startupShutdownLock sync.Mutex
 	notifyChan          chan *bgNotification
+	task                backgroundTask
 
 	compactionLock              sync.Mutex
 	compactionPendingBatchChans []chan []valueTOCEntry
@@ -31,11 +38,15 @@ func (store *defaultValueStore) compactionConfig(cfg *ValueStoreConfig) {
 	store.compactionState.threshold = cfg.CompactionThreshold
 	store.compactionState.ageThreshold = int64(cfg.CompactionAgeThreshold * 1000000000)
 	store.compactionState.workerCount = cfg.CompactionWorkers
+	store.compactionState.smallFileThreshold = cfg.CompactionSmallFileThreshold
+	store.compactionState.mergeTargetSize = int64(cfg.CompactionMergeTargetSize)
+	store.compactionState.upgradesPerPass = cfg.CompactionUpgradesPerPass
 }
 
 func (store *defaultValueStore) compactionStartup() {
 	store.compactionState.startupShutdownLock.Lock()
 	if store.compactionState.notifyChan == nil {
+		store.compactionState.throttle.start()
 		store.compactionState.notifyChan = make(chan *bgNotification, 1)
 		go store.compactionLauncher(store.compactionState.notifyChan)
 	}
@@ -56,6 +67,9 @@ func (store *defaultValueStore) compactionStartup() {
 func (store *defaultValueStore) compactionShutdown() {
 	store.compactionState.startupShutdownLock.Lock()
 	if store.compactionState.notifyChan != nil {
+		// Stopping the throttle first lets a pass sleeping in it get to the
+		// disable notification right away.
+		store.compactionState.throttle.stop()
 		c := make(chan struct{}, 1)
 		store.compactionState.notifyChan <- &bgNotification{
 			action:   _BG_DISABLE,
@@ -63,6 +77,7 @@ func (store *defaultValueStore) compactionShutdown() {
 		}
 		<-c
 		store.compactionState.notifyChan = nil
+		store.compactionState.task.stop()
 	}
 	store.compactionState.compactionLock.Lock()
 	store.compactionState.compactionPendingBatchChans = nil
@@ -76,6 +91,7 @@ func (store *defaultValueStore) compactionLauncher(notifyChan chan *bgNotificati
 	store.randMutex.Lock()
 	nextRun := time.Now().Add(time.Duration(interval + interval*store.rand.NormFloat64()*0.1))
 	store.randMutex.Unlock()
+	store.compactionState.task.launch(nextRun)
 	var notification *bgNotification
 	running := true
 	for running {
@@ -96,11 +112,14 @@ func (store *defaultValueStore) compactionLauncher(notifyChan chan *bgNotificati
 		store.randMutex.Lock()
 		nextRun = time.Now().Add(time.Duration(interval + interval*store.rand.NormFloat64()*0.1))
 		store.randMutex.Unlock()
+		store.compactionState.task.schedule(nextRun)
 		if notification != nil {
 			var nextNotification *bgNotification
 			switch notification.action {
 			case _BG_PASS:
-				nextNotification = store.compactionPass(notifyChan)
+				opts, _ := notification.options.(*CompactionPassOptions)
+				result, _ := notification.result.(*CompactionResult)
+				nextNotification = store.compactionPass(notifyChan, opts, result)
 			case _BG_DISABLE:
 				running = false
 			default:
@@ -111,42 +130,104 @@ func (store *defaultValueStore) compactionLauncher(notifyChan chan *bgNotificati
 			notification.doneChan <- struct{}{}
 			notification = nextNotification
 		} else {
-			notification = store.compactionPass(notifyChan)
+			notification = store.compactionPass(notifyChan, nil, nil)
 		}
 	}
 }
 
+// CompactionPass runs a compaction pass now; see Store.CompactionPass.
+func (store *defaultValueStore) CompactionPass(ctx context.Context, opts *CompactionPassOptions) (*CompactionResult, error) {
+	ctx, span := store.startSpan(ctx, "CompactionPass")
+	defer span.End()
+	result := &CompactionResult{}
+	if err := store.manualPass(ctx, &store.compactionState.startupShutdownLock, &store.compactionState.notifyChan, opts, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
 type valueCompactionJob struct {
 	nametoc          string
 	candidateBlockID uint32
+	reclaimable      int64
+	// index is the job's place among the candidate files in name order, so
+	// small files next to each other can be merged together.
+	index int
+	// upgrade is set for a file in an older format to be rewritten whether
+	// it needs compacting or not.
+	upgrade bool
 }
 
-func (store *defaultValueStore) compactionPass(notifyChan chan *bgNotification) *bgNotification {
+// compactionPass compacts the files with more waste than the threshold, and
+// up to the upgradesPerPass files in an older format, adding what it did to
+// the result; the opts and result may be nil.
+func (store *defaultValueStore) compactionPass(notifyChan chan *bgNotification, opts *CompactionPassOptions, result *CompactionResult) *bgNotification {
+	store.compactionState.task.begin()
 	begin := time.Now()
 	defer func() {
 		elapsed := time.Now().Sub(begin)
 		store.logger.Debug("pass completed", zap.String("name", store.loggerPrefix+"compaction"), zap.Duration("elapsed", elapsed))
 		atomic.StoreInt64(&store.compactionNanoseconds, elapsed.Nanoseconds())
+		store.compactionPassDuration.observe(elapsed)
+		store.compactionState.task.end()
 	}()
+	ctx, span := store.tracer.Start(context.Background(), "ValueStore.compactionPass")
+	defer span.End()
+	if result == nil {
+		result = &CompactionResult{}
+	}
+	threshold := store.compactionState.threshold
+	ageThreshold := store.compactionState.ageThreshold
+	if opts != nil {
+		if opts.Threshold > 0 {
+			threshold = opts.Threshold
+		}
+		if opts.IgnoreAgeThreshold {
+			ageThreshold = 0
+		}
+	}
 	names, err := store.readdirnames(store.pathtoc)
 	if err != nil {
 		store.logger.Error("error from readdirnames", zap.String("name", store.loggerPrefix+"compaction"), zap.Error(err))
+		store.compactionState.task.failed(err)
 		return nil
 	}
 	sort.Strings(names)
 	jobChan := make(chan *valueCompactionJob, len(names))
+	smallJobChan := make(chan *valueCompactionJob, len(names))
 	controlChan := make(chan struct{})
 	wg := &sync.WaitGroup{}
 	for i := 0; i < store.compactionState.workerCount; i++ {
 		wg.Add(1)
-		go store.compactionWorker(jobChan, controlChan, wg)
+		go store.compactionWorker(ctx, jobChan, smallJobChan, controlChan, wg, threshold, result)
 	}
 	waitChan := make(chan struct{}, 1)
 	go func() {
 		wg.Wait()
 		close(waitChan)
 	}()
+	var jobs []*valueCompactionJob
+	upgrades := store.compactionState.upgradesPerPass
 	for _, name := range names {
+		if namets, valid := store.compactionCandidate(name, ageThreshold); valid {
+			blockID := store.locBlockIDFromTimestampnano(namets)
+			live, total := store.locBlockLiveAndTotal(blockID)
+			upgrade := false
+			if upgrades > 0 && blockID != 0 {
+				if fl, ok := store.locBlock(blockID).(*valueStoreFile); ok && fl.version < 1 {
+					upgrade = true
+					upgrades--
+				}
+			}
+			jobs = append(jobs, &valueCompactionJob{name, blockID, total - live, len(jobs), upgrade})
+		}
+	}
+	// The files with the most to reclaim go first, so they're done even if
+	// the pass is cut short.
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobs[i].reclaimable > jobs[j].reclaimable
+	})
+	for _, job := range jobs {
 		select {
 		case notification := <-notifyChan:
 			close(controlChan)
@@ -154,9 +235,8 @@ func (store *defaultValueStore) compactionPass(notifyChan chan *bgNotification)
 			return notification
 		default:
 		}
-		if namets, valid := store.compactionCandidate(name); valid {
-			jobChan <- &valueCompactionJob{name, store.locBlockIDFromTimestampnano(namets)}
-		}
+		store.compactionState.task.progress(0, 1)
+		jobChan <- job
 	}
 	close(jobChan)
 	for {
@@ -166,14 +246,20 @@ func (store *defaultValueStore) compactionPass(notifyChan chan *bgNotification)
 			<-waitChan
 			return notification
 		case <-waitChan:
-			return nil
+			close(smallJobChan)
+			var smallJobs []*valueCompactionJob
+			for job := range smallJobChan {
+				smallJobs = append(smallJobs, job)
+			}
+			return store.compactionMerge(ctx, notifyChan, smallJobs, threshold, result)
 		}
 	}
 }
 
 // compactionCandidate verifies that the given file name is a valid candidate
-// for compaction and also returns the extracted namets.
-func (store *defaultValueStore) compactionCandidate(name string) (int64, bool) {
+// for compaction, at least ageThreshold nanoseconds old, and also returns the
+// extracted namets.
+func (store *defaultValueStore) compactionCandidate(name string, ageThreshold int64) (int64, bool) {
 	if !strings.HasSuffix(name, ".valuetoc") {
 		return 0, false
 	}
@@ -190,120 +276,101 @@ func (store *defaultValueStore) compactionCandidate(name string) (int64, bool) {
 	if namets == int64(atomic.LoadUint64(&store.activeTOCA)) || namets == int64(atomic.LoadUint64(&store.activeTOCB)) {
 		return namets, false
 	}
-	if namets >= time.Now().UnixNano()-store.compactionState.ageThreshold {
+	if namets >= time.Now().UnixNano()-ageThreshold {
 		return namets, false
 	}
 	return namets, true
 }
 
-func (store *defaultValueStore) compactionWorker(jobChan chan *valueCompactionJob, controlChan chan struct{}, wg *sync.WaitGroup) {
+// compactionWorker compacts the files from the jobChan that need it, passing
+// the small ones on to the smallJobChan to be merged once all the workers are
+// done.
+func (store *defaultValueStore) compactionWorker(ctx context.Context, jobChan chan *valueCompactionJob, smallJobChan chan *valueCompactionJob, controlChan chan struct{}, wg *sync.WaitGroup, threshold float64, result *CompactionResult) {
 	for c := range jobChan {
 		select {
 		case <-controlChan:
 			break
 		default:
 		}
+		store.compactionState.task.working(c.nametoc)
 		total, err := valueTOCStat(path.Join(store.pathtoc, c.nametoc), store.stat, store.openReadSeeker)
 		if err != nil {
 			store.logger.Warn("unable to stat", zap.String("name", store.loggerPrefix+"compaction"), zap.String("path", path.Join(store.pathtoc, c.nametoc)), zap.Error(err))
+			store.compactionState.task.failed(err)
+			store.compactionState.task.progress(1, 0)
 			continue
 		}
-		// TODO: This 1000 should be in the Config.
-		// If total is less than 1000, it'll automatically get compacted.
-		if total < 1000 {
-			atomic.AddInt32(&store.smallFileCompactions, 1)
-		} else {
-			toCheck := uint32(total)
-			// If there are more than a million entries, we'll just check the
-			// first million and extrapolate.
-			if toCheck > 1000000 {
-				toCheck = 1000000
-			}
-			if !store.needsCompaction(c.nametoc, c.candidateBlockID, total, toCheck) {
-				continue
-			}
-			atomic.AddInt32(&store.compactions, 1)
+		atomic.AddInt64(&result.FilesExamined, 1)
+		if total < store.compactionState.smallFileThreshold {
+			smallJobChan <- c
+			store.compactionState.task.progress(1, 0)
+			continue
 		}
-		store.compactFile(c.nametoc, c.candidateBlockID, controlChan, "compactionWorker")
+		if !c.upgrade && !store.needsCompaction(c.nametoc, c.candidateBlockID, threshold) {
+			store.compactionState.task.progress(1, 0)
+			continue
+		}
+		atomic.AddInt32(&store.compactions, 1)
+		store.compactFile(ctx, c.nametoc, c.candidateBlockID, controlChan, "compactionWorker", result)
+		store.compactionState.task.progress(1, 0)
 	}
 	wg.Done()
 }
 
-func (store *defaultValueStore) needsCompaction(nametoc string, candidateBlockID uint32, total int, toCheck uint32) bool {
-	// This currently just reads the first store.recoveryBatchSize entries to
-	// determine whether to compact the file or not. It would likely be better
-	// to sample throughout the file instead, but this was simpler for now and,
-	// hopefully, the writes will be scattered enough to not make much of a
-	// difference.
-	stale := uint32(0)
-	checked := uint32(0)
-	store.compactionState.compactionLock.Lock()
-	defer store.compactionState.compactionLock.Unlock()
-	controlChan := make(chan struct{})
-	wg := &sync.WaitGroup{}
-	wg.Add(len(store.compactionState.compactionPendingBatchChans))
-	for i := 0; i < len(store.compactionState.compactionPendingBatchChans); i++ {
-		go func(pendingBatchChan chan []valueTOCEntry, freeBatchChan chan []valueTOCEntry) {
-			skipRest := false
-			for {
-				batch := <-pendingBatchChan
-				if batch == nil {
-					break
-				}
-				if skipRest {
-					continue
-				}
-				for j := 0; j < len(batch); j++ {
-					wr := &batch[j]
-					timestampBits, blockID, _, _ := store.lookup(wr.KeyA, wr.KeyB)
-					if timestampBits != wr.TimestampBits || blockID != wr.BlockID {
-						atomic.AddUint32(&stale, 1)
-					}
-					if c := atomic.AddUint32(&checked, 1); c == toCheck {
-						skipRest = true
-						close(controlChan)
-						break
-					} else if c > toCheck {
-						skipRest = true
-						break
-					}
-				}
-				freeBatchChan <- batch
-			}
-			wg.Done()
-		}(store.compactionState.compactionPendingBatchChans[i], store.compactionState.compactionFreeBatchChans[i])
-	}
-	fpr, err := store.openReadSeeker(path.Join(store.pathtoc, nametoc))
-	if err != nil {
-		// Critical level since future recoveries, compactions, and audits will
-		// keep hitting this file until a person corrects the file system
-		// issue.
-		store.logger.Error("cannot open", zap.String("name", store.loggerPrefix+"compaction"), zap.String("filename", nametoc), zap.Error(err))
-		return false
+// needsCompaction reports whether more than the threshold of the file's
+// bytes are waste, going by the live and total counts of its loc block.
+func (store *defaultValueStore) needsCompaction(nametoc string, candidateBlockID uint32, threshold float64) bool {
+	if candidateBlockID == 0 {
+		// The file isn't loaded, so nothing in it is in use.
+		return true
 	}
-	_, errs := valueReadTOCEntriesBatched(fpr, candidateBlockID, store.compactionState.compactionFreeBatchChans, store.compactionState.compactionPendingBatchChans, controlChan)
-	for _, err := range errs {
-		store.logger.Warn("error from ReadTOCEntriesBatched", zap.String("name", store.loggerPrefix+"compaction"), zap.String("filename", nametoc), zap.Error(err))
+	live, total := store.locBlockLiveAndTotal(candidateBlockID)
+	store.logger.Debug("waste", zap.String("name", store.loggerPrefix+"compaction"), zap.String("filename", nametoc), zap.Int64("live", live), zap.Int64("total", total))
+	return float64(total-live) > float64(total)*threshold
+}
+
+// compactionRemove removes the compacted file pair, renaming whatever can't
+// be removed, and closes its loc block.
+func (store *defaultValueStore) compactionRemove(nametoc string, blockID uint32, caller string) {
+	fullpath := path.Join(store.path, nametoc[:len(nametoc)-3])
+	fullpathtoc := path.Join(store.pathtoc, nametoc)
+	if err := store.remove(fullpathtoc); err != nil {
+		store.logger.Warn("unable to remove", zap.String("name", store.loggerPrefix+caller), zap.String("path", fullpathtoc), zap.Error(err))
+		if err = store.rename(fullpathtoc, fullpathtoc+".renamed"); err != nil {
+			// Critical level since future recoveries, compactions, and audits
+			// will keep hitting this file until a person corrects the file
+			// system issue.
+			store.logger.Error("also could not rename", zap.String("name", store.loggerPrefix+caller), zap.String("path", fullpathtoc), zap.Error(err))
+		}
 	}
-	closeIfCloser(fpr)
-	for i := 0; i < len(store.compactionState.compactionPendingBatchChans); i++ {
-		store.compactionState.compactionPendingBatchChans[i] <- nil
+	if err := store.remove(fullpath); err != nil {
+		store.logger.Warn("unable to remove", zap.String("name", store.loggerPrefix+caller), zap.String("path", fullpath), zap.Error(err))
+		if err = store.rename(fullpath, fullpath+".renamed"); err != nil {
+			store.logger.Warn("also could not rename", zap.String("name", store.loggerPrefix+caller), zap.String("path", fullpath), zap.Error(err))
+		}
 	}
-	wg.Wait()
-	if len(errs) > 0 {
-		store.logger.Warn("since there were errors while reading, compaction is needed", zap.String("name", store.loggerPrefix+"compaction"), zap.String("filename", nametoc))
-		return true
+	if blockID != 0 {
+		if err := store.closeLocBlock(blockID); err != nil {
+			store.logger.Warn("error closing in-memory block", zap.String("name", store.loggerPrefix+caller), zap.String("filename", nametoc), zap.Error(err))
+		}
 	}
-	store.logger.Debug("sample result", zap.String("name", store.loggerPrefix+"compaction"), zap.String("filename", nametoc), zap.Int("total", total), zap.Uint64("checked", uint64(checked)), zap.Uint64("stale", uint64(stale)))
-	return stale > uint32(float64(checked)*store.compactionState.threshold)
 }
 
-func (store *defaultValueStore) compactFile(nametoc string, blockID uint32, controlChan chan struct{}, removemeCaller string) {
+// compactFile rewrites the items still in use from the file to the current
+// ones and removes it, adding what it did to the result if not nil.
+func (store *defaultValueStore) compactFile(ctx context.Context, nametoc string, blockID uint32, controlChan chan struct{}, removemeCaller string, result *CompactionResult) {
 	var readErrorCount uint32
 	var writeErrorCount uint32
 	var count uint32
 	var rewrote uint32
+	var rewroteBytes int64
 	var stale uint32
+	begin := time.Now()
+	_, span := store.tracer.Start(ctx, "ValueStore.compactFile", TraceAttribute{Key: "filename", Value: nametoc}, TraceAttribute{Key: "caller", Value: removemeCaller})
+	defer func() {
+		span.SetAttributes(TraceAttribute{Key: "count", Value: uint64(atomic.LoadUint32(&count))}, TraceAttribute{Key: "rewrote", Value: uint64(atomic.LoadUint32(&rewrote))}, TraceAttribute{Key: "stale", Value: uint64(atomic.LoadUint32(&stale))})
+		span.End()
+	}()
 	store.compactionState.compactionLock.Lock()
 	defer store.compactionState.compactionLock.Unlock()
 	wg := &sync.WaitGroup{}
@@ -369,6 +436,9 @@ func (store *defaultValueStore) compactFile(nametoc string, blockID uint32, cont
 						break
 					}
 					atomic.AddUint32(&rewrote, 1)
+					atomic.AddInt64(&rewroteBytes, int64(len(value)))
+					// Once for the read and once for the write.
+					store.compactionState.throttle.wait(2 * int64(len(value)))
 				}
 				freeBatchChan <- batch
 			}
@@ -377,37 +447,44 @@ func (store *defaultValueStore) compactFile(nametoc string, blockID uint32, cont
 	}
 	fullpath := path.Join(store.path, nametoc[:len(nametoc)-3])
 	fullpathtoc := path.Join(store.pathtoc, nametoc)
-	spindown := func(remove bool) {
+	// spindown finishes up, removing the original file if the compaction
+	// succeeded; err is why it didn't, or nil if it was canceled.
+	spindown := func(remove bool, err error) {
 		if remove {
-			if err := store.remove(fullpathtoc); err != nil {
-				store.logger.Warn("unable to remove", zap.String("name", store.loggerPrefix+"compactFile"), zap.String("path", fullpathtoc), zap.Error(err))
-				if err = store.rename(fullpathtoc, fullpathtoc+".renamed"); err != nil {
-					// Critical level since future recoveries, compactions, and
-					// audits will keep hitting this file until a person
-					// corrects the file system issue.
-					store.logger.Error("also could not rename", zap.String("name", store.loggerPrefix+"compactFile"), zap.String("path", fullpathtoc), zap.Error(err))
+			if result != nil {
+				var size int64
+				if fi, err := store.stat(fullpathtoc); err == nil {
+					size += fi.Size()
 				}
-			}
-			if err := store.remove(fullpath); err != nil {
-				store.logger.Warn("unable to remove", zap.String("name", store.loggerPrefix+"compactFile"), zap.String("path", fullpath), zap.Error(err))
-				if err = store.rename(fullpath, fullpath+".renamed"); err != nil {
-					store.logger.Warn("also could not rename", zap.String("name", store.loggerPrefix+"compactFile"), zap.String("path", fullpath), zap.Error(err))
+				if fi, err := store.stat(fullpath); err == nil {
+					size += fi.Size()
 				}
-			}
-			if blockID != 0 {
-				if err := store.closeLocBlock(blockID); err != nil {
-					store.logger.Warn("error closing in-memory block", zap.String("name", store.loggerPrefix+"compactFile"), zap.String("filename", nametoc), zap.Error(err))
+				atomic.AddInt64(&result.FilesCompacted, 1)
+				atomic.AddInt64(&result.ItemsRewritten, int64(atomic.LoadUint32(&rewrote)))
+				if reclaimed := size - atomic.LoadInt64(&rewroteBytes); reclaimed > 0 {
+					atomic.AddInt64(&result.BytesReclaimed, reclaimed)
 				}
 			}
+			store.compactionRemove(nametoc, blockID, "compactFile")
 		}
 		store.logger.Debug("stats", zap.String("name", store.loggerPrefix+"compactFile"), zap.String("filename", nametoc), zap.Uint64("count", uint64(atomic.LoadUint32(&count))), zap.Uint64("rewrote", uint64(atomic.LoadUint32(&rewrote))), zap.Uint64("stale", uint64(atomic.LoadUint32(&stale))))
+		e := Event{Kind: EventCompaction, Begin: begin, File: nametoc, Count: int64(atomic.LoadUint32(&count)), Changed: int64(atomic.LoadUint32(&rewrote)), Stale: int64(atomic.LoadUint32(&stale)), Err: err}
+		if !remove {
+			if err == nil {
+				return
+			}
+			e.Kind = EventCompactionError
+			store.compactionState.task.failed(err)
+		}
+		store.event(e)
 	}
 	fpr, err := store.openReadSeeker(fullpathtoc)
 	if err != nil {
 		store.logger.Warn("error opening", zap.String("name", store.loggerPrefix+"compactFile"), zap.String("path", fullpathtoc), zap.Error(err))
-		spindown(false)
+		spindown(false, err)
 		return
 	}
+	fpr = &throttledReadSeeker{fpr, &store.compactionState.throttle}
 	fdc, errs := valueReadTOCEntriesBatched(fpr, blockID, store.compactionState.compactionFreeBatchChans, store.compactionState.compactionPendingBatchChans, controlChan)
 	closeIfCloser(fpr)
 	for _, err := range errs {
@@ -416,7 +493,7 @@ func (store *defaultValueStore) compactFile(nametoc string, blockID uint32, cont
 	select {
 	case <-controlChan:
 		store.logger.Debug("canceled compaction", zap.String("name", store.loggerPrefix+"compactFile"), zap.String("filename", nametoc))
-		spindown(false)
+		spindown(false, nil)
 		return
 	default:
 	}
@@ -429,7 +506,7 @@ func (store *defaultValueStore) compactFile(nametoc string, blockID uint32, cont
 		// unable-to-be-read entries from the locmap so replication can repair
 		// them, and then remove the original bad file.
 		store.logger.Error("data read errors; file will be retried later", zap.String("name", store.loggerPrefix+"compactFile"), zap.Uint64("errorCount", uint64(rec)), zap.String("filename", nametoc))
-		spindown(false)
+		spindown(false, fmt.Errorf("%d data read errors", rec))
 		return
 	}
 	if wec := atomic.LoadUint32(&writeErrorCount); wec > 0 {
@@ -437,17 +514,17 @@ func (store *defaultValueStore) compactFile(nametoc string, blockID uint32, cont
 		// until a person can look at the problem and bring the service back
 		// online.
 		store.logger.Error("data write errors; will retry later", zap.String("name", store.loggerPrefix+"compactFile"), zap.Uint64("errorCount", uint64(wec)), zap.String("filename", nametoc))
-		spindown(false)
+		spindown(false, fmt.Errorf("%d data write errors", wec))
 		return
 	}
 	if len(errs) > 0 {
 		if fdc == 0 {
 			store.logger.Warn("errors and no entries were read; file will be retried later", zap.String("name", store.loggerPrefix+"compactFile"), zap.String("filename", nametoc))
-			spindown(false)
+			spindown(false, errs[0])
 			return
 		} else {
 			store.logger.Warn("errors but some entries were read; assuming the recovery was as good as it could get and removing file", zap.String("name", store.loggerPrefix+"compactFile"), zap.String("filename", nametoc))
 		}
 	}
-	spindown(true)
+	spindown(true, nil)
 }
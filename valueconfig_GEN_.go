@@ -1,12 +1,14 @@
 package store
 
 import (
+	"compress/flate"
 	"io"
 	"math"
 	"math/rand"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gholt/locmap"
@@ -15,11 +17,12 @@ import (
 )
 
 // Absolute minimum: timestampnano:8 leader plus at least one TOC entry
-const _VALUE_PAGE_SIZE_MIN = 8 + _VALUE_FILE_ENTRY_SIZE
+const _VALUE_PAGE_SIZE_MIN = 8 + _VALUE_FILE_ENTRY_SIZE_V1
 
 // ValueStoreConfig represents the set of values for configuring a
 // ValueStore. Note that changing the values (shallow changes) in this
-// structure will have no effect on existing ValueStores.
+// structure will have no effect on existing ValueStores; some of them can be
+// changed on a running ValueStore with Reconfigure.
 type ValueStoreConfig struct {
 	// Scale sets how much to scale the default values by; this can reduce
 	// memory usage for systems where the store isn't the only thing running on
@@ -36,6 +39,13 @@ type ValueStoreConfig struct {
 	// would log under names such as "mystoreapp.compaction" and
 	// "mystoreapp.recovery".
 	LoggerName string
+	// Tracer creates spans for each call and for background work; see the
+	// Tracer interface. Defaults to creating no spans at all.
+	Tracer Tracer
+	// EventHandler, if set, is called with each Event, such as a compaction
+	// or an audit failure. It is called from the background tasks, so it
+	// should return quickly, handing the Event off if there is more to do.
+	EventHandler func(Event)
 	// Rand sets the rand.Rand to use as a random data source. Defaults to a
 	// new randomizer based on the current time.
 	Rand *rand.Rand
@@ -78,6 +88,25 @@ type ValueStoreConfig struct {
 	// MsgTimeout indicates the maximum milliseconds a message can be pending
 	// before just discarding it. Defaults to 250 milliseconds.
 	MsgTimeout int
+	// MsgSecrets are the shared cluster secrets used to authenticate
+	// replication messages with an HMAC. The first secret signs outgoing
+	// messages and any of them are accepted for incoming messages, allowing
+	// secrets to be rotated; see SetMsgSecrets. The environment variable form
+	// is a comma separated list. Defaults to none, meaning messages are not
+	// authenticated.
+	MsgSecrets [][]byte
+	// MsgRequireAuth indicates unauthenticated replication messages should be
+	// rejected and authenticated messages always sent, rather than
+	// negotiating with each node. This should only be turned on once every
+	// node has MsgSecrets configured. Defaults to false.
+	MsgRequireAuth bool
+	// MsgCompression indicates bulk-set and pull-replication messages should
+	// be compressed when sent to nodes that have said they accept compressed
+	// messages. Defaults to false.
+	MsgCompression bool
+	// MsgCompressionLevel is the flate compression level, 1 (fastest) through
+	// 9 (smallest), used when MsgCompression is on. Defaults to 1.
+	MsgCompressionLevel int
 	// FileCap indicates how large a file can be before closing it and opening
 	// a new one. Defaults to 4,294,967,295 bytes.
 	FileCap int
@@ -118,16 +147,24 @@ type ValueStoreConfig struct {
 	// messages can be buffered before blocking on creating more. Defaults to
 	// OutPullReplicationWorkers * 4.
 	OutPullReplicationMsgs int
-	// OutPullReplicationBloomN indicates the N-factor for the outgoing
-	// pull-replication bloom filters. This indicates how many keys the bloom
-	// filter can reasonably hold and, in combination with the P-factor,
-	// affects memory usage. Defaults to 1,000,000.
+	// OutPullReplicationBloomN indicates the maximum N-factor for the
+	// outgoing pull-replication bloom filters. Each bloom filter is sized for
+	// the actual number of keys in the range it covers, but ranges will be
+	// split so no filter holds more than this many keys or grows beyond what
+	// fits in MsgCap. Defaults to 1,000,000.
 	OutPullReplicationBloomN int
 	// OutPullReplicationBloomP indicates the P-factor for the outgoing
 	// pull-replication bloom filters. This indicates the desired percentage
 	// chance of a collision within the bloom filter and, in combination with
-	// the N-factor, affects memory usage. Defaults to 0.001.
+	// the N-factor, affects memory usage. With
+	// OutPullReplicationBloomAutoTune this is the highest P-factor that will
+	// be used. Defaults to 0.001.
 	OutPullReplicationBloomP float64
+	// OutPullReplicationBloomAutoTune indicates the P-factor should be
+	// adjusted after each pass based on the false positive rate actually
+	// achieved, as measured by items received in pull replication responses
+	// that the previous pass should have already covered. Defaults to false.
+	OutPullReplicationBloomAutoTune bool
 	// OutPullReplicationMsgTimeout indicates the maximum milliseconds an
 	// outgoing pull replication message can be pending before just discarding
 	// it. Defaults to MsgTimeout.
@@ -143,6 +180,18 @@ type ValueStoreConfig struct {
 	// an outgoing response message to an incoming pull replication message can
 	// be pending before just discarding it. Defaults to MsgTimeout.
 	InPullReplicationResponseMsgTimeout int
+	// MerkleReplication switches outgoing pull replication passes from bloom
+	// filters to hash tree comparisons. A hash tree over the keyA space is
+	// kept up to date as items change; replicas compare tree nodes,
+	// descending only where they differ, and then send each other just the
+	// items in the differing leaves. All replicas should use the same
+	// setting. Defaults to false.
+	MerkleReplication bool
+	// MerkleBits indicates how many of the high bits of keyA select the hash
+	// tree leaf for an item; the tree uses 8 bytes of memory per leaf, with
+	// 2**MerkleBits leaves. This must be at least the ring's partition bit
+	// count or bloom filters will be used instead. Defaults to 16, max 24.
+	MerkleBits int
 	// PushReplicationInterval is much like TombstoneDiscardInterval but for
 	// outgoing push replication passes. Default: 60 seconds
 	PushReplicationInterval int
@@ -154,6 +203,20 @@ type ValueStoreConfig struct {
 	// outgoing push replication message can be pending before just discarding
 	// it. Defaults to MsgTimeout.
 	PushReplicationMsgTimeout int
+	// HandoffInterval indicates the seconds between checks for ring changes
+	// and, while a handoff is in progress, between handoff passes. Defaults
+	// to 1 second.
+	HandoffInterval int
+	// HandoffWorkers indicates how many goroutines may be used for a handoff
+	// pass. Defaults to PushReplicationWorkers.
+	HandoffWorkers int
+	// HintedHandoffInterval indicates the seconds between sending hints, kept
+	// by WriteHint and DeleteHint, to their nodes. Defaults to 1 second.
+	HintedHandoffInterval int
+	// HintedHandoffMaxBytes indicates the most bytes of values that may be
+	// kept as hints; hints beyond that are dropped and left to normal
+	// replication. Defaults to 67108864 (64M).
+	HintedHandoffMaxBytes int
 	// BulkSetMsgCap indicates the maximum bytes for bulk-set messages.
 	// Defaults to MsgCap.
 	BulkSetMsgCap int
@@ -172,6 +235,29 @@ type ValueStoreConfig struct {
 	// response message to an incoming bulk-set message can be pending before
 	// just discarding it. Defaults to MsgTimeout.
 	InBulkSetResponseMsgTimeout int
+	// OutPullReplicationBytesPerSecond limits how many bytes of outgoing
+	// pull-replication messages may be sent per second; see
+	// SetReplicationRateLimits to change this and the other rate limits while
+	// running. Defaults to 0, no limit.
+	OutPullReplicationBytesPerSecond int64
+	// OutPullReplicationMsgsPerSecond limits how many outgoing
+	// pull-replication messages may be sent per second. Defaults to 0, no
+	// limit.
+	OutPullReplicationMsgsPerSecond int64
+	// OutBulkSetBytesPerSecond limits how many bytes of outgoing bulk-set
+	// messages, whether responses to pull replication or from push
+	// replication, may be sent per second. Defaults to 0, no limit.
+	OutBulkSetBytesPerSecond int64
+	// OutBulkSetMsgsPerSecond limits how many outgoing bulk-set messages may
+	// be sent per second. Defaults to 0, no limit.
+	OutBulkSetMsgsPerSecond int64
+	// InBulkSetBytesPerSecond limits how many bytes of incoming bulk-set
+	// messages will be processed per second; once the incoming buffer fills,
+	// additional messages are dropped. Defaults to 0, no limit.
+	InBulkSetBytesPerSecond int64
+	// InBulkSetMsgsPerSecond limits how many incoming bulk-set messages will
+	// be processed per second. Defaults to 0, no limit.
+	InBulkSetMsgsPerSecond int64
 	// BulkSetAckMsgCap indicates the maximum bytes for bulk-set-ack messages.
 	// Defaults to MsgCap.
 	BulkSetAckMsgCap int
@@ -193,11 +279,28 @@ type ValueStoreConfig struct {
 	// compaction. Defaults to 1.
 	CompactionWorkers int
 	// CompactionThreshold indicates how much waste a given file may have
-	// before it is compacted. Defaults to 0.10 (10%).
+	// before it is compacted, as the fraction of its bytes no longer in use.
+	// Defaults to 0.10 (10%).
 	CompactionThreshold float64
 	// CompactionAgeThreshold indicates how old a given file must be before it
 	// is considered for compaction. Defaults to 300 seconds.
 	CompactionAgeThreshold int
+	// CompactionSmallFileThreshold is the number of entries below which a
+	// file is considered small; small files next to each other are merged
+	// into one new file rather than compacted one at a time. Defaults to
+	// 1000.
+	CompactionSmallFileThreshold int
+	// CompactionMergeTargetSize is how large, in bytes, the small files merged
+	// into one new file may add up to. Defaults to FileCap.
+	CompactionMergeTargetSize int
+	// CompactionUpgradesPerPass is how many files in the older v0 format,
+	// without per-value checksums, each compaction pass rewrites even if they
+	// don't otherwise need compacting, upgrading them to the current format
+	// over time. Defaults to 1; -1 disables upgrading.
+	CompactionUpgradesPerPass int
+	// CompactionBytesPerSecond limits how many bytes per second compaction
+	// will read and write. Defaults to 0, unlimited.
+	CompactionBytesPerSecond int64
 	// DiskFreeDisableThreshold controls when to automatically disable writes;
 	// the number is in bytes. If the number of free bytes on either the Path
 	// or TOCPath device falls below this threshold, writes will be
@@ -246,6 +349,27 @@ type ValueStoreConfig struct {
 	// AuditAgeThreshold indicates how old a given file must be before it
 	// is considered for an audit. Defaults to 604,800 seconds (1 week).
 	AuditAgeThreshold int
+	// AuditBytesPerSecond limits how many bytes per second background audits
+	// will read; they also pace themselves to finish in about the
+	// AuditInterval. Audits started with AuditPass are not limited. Defaults
+	// to 0, unlimited.
+	AuditBytesPerSecond int64
+	// AuditHistorySize is how many of the latest audit outcomes, one per file
+	// audited, are kept on disk and returned by AuditReport; past that, the
+	// oldest passed files are dropped before any failed ones. Defaults to
+	// 1000.
+	AuditHistorySize int
+	// AuditDeep has audits also check that each toc entry points within its
+	// data file, past the header, and at bytes no other entry points at,
+	// catching torn writes and bugs that the checksums alone can't; with v1
+	// files, each value is also read and checked against the checksum in its
+	// entry. Entries that fail are treated as corrupted. It costs keeping all
+	// of the entries of the file being audited in memory. Defaults to false.
+	AuditDeep bool
+	// BackgroundIOLatencyTarget, in milliseconds, has compaction and
+	// background audits back off, down to 1/64th of their usual pace, while
+	// Read calls average slower than this. Defaults to 0, disabled.
+	BackgroundIOLatencyTarget int
 	// MemFreeDisableThreshold controls when to automatically disable writes;
 	// the number is in bytes. If the number of free bytes of memory falls
 	// below this threshold, writes will be automatically disabled.
@@ -410,6 +534,33 @@ func resolveValueStoreConfig(c *ValueStoreConfig) *ValueStoreConfig {
 	if cfg.MsgTimeout < 1 {
 		cfg.MsgTimeout = 250
 	}
+	if env := os.Getenv("VALUESTORE_MSG_SECRETS"); env != "" {
+		cfg.MsgSecrets = nil
+		for _, secret := range strings.Split(env, ",") {
+			cfg.MsgSecrets = append(cfg.MsgSecrets, []byte(secret))
+		}
+	}
+	if env := os.Getenv("VALUESTORE_MSG_REQUIRE_AUTH"); env != "" {
+		if val, err := strconv.ParseBool(env); err == nil {
+			cfg.MsgRequireAuth = val
+		}
+	}
+	if env := os.Getenv("VALUESTORE_MSG_COMPRESSION"); env != "" {
+		if val, err := strconv.ParseBool(env); err == nil {
+			cfg.MsgCompression = val
+		}
+	}
+	if env := os.Getenv("VALUESTORE_MSG_COMPRESSION_LEVEL"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			cfg.MsgCompressionLevel = val
+		}
+	}
+	if cfg.MsgCompressionLevel < flate.BestSpeed {
+		cfg.MsgCompressionLevel = flate.BestSpeed
+	}
+	if cfg.MsgCompressionLevel > flate.BestCompression {
+		cfg.MsgCompressionLevel = flate.BestCompression
+	}
 	if env := os.Getenv("VALUESTORE_FILE_CAP"); env != "" {
 		if val, err := strconv.Atoi(env); err == nil {
 			cfg.FileCap = val
@@ -556,6 +707,11 @@ func resolveValueStoreConfig(c *ValueStoreConfig) *ValueStoreConfig {
 	if cfg.OutPullReplicationBloomP < 0.000001 {
 		cfg.OutPullReplicationBloomP = 0.000001
 	}
+	if env := os.Getenv("VALUESTORE_OUT_PULL_REPLICATION_BLOOM_AUTO_TUNE"); env != "" {
+		if val, err := strconv.ParseBool(env); err == nil {
+			cfg.OutPullReplicationBloomAutoTune = val
+		}
+	}
 	if env := os.Getenv("VALUESTORE_OUT_PULL_REPLICATION_MSG_TIMEOUT"); env != "" {
 		if val, err := strconv.Atoi(env); err == nil {
 			cfg.OutPullReplicationMsgTimeout = val
@@ -600,6 +756,25 @@ func resolveValueStoreConfig(c *ValueStoreConfig) *ValueStoreConfig {
 	if cfg.InPullReplicationResponseMsgTimeout < 1 {
 		cfg.InPullReplicationResponseMsgTimeout = 250
 	}
+	if env := os.Getenv("VALUESTORE_MERKLE_REPLICATION"); env != "" {
+		if val, err := strconv.ParseBool(env); err == nil {
+			cfg.MerkleReplication = val
+		}
+	}
+	if env := os.Getenv("VALUESTORE_MERKLE_BITS"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			cfg.MerkleBits = val
+		}
+	}
+	if cfg.MerkleBits == 0 {
+		cfg.MerkleBits = 16
+	}
+	if cfg.MerkleBits < 1 {
+		cfg.MerkleBits = 1
+	}
+	if cfg.MerkleBits > 24 {
+		cfg.MerkleBits = 24
+	}
 	if env := os.Getenv("VALUESTORE_PUSH_REPLICATION_INTERVAL"); env != "" {
 		if val, err := strconv.Atoi(env); err == nil {
 			cfg.PushReplicationInterval = val
@@ -633,6 +808,38 @@ func resolveValueStoreConfig(c *ValueStoreConfig) *ValueStoreConfig {
 	if cfg.PushReplicationMsgTimeout < 1 {
 		cfg.PushReplicationMsgTimeout = 250
 	}
+	if env := os.Getenv("VALUESTORE_HANDOFF_INTERVAL"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			cfg.HandoffInterval = val
+		}
+	}
+	if cfg.HandoffInterval < 1 {
+		cfg.HandoffInterval = 1
+	}
+	if env := os.Getenv("VALUESTORE_HANDOFF_WORKERS"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			cfg.HandoffWorkers = val
+		}
+	}
+	if cfg.HandoffWorkers < 1 {
+		cfg.HandoffWorkers = cfg.PushReplicationWorkers
+	}
+	if env := os.Getenv("VALUESTORE_HINTED_HANDOFF_INTERVAL"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			cfg.HintedHandoffInterval = val
+		}
+	}
+	if cfg.HintedHandoffInterval < 1 {
+		cfg.HintedHandoffInterval = 1
+	}
+	if env := os.Getenv("VALUESTORE_HINTED_HANDOFF_MAX_BYTES"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			cfg.HintedHandoffMaxBytes = val
+		}
+	}
+	if cfg.HintedHandoffMaxBytes < 1 {
+		cfg.HintedHandoffMaxBytes = 67108864
+	}
 	if env := os.Getenv("VALUESTORE_BULK_SET_MSG_CAP"); env != "" {
 		if val, err := strconv.Atoi(env); err == nil {
 			cfg.BulkSetMsgCap = val
@@ -688,6 +895,54 @@ func resolveValueStoreConfig(c *ValueStoreConfig) *ValueStoreConfig {
 	if cfg.InBulkSetResponseMsgTimeout < 1 {
 		cfg.InBulkSetResponseMsgTimeout = 250
 	}
+	if env := os.Getenv("VALUESTORE_OUT_PULL_REPLICATION_BYTES_PER_SECOND"); env != "" {
+		if val, err := strconv.ParseInt(env, 10, 64); err == nil {
+			cfg.OutPullReplicationBytesPerSecond = val
+		}
+	}
+	if cfg.OutPullReplicationBytesPerSecond < 0 {
+		cfg.OutPullReplicationBytesPerSecond = 0
+	}
+	if env := os.Getenv("VALUESTORE_OUT_PULL_REPLICATION_MSGS_PER_SECOND"); env != "" {
+		if val, err := strconv.ParseInt(env, 10, 64); err == nil {
+			cfg.OutPullReplicationMsgsPerSecond = val
+		}
+	}
+	if cfg.OutPullReplicationMsgsPerSecond < 0 {
+		cfg.OutPullReplicationMsgsPerSecond = 0
+	}
+	if env := os.Getenv("VALUESTORE_OUT_BULK_SET_BYTES_PER_SECOND"); env != "" {
+		if val, err := strconv.ParseInt(env, 10, 64); err == nil {
+			cfg.OutBulkSetBytesPerSecond = val
+		}
+	}
+	if cfg.OutBulkSetBytesPerSecond < 0 {
+		cfg.OutBulkSetBytesPerSecond = 0
+	}
+	if env := os.Getenv("VALUESTORE_OUT_BULK_SET_MSGS_PER_SECOND"); env != "" {
+		if val, err := strconv.ParseInt(env, 10, 64); err == nil {
+			cfg.OutBulkSetMsgsPerSecond = val
+		}
+	}
+	if cfg.OutBulkSetMsgsPerSecond < 0 {
+		cfg.OutBulkSetMsgsPerSecond = 0
+	}
+	if env := os.Getenv("VALUESTORE_IN_BULK_SET_BYTES_PER_SECOND"); env != "" {
+		if val, err := strconv.ParseInt(env, 10, 64); err == nil {
+			cfg.InBulkSetBytesPerSecond = val
+		}
+	}
+	if cfg.InBulkSetBytesPerSecond < 0 {
+		cfg.InBulkSetBytesPerSecond = 0
+	}
+	if env := os.Getenv("VALUESTORE_IN_BULK_SET_MSGS_PER_SECOND"); env != "" {
+		if val, err := strconv.ParseInt(env, 10, 64); err == nil {
+			cfg.InBulkSetMsgsPerSecond = val
+		}
+	}
+	if cfg.InBulkSetMsgsPerSecond < 0 {
+		cfg.InBulkSetMsgsPerSecond = 0
+	}
 	if env := os.Getenv("VALUESTORE_OUT_BULK_SET_ACK_MSG_CAP"); env != "" {
 		if val, err := strconv.Atoi(env); err == nil {
 			cfg.BulkSetAckMsgCap = val
@@ -776,6 +1031,44 @@ func resolveValueStoreConfig(c *ValueStoreConfig) *ValueStoreConfig {
 	if cfg.CompactionAgeThreshold < 1 {
 		cfg.CompactionAgeThreshold = 1
 	}
+	if env := os.Getenv("VALUESTORE_COMPACTION_SMALL_FILE_THRESHOLD"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			cfg.CompactionSmallFileThreshold = val
+		}
+	}
+	if cfg.CompactionSmallFileThreshold == 0 {
+		cfg.CompactionSmallFileThreshold = 1000
+	}
+	if cfg.CompactionSmallFileThreshold < 0 {
+		cfg.CompactionSmallFileThreshold = 0
+	}
+	if env := os.Getenv("VALUESTORE_COMPACTION_MERGE_TARGET_SIZE"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			cfg.CompactionMergeTargetSize = val
+		}
+	}
+	if cfg.CompactionMergeTargetSize == 0 || cfg.CompactionMergeTargetSize > cfg.FileCap {
+		cfg.CompactionMergeTargetSize = cfg.FileCap
+	}
+	if cfg.CompactionMergeTargetSize < 1 {
+		cfg.CompactionMergeTargetSize = 1
+	}
+	if env := os.Getenv("VALUESTORE_COMPACTION_UPGRADES_PER_PASS"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			cfg.CompactionUpgradesPerPass = val
+		}
+	}
+	if cfg.CompactionUpgradesPerPass == 0 {
+		cfg.CompactionUpgradesPerPass = 1
+	}
+	if env := os.Getenv("VALUESTORE_COMPACTION_BYTES_PER_SECOND"); env != "" {
+		if val, err := strconv.ParseInt(env, 10, 64); err == nil {
+			cfg.CompactionBytesPerSecond = val
+		}
+	}
+	if cfg.CompactionBytesPerSecond < 0 {
+		cfg.CompactionBytesPerSecond = 0
+	}
 	if env := os.Getenv("VALUESTORE_DISK_FREE_DISABLE_THRESHOLD"); env != "" {
 		if val, err := strconv.ParseUint(env, 10, 64); err == nil {
 			cfg.DiskFreeDisableThreshold = val
@@ -849,6 +1142,38 @@ func resolveValueStoreConfig(c *ValueStoreConfig) *ValueStoreConfig {
 	if cfg.AuditAgeThreshold < 1 {
 		cfg.AuditAgeThreshold = 1
 	}
+	if env := os.Getenv("VALUESTORE_AUDIT_BYTES_PER_SECOND"); env != "" {
+		if val, err := strconv.ParseInt(env, 10, 64); err == nil {
+			cfg.AuditBytesPerSecond = val
+		}
+	}
+	if cfg.AuditBytesPerSecond < 0 {
+		cfg.AuditBytesPerSecond = 0
+	}
+	if env := os.Getenv("VALUESTORE_AUDIT_HISTORY_SIZE"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			cfg.AuditHistorySize = val
+		}
+	}
+	if cfg.AuditHistorySize == 0 {
+		cfg.AuditHistorySize = 1000
+	}
+	if cfg.AuditHistorySize < 1 {
+		cfg.AuditHistorySize = 1
+	}
+	if env := os.Getenv("VALUESTORE_AUDIT_DEEP"); env != "" {
+		if val, err := strconv.ParseBool(env); err == nil {
+			cfg.AuditDeep = val
+		}
+	}
+	if env := os.Getenv("VALUESTORE_BACKGROUND_IO_LATENCY_TARGET"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			cfg.BackgroundIOLatencyTarget = val
+		}
+	}
+	if cfg.BackgroundIOLatencyTarget < 0 {
+		cfg.BackgroundIOLatencyTarget = 0
+	}
 	if env := os.Getenv("VALUESTORE_MEM_FREE_DISABLE_THRESHOLD"); env != "" {
 		if val, err := strconv.ParseUint(env, 10, 64); err == nil {
 			cfg.MemFreeDisableThreshold = val
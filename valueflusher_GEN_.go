@@ -15,6 +15,7 @@ type valueFlusherState struct {
 
 	startupShutdownLock sync.Mutex
 	notifyChan          chan *bgNotification
+	task                backgroundTask
 }
 
 func (store *defaultValueStore) flusherConfig(cfg *ValueStoreConfig) {
@@ -41,6 +42,7 @@ func (store *defaultValueStore) flusherShutdown() {
 		}
 		<-c
 		store.flusherState.notifyChan = nil
+		store.flusherState.task.stop()
 	}
 	store.flusherState.startupShutdownLock.Unlock()
 }
@@ -50,6 +52,7 @@ func (store *defaultValueStore) flusherLauncher(notifyChan chan *bgNotification)
 	store.randMutex.Lock()
 	nextRun := time.Now().Add(time.Duration(interval + interval*store.rand.NormFloat64()*0.1))
 	store.randMutex.Unlock()
+	store.flusherState.task.launch(nextRun)
 	justFlushed := false
 	running := true
 	for running {
@@ -69,6 +72,7 @@ func (store *defaultValueStore) flusherLauncher(notifyChan chan *bgNotification)
 		store.randMutex.Lock()
 		nextRun = time.Now().Add(time.Duration(interval + interval*store.rand.NormFloat64()*0.1))
 		store.randMutex.Unlock()
+		store.flusherState.task.schedule(nextRun)
 		if notification != nil {
 			if notification.action == _BG_DISABLE {
 				running = false
@@ -78,6 +82,7 @@ func (store *defaultValueStore) flusherLauncher(notifyChan chan *bgNotification)
 			notification.doneChan <- struct{}{}
 			continue
 		}
+		store.flusherState.task.begin()
 		m := atomic.LoadInt32(&store.modifications)
 		atomic.AddInt32(&store.modifications, -m)
 		if (m == 0 && !justFlushed) || (m > 0 && m < store.flusherState.flusherThreshold) {
@@ -87,5 +92,6 @@ func (store *defaultValueStore) flusherLauncher(notifyChan chan *bgNotification)
 		} else {
 			justFlushed = false
 		}
+		store.flusherState.task.end()
 	}
 }
@@ -0,0 +1,318 @@
+package store
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gholt/brimtime"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+)
+
+// Handoff streams all out of place data, that is data for partitions the
+// local node is no longer responsible for, to the new owners after a ring
+// change. Push replication only sends one batch per partition per pass, so
+// handing off a large partition with it alone can take many intervals.
+//
+// Each handoff pass first counts what is left to hand off for the ring
+// version, then sends all of it; the new owners' acks then locally remove the
+// handed off data. Passes repeat each HandoffInterval until nothing is left,
+// at which point the handoff is complete and push replication takes over
+// again for any stragglers.
+type valueHandoffState struct {
+	interval   int
+	workers    int
+	msgTimeout time.Duration
+
+	startupShutdownLock sync.Mutex
+	notifyChan          chan *bgNotification
+	task                backgroundTask
+	lists               [][]uint64
+	valBufs             [][]byte
+
+	statusLock sync.Mutex
+	// ringVersion is the ring version the handoff status is for; a differing
+	// ring version starts a new handoff. It starts out as the first ring
+	// version seen, as the ring the store starts with is no ring change.
+	ringVersion int64
+	active      bool
+	begin       time.Time
+	end         time.Time
+	partitions  map[uint32]*HandoffPartitionStatus
+}
+
+func (store *defaultValueStore) handoffConfig(cfg *ValueStoreConfig) {
+	store.handoffState.interval = cfg.HandoffInterval
+	store.handoffState.workers = cfg.HandoffWorkers
+	store.handoffState.msgTimeout = time.Duration(cfg.PushReplicationMsgTimeout) * time.Millisecond
+}
+
+func (store *defaultValueStore) handoffStartup() {
+	store.handoffState.startupShutdownLock.Lock()
+	if store.handoffState.notifyChan == nil {
+		store.handoffState.notifyChan = make(chan *bgNotification, 1)
+		store.handoffState.lists = nil
+		store.handoffState.valBufs = nil
+		go store.handoffLauncher(store.handoffState.notifyChan)
+	}
+	store.handoffState.startupShutdownLock.Unlock()
+}
+
+func (store *defaultValueStore) handoffShutdown() {
+	store.handoffState.startupShutdownLock.Lock()
+	if store.handoffState.notifyChan != nil {
+		c := make(chan struct{}, 1)
+		store.handoffState.notifyChan <- &bgNotification{
+			action:   _BG_DISABLE,
+			doneChan: c,
+		}
+		<-c
+		store.handoffState.notifyChan = nil
+		store.handoffState.task.stop()
+		store.handoffState.lists = nil
+		store.handoffState.valBufs = nil
+	}
+	store.handoffState.startupShutdownLock.Unlock()
+}
+
+func (store *defaultValueStore) handoffLauncher(notifyChan chan *bgNotification) {
+	interval := float64(store.handoffState.interval) * float64(time.Second)
+	nextRun := time.Now().Add(time.Duration(interval))
+	store.handoffState.task.launch(nextRun)
+	var notification *bgNotification
+	running := true
+	for running {
+		if notification == nil {
+			sleep := nextRun.Sub(time.Now())
+			if sleep > 0 {
+				select {
+				case notification = <-notifyChan:
+				case <-time.After(sleep):
+				}
+			} else {
+				select {
+				case notification = <-notifyChan:
+				default:
+				}
+			}
+		}
+		nextRun = time.Now().Add(time.Duration(interval))
+		store.handoffState.task.schedule(nextRun)
+		if notification != nil {
+			var nextNotification *bgNotification
+			switch notification.action {
+			case _BG_PASS:
+				nextNotification = store.handoffPass(notifyChan)
+			case _BG_DISABLE:
+				running = false
+			default:
+				store.logger.Error("invalid action requested", zap.String("name", store.loggerPrefix+"handoff"), zap.Int("action", int(notification.action)))
+			}
+			notification.doneChan <- struct{}{}
+			notification = nextNotification
+		} else {
+			notification = store.handoffPass(notifyChan)
+		}
+	}
+}
+
+// handoffActive returns true if a handoff is in progress for the current
+// ring version; push replication leaves out of place data to it meanwhile.
+func (store *defaultValueStore) handoffActive(ringVersion int64) bool {
+	store.handoffState.statusLock.Lock()
+	active := store.handoffState.active && store.handoffState.ringVersion == ringVersion
+	store.handoffState.statusLock.Unlock()
+	return active
+}
+
+// HandoffStatus returns the progress of handing off data after the latest
+// ring change.
+func (store *defaultValueStore) HandoffStatus(ctx context.Context) (*HandoffStatus, error) {
+	_, span := store.startSpan(ctx, "HandoffStatus")
+	defer span.End()
+	store.handoffState.statusLock.Lock()
+	status := &HandoffStatus{
+		RingVersion: store.handoffState.ringVersion,
+		Active:      store.handoffState.active,
+		Begin:       store.handoffState.begin,
+		End:         store.handoffState.end,
+		Partitions:  make([]HandoffPartitionStatus, 0, len(store.handoffState.partitions)),
+	}
+	for _, p := range store.handoffState.partitions {
+		status.Partitions = append(status.Partitions, *p)
+		status.RemainingKeys += p.RemainingKeys
+		status.RemainingBytes += p.RemainingBytes
+		status.SentKeys += p.SentKeys
+		status.SentBytes += p.SentBytes
+	}
+	store.handoffState.statusLock.Unlock()
+	sort.Slice(status.Partitions, func(i, j int) bool {
+		return status.Partitions[i].Partition < status.Partitions[j].Partition
+	})
+	return status, nil
+}
+
+func (store *defaultValueStore) handoffPass(notifyChan chan *bgNotification) *bgNotification {
+	if store.msgRing == nil {
+		return nil
+	}
+	ring := store.msgRing.Ring()
+	if ring == nil {
+		return nil
+	}
+	ringVersion := ring.Version()
+	store.handoffState.statusLock.Lock()
+	if store.handoffState.ringVersion == 0 {
+		store.handoffState.ringVersion = ringVersion
+	}
+	if store.handoffState.ringVersion != ringVersion {
+		store.handoffState.ringVersion = ringVersion
+		store.handoffState.active = true
+		store.handoffState.begin = time.Now()
+		store.handoffState.end = time.Time{}
+		store.handoffState.partitions = make(map[uint32]*HandoffPartitionStatus)
+	}
+	active := store.handoffState.active
+	store.handoffState.statusLock.Unlock()
+	if !active {
+		return nil
+	}
+	store.handoffState.task.begin()
+	begin := time.Now()
+	defer func() {
+		elapsed := time.Now().Sub(begin)
+		store.logger.Debug("pass completed", zap.String("name", store.loggerPrefix+"handoff"), zap.Duration("elapsed", elapsed))
+		atomic.StoreInt64(&store.handoffNanoseconds, elapsed.Nanoseconds())
+		store.handoffPassDuration.observe(elapsed)
+		store.handoffState.task.end()
+	}()
+	pbc := ring.PartitionBitCount()
+	partitionShift := uint64(64 - pbc)
+	partitionMax := (uint64(1) << pbc) - 1
+	workerMax := uint64(store.handoffState.workers - 1)
+	// To avoid memory churn, the scratchpad areas are allocated just once and
+	// passed in to the workers.
+	for len(store.handoffState.lists) < int(workerMax+1) {
+		store.handoffState.lists = append(store.handoffState.lists, make([]uint64, store.bulkSetState.msgCap/_VALUE_BULK_SET_MSG_MIN_ENTRY_LENGTH*2))
+	}
+	for len(store.handoffState.valBufs) < int(workerMax+1) {
+		store.handoffState.valBufs = append(store.handoffState.valBufs, make([]byte, store.valueCap))
+	}
+	timestampbitsNow := uint64(brimtime.TimeToUnixMicro(time.Now())) << _TSB_UTIL_BITS
+	cutoff := timestampbitsNow - store.replicationIgnoreRecent
+	tombstoneCutoff := timestampbitsNow - store.tombstoneDiscardState.age
+	partitionRange := func(partition uint64) (uint64, uint64) {
+		if partition == partitionMax {
+			return partition << partitionShift, math.MaxUint64
+		}
+		return partition << partitionShift, ((partition + 1) << partitionShift) - 1
+	}
+	var abort uint32
+	ringChanged := func() bool {
+		if atomic.LoadUint32(&abort) != 0 {
+			return true
+		}
+		ring2 := store.msgRing.Ring()
+		return ring2 == nil || ring2.Version() != ringVersion
+	}
+	// count updates the remaining keys and bytes to hand off for the
+	// partition, returning true if there are any.
+	count := func(partition uint64) bool {
+		var keys, bytes int64
+		rangeBegin, rangeEnd := partitionRange(partition)
+		store.locmap.ScanCallback(rangeBegin, rangeEnd, 0, _TSB_LOCAL_REMOVAL, cutoff, math.MaxUint64, func(keyA uint64, keyB uint64, timestampbits uint64, length uint32) bool {
+			if timestampbits&_TSB_DELETION == 0 || timestampbits >= tombstoneCutoff {
+				keys++
+				bytes += int64(length)
+			}
+			return true
+		})
+		store.handoffState.statusLock.Lock()
+		p := store.handoffState.partitions[uint32(partition)]
+		if p == nil && keys > 0 {
+			p = &HandoffPartitionStatus{Partition: uint32(partition)}
+			store.handoffState.partitions[uint32(partition)] = p
+		}
+		if p != nil {
+			p.RemainingKeys = keys
+			p.RemainingBytes = bytes
+		}
+		store.handoffState.statusLock.Unlock()
+		return keys > 0
+	}
+	// sent records each bulk-set message sent for the partition. What's sent
+	// is taken off the remaining counts, as a guide until count is run again
+	// on the next pass.
+	sent := func(partition uint64) func(int64, int64) {
+		return func(keys int64, bytes int64) {
+			atomic.AddInt32(&store.outHandoffs, 1)
+			atomic.AddInt32(&store.outHandoffValues, int32(keys))
+			store.handoffState.statusLock.Lock()
+			if p := store.handoffState.partitions[uint32(partition)]; p != nil {
+				p.SentKeys += keys
+				p.SentBytes += bytes
+				p.RemainingKeys -= keys
+				if p.RemainingKeys < 0 {
+					p.RemainingKeys = 0
+				}
+				p.RemainingBytes -= bytes
+				if p.RemainingBytes < 0 {
+					p.RemainingBytes = 0
+				}
+			}
+			store.handoffState.statusLock.Unlock()
+		}
+	}
+	var remaining uint32
+	wg := &sync.WaitGroup{}
+	wg.Add(int(workerMax + 1))
+	for worker := uint64(0); worker <= workerMax; worker++ {
+		go func(worker uint64) {
+			list := store.handoffState.lists[worker]
+			valbuf := store.handoffState.valBufs[worker]
+			for partition := worker; partition <= partitionMax; partition += workerMax + 1 {
+				if ringChanged() {
+					break
+				}
+				if !ring.Responsible(uint32(partition)) && count(partition) {
+					atomic.StoreUint32(&remaining, 1)
+					rangeBegin, rangeEnd := partitionRange(partition)
+					store.pushReplicationRange(uint32(partition), rangeBegin, rangeEnd, list, valbuf, store.handoffState.msgTimeout, ringChanged, sent(partition))
+				}
+			}
+			wg.Done()
+		}(worker)
+	}
+	waitChan := make(chan struct{}, 1)
+	go func() {
+		wg.Wait()
+		close(waitChan)
+	}()
+	select {
+	case notification := <-notifyChan:
+		atomic.AddUint32(&abort, 1)
+		<-waitChan
+		return notification
+	case <-waitChan:
+	}
+	if ringChanged() || atomic.LoadUint32(&remaining) != 0 {
+		return nil
+	}
+	store.handoffState.statusLock.Lock()
+	if store.handoffState.ringVersion == ringVersion {
+		store.handoffState.active = false
+		store.handoffState.end = time.Now()
+	}
+	var keys int64
+	for _, p := range store.handoffState.partitions {
+		keys += p.SentKeys
+	}
+	elapsed := store.handoffState.end.Sub(store.handoffState.begin)
+	store.handoffState.statusLock.Unlock()
+	atomic.AddInt32(&store.handoffCompletions, 1)
+	store.logger.Info("handoff completed", zap.String("name", store.loggerPrefix+"handoff"), zap.Int64("ringVersion", ringVersion), zap.Int64("keys", keys), zap.Duration("elapsed", elapsed))
+	return nil
+}
@@ -0,0 +1,280 @@
+package store
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ring "github.com/gholt/devicering"
+	"github.com/gholt/msgring"
+	"golang.org/x/net/context"
+)
+
+type msgRingValueHintTester struct {
+	ring         ring.Ring
+	lock         sync.Mutex
+	reachable    bool
+	toNodeIDs    []uint64
+	toNodeBodies [][]byte
+}
+
+func (m *msgRingValueHintTester) Ring() ring.Ring {
+	return m.ring
+}
+
+func (m *msgRingValueHintTester) MaxMsgLength() uint64 {
+	return 65536
+}
+
+func (m *msgRingValueHintTester) SetMsgHandler(msgType uint64, handler msgring.MsgUnmarshaller) {
+}
+
+func (m *msgRingValueHintTester) MsgToNode(msg msgring.Msg, nodeID uint64, timeout time.Duration) {
+	if bsm, ok := msg.(*valueBulkSetMsg); ok {
+		m.lock.Lock()
+		m.toNodeIDs = append(m.toNodeIDs, nodeID)
+		m.toNodeBodies = append(m.toNodeBodies, append([]byte(nil), bsm.body...))
+		m.lock.Unlock()
+	}
+	msg.Free(0, 0)
+}
+
+func (m *msgRingValueHintTester) MsgToOtherReplicas(msg msgring.Msg, partition uint32, timeout time.Duration) {
+	msg.Free(0, 0)
+}
+
+func (m *msgRingValueHintTester) NodeReachable(nodeID uint64) bool {
+	m.lock.Lock()
+	reachable := m.reachable
+	m.lock.Unlock()
+	return reachable
+}
+
+func (m *msgRingValueHintTester) sent() ([]uint64, [][]byte) {
+	m.lock.Lock()
+	ids, bodies := m.toNodeIDs, m.toNodeBodies
+	m.toNodeIDs = nil
+	m.toNodeBodies = nil
+	m.lock.Unlock()
+	return ids, bodies
+}
+
+func TestValueHintedHandoff(t *testing.T) {
+	b := ring.NewBuilder(64)
+	b.SetReplicaCount(2)
+	n, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	r.SetLocalNode(n.ID())
+	m := &msgRingValueHintTester{ring: r}
+	cfg := newTestValueStoreConfig()
+	cfg.MsgRing = m
+	cfg.HintedHandoffInterval = 3600
+	cfg.HintedHandoffMaxBytes = 20
+	cfg.PushReplicationMsgTimeout = 1
+	// A single worker handles the acks in order.
+	cfg.InBulkSetAckWorkers = 1
+	store, _ := newTestValueStore(cfg)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	if _, err = store.WriteHint(context.Background(), n.ID(), 1, 2, 0x500, []byte("testing")); err == nil {
+		t.Fatal("expected error for hint to local node")
+	}
+	if _, err = store.WriteHint(context.Background(), 12345, 1, 2, 0x500, []byte("testing")); err == nil {
+		t.Fatal("expected error for hint to unknown node")
+	}
+	// The third write is stored but its hint is dropped for lack of room.
+	for i := uint64(1); i <= 3; i++ {
+		if _, err = store.WriteHint(context.Background(), n2.ID(), i, 2, 0x500, []byte("testing")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = store.DeleteHint(context.Background(), n2.ID(), 4, 2, 0x500); err != nil {
+		t.Fatal(err)
+	}
+	if ts, _, err := store.Read(context.Background(), 3, 2, nil); err != nil || ts != 0x500 {
+		t.Fatal(ts, err)
+	}
+	stats, _ := store.Stats(context.Background(), false)
+	if s := stats.(*ValueStoreStats); s.Hints != 3 || s.HintBytes != 14 || s.HintsDropped != 1 {
+		t.Fatal(s.Hints, s.HintBytes, s.HintsDropped)
+	}
+	// Nothing is sent while the node is unreachable.
+	notifyChan := make(chan *bgNotification)
+	store.hintedHandoffPass(notifyChan)
+	if ids, _ := m.sent(); len(ids) != 0 {
+		t.Fatal(ids)
+	}
+	m.lock.Lock()
+	m.reachable = true
+	m.lock.Unlock()
+	store.hintedHandoffPass(notifyChan)
+	ids, bodies := m.sent()
+	if len(ids) != 1 || ids[0] != n2.ID() || len(bodies[0]) != 3*_VALUE_BULK_SET_MSG_ENTRY_HEADER_LENGTH+14 {
+		t.Fatal(ids, len(bodies))
+	}
+	// The node acknowledges two of the hints; the other is resent. Acks not
+	// naming the node, such as from the other replicas, or naming some other
+	// node don't count, so their ack of the third hint doesn't remove it.
+	ack := func(nodeID uint64, keyAs ...uint64) {
+		bsam := &valueBulkSetAckMsg{nodeID: nodeID, body: make([]byte, 0, 1000)}
+		for _, keyA := range keyAs {
+			timestampbits := uint64(0x500 << _TSB_UTIL_BITS)
+			if keyA == 4 {
+				timestampbits |= _TSB_DELETION
+			}
+			if !bsam.add(keyA, 2, timestampbits) {
+				t.Fatal("")
+			}
+		}
+		buf := &bytes.Buffer{}
+		bsam.WriteContent(buf)
+		l := uint64(buf.Len())
+		if l != bsam.MsgLength() {
+			t.Fatal(l, bsam.MsgLength())
+		}
+		in := store.newInBulkSetAckMsg
+		if nodeID != 0 {
+			if bsam.MsgType() != _VALUE_NODE_BULK_SET_ACK_MSG_TYPE {
+				t.Fatal(bsam.MsgType())
+			}
+			in = store.newInNodeBulkSetAckMsg
+		}
+		if n, err := in(buf, l); err != nil || n != l {
+			t.Fatal(n, err)
+		}
+	}
+	ack(0, 2)
+	ack(n2.ID()+1, 2)
+	ack(n2.ID(), 1, 4)
+	for i := 0; i < 100 && atomic.LoadInt64(&store.hintedHandoffState.count) != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c := atomic.LoadInt64(&store.hintedHandoffState.count); c != 1 {
+		t.Fatal(c)
+	}
+	time.Sleep(2 * time.Millisecond)
+	store.hintedHandoffPass(notifyChan)
+	ids, bodies = m.sent()
+	if len(ids) != 1 || len(bodies[0]) != _VALUE_BULK_SET_MSG_ENTRY_HEADER_LENGTH+7 {
+		t.Fatal(ids, len(bodies))
+	}
+	stats, _ = store.Stats(context.Background(), false)
+	if s := stats.(*ValueStoreStats); s.Hints != 1 || s.HintBytes != 7 || s.HintsAcked != 2 || s.OutHintedHandoffs != 2 || s.OutHintedHandoffValues != 4 {
+		t.Fatal(s.Hints, s.HintBytes, s.HintsAcked, s.OutHintedHandoffs, s.OutHintedHandoffValues)
+	}
+}
+
+func TestValueHintedHandoffSaved(t *testing.T) {
+	b := ring.NewBuilder(64)
+	b.SetReplicaCount(2)
+	n, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	r.SetLocalNode(n.ID())
+	fs := newMemFS()
+	newStore := func() *defaultValueStore {
+		cfg := newTestValueStoreConfigWithFS(fs)
+		cfg.MsgRing = &msgRingValueHintTester{ring: r}
+		cfg.HintedHandoffInterval = 3600
+		store, _ := newTestValueStore(cfg)
+		if err := store.Startup(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	store := newStore()
+	if _, err = store.WriteHint(context.Background(), n2.ID(), 1, 2, 0x500, []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.DeleteHint(context.Background(), n2.ID(), 4, 2, 0x500); err != nil {
+		t.Fatal(err)
+	}
+	store.Shutdown(context.Background())
+	// The hints survive a restart.
+	store = newStore()
+	defer store.Shutdown(context.Background())
+	stats, _ := store.Stats(context.Background(), false)
+	if s := stats.(*ValueStoreStats); s.Hints != 2 || s.HintBytes != 7 {
+		t.Fatal(s.Hints, s.HintBytes)
+	}
+	store.hintedHandoffState.lock.Lock()
+	h := store.hintedHandoffState.nodes[n2.ID()][valueHintKey{keyA: 1, keyB: 2}]
+	d := store.hintedHandoffState.nodes[n2.ID()][valueHintKey{keyA: 4, keyB: 2}]
+	store.hintedHandoffState.lock.Unlock()
+	if h == nil || h.timestampbits != 0x500<<_TSB_UTIL_BITS || string(h.value) != "testing" {
+		t.Fatal(h)
+	}
+	if d == nil || d.timestampbits != (0x500<<_TSB_UTIL_BITS)|_TSB_DELETION || d.value != nil {
+		t.Fatal(d)
+	}
+}
+
+func TestValueHintedHandoffTooLarge(t *testing.T) {
+	b := ring.NewBuilder(64)
+	b.SetReplicaCount(2)
+	n, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	r.SetLocalNode(n.ID())
+	m := &msgRingValueHintTester{ring: r, reachable: true}
+	cfg := newTestValueStoreConfig()
+	cfg.MsgRing = m
+	cfg.HintedHandoffInterval = 3600
+	cfg.BulkSetMsgCap = _VALUE_BULK_SET_MSG_ENTRY_HEADER_LENGTH + 10
+	store, _ := newTestValueStore(cfg)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	// The write itself is stored but its hint could never be sent.
+	if _, err = store.WriteHint(context.Background(), n2.ID(), 1, 2, 0x500, []byte("testing testing")); err != nil {
+		t.Fatal(err)
+	}
+	if ts, _, err := store.Read(context.Background(), 1, 2, nil); err != nil || ts != 0x500 {
+		t.Fatal(ts, err)
+	}
+	stats, _ := store.Stats(context.Background(), false)
+	if s := stats.(*ValueStoreStats); s.Hints != 0 || s.HintBytes != 0 || s.HintsDropped != 1 {
+		t.Fatal(s.Hints, s.HintBytes, s.HintsDropped)
+	}
+	// A hint kept while the cap was larger is dropped when found too large
+	// to send, rather than retried forever.
+	store.bulkSetState.msgCap = 1000
+	store.hint(n2.ID(), valueHintKey{keyA: 1, keyB: 2}, 0x500<<_TSB_UTIL_BITS, []byte("testing testing"))
+	store.bulkSetState.msgCap = cfg.BulkSetMsgCap
+	if _, err = store.WriteHint(context.Background(), n2.ID(), 5, 2, 0x500, []byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	store.hintedHandoffPass(make(chan *bgNotification))
+	ids, bodies := m.sent()
+	if len(ids) != 1 || len(bodies[0]) != _VALUE_BULK_SET_MSG_ENTRY_HEADER_LENGTH+4 {
+		t.Fatal(ids, len(bodies))
+	}
+	stats, _ = store.Stats(context.Background(), false)
+	if s := stats.(*ValueStoreStats); s.Hints != 1 || s.HintBytes != 4 || s.HintsDropped != 1 {
+		t.Fatal(s.Hints, s.HintBytes, s.HintsDropped)
+	}
+}
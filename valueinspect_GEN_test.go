@@ -0,0 +1,131 @@
+package store
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/gholt/brimio"
+	"github.com/spaolacci/murmur3"
+)
+
+func TestValueInspectAndRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "valueinspect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checksumInterval := 64
+	write := func(fullPath string, data ...[]byte) {
+		fp, err := os.Create(fullPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := brimio.NewMultiCoreChecksummedWriter(fp, checksumInterval, murmur3.New32, 1)
+		for _, d := range data {
+			w.Write(d)
+		}
+		w.Write(valueTermBlock(uint32(checksumInterval)))
+		w.Close()
+	}
+	checksum := func(value string) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, murmur3.Sum32([]byte(value)))
+		return b
+	}
+	head := []byte("VALUESTORE v1                   ")
+	binary.BigEndian.PutUint32(head[28:], uint32(checksumInterval))
+	dataPath := path.Join(dir, "0000000000000000001.value")
+	// The second value's checksum is for some other value.
+	write(dataPath, head, []byte("good"), checksum("good"), []byte("bad!"), checksum("nope"))
+	headtoc := []byte("VALUESTORETOC v1                ")
+	binary.BigEndian.PutUint32(headtoc[28:], uint32(checksumInterval))
+	entry := func(keyB uint64, offset uint32, value string) []byte {
+		b := make([]byte, _VALUE_FILE_ENTRY_SIZE_V1)
+		binary.BigEndian.PutUint64(b, 1)
+		binary.BigEndian.PutUint64(b[8:], keyB)
+
+		binary.BigEndian.PutUint64(b[16:], 0x500)
+		binary.BigEndian.PutUint32(b[24:], offset)
+		binary.BigEndian.PutUint32(b[28:], uint32(len(value)))
+
+		binary.BigEndian.PutUint32(b[_VALUE_FILE_ENTRY_SIZE:], murmur3.Sum32([]byte(value)))
+		return b
+	}
+	tocPath := path.Join(dir, "0000000000000000001.valuetoc")
+	// The third entry points way past the end of the values file.
+	write(tocPath, headtoc, entry(2, 32, "good"), entry(3, 40, "bad!"), entry(4, 4000, "gone"))
+	version, count, err := StatValueTOCFile(tocPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 || count != 3 {
+		t.Fatal(version, count)
+	}
+	var keyBs []uint64
+	read, errs := ReadValueTOCFile(tocPath, func(entry *ValueFileEntry) {
+		keyBs = append(keyBs, entry.KeyB)
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if read != 3 || len(keyBs) != 3 || keyBs[0] != 2 || keyBs[1] != 3 || keyBs[2] != 4 {
+		t.Fatal(read, keyBs)
+	}
+	ranges, verified, errs := VerifyValueFile(dataPath)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if len(ranges) != 0 || verified != int64(checksumInterval) {
+		t.Fatal(ranges, verified)
+	}
+	newPath := tocPath + ".repaired"
+	result, err := RepairValueTOCFile(tocPath, dataPath, newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Kept != 1 || result.Dropped != 2 || result.Lost != 0 || len(result.ReadErrors) != 0 {
+		t.Fatal(result)
+	}
+	keyBs = nil
+	read, errs = ReadValueTOCFile(newPath, func(entry *ValueFileEntry) {
+		keyBs = append(keyBs, entry.KeyB)
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if read != 1 || keyBs[0] != 2 {
+		t.Fatal(read, keyBs)
+	}
+	// An existing file is never overwritten.
+	if _, err := RepairValueTOCFile(tocPath, dataPath, newPath); !os.IsExist(err) {
+		t.Fatal(err)
+	}
+	// Entries in a damaged block of the toc file are counted as lost.
+	fp, err := os.OpenFile(tocPath, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.WriteAt([]byte("x"), 40)
+	fp.Close()
+	result, err = RepairValueTOCFile(tocPath, dataPath, newPath+"2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Lost == 0 || len(result.ReadErrors) == 0 || result.Kept+result.Dropped+result.Lost != 3 {
+		t.Fatal(result)
+	}
+	// Damage the values file and the damage is reported.
+	fp, err = os.OpenFile(dataPath, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.WriteAt([]byte("x"), 34)
+	fp.Close()
+	ranges, _, _ = VerifyValueFile(dataPath)
+	if len(ranges) != 1 || ranges[0].Start != 0 || ranges[0].Stop != uint32(checksumInterval)-1 {
+		t.Fatal(ranges)
+	}
+}
@@ -54,10 +54,45 @@ func newValueKTBloomFilterFromMsg(prm *valuePullReplicationMsg, headerOffset int
 	}
 }
 
+// valueKTBloomFilterMaxN returns the largest N-factor a bloom filter with
+// the P-factor can have and still fit within the given number of bytes.
+func valueKTBloomFilterMaxN(bytes int, p float64) uint64 {
+	// Leave a byte for the rounding up of m.
+	if bytes < 2 {
+		return 1
+	}
+	n := uint64(float64((bytes-1)*8) * math.Pow(math.Log(2), 2) / -math.Log(p))
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// resize reconfigures the filter for a new N-factor and P-factor, clearing it
+// and reusing the existing bits memory if it is large enough.
+func (ktbf *valueKTBloomFilter) resize(n uint64, p float64, salt uint16) {
+	m := -((float64(n) * math.Log(p)) / math.Pow(math.Log(2), 2))
+	ktbf.n = n
+	ktbf.p = p
+	ktbf.m = uint32(math.Ceil(m/8)) * 8
+	ktbf.kDiv4 = uint32(math.Ceil(m / float64(n) * math.Log(2) / 4))
+	l := int(math.Ceil(m / 8))
+	if cap(ktbf.bits) < l {
+		ktbf.bits = make([]byte, l)
+	} else {
+		ktbf.bits = ktbf.bits[:l]
+	}
+	ktbf.reset(salt)
+}
+
 func (ktbf *valueKTBloomFilter) toMsg(prm *valuePullReplicationMsg, headerOffset int) {
 	binary.BigEndian.PutUint64(prm.header[headerOffset:], ktbf.n)
 	binary.BigEndian.PutUint64(prm.header[headerOffset+8:], math.Float64bits(ktbf.p))
 	binary.BigEndian.PutUint16(prm.header[headerOffset+16:], uint16(ktbf.salt>>16))
+	if cap(prm.body) < len(ktbf.bits) {
+		prm.body = make([]byte, len(ktbf.bits))
+	}
+	prm.body = prm.body[:len(ktbf.bits)]
 	copy(prm.body, ktbf.bits)
 }
 
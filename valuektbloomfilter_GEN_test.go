@@ -81,3 +81,39 @@ func TestValueKTBloomFilterPersistence(t *testing.T) {
 		}
 	}
 }
+
+func TestValueKTBloomFilterResize(t *testing.T) {
+	f := newValueKTBloomFilter(10, 0.01, 0)
+	f.add(1, 2, 5)
+	f.resize(1000, 0.001, 1)
+	if f.mayHave(1, 2, 5) {
+		t.Fatal("")
+	}
+	for i := uint64(0); i < 1000; i++ {
+		f.add(i, i, i)
+	}
+	for i := uint64(0); i < 1000; i++ {
+		if !f.mayHave(i, i, i) {
+			t.Fatal(i)
+		}
+	}
+	f2 := newValueKTBloomFilter(1000, 0.001, 1)
+	if f.m != f2.m || f.kDiv4 != f2.kDiv4 || len(f.bits) != len(f2.bits) {
+		t.Fatal(f, f2)
+	}
+	f.resize(10, 0.01, 0)
+	if len(f.bits) != 12 {
+		t.Fatal(len(f.bits))
+	}
+}
+
+func TestValueKTBloomFilterMaxN(t *testing.T) {
+	for _, p := range []float64{0.1, 0.01, 0.001, 0.000001} {
+		for _, b := range []int{1024, 65536, 16777216} {
+			n := valueKTBloomFilterMaxN(b, p)
+			if l := len(newValueKTBloomFilter(n, p, 0).bits); l > b {
+				t.Fatal(b, p, n, l)
+			}
+		}
+	}
+}
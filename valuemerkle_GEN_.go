@@ -0,0 +1,640 @@
+package store
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gholt/brimtime"
+	"go.uber.org/zap"
+)
+
+// mkm: senderNodeID:8, ringVersion:8, partition:4, merkleBits:1, depth:1, flags:1 entries:n
+// mkm entry: index:4, hash:8
+
+const _VALUE_MERKLE_MSG_TYPE = 0x8d1c5a3e27f04b96
+const _VALUE_AUTH_MERKLE_MSG_TYPE = 0x4f2a96d1c07eb358
+
+const _VALUE_MERKLE_MSG_HEADER_BYTES = 23
+const _VALUE_MERKLE_MSG_ENTRY_BYTES = 12
+
+// _VALUE_MERKLE_FLAG_NO_REPLY indicates the receiver of leaf level hashes
+// should send its items for differing leaves but not send its own leaf hashes
+// back, as the sender has already done so.
+const _VALUE_MERKLE_FLAG_NO_REPLY = 0x01
+
+// valueMerkleState tracks the hash tree used for hash tree pull replication.
+//
+// The tree is over the whole keyA space with 2**bits leaves, each leaf being
+// the XOR of the hashes of all the items (keys plus timestampbits) whose keyA
+// falls within that leaf's range; items marked for local removal are not
+// included. Using XOR allows items to be added and removed incrementally, in
+// any order, as locmap entries are set. Only the leaves are stored; inner
+// nodes are XORs of their leaves and are computed when needed. The subtree for
+// a ring partition is rooted at depth PartitionBitCount of the full tree,
+// which is why bits must be at least the ring's PartitionBitCount.
+type valueMerkleState struct {
+	bits                 uint16
+	leaves               []uint64
+	msgCap               int
+	inWorkers            int
+	inMsgs               int
+	inResponseMsgTimeout time.Duration
+	outMsgs              int
+	outMsgTimeout        time.Duration
+
+	startupShutdownLock sync.Mutex
+	inNotifyChan        chan *bgNotification
+	inMsgChan           chan *valueMerkleMsg
+	inFreeMsgChan       chan *valueMerkleMsg
+	outFreeMsgChan      chan *valueMerkleMsg
+}
+
+type valueMerkleMsg struct {
+	store  *defaultValueStore
+	header []byte
+	body   []byte
+}
+
+func (store *defaultValueStore) merkleConfig(cfg *ValueStoreConfig) {
+	if !cfg.MerkleReplication {
+		return
+	}
+	store.merkleState.bits = uint16(cfg.MerkleBits)
+	store.merkleState.leaves = make([]uint64, 1<<store.merkleState.bits)
+	store.merkleState.msgCap = cfg.MsgCap
+	store.merkleState.inWorkers = cfg.InPullReplicationWorkers
+	store.merkleState.inMsgs = cfg.InPullReplicationMsgs
+	store.merkleState.inResponseMsgTimeout = time.Duration(cfg.InPullReplicationResponseMsgTimeout) * time.Millisecond
+	store.merkleState.outMsgs = cfg.OutPullReplicationMsgs
+	store.merkleState.outMsgTimeout = time.Duration(cfg.OutPullReplicationMsgTimeout) * time.Millisecond
+	if store.msgRing != nil {
+		store.msgRing.SetMsgHandler(_VALUE_MERKLE_MSG_TYPE, store.newInMerkleMsg)
+		store.msgRing.SetMsgHandler(_VALUE_AUTH_MERKLE_MSG_TYPE, store.newInAuthMerkleMsg)
+	}
+}
+
+func (store *defaultValueStore) merkleStartup() {
+	if store.merkleState.leaves == nil {
+		return
+	}
+	store.merkleState.startupShutdownLock.Lock()
+	if store.merkleState.inNotifyChan == nil {
+		store.merkleState.inNotifyChan = make(chan *bgNotification, 1)
+		store.merkleState.inMsgChan = make(chan *valueMerkleMsg, store.merkleState.inMsgs)
+		store.merkleState.inFreeMsgChan = make(chan *valueMerkleMsg, store.merkleState.inMsgs)
+		for i := 0; i < cap(store.merkleState.inFreeMsgChan); i++ {
+			store.merkleState.inFreeMsgChan <- &valueMerkleMsg{
+				store:  store,
+				header: make([]byte, _VALUE_MERKLE_MSG_HEADER_BYTES),
+			}
+		}
+		store.merkleState.outFreeMsgChan = make(chan *valueMerkleMsg, store.merkleState.outMsgs)
+		for i := 0; i < cap(store.merkleState.outFreeMsgChan); i++ {
+			store.merkleState.outFreeMsgChan <- &valueMerkleMsg{
+				store:  store,
+				header: make([]byte, _VALUE_MERKLE_MSG_HEADER_BYTES),
+			}
+		}
+		go store.inMerkleLauncher(store.merkleState.inNotifyChan)
+	}
+	store.merkleState.startupShutdownLock.Unlock()
+}
+
+func (store *defaultValueStore) merkleShutdown() {
+	store.merkleState.startupShutdownLock.Lock()
+	if store.merkleState.inNotifyChan != nil {
+		c := make(chan struct{}, 1)
+		store.merkleState.inNotifyChan <- &bgNotification{
+			action:   _BG_DISABLE,
+			doneChan: c,
+		}
+		<-c
+		store.merkleState.inNotifyChan = nil
+		store.merkleState.inMsgChan = nil
+		store.merkleState.inFreeMsgChan = nil
+		store.merkleState.outFreeMsgChan = nil
+	}
+	store.merkleState.startupShutdownLock.Unlock()
+}
+
+// merkleClear zeroes the hash tree; used when the locmap is cleared.
+func (store *defaultValueStore) merkleClear() {
+	for i := range store.merkleState.leaves {
+		atomic.StoreUint64(&store.merkleState.leaves[i], 0)
+	}
+}
+
+// valueMerkleHash returns the hash of an item as it contributes to its hash
+// tree leaf.
+func valueMerkleHash(keyA uint64, keyB uint64, timestampbits uint64) uint64 {
+	h := merkleMix(keyA ^ 0x9e3779b97f4a7c15)
+	h = merkleMix(h ^ keyB)
+
+	return merkleMix(h ^ timestampbits)
+}
+
+// merkleUpdate records an item changing from ptimestampbits to timestampbits
+// in the hash tree; a ptimestampbits of 0 indicates the item is new.
+func (store *defaultValueStore) merkleUpdate(keyA uint64, keyB uint64, ptimestampbits uint64, timestampbits uint64) {
+	if store.merkleState.leaves == nil {
+		return
+	}
+	var h uint64
+	if ptimestampbits != 0 && ptimestampbits&_TSB_LOCAL_REMOVAL == 0 {
+		h = valueMerkleHash(keyA, keyB, ptimestampbits)
+	}
+	if timestampbits&_TSB_LOCAL_REMOVAL == 0 {
+		h ^= valueMerkleHash(keyA, keyB, timestampbits)
+	}
+	if h == 0 {
+		return
+	}
+	leaf := &store.merkleState.leaves[keyA>>(64-store.merkleState.bits)]
+	for {
+		o := atomic.LoadUint64(leaf)
+		if atomic.CompareAndSwapUint64(leaf, o, o^h) {
+			break
+		}
+	}
+}
+
+// merkleNode returns the hash of the node at depth and index within the
+// partition's subtree; leafDepth is the depth of the leaves within that
+// subtree.
+func (store *defaultValueStore) merkleNode(partition uint32, leafDepth uint16, depth uint16, index uint32) uint64 {
+	span := uint64(1) << (leafDepth - depth)
+	start := uint64(partition)<<leafDepth + uint64(index)*span
+	var h uint64
+	for i := start; i < start+span; i++ {
+		h ^= atomic.LoadUint64(&store.merkleState.leaves[i])
+	}
+	return h
+}
+
+func (store *defaultValueStore) inMerkleLauncher(notifyChan chan *bgNotification) {
+	wg := &sync.WaitGroup{}
+	wg.Add(store.merkleState.inWorkers)
+	for i := 0; i < store.merkleState.inWorkers; i++ {
+		go store.inMerkle(wg)
+	}
+	var notification *bgNotification
+	running := true
+	for running {
+		notification = <-notifyChan
+		if notification.action == _BG_DISABLE {
+			for i := 0; i < store.merkleState.inWorkers; i++ {
+				store.merkleState.inMsgChan <- nil
+			}
+			wg.Wait()
+			running = false
+		} else {
+			store.logger.Error("invalid action requested", zap.String("name", store.loggerPrefix+"inMerkle"), zap.Int("action", int(notification.action)))
+		}
+		notification.doneChan <- struct{}{}
+	}
+}
+
+// newInMerkleMsg reads unauthenticated hash tree messages from the MsgRing
+// and puts them on the inMsgChan for the inMerkle workers to work on.
+func (store *defaultValueStore) newInMerkleMsg(r io.Reader, l uint64) (uint64, error) {
+	if store.msgAuthState.requireAuth {
+		n, err := tossRead(r, l)
+		if err != nil {
+			atomic.AddInt32(&store.inMerkleInvalids, 1)
+			return n, err
+		}
+		atomic.AddInt32(&store.inPullReplicationRejects, 1)
+		store.logger.Warn("rejected unauthenticated incoming message", zap.String("name", store.loggerPrefix+"inMerkle"))
+		return n, nil
+	}
+	mkm, n, err := store.readInMerkleMsg(r, l)
+	if mkm != nil {
+		store.merkleState.inMsgChan <- mkm
+		atomic.AddInt32(&store.inMerkles, 1)
+		atomic.AddInt64(&store.inMerkleBytes, int64(l))
+	}
+	return n, err
+}
+
+// newInAuthMerkleMsg reads authenticated hash tree messages from the MsgRing
+// and puts them on the inMsgChan for the inMerkle workers to work on.
+func (store *defaultValueStore) newInAuthMerkleMsg(r io.Reader, l uint64) (uint64, error) {
+	var mkm *valueMerkleMsg
+	nodeID, ok, n, err := store.readInAuthMsg(r, l, func(r io.Reader, l uint64) (uint64, error) {
+		var n uint64
+		var err error
+		mkm, n, err = store.readInMerkleMsg(r, l)
+		return n, err
+	})
+	if ok {
+		if mkm != nil {
+			store.merkleState.inMsgChan <- mkm
+			atomic.AddInt32(&store.inMerkles, 1)
+			atomic.AddInt64(&store.inMerkleBytes, int64(l))
+		}
+		return n, err
+	}
+	if mkm != nil {
+		store.merkleState.inFreeMsgChan <- mkm
+	}
+	if err == nil {
+		atomic.AddInt32(&store.inPullReplicationRejects, 1)
+		store.logger.Warn("rejected unverified incoming message", zap.String("name", store.loggerPrefix+"inMerkle"), zap.Uint64("nodeID", nodeID))
+	}
+	return n, err
+}
+
+// readInMerkleMsg reads a hash tree message, returning nil if the message
+// was discarded.
+func (store *defaultValueStore) readInMerkleMsg(r io.Reader, l uint64) (*valueMerkleMsg, uint64, error) {
+	var mkm *valueMerkleMsg
+	select {
+	case mkm = <-store.merkleState.inFreeMsgChan:
+	default:
+		// If there isn't a free valueMerkleMsg, just read and discard the
+		// incoming hash tree message.
+		left := l
+		var sn int
+		var err error
+		for left > 0 {
+			t := toss
+			if left < uint64(len(t)) {
+				t = t[:left]
+			}
+			sn, err = r.Read(t)
+			left -= uint64(sn)
+			if err != nil {
+				atomic.AddInt32(&store.inMerkleInvalids, 1)
+				return nil, l - left, err
+			}
+		}
+		atomic.AddInt32(&store.inMerkleDrops, 1)
+		return nil, l, nil
+	}
+	// A message can't reasonably list more nodes than there are leaves, so
+	// anything larger, or malformed, is just thrown away.
+	if l < _VALUE_MERKLE_MSG_HEADER_BYTES || (l-_VALUE_MERKLE_MSG_HEADER_BYTES)%_VALUE_MERKLE_MSG_ENTRY_BYTES != 0 || l-_VALUE_MERKLE_MSG_HEADER_BYTES > uint64(len(store.merkleState.leaves))*_VALUE_MERKLE_MSG_ENTRY_BYTES {
+		store.merkleState.inFreeMsgChan <- mkm
+		left := l
+		var sn int
+		var err error
+		for left > 0 {
+			t := toss
+			if left < uint64(len(t)) {
+				t = t[:left]
+			}
+			sn, err = r.Read(t)
+			left -= uint64(sn)
+			if err != nil {
+				atomic.AddInt32(&store.inMerkleInvalids, 1)
+				return nil, l - left, err
+			}
+		}
+		atomic.AddInt32(&store.inMerkleInvalids, 1)
+		return nil, l, nil
+	}
+	bl := l - _VALUE_MERKLE_MSG_HEADER_BYTES
+	if uint64(cap(mkm.body)) < bl {
+		mkm.body = make([]byte, bl)
+	}
+	mkm.body = mkm.body[:bl]
+	var n int
+	var sn int
+	var err error
+	for n != len(mkm.header) {
+		sn, err = r.Read(mkm.header[n:])
+		n += sn
+		if err != nil {
+			store.merkleState.inFreeMsgChan <- mkm
+			atomic.AddInt32(&store.inMerkleInvalids, 1)
+			return nil, uint64(n), err
+		}
+	}
+	n = 0
+	for n != len(mkm.body) {
+		sn, err = r.Read(mkm.body[n:])
+		n += sn
+		if err != nil {
+			store.merkleState.inFreeMsgChan <- mkm
+			atomic.AddInt32(&store.inMerkleInvalids, 1)
+			return nil, uint64(len(mkm.header)) + uint64(n), err
+		}
+	}
+	return mkm, l, nil
+}
+
+// inMerkle actually processes incoming hash tree messages; there may be more
+// than one of these workers.
+//
+// Each message lists nodes at one depth of a partition's subtree as the
+// sender sees them. Nodes that match locally are done with. For nodes that
+// differ, the children are sent back as seen locally, so the two sides take
+// turns descending the tree. Once the leaf depth is reached, the items in
+// each differing leaf are sent to the other side with a bulk-set message and,
+// unless the sender already did so, the leaf hashes are sent back so the
+// other side will do the same in return.
+func (store *defaultValueStore) inMerkle(wg *sync.WaitGroup) {
+	k := make([]uint64, store.bulkSetState.msgCap/_VALUE_BULK_SET_MSG_MIN_ENTRY_LENGTH*2)
+	v := make([]byte, store.valueCap)
+	var diffs []uint32
+	for {
+		mkm := <-store.merkleState.inMsgChan
+		if mkm == nil {
+			break
+		}
+		if store.msgRing == nil {
+			store.merkleState.inFreeMsgChan <- mkm
+			continue
+		}
+		ring := store.msgRing.Ring()
+		if ring == nil {
+			store.merkleState.inFreeMsgChan <- mkm
+			continue
+		}
+		// If the sender is working from a different ring, the partitions
+		// may not line up, so just ignore the message; the next pass will
+		// sort things out once the rings agree.
+		if mkm.ringVersion() != ring.Version() {
+			store.merkleState.inFreeMsgChan <- mkm
+			continue
+		}
+		partitionBitCount := ring.PartitionBitCount()
+		partition := mkm.partition()
+		depth := mkm.depth()
+		if mkm.merkleBits() != store.merkleState.bits || partitionBitCount > store.merkleState.bits || depth > store.merkleState.bits-partitionBitCount || uint64(partition) >= uint64(1)<<partitionBitCount {
+			store.merkleState.inFreeMsgChan <- mkm
+			atomic.AddInt32(&store.inMerkleInvalids, 1)
+			continue
+		}
+		if !ring.Responsible(partition) {
+			store.merkleState.inFreeMsgChan <- mkm
+			continue
+		}
+		leafDepth := store.merkleState.bits - partitionBitCount
+		nodeID := mkm.nodeID()
+		flags := mkm.flags()
+		diffs = diffs[:0]
+		for body := mkm.body; len(body) >= _VALUE_MERKLE_MSG_ENTRY_BYTES; body = body[_VALUE_MERKLE_MSG_ENTRY_BYTES:] {
+			index := binary.BigEndian.Uint32(body)
+			if uint64(index) >= uint64(1)<<depth {
+				continue
+			}
+			if store.merkleNode(partition, leafDepth, depth, index) != binary.BigEndian.Uint64(body[4:]) {
+				diffs = append(diffs, index)
+			}
+		}
+		store.merkleState.inFreeMsgChan <- mkm
+		if len(diffs) == 0 {
+			continue
+		}
+		ringVersion := ring.Version()
+		if depth < leafDepth {
+			reply := store.newOutMerkleMsg(ringVersion, partition, depth+1, 0)
+			for _, index := range diffs {
+				for child := index * 2; child <= index*2+1; child++ {
+					if !reply.add(child, store.merkleNode(partition, leafDepth, depth+1, child)) {
+						store.sendMerkleMsg(reply, nodeID)
+						reply = store.newOutMerkleMsg(ringVersion, partition, depth+1, 0)
+						reply.add(child, store.merkleNode(partition, leafDepth, depth+1, child))
+					}
+				}
+			}
+			store.sendMerkleMsg(reply, nodeID)
+			continue
+		}
+		for _, index := range diffs {
+			k, v = store.merkleSendLeaf(nodeID, uint64(partition)<<leafDepth+uint64(index), k, v)
+		}
+		if flags&_VALUE_MERKLE_FLAG_NO_REPLY == 0 {
+			reply := store.newOutMerkleMsg(ringVersion, partition, depth, _VALUE_MERKLE_FLAG_NO_REPLY)
+			for _, index := range diffs {
+				if !reply.add(index, store.merkleNode(partition, leafDepth, depth, index)) {
+					store.sendMerkleMsg(reply, nodeID)
+					reply = store.newOutMerkleMsg(ringVersion, partition, depth, _VALUE_MERKLE_FLAG_NO_REPLY)
+					reply.add(index, store.merkleNode(partition, leafDepth, depth, index))
+				}
+			}
+			store.sendMerkleMsg(reply, nodeID)
+		}
+	}
+	wg.Done()
+}
+
+// merkleSendLeaf sends the items within the hash tree leaf to the node with a
+// bulk-set message; the k and v buffers are returned for reuse. Since the
+// whole leaf is sent, items the other node already has will be sent as well;
+// larger MerkleBits values reduce this at the cost of memory.
+func (store *defaultValueStore) merkleSendLeaf(nodeID uint64, leaf uint64, k []uint64, v []byte) ([]uint64, []byte) {
+	k = k[:0]
+	rightwardLeafShift := 64 - store.merkleState.bits
+	start := leaf << rightwardLeafShift
+	stop := start + (uint64(1) << rightwardLeafShift) - 1
+	timestampbitsnow := uint64(brimtime.TimeToUnixMicro(time.Now())) << _TSB_UTIL_BITS
+	cutoff := timestampbitsnow - store.replicationIgnoreRecent
+	tombstoneCutoff := timestampbitsnow - store.tombstoneDiscardState.age
+	l := int64(store.bulkSetState.msgCap)
+	store.locmap.ScanCallback(start, stop, 0, _TSB_LOCAL_REMOVAL, cutoff, math.MaxUint64, func(keyA uint64, keyB uint64, timestampbits uint64, length uint32) bool {
+		if timestampbits&_TSB_DELETION == 0 || timestampbits >= tombstoneCutoff {
+			k = append(k, keyA, keyB)
+			l -= _VALUE_BULK_SET_MSG_ENTRY_HEADER_LENGTH + int64(length)
+			if l <= 0 {
+				return false
+			}
+		}
+		return true
+	})
+	if len(k) == 0 {
+		return k, v
+	}
+	bsm := store.newOutBulkSetMsg()
+	// Indicate that a response to this bulk-set message is not necessary. If
+	// the message fails to reach its destination, the hash trees will still
+	// differ on the next pass.
+	binary.BigEndian.PutUint64(bsm.header, 0)
+	var t uint64
+	var err error
+	for i := 0; i < len(k); i += 2 {
+		t, v, err = store.read(k[i], k[i+1], v[:0])
+		if IsNotFound(err) {
+			if t == 0 {
+				continue
+			}
+		} else if err != nil {
+			continue
+		}
+		if t&_TSB_LOCAL_REMOVAL == 0 {
+			if !bsm.add(k[i], k[i+1], t, v) {
+				break
+			}
+			atomic.AddInt32(&store.outBulkSetValues, 1)
+		}
+	}
+	if len(bsm.body) > 0 {
+		atomic.AddInt32(&store.outBulkSets, 1)
+		atomic.AddInt64(&store.outBulkSetBytes, int64(bsm.MsgLength()))
+		if store.bulkSetState.outLimiter.wait(bsm.MsgLength()) {
+			atomic.AddInt32(&store.outBulkSetRateLimitHits, 1)
+		}
+		store.msgToNode(bsm, nodeID, store.merkleState.inResponseMsgTimeout)
+	} else {
+		bsm.Free(0, 0)
+	}
+	return k, v
+}
+
+// outMerklePass sends the root hash of each partition's subtree the local node
+// is responsible for to the other replicas; the rest of the exchange is driven
+// by the inMerkle workers. Returned is the notification that interrupted the
+// pass, if any, and the number of bytes sent. The pass is the pull
+// replication pass number for the replication status.
+func (store *defaultValueStore) outMerklePass(notifyChan chan *bgNotification, pass uint64) (*bgNotification, int64) {
+	ring := store.msgRing.Ring()
+	ringVersion := ring.Version()
+	partitionBitCount := ring.PartitionBitCount()
+	leafDepth := store.merkleState.bits - partitionBitCount
+	partitionCount := uint64(1) << partitionBitCount
+	var abort uint32
+	var bytes int64
+	waitChan := make(chan struct{}, 1)
+	go func() {
+		for p := uint64(0); p < partitionCount; p++ {
+			if atomic.LoadUint32(&abort) != 0 {
+				break
+			}
+			ring2 := store.msgRing.Ring()
+			if ring2 == nil || ring2.Version() != ringVersion {
+				break
+			}
+			if !ring.Responsible(uint32(p)) {
+				continue
+			}
+			store.replicationPullStarted(partitionBitCount, uint32(p), pass)
+			mkm := store.newOutMerkleMsg(ringVersion, uint32(p), 0, 0)
+			mkm.add(0, store.merkleNode(uint32(p), leafDepth, 0, 0))
+			atomic.AddInt32(&store.outPullReplications, 1)
+			atomic.AddInt32(&store.outMerkles, 1)
+			atomic.AddInt64(&store.outMerkleBytes, int64(mkm.MsgLength()))
+			atomic.AddInt64(&bytes, int64(mkm.MsgLength()))
+			if store.pullReplicationState.outLimiter.wait(mkm.MsgLength()) {
+				atomic.AddInt32(&store.outPullReplicationRateLimitHits, 1)
+			}
+			store.msgToOtherReplicas(mkm, uint32(p), store.merkleState.outMsgTimeout)
+			// The rest of the exchange is driven by the replies, so the
+			// partition's part of the pass is done.
+			store.replicationPulled(partitionBitCount, uint32(p), pass, 1)
+		}
+		close(waitChan)
+	}()
+	select {
+	case notification := <-notifyChan:
+		atomic.AddUint32(&abort, 1)
+		<-waitChan
+		return notification, atomic.LoadInt64(&bytes)
+	case <-waitChan:
+		return nil, atomic.LoadInt64(&bytes)
+	}
+}
+
+// newOutMerkleMsg gives an initialized valueMerkleMsg for filling out and
+// eventually sending using the MsgRing. There is a fixed number of outgoing
+// valueMerkleMsg instances that can exist at any given time; once the limit
+// is reached, this method will block until one is available to return.
+func (store *defaultValueStore) newOutMerkleMsg(ringVersion int64, partition uint32, depth uint16, flags byte) *valueMerkleMsg {
+	mkm := <-store.merkleState.outFreeMsgChan
+	if store.msgRing != nil {
+		if r := store.msgRing.Ring(); r != nil {
+			if n := r.LocalNode(); n != nil {
+				binary.BigEndian.PutUint64(mkm.header, n.ID())
+			}
+		}
+	}
+	binary.BigEndian.PutUint64(mkm.header[8:], uint64(ringVersion))
+	binary.BigEndian.PutUint32(mkm.header[16:], partition)
+	mkm.header[20] = byte(store.merkleState.bits)
+	mkm.header[21] = byte(depth)
+	mkm.header[22] = flags
+	mkm.body = mkm.body[:0]
+	return mkm
+}
+
+func (store *defaultValueStore) sendMerkleMsg(mkm *valueMerkleMsg, nodeID uint64) {
+	if len(mkm.body) == 0 {
+		mkm.Free(0, 0)
+		return
+	}
+	atomic.AddInt32(&store.outMerkles, 1)
+	atomic.AddInt64(&store.outMerkleBytes, int64(mkm.MsgLength()))
+	store.msgToNode(mkm, nodeID, store.merkleState.inResponseMsgTimeout)
+}
+
+func (mkm *valueMerkleMsg) MsgType() uint64 {
+	return _VALUE_MERKLE_MSG_TYPE
+}
+
+func (mkm *valueMerkleMsg) MsgLength() uint64 {
+	return uint64(len(mkm.header)) + uint64(len(mkm.body))
+}
+
+func (mkm *valueMerkleMsg) nodeID() uint64 {
+	return binary.BigEndian.Uint64(mkm.header)
+}
+
+func (mkm *valueMerkleMsg) ringVersion() int64 {
+	return int64(binary.BigEndian.Uint64(mkm.header[8:]))
+}
+
+func (mkm *valueMerkleMsg) partition() uint32 {
+	return binary.BigEndian.Uint32(mkm.header[16:])
+}
+
+func (mkm *valueMerkleMsg) merkleBits() uint16 {
+	return uint16(mkm.header[20])
+}
+
+func (mkm *valueMerkleMsg) depth() uint16 {
+	return uint16(mkm.header[21])
+}
+
+func (mkm *valueMerkleMsg) flags() byte {
+	return mkm.header[22]
+}
+
+// add appends the node's hash to the message, returning false if the message
+// is already at its cap.
+func (mkm *valueMerkleMsg) add(index uint32, hash uint64) bool {
+	o := len(mkm.body)
+	if len(mkm.header)+o+_VALUE_MERKLE_MSG_ENTRY_BYTES > mkm.store.merkleState.msgCap {
+		return false
+	}
+	if o+_VALUE_MERKLE_MSG_ENTRY_BYTES > cap(mkm.body) {
+		b := make([]byte, o, 2*cap(mkm.body)+_VALUE_MERKLE_MSG_ENTRY_BYTES)
+		copy(b, mkm.body)
+		mkm.body = b
+	}
+	mkm.body = mkm.body[:o+_VALUE_MERKLE_MSG_ENTRY_BYTES]
+	binary.BigEndian.PutUint32(mkm.body[o:], index)
+	binary.BigEndian.PutUint64(mkm.body[o+4:], hash)
+	return true
+}
+
+func (mkm *valueMerkleMsg) WriteContent(w io.Writer) (uint64, error) {
+	var n int
+	var sn int
+	var err error
+	sn, err = w.Write(mkm.header)
+	n += sn
+	if err != nil {
+		return uint64(n), err
+	}
+	sn, err = w.Write(mkm.body)
+	n += sn
+	return uint64(n), err
+}
+
+func (mkm *valueMerkleMsg) Free(successes int, failures int) {
+	mkm.store.merkleState.outFreeMsgChan <- mkm
+}
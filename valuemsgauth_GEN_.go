@@ -0,0 +1,201 @@
+package store
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"io"
+	"sync"
+
+	"github.com/gholt/msgring"
+	"golang.org/x/net/context"
+)
+
+// Authenticated messages wrap the original, unauthenticated replication
+// message formats with a protocol version, the sender's node ID, and an
+// HMAC-SHA256 of everything before it keyed with the cluster secret:
+//
+// am: version:1 senderNodeID:8 msg:n hmac:32
+//
+// Each wrapped message type has its own authenticated message type so older
+// nodes that know nothing of them simply discard them. A node only sends
+// authenticated messages to nodes that have said they support them with a
+// hello message; see msgprotocol.got. Once all nodes are upgraded and have
+// MsgSecrets, MsgRequireAuth can be turned on to reject any unauthenticated
+// messages.
+const _VALUE_MSG_AUTH_VERSION = 1
+const _VALUE_MSG_AUTH_HEADER_BYTES = 9
+const _VALUE_MSG_AUTH_TRAILER_BYTES = sha256.Size
+
+type valueMsgAuthState struct {
+	requireAuth bool
+
+	lock sync.RWMutex
+	// secrets are the accepted cluster secrets; the first is used to sign
+	// outgoing messages.
+	secrets [][]byte
+}
+
+type valueAuthMsg struct {
+	msgType uint64
+	header  []byte
+	msg     msgring.Msg
+	secret  []byte
+}
+
+func (store *defaultValueStore) msgAuthConfig(cfg *ValueStoreConfig) {
+	store.msgAuthState.requireAuth = cfg.MsgRequireAuth
+	store.msgAuthState.secrets = copyMsgSecrets(cfg.MsgSecrets)
+}
+
+// SetMsgSecrets replaces the cluster secrets used to authenticate
+// replication messages; the first secret will be used to sign outgoing
+// messages and any of them will be accepted for incoming messages. To rotate
+// secrets without interruption, first add the new secret as a secondary
+// secret on every node, then make it the primary secret on every node, and
+// finally remove the old secret.
+func (store *defaultValueStore) SetMsgSecrets(ctx context.Context, secrets [][]byte) error {
+	_, span := store.startSpan(ctx, "SetMsgSecrets")
+	defer span.End()
+	secrets = copyMsgSecrets(secrets)
+	store.msgAuthState.lock.Lock()
+	store.msgAuthState.secrets = secrets
+	store.msgAuthState.lock.Unlock()
+	return nil
+}
+
+// msgAuthVersion returns the protocol version to use when sending to nodes
+// with the features.
+func (store *defaultValueStore) msgAuthVersion(features byte) byte {
+	store.msgAuthState.lock.RLock()
+	var version byte
+	if len(store.msgAuthState.secrets) > 0 && (store.msgAuthState.requireAuth || features&_VALUE_MSG_FEATURE_AUTH != 0) {
+		version = _VALUE_MSG_AUTH_VERSION
+	}
+	store.msgAuthState.lock.RUnlock()
+	return version
+}
+
+// valueAuthMsgType returns the authenticated message type for wrapping the
+// msgType.
+func valueAuthMsgType(msgType uint64) uint64 {
+	switch msgType {
+	case _VALUE_BULK_SET_MSG_TYPE:
+		return _VALUE_AUTH_BULK_SET_MSG_TYPE
+	case _VALUE_BULK_SET_ACK_MSG_TYPE:
+		return _VALUE_AUTH_BULK_SET_ACK_MSG_TYPE
+	case _VALUE_NODE_BULK_SET_ACK_MSG_TYPE:
+		return _VALUE_AUTH_NODE_BULK_SET_ACK_MSG_TYPE
+	case _VALUE_PULL_REPLICATION_MSG_TYPE:
+		return _VALUE_AUTH_PULL_REPLICATION_MSG_TYPE
+	case _VALUE_COMPRESSED_BULK_SET_MSG_TYPE:
+		return _VALUE_AUTH_COMPRESSED_BULK_SET_MSG_TYPE
+	case _VALUE_COMPRESSED_PULL_REPLICATION_MSG_TYPE:
+		return _VALUE_AUTH_COMPRESSED_PULL_REPLICATION_MSG_TYPE
+	case _VALUE_MERKLE_MSG_TYPE:
+		return _VALUE_AUTH_MERKLE_MSG_TYPE
+	}
+	panic("no authenticated message type")
+}
+
+// readInAuthMsg reads an authenticated message envelope, using the read
+// function to read the wrapped message. Returned is the sender's node ID,
+// whether the message verified against any of the cluster secrets, and the
+// usual bytes read and error. Messages that are too short, of an unknown
+// version, or received while there are no secrets to verify them are read
+// and discarded, returning false.
+func (store *defaultValueStore) readInAuthMsg(r io.Reader, l uint64, read func(io.Reader, uint64) (uint64, error)) (uint64, bool, uint64, error) {
+	if l < _VALUE_MSG_AUTH_HEADER_BYTES+_VALUE_MSG_AUTH_TRAILER_BYTES {
+		n, err := tossRead(r, l)
+		return 0, false, n, err
+	}
+	var header [_VALUE_MSG_AUTH_HEADER_BYTES]byte
+	n, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return 0, false, uint64(n), err
+	}
+	nodeID := binary.BigEndian.Uint64(header[1:])
+	store.msgAuthState.lock.RLock()
+	secrets := store.msgAuthState.secrets
+	store.msgAuthState.lock.RUnlock()
+	if header[0] != _VALUE_MSG_AUTH_VERSION || len(secrets) == 0 {
+		m, err := tossRead(r, l-_VALUE_MSG_AUTH_HEADER_BYTES)
+		return nodeID, false, _VALUE_MSG_AUTH_HEADER_BYTES + m, err
+	}
+	macs := make([]hash.Hash, len(secrets))
+	ws := make([]io.Writer, len(secrets))
+	for i, secret := range secrets {
+		macs[i] = hmac.New(sha256.New, secret)
+		macs[i].Write(header[:])
+		ws[i] = macs[i]
+	}
+	bl := l - _VALUE_MSG_AUTH_HEADER_BYTES - _VALUE_MSG_AUTH_TRAILER_BYTES
+	m, err := read(io.TeeReader(r, io.MultiWriter(ws...)), bl)
+	if err != nil {
+		return nodeID, false, _VALUE_MSG_AUTH_HEADER_BYTES + m, err
+	}
+	var trailer [_VALUE_MSG_AUTH_TRAILER_BYTES]byte
+	n, err = io.ReadFull(r, trailer[:])
+	if err != nil {
+		return nodeID, false, _VALUE_MSG_AUTH_HEADER_BYTES + bl + uint64(n), err
+	}
+	for _, mac := range macs {
+		if hmac.Equal(mac.Sum(nil), trailer[:]) {
+			return nodeID, true, l, nil
+		}
+	}
+	return nodeID, false, l, nil
+}
+
+// newOutAuthMsg wraps the msg for sending authenticated. Freeing the
+// valueAuthMsg frees the wrapped msg.
+func (store *defaultValueStore) newOutAuthMsg(msg msgring.Msg) *valueAuthMsg {
+	am := &valueAuthMsg{
+		msgType: valueAuthMsgType(msg.MsgType()),
+		header:  make([]byte, _VALUE_MSG_AUTH_HEADER_BYTES),
+		msg:     msg,
+	}
+	am.header[0] = _VALUE_MSG_AUTH_VERSION
+	if store.msgRing != nil {
+		if r := store.msgRing.Ring(); r != nil {
+			if n := r.LocalNode(); n != nil {
+				binary.BigEndian.PutUint64(am.header[1:], n.ID())
+			}
+		}
+	}
+	store.msgAuthState.lock.RLock()
+	if len(store.msgAuthState.secrets) > 0 {
+		am.secret = store.msgAuthState.secrets[0]
+	}
+	store.msgAuthState.lock.RUnlock()
+	return am
+}
+
+func (am *valueAuthMsg) MsgType() uint64 {
+	return am.msgType
+}
+
+func (am *valueAuthMsg) MsgLength() uint64 {
+	return uint64(len(am.header)) + am.msg.MsgLength() + _VALUE_MSG_AUTH_TRAILER_BYTES
+}
+
+func (am *valueAuthMsg) WriteContent(w io.Writer) (uint64, error) {
+	mac := hmac.New(sha256.New, am.secret)
+	mac.Write(am.header)
+	n, err := w.Write(am.header)
+	if err != nil {
+		return uint64(n), err
+	}
+	m, err := am.msg.WriteContent(io.MultiWriter(w, mac))
+	l := uint64(n) + m
+	if err != nil {
+		return l, err
+	}
+	n, err = w.Write(mac.Sum(nil))
+	return l + uint64(n), err
+}
+
+func (am *valueAuthMsg) Free(successes int, failures int) {
+	am.msg.Free(successes, failures)
+}
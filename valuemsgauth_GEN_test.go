@@ -0,0 +1,212 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	ring "github.com/gholt/devicering"
+	"github.com/gholt/msgring"
+	"golang.org/x/net/context"
+)
+
+type msgRingValueMsgAuthTester struct {
+	ring        ring.Ring
+	lock        sync.Mutex
+	toNodeMsgs  []*bytes.Buffer
+	toNodeTypes []uint64
+}
+
+func (m *msgRingValueMsgAuthTester) Ring() ring.Ring {
+	return m.ring
+}
+
+func (m *msgRingValueMsgAuthTester) MaxMsgLength() uint64 {
+	return 65536
+}
+
+func (m *msgRingValueMsgAuthTester) SetMsgHandler(msgType uint64, handler msgring.MsgUnmarshaller) {
+}
+
+func (m *msgRingValueMsgAuthTester) MsgToNode(msg msgring.Msg, nodeID uint64, timeout time.Duration) {
+	buf := &bytes.Buffer{}
+	msg.WriteContent(buf)
+	m.lock.Lock()
+	m.toNodeMsgs = append(m.toNodeMsgs, buf)
+	m.toNodeTypes = append(m.toNodeTypes, msg.MsgType())
+	m.lock.Unlock()
+	msg.Free(0, 0)
+}
+
+func (m *msgRingValueMsgAuthTester) MsgToOtherReplicas(msg msgring.Msg, partition uint32, timeout time.Duration) {
+	msg.Free(0, 0)
+}
+
+func newTestValueMsgAuthStore(t *testing.T, secrets ...string) (*defaultValueStore, *msgRingValueMsgAuthTester, uint64) {
+	cfg := newTestValueStoreConfig()
+	for _, secret := range secrets {
+		cfg.MsgSecrets = append(cfg.MsgSecrets, []byte(secret))
+	}
+	return newTestValueMsgRingStore(t, cfg)
+}
+
+// newTestValueMsgRingStore starts a store with the cfg on a two node ring,
+// returning the other node's ID.
+func newTestValueMsgRingStore(t *testing.T, cfg *ValueStoreConfig) (*defaultValueStore, *msgRingValueMsgAuthTester, uint64) {
+	b := ring.NewBuilder(64)
+	b.SetReplicaCount(2)
+	n, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	r.SetLocalNode(n.ID())
+	m := &msgRingValueMsgAuthTester{ring: r}
+	cfg.MsgRing = m
+	cfg.InBulkSetWorkers = 1
+	cfg.InBulkSetMsgs = 1
+	store, _ := newTestValueStore(cfg)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return store, m, n2.ID()
+}
+
+func TestValueMsgAuthNegotiation(t *testing.T) {
+	store, m, peerID := newTestValueMsgAuthStore(t, "secret")
+	defer store.Shutdown(context.Background())
+	// The peer isn't known to accept authenticated messages yet, so it gets
+	// the original message type.
+	store.msgToNode(store.newOutBulkSetMsg(), peerID, time.Second)
+	store.msgHello()
+	m.lock.Lock()
+	if len(m.toNodeTypes) != 2 || m.toNodeTypes[0] != _VALUE_BULK_SET_MSG_TYPE || m.toNodeTypes[1] != _VALUE_HELLO_MSG_TYPE {
+		t.Fatal(m.toNodeTypes)
+	}
+	if !bytes.Equal(m.toNodeMsgs[1].Bytes()[8:], []byte{_VALUE_MSG_FEATURE_AUTH | _VALUE_MSG_FEATURE_NODE_ACK}) {
+		t.Fatal(m.toNodeMsgs[1].Bytes())
+	}
+	m.lock.Unlock()
+	// A hello from the peer saying it accepts authenticated messages.
+	buf := &bytes.Buffer{}
+	if _, err := store.newOutHelloMsg(peerID, _VALUE_MSG_FEATURE_AUTH).WriteContent(buf); err != nil {
+		t.Fatal(err)
+	}
+	l := uint64(buf.Len())
+	if n, err := store.newInHelloMsg(buf, l); err != nil || n != l {
+		t.Fatal(n, err)
+	}
+	if store.msgAuthVersion(store.msgPeerFeatures(peerID)) != _VALUE_MSG_AUTH_VERSION {
+		t.Fatal(store.msgPeerFeatures(peerID))
+	}
+	// A hello back since the peer was newly learned, then authenticated
+	// messages from then on.
+	store.msgToNode(store.newOutBulkSetMsg(), peerID, time.Second)
+	m.lock.Lock()
+	if len(m.toNodeTypes) != 4 || m.toNodeTypes[2] != _VALUE_HELLO_MSG_TYPE || m.toNodeTypes[3] != _VALUE_AUTH_BULK_SET_MSG_TYPE {
+		t.Fatal(m.toNodeTypes)
+	}
+	m.lock.Unlock()
+	// No more hellos once every node is known.
+	store.msgHello()
+	m.lock.Lock()
+	if len(m.toNodeTypes) != 4 {
+		t.Fatal(m.toNodeTypes)
+	}
+	m.lock.Unlock()
+}
+
+func TestValueMsgAuthBulkSet(t *testing.T) {
+	store, _, peerID := newTestValueMsgAuthStore(t, "new", "old")
+	defer store.Shutdown(context.Background())
+	send := func(secret string, keyA uint64) uint64 {
+		bsm := &valueBulkSetMsg{header: make([]byte, _VALUE_BULK_SET_MSG_HEADER_LENGTH), body: make([]byte, 0, 1000)}
+		if !bsm.add(keyA, 2, 0x500, []byte("testing")) {
+			t.Fatal("")
+		}
+		am := &valueAuthMsg{msgType: _VALUE_AUTH_BULK_SET_MSG_TYPE, header: make([]byte, _VALUE_MSG_AUTH_HEADER_BYTES), msg: bsm, secret: []byte(secret)}
+		am.header[0] = _VALUE_MSG_AUTH_VERSION
+		binary.BigEndian.PutUint64(am.header[1:], peerID)
+		buf := &bytes.Buffer{}
+		if _, err := am.WriteContent(buf); err != nil {
+			t.Fatal(err)
+		}
+		l := uint64(buf.Len())
+		if l != am.MsgLength() {
+			t.Fatal(l, am.MsgLength())
+		}
+		n, err := store.newInAuthBulkSetMsg(buf, l)
+		if err != nil || n != l {
+			t.Fatal(n, err)
+		}
+		// only one of these, so if we get it back we know the previous data
+		// was processed
+		bsm = <-store.bulkSetState.inFreeMsgChan
+		store.bulkSetState.inFreeMsgChan <- bsm
+		ts, _, err := store.Read(context.Background(), keyA, 2, nil)
+		if err != nil && !IsNotFound(err) {
+			t.Fatal(err)
+		}
+		return uint64(ts)
+	}
+	if ts := send("new", 1); ts != 5 {
+		t.Fatal(ts)
+	}
+	// The previous secret is still accepted during rotation.
+	if ts := send("old", 10); ts != 5 {
+		t.Fatal(ts)
+	}
+	if ts := send("wrong", 20); ts != 0 {
+		t.Fatal(ts)
+	}
+	if store.inBulkSetRejects != 1 {
+		t.Fatal(store.inBulkSetRejects)
+	}
+	// Once rotated away, the old secret is rejected.
+	store.SetMsgSecrets(context.Background(), [][]byte{[]byte("new")})
+	if ts := send("old", 30); ts != 0 {
+		t.Fatal(ts)
+	}
+	if store.inBulkSetRejects != 2 {
+		t.Fatal(store.inBulkSetRejects)
+	}
+}
+
+func TestValueMsgAuthRequired(t *testing.T) {
+	store, _, _ := newTestValueMsgAuthStore(t, "secret")
+	defer store.Shutdown(context.Background())
+	store.msgAuthState.requireAuth = true
+	bsm := &valueBulkSetMsg{header: make([]byte, _VALUE_BULK_SET_MSG_HEADER_LENGTH), body: make([]byte, 0, 1000)}
+	if !bsm.add(1, 2, 0x500, []byte("testing")) {
+		t.Fatal("")
+	}
+	buf := &bytes.Buffer{}
+	bsm.WriteContent(buf)
+	l := uint64(buf.Len())
+	if n, err := store.newInBulkSetMsg(buf, l); err != nil || n != l {
+		t.Fatal(n, err)
+	}
+	if store.inBulkSetRejects != 1 || store.inBulkSets != 0 {
+		t.Fatal(store.inBulkSetRejects, store.inBulkSets)
+	}
+	// Hash tree messages are rejected the same way and sent authenticated.
+	mkm := &valueMerkleMsg{header: make([]byte, _VALUE_MERKLE_MSG_HEADER_BYTES), body: make([]byte, _VALUE_MERKLE_MSG_ENTRY_BYTES)}
+	buf.Reset()
+	mkm.WriteContent(buf)
+	l = uint64(buf.Len())
+	if n, err := store.newInMerkleMsg(buf, l); err != nil || n != l {
+		t.Fatal(n, err)
+	}
+	if store.inPullReplicationRejects != 1 || store.inMerkles != 0 {
+		t.Fatal(store.inPullReplicationRejects, store.inMerkles)
+	}
+	if valueAuthMsgType(_VALUE_MERKLE_MSG_TYPE) != _VALUE_AUTH_MERKLE_MSG_TYPE {
+		t.Fatal(valueAuthMsgType(_VALUE_MERKLE_MSG_TYPE))
+	}
+}
@@ -0,0 +1,161 @@
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/gholt/msgring"
+	"go.uber.org/zap"
+)
+
+// Compressed messages wrap the original bulk-set and pull-replication message
+// formats with their uncompressed length and flate compress them:
+//
+// cm: uncompressedLength:8 deflate:n
+//
+// As with authenticated messages, each compressed message type has its own
+// message type so older nodes simply discard them, and they are only sent to
+// nodes that have said they accept them with a hello message; see
+// msgprotocol.got. Compressed messages can also be authenticated, with the
+// HMAC covering the compressed form.
+
+const _VALUE_COMPRESSED_BULK_SET_MSG_TYPE = 0x17d90232638550dd
+const _VALUE_COMPRESSED_PULL_REPLICATION_MSG_TYPE = 0xc2b92882f6c92aa7
+const _VALUE_AUTH_COMPRESSED_BULK_SET_MSG_TYPE = 0xbbff683a6a59d6a4
+const _VALUE_AUTH_COMPRESSED_PULL_REPLICATION_MSG_TYPE = 0xe76b74471cd6d415
+
+const _VALUE_COMPRESSED_MSG_HEADER_BYTES = 8
+
+type valueCompressionState struct {
+	enabled     bool
+	level       int
+	freeMsgChan chan *valueCompressedMsg
+}
+
+type valueCompressedMsg struct {
+	store   *defaultValueStore
+	msgType uint64
+	header  []byte
+	buf     bytes.Buffer
+	fw      *flate.Writer
+}
+
+func (store *defaultValueStore) compressionConfig(cfg *ValueStoreConfig) {
+	store.compressionState.enabled = cfg.MsgCompression
+	store.compressionState.level = cfg.MsgCompressionLevel
+	if store.compressionState.enabled {
+		// Enough for every outgoing bulk-set and pull-replication message to
+		// be compressed at once; the flate writers are created as needed.
+		store.compressionState.freeMsgChan = make(chan *valueCompressedMsg, cfg.OutBulkSetMsgs+cfg.OutPullReplicationMsgs)
+		for i := cap(store.compressionState.freeMsgChan); i > 0; i-- {
+			store.compressionState.freeMsgChan <- &valueCompressedMsg{
+				store:  store,
+				header: make([]byte, _VALUE_COMPRESSED_MSG_HEADER_BYTES),
+			}
+		}
+	}
+}
+
+// compressMsg returns the msg compressed, freeing the original, or the msg
+// itself if it isn't a type that is compressed, didn't get any smaller, or
+// there isn't a free valueCompressedMsg to use.
+func (store *defaultValueStore) compressMsg(msg msgring.Msg) msgring.Msg {
+	var msgType uint64
+	switch msg.MsgType() {
+	case _VALUE_BULK_SET_MSG_TYPE:
+		msgType = _VALUE_COMPRESSED_BULK_SET_MSG_TYPE
+	case _VALUE_PULL_REPLICATION_MSG_TYPE:
+		msgType = _VALUE_COMPRESSED_PULL_REPLICATION_MSG_TYPE
+	default:
+		return msg
+	}
+	var cm *valueCompressedMsg
+	select {
+	case cm = <-store.compressionState.freeMsgChan:
+	default:
+		atomic.AddInt32(&store.outCompressionSkips, 1)
+		return msg
+	}
+	begin := time.Now()
+	cm.buf.Reset()
+	var err error
+	if cm.fw == nil {
+		cm.fw, err = flate.NewWriter(&cm.buf, store.compressionState.level)
+	} else {
+		cm.fw.Reset(&cm.buf)
+	}
+	if err == nil {
+		_, err = msg.WriteContent(cm.fw)
+	}
+	if err == nil {
+		err = cm.fw.Close()
+	}
+	atomic.AddInt64(&store.outCompressionNanoseconds, time.Now().Sub(begin).Nanoseconds())
+	ul := msg.MsgLength()
+	if err != nil || cm.MsgLength() >= ul {
+		store.compressionState.freeMsgChan <- cm
+		atomic.AddInt32(&store.outCompressionSkips, 1)
+		return msg
+	}
+	cm.msgType = msgType
+	binary.BigEndian.PutUint64(cm.header, ul)
+	atomic.AddInt64(&store.outCompressionBytes, int64(ul))
+	atomic.AddInt64(&store.outCompressedBytes, int64(cm.MsgLength()))
+	msg.Free(0, 0)
+	return cm
+}
+
+// readInCompressedMsg reads a compressed message, using the read function to
+// read the decompressed message. Messages that can't be decompressed are
+// read and discarded without error, as the rest of the stream is still fine;
+// only errors reading the stream itself are returned.
+func (store *defaultValueStore) readInCompressedMsg(r io.Reader, l uint64, read func(io.Reader, uint64) (uint64, error)) (uint64, error) {
+	if l < _VALUE_COMPRESSED_MSG_HEADER_BYTES {
+		atomic.AddInt32(&store.inDecompressionErrors, 1)
+		return tossRead(r, l)
+	}
+	var header [_VALUE_COMPRESSED_MSG_HEADER_BYTES]byte
+	n, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return uint64(n), err
+	}
+	lr := &io.LimitedReader{R: r, N: int64(l - _VALUE_COMPRESSED_MSG_HEADER_BYTES)}
+	begin := time.Now()
+	fr := flate.NewReader(lr)
+	_, err = read(&dataBeforeEOFReader{r: fr}, binary.BigEndian.Uint64(header[:]))
+	fr.Close()
+	atomic.AddInt64(&store.inDecompressionNanoseconds, time.Now().Sub(begin).Nanoseconds())
+	if err != nil {
+		atomic.AddInt32(&store.inDecompressionErrors, 1)
+		store.logger.Debug("error decompressing incoming message", zap.String("name", store.loggerPrefix+"readInCompressedMsg"), zap.Error(err))
+	}
+	// Discard anything the flate reader didn't need, such as after a corrupt
+	// stream; an error here means the stream itself failed.
+	_, err = tossRead(lr, uint64(lr.N))
+	return l - uint64(lr.N), err
+}
+
+func (cm *valueCompressedMsg) MsgType() uint64 {
+	return cm.msgType
+}
+
+func (cm *valueCompressedMsg) MsgLength() uint64 {
+	return uint64(len(cm.header) + cm.buf.Len())
+}
+
+func (cm *valueCompressedMsg) WriteContent(w io.Writer) (uint64, error) {
+	n, err := w.Write(cm.header)
+	if err != nil {
+		return uint64(n), err
+	}
+	m, err := w.Write(cm.buf.Bytes())
+	return uint64(n + m), err
+}
+
+func (cm *valueCompressedMsg) Free(successes int, failures int) {
+	cm.store.compressionState.freeMsgChan <- cm
+}
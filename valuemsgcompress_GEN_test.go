@@ -0,0 +1,153 @@
+package store
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func newTestValueCompressionStore(t *testing.T, secrets ...string) (*defaultValueStore, *msgRingValueMsgAuthTester, uint64) {
+	cfg := newTestValueStoreConfig()
+	cfg.MsgCompression = true
+	for _, secret := range secrets {
+		cfg.MsgSecrets = append(cfg.MsgSecrets, []byte(secret))
+	}
+	return newTestValueMsgRingStore(t, cfg)
+}
+
+func newTestValueCompressibleBulkSetMsg(t *testing.T, store *defaultValueStore, keyA uint64) *valueBulkSetMsg {
+	bsm := store.newOutBulkSetMsg()
+	if !bsm.add(keyA, 2, 0x500, bytes.Repeat([]byte("testing"), 100)) {
+		t.Fatal("")
+	}
+	return bsm
+}
+
+func TestValueCompressionNegotiation(t *testing.T) {
+	store, m, peerID := newTestValueCompressionStore(t)
+	defer store.Shutdown(context.Background())
+	// Unknown peers get uncompressed messages.
+	store.msgToNode(newTestValueCompressibleBulkSetMsg(t, store, 1), peerID, time.Second)
+	buf := &bytes.Buffer{}
+	if _, err := store.newOutHelloMsg(peerID, _VALUE_MSG_FEATURE_COMPRESSION).WriteContent(buf); err != nil {
+		t.Fatal(err)
+	}
+	l := uint64(buf.Len())
+	if n, err := store.newInHelloMsg(buf, l); err != nil || n != l {
+		t.Fatal(n, err)
+	}
+	store.msgToNode(newTestValueCompressibleBulkSetMsg(t, store, 1), peerID, time.Second)
+	// Bulk-set-acks are never compressed.
+	store.msgToNode(store.newOutBulkSetAckMsg(), peerID, time.Second)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.toNodeTypes) != 4 || m.toNodeTypes[0] != _VALUE_BULK_SET_MSG_TYPE || m.toNodeTypes[1] != _VALUE_HELLO_MSG_TYPE || m.toNodeTypes[2] != _VALUE_COMPRESSED_BULK_SET_MSG_TYPE || m.toNodeTypes[3] != _VALUE_BULK_SET_ACK_MSG_TYPE {
+		t.Fatal(m.toNodeTypes)
+	}
+	if m.toNodeMsgs[2].Len() >= m.toNodeMsgs[0].Len() {
+		t.Fatal(m.toNodeMsgs[2].Len(), m.toNodeMsgs[0].Len())
+	}
+	if store.outCompressionBytes != int64(m.toNodeMsgs[0].Len()) || store.outCompressedBytes != int64(m.toNodeMsgs[2].Len()) {
+		t.Fatal(store.outCompressionBytes, store.outCompressedBytes)
+	}
+}
+
+func TestValueCompressionBulkSet(t *testing.T) {
+	for _, secret := range []string{"", "secret"} {
+		var store *defaultValueStore
+		features := byte(_VALUE_MSG_FEATURE_COMPRESSION)
+		if secret == "" {
+			store, _, _ = newTestValueCompressionStore(t)
+		} else {
+			store, _, _ = newTestValueCompressionStore(t, secret)
+			features |= _VALUE_MSG_FEATURE_AUTH
+		}
+		msg := store.msgWithFeatures(newTestValueCompressibleBulkSetMsg(t, store, 1), features)
+		buf := &bytes.Buffer{}
+		if _, err := msg.WriteContent(buf); err != nil {
+			t.Fatal(err)
+		}
+		l := uint64(buf.Len())
+		if l != msg.MsgLength() {
+			t.Fatal(l, msg.MsgLength())
+		}
+		msg.Free(0, 0)
+		var n uint64
+		var err error
+		switch msg.MsgType() {
+		case _VALUE_COMPRESSED_BULK_SET_MSG_TYPE:
+			n, err = store.newInCompressedBulkSetMsg(buf, l)
+		case _VALUE_AUTH_COMPRESSED_BULK_SET_MSG_TYPE:
+			n, err = store.newInAuthCompressedBulkSetMsg(buf, l)
+		default:
+			t.Fatal(secret, msg.MsgType())
+		}
+		if err != nil || n != l {
+			t.Fatal(n, err)
+		}
+		// only one of these, so if we get it back we know the previous data
+		// was processed
+		bsm := <-store.bulkSetState.inFreeMsgChan
+		store.bulkSetState.inFreeMsgChan <- bsm
+		ts, v, err := store.Read(context.Background(), 1, 2, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ts != 5 || !bytes.Equal(v, bytes.Repeat([]byte("testing"), 100)) {
+			t.Fatal(ts, len(v))
+		}
+		if store.inDecompressionErrors != 0 {
+			t.Fatal(store.inDecompressionErrors)
+		}
+		store.Shutdown(context.Background())
+	}
+}
+
+func TestValueCompressionCorrupt(t *testing.T) {
+	store, _, _ := newTestValueCompressionStore(t)
+	defer store.Shutdown(context.Background())
+	msg := store.compressMsg(newTestValueCompressibleBulkSetMsg(t, store, 1))
+	buf := &bytes.Buffer{}
+	if _, err := msg.WriteContent(buf); err != nil {
+		t.Fatal(err)
+	}
+	msg.Free(0, 0)
+	b := buf.Bytes()
+	for i := _VALUE_COMPRESSED_MSG_HEADER_BYTES; i < len(b); i++ {
+		b[i] = 0xff
+	}
+	// Trailing data shows the whole message was consumed.
+	l := uint64(len(b))
+	buf.Write([]byte("trailing"))
+	if n, err := store.newInCompressedBulkSetMsg(buf, l); err != nil || n != l {
+		t.Fatal(n, err)
+	}
+	if buf.String() != "trailing" {
+		t.Fatal(buf.String())
+	}
+	if store.inDecompressionErrors != 1 || store.inBulkSets != 0 {
+		t.Fatal(store.inDecompressionErrors, store.inBulkSets)
+	}
+}
+
+func TestValueCompressionSkipsIncompressible(t *testing.T) {
+	store, _, _ := newTestValueCompressionStore(t)
+	defer store.Shutdown(context.Background())
+	bsm := store.newOutBulkSetMsg()
+	value := make([]byte, 500)
+	rand.New(rand.NewSource(1)).Read(value)
+	if !bsm.add(1, 2, 0x500, value) {
+		t.Fatal("")
+	}
+	msg := store.compressMsg(bsm)
+	if msg != bsm {
+		t.Fatal(msg.MsgType())
+	}
+	msg.Free(0, 0)
+	if store.outCompressionSkips != 1 {
+		t.Fatal(store.outCompressionSkips)
+	}
+}
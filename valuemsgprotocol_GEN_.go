@@ -0,0 +1,211 @@
+package store
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gholt/msgring"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+)
+
+// Nodes tell each other which optional message features they support with
+// hello messages, sent with each pull replication pass to any node whose
+// features aren't known yet and sent back in reply when a node is first heard
+// from:
+//
+// hello: senderNodeID:8 features:1
+//
+// Messages are only sent using a feature, such as authentication or
+// compression, to nodes known to support it; this lets mixed-version
+// clusters, and clusters part way through turning a feature on, keep working.
+// Older nodes that know nothing of hello messages simply discard them.
+
+const _VALUE_HELLO_MSG_TYPE = 0xae57b1ca18123bc0
+
+const _VALUE_HELLO_MSG_BYTES = 9
+
+const (
+	// _VALUE_MSG_FEATURE_AUTH indicates the node has MsgSecrets and accepts
+	// authenticated messages.
+	_VALUE_MSG_FEATURE_AUTH = 0x01
+	// _VALUE_MSG_FEATURE_COMPRESSION indicates the node accepts compressed
+	// messages.
+	_VALUE_MSG_FEATURE_COMPRESSION = 0x02
+	// _VALUE_MSG_FEATURE_NODE_ACK indicates the node accepts node
+	// bulk-set-ack messages.
+	_VALUE_MSG_FEATURE_NODE_ACK = 0x04
+)
+
+type valueMsgProtocolState struct {
+	helloTimeout time.Duration
+
+	lock sync.RWMutex
+	// peerFeatures are the features other nodes have said they support;
+	// nodes not listed are assumed to support none.
+	peerFeatures map[uint64]byte
+}
+
+type valueHelloMsg struct {
+	body []byte
+}
+
+func (store *defaultValueStore) msgProtocolConfig(cfg *ValueStoreConfig) {
+	store.msgProtocolState.helloTimeout = time.Duration(cfg.OutPullReplicationMsgTimeout) * time.Millisecond
+	store.msgProtocolState.peerFeatures = make(map[uint64]byte)
+	if store.msgRing != nil {
+		store.msgRing.SetMsgHandler(_VALUE_HELLO_MSG_TYPE, store.newInHelloMsg)
+	}
+}
+
+// msgLocalFeatures returns the message features the local node supports.
+func (store *defaultValueStore) msgLocalFeatures() byte {
+	features := byte(_VALUE_MSG_FEATURE_NODE_ACK)
+	store.msgAuthState.lock.RLock()
+	if len(store.msgAuthState.secrets) > 0 {
+		features |= _VALUE_MSG_FEATURE_AUTH
+	}
+	store.msgAuthState.lock.RUnlock()
+	if store.compressionState.enabled {
+		features |= _VALUE_MSG_FEATURE_COMPRESSION
+	}
+	return features
+}
+
+// msgPeerFeatures returns the message features the node is known to
+// support.
+func (store *defaultValueStore) msgPeerFeatures(nodeID uint64) byte {
+	store.msgProtocolState.lock.RLock()
+	features := store.msgProtocolState.peerFeatures[nodeID]
+	store.msgProtocolState.lock.RUnlock()
+	return features
+}
+
+// msgToNode sends the msg to the node, using whatever message features the
+// node supports.
+func (store *defaultValueStore) msgToNode(msg msgring.Msg, nodeID uint64, timeout time.Duration) {
+	_, span := store.tracer.Start(context.Background(), "ValueStore.msgToNode", TraceAttribute{Key: "msgType", Value: msg.MsgType()}, TraceAttribute{Key: "length", Value: msg.MsgLength()}, TraceAttribute{Key: "nodeID", Value: nodeID})
+	defer span.End()
+	store.msgRing.MsgToNode(store.msgWithFeatures(msg, store.msgPeerFeatures(nodeID)), nodeID, timeout)
+}
+
+// msgToOtherReplicas sends the msg to the other replicas of the partition,
+// using only the message features all of those replicas support.
+func (store *defaultValueStore) msgToOtherReplicas(msg msgring.Msg, partition uint32, timeout time.Duration) {
+	_, span := store.tracer.Start(context.Background(), "ValueStore.msgToOtherReplicas", TraceAttribute{Key: "msgType", Value: msg.MsgType()}, TraceAttribute{Key: "length", Value: msg.MsgLength()}, TraceAttribute{Key: "partition", Value: uint64(partition)})
+	defer span.End()
+	var features byte
+	if ring := store.msgRing.Ring(); ring != nil {
+		features = 0xff
+		var localID uint64
+		if n := ring.LocalNode(); n != nil {
+			localID = n.ID()
+		}
+		store.msgProtocolState.lock.RLock()
+		for _, n := range ring.ResponsibleNodes(partition) {
+			if n.ID() != localID {
+				features &= store.msgProtocolState.peerFeatures[n.ID()]
+			}
+		}
+		store.msgProtocolState.lock.RUnlock()
+	}
+	store.msgRing.MsgToOtherReplicas(store.msgWithFeatures(msg, features), partition, timeout)
+}
+
+// msgWithFeatures returns the msg compressed and authenticated as the
+// features allow and the local configuration calls for.
+func (store *defaultValueStore) msgWithFeatures(msg msgring.Msg, features byte) msgring.Msg {
+	if store.compressionState.enabled && features&_VALUE_MSG_FEATURE_COMPRESSION != 0 {
+		msg = store.compressMsg(msg)
+	}
+	if store.msgAuthVersion(features) >= _VALUE_MSG_AUTH_VERSION {
+		msg = store.newOutAuthMsg(msg)
+	}
+	return msg
+}
+
+// msgHello sends hello messages to all the nodes in the ring whose features
+// aren't known yet. This is called with each out pull replication pass.
+func (store *defaultValueStore) msgHello() {
+	if store.msgRing == nil {
+		return
+	}
+	ring := store.msgRing.Ring()
+	if ring == nil {
+		return
+	}
+	features := store.msgLocalFeatures()
+	var localID uint64
+	if n := ring.LocalNode(); n != nil {
+		localID = n.ID()
+	}
+	var nodeIDs []uint64
+	store.msgProtocolState.lock.RLock()
+	for _, n := range ring.Nodes() {
+		if _, ok := store.msgProtocolState.peerFeatures[n.ID()]; !ok && n.ID() != localID {
+			nodeIDs = append(nodeIDs, n.ID())
+		}
+	}
+	store.msgProtocolState.lock.RUnlock()
+	for _, nodeID := range nodeIDs {
+		store.msgRing.MsgToNode(store.newOutHelloMsg(localID, features), nodeID, store.msgProtocolState.helloTimeout)
+	}
+}
+
+// newInHelloMsg reads hello messages from the MsgRing, recording the sender's
+// features and saying hello back if those weren't known yet.
+func (store *defaultValueStore) newInHelloMsg(r io.Reader, l uint64) (uint64, error) {
+	if l < _VALUE_HELLO_MSG_BYTES {
+		return tossRead(r, l)
+	}
+	var body [_VALUE_HELLO_MSG_BYTES]byte
+	n, err := io.ReadFull(r, body[:])
+	if err != nil {
+		return uint64(n), err
+	}
+	// Future versions may add to the hello message.
+	m, err := tossRead(r, l-_VALUE_HELLO_MSG_BYTES)
+	if err != nil {
+		return _VALUE_HELLO_MSG_BYTES + m, err
+	}
+	nodeID := binary.BigEndian.Uint64(body[:])
+	features := body[8]
+	store.msgProtocolState.lock.Lock()
+	prev, known := store.msgProtocolState.peerFeatures[nodeID]
+	store.msgProtocolState.peerFeatures[nodeID] = features
+	store.msgProtocolState.lock.Unlock()
+	if !known || prev != features {
+		store.logger.Debug("peer features", zap.String("name", store.loggerPrefix+"inHello"), zap.Uint64("nodeID", nodeID), zap.Int("features", int(features)))
+		if ring := store.msgRing.Ring(); ring != nil {
+			if n := ring.LocalNode(); n != nil {
+				store.msgRing.MsgToNode(store.newOutHelloMsg(n.ID(), store.msgLocalFeatures()), nodeID, store.msgProtocolState.helloTimeout)
+			}
+		}
+	}
+	return l, nil
+}
+
+func (store *defaultValueStore) newOutHelloMsg(nodeID uint64, features byte) *valueHelloMsg {
+	hm := &valueHelloMsg{body: make([]byte, _VALUE_HELLO_MSG_BYTES)}
+	binary.BigEndian.PutUint64(hm.body, nodeID)
+	hm.body[8] = features
+	return hm
+}
+
+func (hm *valueHelloMsg) MsgType() uint64 {
+	return _VALUE_HELLO_MSG_TYPE
+}
+
+func (hm *valueHelloMsg) MsgLength() uint64 {
+	return uint64(len(hm.body))
+}
+
+func (hm *valueHelloMsg) WriteContent(w io.Writer) (uint64, error) {
+	n, err := w.Write(hm.body)
+	return uint64(n), err
+}
+
+func (hm *valueHelloMsg) Free(successes int, failures int) {
+}
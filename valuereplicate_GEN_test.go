@@ -0,0 +1,121 @@
+package store
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ring "github.com/gholt/devicering"
+	"golang.org/x/net/context"
+)
+
+func TestValueReplicatePartition(t *testing.T) {
+	b := ring.NewBuilder(64)
+	b.SetReplicaCount(2)
+	n, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	r.SetLocalNode(n.ID())
+	m := &msgRingValueHandoffTester{ring: r, toOtherBodies: make(map[uint32][]byte)}
+	cfg := newTestValueStoreConfig()
+	cfg.MsgRing = m
+	cfg.OutPullReplicationMsgTimeout = 50
+	cfg.InPullReplicationResponseMsgTimeout = 50
+	store, _ := newTestValueStore(cfg)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	partitionShift := uint64(64 - r.PartitionBitCount())
+	keyA := uint64(3) << partitionShift
+	for i := uint64(0); i < 10; i++ {
+		if _, err = store.write(keyA+i, 2, 0x500, []byte("testing"), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Outside the partition.
+	if _, err = store.write(keyA-1, 2, 0x500, []byte("testing"), false); err != nil {
+		t.Fatal(err)
+	}
+	type resultErr struct {
+		result *ReplicateResult
+		err    error
+	}
+	c := make(chan resultErr, 1)
+	go func() {
+		result, err := store.ReplicatePartition(context.Background(), 3)
+		c <- resultErr{result, err}
+	}()
+	for atomic.LoadInt32(&store.replicateState.active) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// A pull replication response with two items in the partition, one of
+	// them older than what is already here, and one outside it.
+	bsm := &valueBulkSetMsg{header: make([]byte, _VALUE_BULK_SET_MSG_HEADER_LENGTH), body: make([]byte, 0, 1000)}
+	if !bsm.add(keyA+100, 2, 0x500, []byte("testing")) {
+		t.Fatal("")
+	}
+	if !bsm.add(keyA, 2, 0x400, []byte("testing")) {
+		t.Fatal("")
+	}
+	if !bsm.add(keyA-2, 2, 0x500, []byte("testing")) {
+		t.Fatal("")
+	}
+	buf := &bytes.Buffer{}
+	bsm.WriteContent(buf)
+	l := uint64(buf.Len())
+	if n, err := store.newInBulkSetMsg(buf, l); err != nil || n != l {
+		t.Fatal(n, err)
+	}
+	re := <-c
+	if re.err != nil {
+		t.Fatal(re.err)
+	}
+	if re.result.Partitions != 1 || re.result.ItemsSent != 10 || re.result.ItemsReceived != 2 || re.result.ItemsApplied != 1 {
+		t.Fatal(re.result)
+	}
+	m.lock.Lock()
+	if len(m.toOtherBodies) != 1 || len(m.toOtherBodies[3]) != 10*int(_VALUE_BULK_SET_MSG_ENTRY_HEADER_LENGTH+7) {
+		t.Fatal(len(m.toOtherBodies), len(m.toOtherBodies[3]))
+	}
+	m.lock.Unlock()
+	if atomic.LoadInt32(&store.replicateState.active) != 0 {
+		t.Fatal(store.replicateState.active)
+	}
+}
+
+func TestValueReplicateRangeErrors(t *testing.T) {
+	b := ring.NewBuilder(64)
+	n, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	r.SetLocalNode(n.ID())
+	cfg := newTestValueStoreConfig()
+	cfg.MsgRing = &msgRingValueHandoffTester{ring: r, toOtherBodies: make(map[uint32][]byte)}
+	store, _ := newTestValueStore(cfg)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	if _, err := store.ReplicateRange(context.Background(), 2, 1); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := store.ReplicatePartition(context.Background(), 1<<r.PartitionBitCount()); err == nil {
+		t.Fatal("expected error")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err := store.ReplicateRange(ctx, 0, 1)
+	if err != context.Canceled || result == nil {
+		t.Fatal(result, err)
+	}
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"fmt"
+	"math"
 	"sync/atomic"
 	"time"
 
@@ -10,12 +11,13 @@ import (
 )
 
 // ValueStoreStats contains all the statistics gathered by the Store's Stats
-// call.
+// call. Fields tagged `stats:"gauge"` are readings rather than counters reset
+// with each Stats call.
 type ValueStoreStats struct {
 	// Values is the number of values in the ValueStore.
-	Values uint64
+	Values uint64 `stats:"gauge"`
 	// ValuesBytes is the number of bytes of the values in the ValueStore.
-	ValueBytes uint64
+	ValueBytes uint64 `stats:"gauge"`
 	// Lookups is the number of calls to Lookup.
 	Lookups int32
 	// LookupErrors is the number of errors returned by Lookup; not-found
@@ -57,7 +59,41 @@ type ValueStoreStats struct {
 	OutBulkSetPushValues int32
 	// OutPushReplicationNanoseconds is how long the last out push replication
 	// pass took.
-	OutPushReplicationNanoseconds int64
+	OutPushReplicationNanoseconds int64 `stats:"gauge"`
+	// OutHandoffs is the number of outgoing bulk-set messages due to handoff
+	// after a ring change.
+	OutHandoffs int32
+	// OutHandoffValues is the number of values in outgoing bulk-set messages
+	// due to handoff.
+	OutHandoffValues int32
+	// HandoffNanoseconds is how long the last handoff pass took.
+	HandoffNanoseconds int64 `stats:"gauge"`
+	// HandoffCompletions is the number of handoffs that completed, that is
+	// ring changes after which all out of place data was handed off.
+	HandoffCompletions int32
+	// DivergedPartitions is the number of partitions whose latest two pull
+	// replication passes received items newer than the local copy; see
+	// Store.DivergedPartitions.
+	DivergedPartitions int `stats:"gauge"`
+	// OutHintedHandoffs is the number of outgoing bulk-set messages sending
+	// hints to their nodes.
+	OutHintedHandoffs int32
+	// OutHintedHandoffValues is the number of hints sent, including resends
+	// of hints not yet acknowledged.
+	OutHintedHandoffValues int32
+	// HintedHandoffNanoseconds is how long the last hinted handoff pass
+	// took.
+	HintedHandoffNanoseconds int64 `stats:"gauge"`
+	// HintsAcked is the number of hints acknowledged by their nodes.
+	HintsAcked int32
+	// HintsDropped is the number of hints dropped for lack of room, see
+	// Config.HintedHandoffMaxBytes, or for being too large for a bulk-set
+	// message, see Config.BulkSetMsgCap.
+	HintsDropped int32
+	// Hints is the number of hints currently kept.
+	Hints int64 `stats:"gauge"`
+	// HintBytes is the number of bytes of values currently kept as hints.
+	HintBytes int64 `stats:"gauge"`
 	// InBulkSets is the number of incoming bulk-set messages.
 	InBulkSets int32
 	// InBulkSetDrops is the number of incoming bulk-set messages dropped due
@@ -66,6 +102,13 @@ type ValueStoreStats struct {
 	// InBulkSetInvalids is the number of incoming bulk-set messages that
 	// couldn't be parsed.
 	InBulkSetInvalids int32
+	// InBulkSetOversizes is the number of incoming bulk-set entries discarded
+	// for being too large to fit within BulkSetMsgCap; larger messages are
+	// otherwise processed in BulkSetMsgCap sized chunks.
+	InBulkSetOversizes int32
+	// InBulkSetRejects is the number of incoming bulk-set messages rejected
+	// for failing authentication.
+	InBulkSetRejects int32
 	// InBulkSetWrites is the number of writes due to incoming bulk-set
 	// messages.
 	InBulkSetWrites int32
@@ -85,6 +128,9 @@ type ValueStoreStats struct {
 	// InBulkSetAckInvalids is the number of incoming bulk-set-ack messages
 	// that couldn't be parsed.
 	InBulkSetAckInvalids int32
+	// InBulkSetAckRejects is the number of incoming bulk-set-ack messages
+	// rejected for failing authentication.
+	InBulkSetAckRejects int32
 	// InBulkSetAckWrites is the number of writes (for local removal) due to
 	// incoming bulk-set-ack messages.
 	InBulkSetAckWrites int32
@@ -98,7 +144,24 @@ type ValueStoreStats struct {
 	OutPullReplications int32
 	// OutPullReplicationNanoseconds is how long the last out pull replication
 	// pass took.
-	OutPullReplicationNanoseconds int64
+	OutPullReplicationNanoseconds int64 `stats:"gauge"`
+	// OutPullReplicationBytes is the number of bytes in outgoing
+	// pull-replication messages; these are bloom filters or, with
+	// MerkleReplication, hash tree roots.
+	OutPullReplicationBytes int64
+	// OutPullReplicationPassBytes is how many bytes of pull-replication
+	// messages the last out pull replication pass sent.
+	OutPullReplicationPassBytes int64 `stats:"gauge"`
+	// OutPullReplicationBloomP is the P-factor currently used for outgoing
+	// pull-replication bloom filters; this only differs from the configured
+	// value with OutPullReplicationBloomAutoTune.
+	OutPullReplicationBloomP float64 `stats:"gauge"`
+	// OutPullReplicationBloomFPRate is the false positive rate achieved by the
+	// outgoing pull-replication bloom filters, as last measured.
+	OutPullReplicationBloomFPRate float64 `stats:"gauge"`
+	// OutBulkSetBytes is the number of bytes in outgoing bulk-set messages in
+	// response to incoming pull-replication or hash tree messages.
+	OutBulkSetBytes int64
 	// InPullReplications is the number of incoming pull-replication messages.
 	InPullReplications int32
 	// InPullReplicationDrops is the number of incoming pull-replication
@@ -107,52 +170,161 @@ type ValueStoreStats struct {
 	// InPullReplicationInvalids is the number of incoming pull-replication
 	// messages that couldn't be parsed.
 	InPullReplicationInvalids int32
+	// InPullReplicationOversizes is the number of incoming pull-replication
+	// messages dropped for being larger than MsgCap.
+	InPullReplicationOversizes int32
+	// InPullReplicationRejects is the number of incoming pull-replication
+	// and hash tree messages rejected for failing authentication.
+	InPullReplicationRejects int32
+	// OutMerkles is the number of outgoing hash tree messages, including
+	// those sent in reply to incoming hash tree messages.
+	OutMerkles int32
+	// OutMerkleBytes is the number of bytes in outgoing hash tree messages.
+	OutMerkleBytes int64
+	// InMerkles is the number of incoming hash tree messages.
+	InMerkles int32
+	// InMerkleBytes is the number of bytes in incoming hash tree messages.
+	InMerkleBytes int64
+	// InMerkleDrops is the number of incoming hash tree messages dropped due
+	// to the local system being overworked at the time.
+	InMerkleDrops int32
+	// InMerkleInvalids is the number of incoming hash tree messages that
+	// couldn't be parsed or didn't match the local hash tree layout.
+	InMerkleInvalids int32
+	// OutPullReplicationRateLimitHits is the number of outgoing
+	// pull-replication messages delayed by the rate limits.
+	OutPullReplicationRateLimitHits int32
+	// OutBulkSetRateLimitHits is the number of outgoing bulk-set messages
+	// delayed by the rate limits.
+	OutBulkSetRateLimitHits int32
+	// InBulkSetRateLimitHits is the number of incoming bulk-set messages
+	// whose processing was delayed by the rate limits.
+	InBulkSetRateLimitHits int32
+	// OutCompressionBytes is the number of bytes of outgoing messages that
+	// were compressed, before compression.
+	OutCompressionBytes int64
+	// OutCompressedBytes is the number of bytes OutCompressionBytes were
+	// compressed to.
+	OutCompressedBytes int64
+	// OutCompressionRatio is OutCompressedBytes / OutCompressionBytes, or 0
+	// if nothing was compressed.
+	OutCompressionRatio float64 `stats:"gauge"`
+	// OutCompressionNanoseconds is how long was spent compressing outgoing
+	// messages.
+	OutCompressionNanoseconds int64
+	// OutCompressionSkips is the number of outgoing messages that could have
+	// been compressed but were sent uncompressed, either because they didn't
+	// get any smaller or because all compression buffers were in use.
+	OutCompressionSkips int32
+	// InDecompressionNanoseconds is how long was spent decompressing
+	// incoming messages.
+	InDecompressionNanoseconds int64
+	// InDecompressionErrors is the number of incoming compressed messages
+	// that couldn't be decompressed.
+	InDecompressionErrors int32
 	// ExpiredDeletions is the number of recent deletes that have become old
 	// enough to be completely discarded.
 	ExpiredDeletions int32
 	// TombstoneDiscardNanoseconds is how long the last tombstone discard pass
 	// took.
-	TombstoneDiscardNanoseconds int64
+	TombstoneDiscardNanoseconds int64 `stats:"gauge"`
 	// CompactionNanoseconds is how long the last compaction pass took.
-	CompactionNanoseconds int64
+	CompactionNanoseconds int64 `stats:"gauge"`
 	// Compactions is the number of disk file sets compacted due to their
 	// contents exceeding a staleness threshold. For example, this happens when
 	// enough of the values have been overwritten or deleted in more recent
 	// operations.
 	Compactions int32
-	// SmallFileCompactions is the number of disk file sets compacted due to
-	// the entire file size being too small. For example, this may happen when
-	// the store is shutdown and restarted.
+	// SmallFileCompactions is the number of disk file sets merged into others
+	// due to having fewer entries than the CompactionSmallFileThreshold. For
+	// example, this may happen when the store is shutdown and restarted.
 	SmallFileCompactions int32
+	// AuditItemsRemoved is the number of items audits found in corrupted
+	// areas of disk files and removed, leaving replication to restore them.
+	AuditItemsRemoved int32
+	// AuditFilesPassed is the number of disk files audits found nothing wrong
+	// with.
+	AuditFilesPassed int32
+	// AuditFilesFailed is the number of disk files audits found corruption
+	// in; see AuditReport for the details.
+	AuditFilesFailed int32
+	// CompactionThrottleHits is the number of times compaction had to wait
+	// to stay within its CompactionBytesPerSecond or to back off for
+	// foreground reads.
+	CompactionThrottleHits int32
+	// AuditThrottleHits is the number of times background audits had to wait
+	// to stay within their AuditBytesPerSecond or to back off for foreground
+	// reads.
+	AuditThrottleHits int32
 	// DiskFree is the number of bytes free on the device containing the
 	// Config.Path for the defaultValueStore.
-	DiskFree uint64
+	DiskFree uint64 `stats:"gauge"`
 	// DiskUsed is the number of bytes used on the device containing the
 	// Config.Path for the defaultValueStore.
-	DiskUsed uint64
+	DiskUsed uint64 `stats:"gauge"`
 	// DiskSize is the size in bytes of the device containing the Config.Path
 	// for the defaultValueStore.
-	DiskSize uint64
+	DiskSize uint64 `stats:"gauge"`
 	// DiskFreeTOC is the number of bytes free on the device containing the
 	// Config.PathTOC for the defaultValueStore.
-	DiskFreeTOC uint64
+	DiskFreeTOC uint64 `stats:"gauge"`
 	// DiskUsedTOC is the number of bytes used on the device containing the
 	// Config.PathTOC for the defaultValueStore.
-	DiskUsedTOC uint64
+	DiskUsedTOC uint64 `stats:"gauge"`
 	// DiskSizeTOC is the size in bytes of the device containing the
 	// Config.PathTOC for the defaultValueStore.
-	DiskSizeTOC uint64
+	DiskSizeTOC uint64 `stats:"gauge"`
 	// MemFree is the number of bytes of free memory.
-	MemFree uint64
+	MemFree uint64 `stats:"gauge"`
 	// MemUsed is the number of bytes of used memory.
-	MemUsed uint64
+	MemUsed uint64 `stats:"gauge"`
 	// MemSize is the size in bytes of total memory on the system.
-	MemSize uint64
+	MemSize uint64 `stats:"gauge"`
 	// ReadOnly indicates when the system has been put in read-only mode,
 	// whether by DisableWrites or automatically by the watcher.
-	ReadOnly bool
+	ReadOnly bool `stats:"gauge"`
 	// AuditNanoseconds is how long the last audit pass took.
-	AuditNanoseconds int64
+	AuditNanoseconds int64 `stats:"gauge"`
+	// LookupLatency is the distribution of how long Lookup calls took. This
+	// and the other LatencyHistogram fields are not reset by Stats calls.
+	LookupLatency *LatencyHistogram
+
+	// ReadLatency is the distribution of how long Read calls took.
+	ReadLatency *LatencyHistogram
+
+	// WriteLatency is the distribution of how long Write calls took.
+	WriteLatency *LatencyHistogram
+	// DeleteLatency is the distribution of how long Delete calls took.
+	DeleteLatency *LatencyHistogram
+	// WriteQueueLatency is the distribution of how long writes, external and
+	// internal, waited for a memWriter to pick them up.
+	WriteQueueLatency *LatencyHistogram
+	// FileWriteLatency is the distribution of how long each write of a
+	// checksummed block to a values file took.
+	FileWriteLatency *LatencyHistogram
+	// TOCWriteLatency is the distribution of how long each write of a block
+	// of entries to a toc file took.
+	TOCWriteLatency *LatencyHistogram
+	// OutPushReplicationPassDuration is the distribution of how long out push
+	// replication passes took.
+	OutPushReplicationPassDuration *LatencyHistogram
+	// HandoffPassDuration is the distribution of how long handoff passes
+	// took.
+	HandoffPassDuration *LatencyHistogram
+	// HintedHandoffPassDuration is the distribution of how long hinted
+	// handoff passes took.
+	HintedHandoffPassDuration *LatencyHistogram
+	// OutPullReplicationPassDuration is the distribution of how long out pull
+	// replication passes took.
+	OutPullReplicationPassDuration *LatencyHistogram
+	// TombstoneDiscardPassDuration is the distribution of how long tombstone
+	// discard passes took.
+	TombstoneDiscardPassDuration *LatencyHistogram
+	// CompactionPassDuration is the distribution of how long compaction
+	// passes took.
+	CompactionPassDuration *LatencyHistogram
+	// AuditPassDuration is the distribution of how long audit passes took.
+	AuditPassDuration *LatencyHistogram
 
 	debug                      bool
 	freeableMemBlockChansCap   int
@@ -189,66 +361,26 @@ type ValueStoreStats struct {
 	fileReaders                int
 	checksumInterval           uint32
 	replicationIgnoreRecent    int
+	merkleBits                 uint16
+	fileBytesLive              int64
+	fileBytesTotal             int64
+	fileBytes                  []valueFileBytesStat
 	locmapDebugInfo            fmt.Stringer
 }
 
+// valueFileBytesStat is the live and total bytes of a file, for the debug
+// stats.
+type valueFileBytesStat struct {
+	name  string
+	live  int64
+	total int64
+}
+
 func (store *defaultValueStore) Stats(ctx context.Context, debug bool) (fmt.Stringer, error) {
+	_, span := store.startSpan(ctx, "Stats")
+	defer span.End()
 	store.statsLock.Lock()
-	stats := &ValueStoreStats{
-		Lookups:      atomic.LoadInt32(&store.lookups),
-		LookupErrors: atomic.LoadInt32(&store.lookupErrors),
-
-		Reads:      atomic.LoadInt32(&store.reads),
-		ReadErrors: atomic.LoadInt32(&store.readErrors),
-
-		Writes:                        atomic.LoadInt32(&store.writes),
-		WriteErrors:                   atomic.LoadInt32(&store.writeErrors),
-		WritesOverridden:              atomic.LoadInt32(&store.writesOverridden),
-		Deletes:                       atomic.LoadInt32(&store.deletes),
-		DeleteErrors:                  atomic.LoadInt32(&store.deleteErrors),
-		DeletesOverridden:             atomic.LoadInt32(&store.deletesOverridden),
-		OutBulkSets:                   atomic.LoadInt32(&store.outBulkSets),
-		OutBulkSetValues:              atomic.LoadInt32(&store.outBulkSetValues),
-		OutBulkSetPushes:              atomic.LoadInt32(&store.outBulkSetPushes),
-		OutBulkSetPushValues:          atomic.LoadInt32(&store.outBulkSetPushValues),
-		OutPushReplicationNanoseconds: atomic.LoadInt64(&store.outPushReplicationNanoseconds),
-		InBulkSets:                    atomic.LoadInt32(&store.inBulkSets),
-		InBulkSetDrops:                atomic.LoadInt32(&store.inBulkSetDrops),
-		InBulkSetInvalids:             atomic.LoadInt32(&store.inBulkSetInvalids),
-		InBulkSetWrites:               atomic.LoadInt32(&store.inBulkSetWrites),
-		InBulkSetWriteErrors:          atomic.LoadInt32(&store.inBulkSetWriteErrors),
-		InBulkSetWritesOverridden:     atomic.LoadInt32(&store.inBulkSetWritesOverridden),
-		OutBulkSetAcks:                atomic.LoadInt32(&store.outBulkSetAcks),
-		InBulkSetAcks:                 atomic.LoadInt32(&store.inBulkSetAcks),
-		InBulkSetAckDrops:             atomic.LoadInt32(&store.inBulkSetAckDrops),
-		InBulkSetAckInvalids:          atomic.LoadInt32(&store.inBulkSetAckInvalids),
-		InBulkSetAckWrites:            atomic.LoadInt32(&store.inBulkSetAckWrites),
-		InBulkSetAckWriteErrors:       atomic.LoadInt32(&store.inBulkSetAckWriteErrors),
-		InBulkSetAckWritesOverridden:  atomic.LoadInt32(&store.inBulkSetAckWritesOverridden),
-		OutPullReplications:           atomic.LoadInt32(&store.outPullReplications),
-		OutPullReplicationNanoseconds: atomic.LoadInt64(&store.outPullReplicationNanoseconds),
-		InPullReplications:            atomic.LoadInt32(&store.inPullReplications),
-		InPullReplicationDrops:        atomic.LoadInt32(&store.inPullReplicationDrops),
-		InPullReplicationInvalids:     atomic.LoadInt32(&store.inPullReplicationInvalids),
-		ExpiredDeletions:              atomic.LoadInt32(&store.expiredDeletions),
-		TombstoneDiscardNanoseconds:   atomic.LoadInt64(&store.tombstoneDiscardNanoseconds),
-		CompactionNanoseconds:         atomic.LoadInt64(&store.compactionNanoseconds),
-		Compactions:                   atomic.LoadInt32(&store.compactions),
-		SmallFileCompactions:          atomic.LoadInt32(&store.smallFileCompactions),
-		DiskFree:                      atomic.LoadUint64(&store.watcherState.diskFree),
-		DiskUsed:                      atomic.LoadUint64(&store.watcherState.diskUsed),
-		DiskSize:                      atomic.LoadUint64(&store.watcherState.diskSize),
-		DiskFreeTOC:                   atomic.LoadUint64(&store.watcherState.diskFreeTOC),
-		DiskUsedTOC:                   atomic.LoadUint64(&store.watcherState.diskUsedTOC),
-		DiskSizeTOC:                   atomic.LoadUint64(&store.watcherState.diskSizeTOC),
-		MemFree:                       atomic.LoadUint64(&store.watcherState.memFree),
-		MemUsed:                       atomic.LoadUint64(&store.watcherState.memUsed),
-		MemSize:                       atomic.LoadUint64(&store.watcherState.memSize),
-		AuditNanoseconds:              atomic.LoadInt64(&store.auditNanoseconds),
-	}
-	store.disableEnableWritesLock.Lock()
-	stats.ReadOnly = store.readOnly
-	store.disableEnableWritesLock.Unlock()
+	stats := store.statsSnapshot()
 	atomic.AddInt32(&store.lookups, -stats.Lookups)
 	atomic.AddInt32(&store.lookupErrors, -stats.LookupErrors)
 
@@ -265,9 +397,18 @@ func (store *defaultValueStore) Stats(ctx context.Context, debug bool) (fmt.Stri
 	atomic.AddInt32(&store.outBulkSetValues, -stats.OutBulkSetValues)
 	atomic.AddInt32(&store.outBulkSetPushes, -stats.OutBulkSetPushes)
 	atomic.AddInt32(&store.outBulkSetPushValues, -stats.OutBulkSetPushValues)
+	atomic.AddInt32(&store.outHandoffs, -stats.OutHandoffs)
+	atomic.AddInt32(&store.outHandoffValues, -stats.OutHandoffValues)
+	atomic.AddInt32(&store.handoffCompletions, -stats.HandoffCompletions)
+	atomic.AddInt32(&store.outHintedHandoffs, -stats.OutHintedHandoffs)
+	atomic.AddInt32(&store.outHintedHandoffValues, -stats.OutHintedHandoffValues)
+	atomic.AddInt32(&store.hintsAcked, -stats.HintsAcked)
+	atomic.AddInt32(&store.hintsDropped, -stats.HintsDropped)
 	atomic.AddInt32(&store.inBulkSets, -stats.InBulkSets)
 	atomic.AddInt32(&store.inBulkSetDrops, -stats.InBulkSetDrops)
 	atomic.AddInt32(&store.inBulkSetInvalids, -stats.InBulkSetInvalids)
+	atomic.AddInt32(&store.inBulkSetOversizes, -stats.InBulkSetOversizes)
+	atomic.AddInt32(&store.inBulkSetRejects, -stats.InBulkSetRejects)
 	atomic.AddInt32(&store.inBulkSetWrites, -stats.InBulkSetWrites)
 	atomic.AddInt32(&store.inBulkSetWriteErrors, -stats.InBulkSetWriteErrors)
 	atomic.AddInt32(&store.inBulkSetWritesOverridden, -stats.InBulkSetWritesOverridden)
@@ -275,16 +416,42 @@ func (store *defaultValueStore) Stats(ctx context.Context, debug bool) (fmt.Stri
 	atomic.AddInt32(&store.inBulkSetAcks, -stats.InBulkSetAcks)
 	atomic.AddInt32(&store.inBulkSetAckDrops, -stats.InBulkSetAckDrops)
 	atomic.AddInt32(&store.inBulkSetAckInvalids, -stats.InBulkSetAckInvalids)
+	atomic.AddInt32(&store.inBulkSetAckRejects, -stats.InBulkSetAckRejects)
 	atomic.AddInt32(&store.inBulkSetAckWrites, -stats.InBulkSetAckWrites)
 	atomic.AddInt32(&store.inBulkSetAckWriteErrors, -stats.InBulkSetAckWriteErrors)
 	atomic.AddInt32(&store.inBulkSetAckWritesOverridden, -stats.InBulkSetAckWritesOverridden)
 	atomic.AddInt32(&store.outPullReplications, -stats.OutPullReplications)
+	atomic.AddInt64(&store.outPullReplicationBytes, -stats.OutPullReplicationBytes)
+	atomic.AddInt64(&store.outBulkSetBytes, -stats.OutBulkSetBytes)
 	atomic.AddInt32(&store.inPullReplications, -stats.InPullReplications)
 	atomic.AddInt32(&store.inPullReplicationDrops, -stats.InPullReplicationDrops)
 	atomic.AddInt32(&store.inPullReplicationInvalids, -stats.InPullReplicationInvalids)
+	atomic.AddInt32(&store.inPullReplicationOversizes, -stats.InPullReplicationOversizes)
+	atomic.AddInt32(&store.inPullReplicationRejects, -stats.InPullReplicationRejects)
+	atomic.AddInt32(&store.outMerkles, -stats.OutMerkles)
+	atomic.AddInt64(&store.outMerkleBytes, -stats.OutMerkleBytes)
+	atomic.AddInt32(&store.inMerkles, -stats.InMerkles)
+	atomic.AddInt64(&store.inMerkleBytes, -stats.InMerkleBytes)
+	atomic.AddInt32(&store.inMerkleDrops, -stats.InMerkleDrops)
+	atomic.AddInt32(&store.inMerkleInvalids, -stats.InMerkleInvalids)
+	atomic.AddInt32(&store.outPullReplicationRateLimitHits, -stats.OutPullReplicationRateLimitHits)
+	atomic.AddInt32(&store.outBulkSetRateLimitHits, -stats.OutBulkSetRateLimitHits)
+	atomic.AddInt32(&store.inBulkSetRateLimitHits, -stats.InBulkSetRateLimitHits)
+	atomic.AddInt64(&store.outCompressionBytes, -stats.OutCompressionBytes)
+	atomic.AddInt64(&store.outCompressedBytes, -stats.OutCompressedBytes)
+	atomic.AddInt64(&store.outCompressionNanoseconds, -stats.OutCompressionNanoseconds)
+	atomic.AddInt32(&store.outCompressionSkips, -stats.OutCompressionSkips)
+	atomic.AddInt64(&store.inDecompressionNanoseconds, -stats.InDecompressionNanoseconds)
+	atomic.AddInt32(&store.inDecompressionErrors, -stats.InDecompressionErrors)
 	atomic.AddInt32(&store.expiredDeletions, -stats.ExpiredDeletions)
 	atomic.AddInt32(&store.compactions, -stats.Compactions)
 	atomic.AddInt32(&store.smallFileCompactions, -stats.SmallFileCompactions)
+	atomic.AddInt32(&store.auditItemsRemoved, -stats.AuditItemsRemoved)
+	atomic.AddInt32(&store.auditFilesPassed, -stats.AuditFilesPassed)
+	atomic.AddInt32(&store.auditFilesFailed, -stats.AuditFilesFailed)
+	atomic.AddInt32(&store.compactionState.throttle.hits, -stats.CompactionThrottleHits)
+	atomic.AddInt32(&store.auditState.throttle.hits, -stats.AuditThrottleHits)
+	statsAccumulate(store.statsTotals, stats)
 	store.statsLock.Unlock()
 	if !debug {
 		locmapStats := store.locmap.Stats(false)
@@ -333,6 +500,20 @@ func (store *defaultValueStore) Stats(ctx context.Context, debug bool) (fmt.Stri
 		stats.fileReaders = store.fileReaders
 		stats.checksumInterval = store.checksumInterval
 		stats.replicationIgnoreRecent = int(store.replicationIgnoreRecent / uint64(time.Second))
+		stats.merkleBits = store.merkleState.bits
+		for id := uint64(1); id <= stats.maxLocBlockID && id < uint64(len(store.locBlocks)); id++ {
+			fl, ok := store.locBlocks[id].(*valueStoreFile)
+			if !ok {
+				continue
+			}
+			live, total := store.locBlockLiveAndTotal(uint32(id))
+			if total == 0 {
+				continue
+			}
+			stats.fileBytesLive += live
+			stats.fileBytesTotal += total
+			stats.fileBytes = append(stats.fileBytes, valueFileBytesStat{name: fmt.Sprintf("%019d.value", fl.nameTimestamp), live: live, total: total})
+		}
 		locmapStats := store.locmap.Stats(true)
 		stats.Values = locmapStats.ActiveCount
 		stats.ValueBytes = locmapStats.ActiveBytes
@@ -341,6 +522,148 @@ func (store *defaultValueStore) Stats(ctx context.Context, debug bool) (fmt.Stri
 	return stats, nil
 }
 
+// StatsMetrics returns the same statistics as Stats, other than the debug
+// ones, but with the counters as totals since the Store was created; nothing
+// is reset, so any number of metrics systems can read them alongside Stats.
+func (store *defaultValueStore) StatsMetrics(ctx context.Context) ([]StatsMetric, error) {
+	_, span := store.startSpan(ctx, "StatsMetrics")
+	defer span.End()
+	store.statsLock.Lock()
+	stats := store.statsSnapshot()
+	totals := make(map[string]int64, len(store.statsTotals))
+	for k, v := range store.statsTotals {
+		totals[k] = v
+	}
+	store.statsLock.Unlock()
+	locmapStats := store.locmap.Stats(false)
+	stats.Values = locmapStats.ActiveCount
+	stats.ValueBytes = locmapStats.ActiveBytes
+	return statsMetrics(totals, stats), nil
+}
+
+// statsSnapshot returns the current statistics without resetting anything;
+// the caller must hold the statsLock. The Values and ValueBytes are left for
+// the caller as they come from the more expensive locmap stats.
+func (store *defaultValueStore) statsSnapshot() *ValueStoreStats {
+	stats := &ValueStoreStats{
+		Lookups:      atomic.LoadInt32(&store.lookups),
+		LookupErrors: atomic.LoadInt32(&store.lookupErrors),
+
+		Reads:      atomic.LoadInt32(&store.reads),
+		ReadErrors: atomic.LoadInt32(&store.readErrors),
+
+		Writes:                          atomic.LoadInt32(&store.writes),
+		WriteErrors:                     atomic.LoadInt32(&store.writeErrors),
+		WritesOverridden:                atomic.LoadInt32(&store.writesOverridden),
+		Deletes:                         atomic.LoadInt32(&store.deletes),
+		DeleteErrors:                    atomic.LoadInt32(&store.deleteErrors),
+		DeletesOverridden:               atomic.LoadInt32(&store.deletesOverridden),
+		OutBulkSets:                     atomic.LoadInt32(&store.outBulkSets),
+		OutBulkSetValues:                atomic.LoadInt32(&store.outBulkSetValues),
+		OutBulkSetPushes:                atomic.LoadInt32(&store.outBulkSetPushes),
+		OutBulkSetPushValues:            atomic.LoadInt32(&store.outBulkSetPushValues),
+		OutPushReplicationNanoseconds:   atomic.LoadInt64(&store.outPushReplicationNanoseconds),
+		OutHandoffs:                     atomic.LoadInt32(&store.outHandoffs),
+		OutHandoffValues:                atomic.LoadInt32(&store.outHandoffValues),
+		HandoffNanoseconds:              atomic.LoadInt64(&store.handoffNanoseconds),
+		HandoffCompletions:              atomic.LoadInt32(&store.handoffCompletions),
+		DivergedPartitions:              store.replicationDivergedCount(),
+		OutHintedHandoffs:               atomic.LoadInt32(&store.outHintedHandoffs),
+		OutHintedHandoffValues:          atomic.LoadInt32(&store.outHintedHandoffValues),
+		HintedHandoffNanoseconds:        atomic.LoadInt64(&store.hintedHandoffNanoseconds),
+		HintsAcked:                      atomic.LoadInt32(&store.hintsAcked),
+		HintsDropped:                    atomic.LoadInt32(&store.hintsDropped),
+		Hints:                           atomic.LoadInt64(&store.hintedHandoffState.count),
+		HintBytes:                       atomic.LoadInt64(&store.hintedHandoffState.bytes),
+		InBulkSets:                      atomic.LoadInt32(&store.inBulkSets),
+		InBulkSetDrops:                  atomic.LoadInt32(&store.inBulkSetDrops),
+		InBulkSetInvalids:               atomic.LoadInt32(&store.inBulkSetInvalids),
+		InBulkSetOversizes:              atomic.LoadInt32(&store.inBulkSetOversizes),
+		InBulkSetRejects:                atomic.LoadInt32(&store.inBulkSetRejects),
+		InBulkSetWrites:                 atomic.LoadInt32(&store.inBulkSetWrites),
+		InBulkSetWriteErrors:            atomic.LoadInt32(&store.inBulkSetWriteErrors),
+		InBulkSetWritesOverridden:       atomic.LoadInt32(&store.inBulkSetWritesOverridden),
+		OutBulkSetAcks:                  atomic.LoadInt32(&store.outBulkSetAcks),
+		InBulkSetAcks:                   atomic.LoadInt32(&store.inBulkSetAcks),
+		InBulkSetAckDrops:               atomic.LoadInt32(&store.inBulkSetAckDrops),
+		InBulkSetAckInvalids:            atomic.LoadInt32(&store.inBulkSetAckInvalids),
+		InBulkSetAckRejects:             atomic.LoadInt32(&store.inBulkSetAckRejects),
+		InBulkSetAckWrites:              atomic.LoadInt32(&store.inBulkSetAckWrites),
+		InBulkSetAckWriteErrors:         atomic.LoadInt32(&store.inBulkSetAckWriteErrors),
+		InBulkSetAckWritesOverridden:    atomic.LoadInt32(&store.inBulkSetAckWritesOverridden),
+		OutPullReplications:             atomic.LoadInt32(&store.outPullReplications),
+		OutPullReplicationNanoseconds:   atomic.LoadInt64(&store.outPullReplicationNanoseconds),
+		OutPullReplicationBytes:         atomic.LoadInt64(&store.outPullReplicationBytes),
+		OutPullReplicationPassBytes:     atomic.LoadInt64(&store.outPullReplicationPassBytes),
+		OutPullReplicationBloomP:        math.Float64frombits(atomic.LoadUint64(&store.pullReplicationState.outBloomPBits)),
+		OutPullReplicationBloomFPRate:   math.Float64frombits(atomic.LoadUint64(&store.outPullReplicationBloomFPRate)),
+		OutBulkSetBytes:                 atomic.LoadInt64(&store.outBulkSetBytes),
+		InPullReplications:              atomic.LoadInt32(&store.inPullReplications),
+		InPullReplicationDrops:          atomic.LoadInt32(&store.inPullReplicationDrops),
+		InPullReplicationInvalids:       atomic.LoadInt32(&store.inPullReplicationInvalids),
+		InPullReplicationOversizes:      atomic.LoadInt32(&store.inPullReplicationOversizes),
+		InPullReplicationRejects:        atomic.LoadInt32(&store.inPullReplicationRejects),
+		OutMerkles:                      atomic.LoadInt32(&store.outMerkles),
+		OutMerkleBytes:                  atomic.LoadInt64(&store.outMerkleBytes),
+		InMerkles:                       atomic.LoadInt32(&store.inMerkles),
+		InMerkleBytes:                   atomic.LoadInt64(&store.inMerkleBytes),
+		InMerkleDrops:                   atomic.LoadInt32(&store.inMerkleDrops),
+		InMerkleInvalids:                atomic.LoadInt32(&store.inMerkleInvalids),
+		OutPullReplicationRateLimitHits: atomic.LoadInt32(&store.outPullReplicationRateLimitHits),
+		OutBulkSetRateLimitHits:         atomic.LoadInt32(&store.outBulkSetRateLimitHits),
+		InBulkSetRateLimitHits:          atomic.LoadInt32(&store.inBulkSetRateLimitHits),
+		OutCompressionBytes:             atomic.LoadInt64(&store.outCompressionBytes),
+		OutCompressedBytes:              atomic.LoadInt64(&store.outCompressedBytes),
+		OutCompressionNanoseconds:       atomic.LoadInt64(&store.outCompressionNanoseconds),
+		OutCompressionSkips:             atomic.LoadInt32(&store.outCompressionSkips),
+		InDecompressionNanoseconds:      atomic.LoadInt64(&store.inDecompressionNanoseconds),
+		InDecompressionErrors:           atomic.LoadInt32(&store.inDecompressionErrors),
+		ExpiredDeletions:                atomic.LoadInt32(&store.expiredDeletions),
+		TombstoneDiscardNanoseconds:     atomic.LoadInt64(&store.tombstoneDiscardNanoseconds),
+		CompactionNanoseconds:           atomic.LoadInt64(&store.compactionNanoseconds),
+		Compactions:                     atomic.LoadInt32(&store.compactions),
+		SmallFileCompactions:            atomic.LoadInt32(&store.smallFileCompactions),
+		AuditItemsRemoved:               atomic.LoadInt32(&store.auditItemsRemoved),
+		AuditFilesPassed:                atomic.LoadInt32(&store.auditFilesPassed),
+		AuditFilesFailed:                atomic.LoadInt32(&store.auditFilesFailed),
+		CompactionThrottleHits:          atomic.LoadInt32(&store.compactionState.throttle.hits),
+		AuditThrottleHits:               atomic.LoadInt32(&store.auditState.throttle.hits),
+		DiskFree:                        atomic.LoadUint64(&store.watcherState.diskFree),
+		DiskUsed:                        atomic.LoadUint64(&store.watcherState.diskUsed),
+		DiskSize:                        atomic.LoadUint64(&store.watcherState.diskSize),
+		DiskFreeTOC:                     atomic.LoadUint64(&store.watcherState.diskFreeTOC),
+		DiskUsedTOC:                     atomic.LoadUint64(&store.watcherState.diskUsedTOC),
+		DiskSizeTOC:                     atomic.LoadUint64(&store.watcherState.diskSizeTOC),
+		MemFree:                         atomic.LoadUint64(&store.watcherState.memFree),
+		MemUsed:                         atomic.LoadUint64(&store.watcherState.memUsed),
+		MemSize:                         atomic.LoadUint64(&store.watcherState.memSize),
+		AuditNanoseconds:                atomic.LoadInt64(&store.auditNanoseconds),
+		LookupLatency:                   store.lookupLatency.snapshot(),
+
+		ReadLatency: store.readLatency.snapshot(),
+
+		WriteLatency:                   store.writeLatency.snapshot(),
+		DeleteLatency:                  store.deleteLatency.snapshot(),
+		WriteQueueLatency:              store.writeQueueLatency.snapshot(),
+		FileWriteLatency:               store.fileWriteLatency.snapshot(),
+		TOCWriteLatency:                store.tocWriteLatency.snapshot(),
+		OutPushReplicationPassDuration: store.outPushReplicationPassDuration.snapshot(),
+		HandoffPassDuration:            store.handoffPassDuration.snapshot(),
+		HintedHandoffPassDuration:      store.hintedHandoffPassDuration.snapshot(),
+		OutPullReplicationPassDuration: store.outPullReplicationPassDuration.snapshot(),
+		TombstoneDiscardPassDuration:   store.tombstoneDiscardPassDuration.snapshot(),
+		CompactionPassDuration:         store.compactionPassDuration.snapshot(),
+		AuditPassDuration:              store.auditPassDuration.snapshot(),
+	}
+	store.disableEnableWritesLock.Lock()
+	stats.ReadOnly = store.readOnly
+	store.disableEnableWritesLock.Unlock()
+	if stats.OutCompressionBytes > 0 {
+		stats.OutCompressionRatio = float64(stats.OutCompressedBytes) / float64(stats.OutCompressionBytes)
+	}
+	return stats
+}
+
 // String returns a string representation of the ValueStoreStats structure.
 func (stats *ValueStoreStats) String() string {
 	report := [][]string{
@@ -363,9 +686,23 @@ func (stats *ValueStoreStats) String() string {
 		{"OutBulkSetPushes", fmt.Sprintf("%d", stats.OutBulkSetPushes)},
 		{"OutBulkSetPushValues", fmt.Sprintf("%d", stats.OutBulkSetPushValues)},
 		{"OutPushReplicationNanoseconds", fmt.Sprintf("%d", stats.OutPushReplicationNanoseconds)},
+		{"OutHandoffs", fmt.Sprintf("%d", stats.OutHandoffs)},
+		{"OutHandoffValues", fmt.Sprintf("%d", stats.OutHandoffValues)},
+		{"HandoffNanoseconds", fmt.Sprintf("%d", stats.HandoffNanoseconds)},
+		{"HandoffCompletions", fmt.Sprintf("%d", stats.HandoffCompletions)},
+		{"DivergedPartitions", fmt.Sprintf("%d", stats.DivergedPartitions)},
+		{"OutHintedHandoffs", fmt.Sprintf("%d", stats.OutHintedHandoffs)},
+		{"OutHintedHandoffValues", fmt.Sprintf("%d", stats.OutHintedHandoffValues)},
+		{"HintedHandoffNanoseconds", fmt.Sprintf("%d", stats.HintedHandoffNanoseconds)},
+		{"HintsAcked", fmt.Sprintf("%d", stats.HintsAcked)},
+		{"HintsDropped", fmt.Sprintf("%d", stats.HintsDropped)},
+		{"Hints", fmt.Sprintf("%d", stats.Hints)},
+		{"HintBytes", fmt.Sprintf("%d", stats.HintBytes)},
 		{"InBulkSets", fmt.Sprintf("%d", stats.InBulkSets)},
 		{"InBulkSetDrops", fmt.Sprintf("%d", stats.InBulkSetDrops)},
 		{"InBulkSetInvalids", fmt.Sprintf("%d", stats.InBulkSetInvalids)},
+		{"InBulkSetOversizes", fmt.Sprintf("%d", stats.InBulkSetOversizes)},
+		{"InBulkSetRejects", fmt.Sprintf("%d", stats.InBulkSetRejects)},
 		{"InBulkSetWrites", fmt.Sprintf("%d", stats.InBulkSetWrites)},
 		{"InBulkSetWriteErrors", fmt.Sprintf("%d", stats.InBulkSetWriteErrors)},
 		{"InBulkSetWritesOverridden", fmt.Sprintf("%d", stats.InBulkSetWritesOverridden)},
@@ -373,19 +710,48 @@ func (stats *ValueStoreStats) String() string {
 		{"InBulkSetAcks", fmt.Sprintf("%d", stats.InBulkSetAcks)},
 		{"InBulkSetAckDrops", fmt.Sprintf("%d", stats.InBulkSetAckDrops)},
 		{"InBulkSetAckInvalids", fmt.Sprintf("%d", stats.InBulkSetAckInvalids)},
+		{"InBulkSetAckRejects", fmt.Sprintf("%d", stats.InBulkSetAckRejects)},
 		{"InBulkSetAckWrites", fmt.Sprintf("%d", stats.InBulkSetAckWrites)},
 		{"InBulkSetAckWriteErrors", fmt.Sprintf("%d", stats.InBulkSetAckWriteErrors)},
 		{"InBulkSetAckWritesOverridden", fmt.Sprintf("%d", stats.InBulkSetAckWritesOverridden)},
 		{"OutPullReplications", fmt.Sprintf("%d", stats.OutPullReplications)},
 		{"OutPullReplicationNanoseconds", fmt.Sprintf("%d", stats.OutPullReplicationNanoseconds)},
+		{"OutPullReplicationBytes", fmt.Sprintf("%d", stats.OutPullReplicationBytes)},
+		{"OutPullReplicationPassBytes", fmt.Sprintf("%d", stats.OutPullReplicationPassBytes)},
+		{"OutPullReplicationBloomP", fmt.Sprintf("%g", stats.OutPullReplicationBloomP)},
+		{"OutPullReplicationBloomFPRate", fmt.Sprintf("%g", stats.OutPullReplicationBloomFPRate)},
+		{"OutBulkSetBytes", fmt.Sprintf("%d", stats.OutBulkSetBytes)},
 		{"InPullReplications", fmt.Sprintf("%d", stats.InPullReplications)},
 		{"InPullReplicationDrops", fmt.Sprintf("%d", stats.InPullReplicationDrops)},
 		{"InPullReplicationInvalids", fmt.Sprintf("%d", stats.InPullReplicationInvalids)},
+		{"InPullReplicationOversizes", fmt.Sprintf("%d", stats.InPullReplicationOversizes)},
+		{"InPullReplicationRejects", fmt.Sprintf("%d", stats.InPullReplicationRejects)},
+		{"OutMerkles", fmt.Sprintf("%d", stats.OutMerkles)},
+		{"OutMerkleBytes", fmt.Sprintf("%d", stats.OutMerkleBytes)},
+		{"InMerkles", fmt.Sprintf("%d", stats.InMerkles)},
+		{"InMerkleBytes", fmt.Sprintf("%d", stats.InMerkleBytes)},
+		{"InMerkleDrops", fmt.Sprintf("%d", stats.InMerkleDrops)},
+		{"InMerkleInvalids", fmt.Sprintf("%d", stats.InMerkleInvalids)},
+		{"OutPullReplicationRateLimitHits", fmt.Sprintf("%d", stats.OutPullReplicationRateLimitHits)},
+		{"OutBulkSetRateLimitHits", fmt.Sprintf("%d", stats.OutBulkSetRateLimitHits)},
+		{"InBulkSetRateLimitHits", fmt.Sprintf("%d", stats.InBulkSetRateLimitHits)},
+		{"OutCompressionBytes", fmt.Sprintf("%d", stats.OutCompressionBytes)},
+		{"OutCompressedBytes", fmt.Sprintf("%d", stats.OutCompressedBytes)},
+		{"OutCompressionRatio", fmt.Sprintf("%g", stats.OutCompressionRatio)},
+		{"OutCompressionNanoseconds", fmt.Sprintf("%d", stats.OutCompressionNanoseconds)},
+		{"OutCompressionSkips", fmt.Sprintf("%d", stats.OutCompressionSkips)},
+		{"InDecompressionNanoseconds", fmt.Sprintf("%d", stats.InDecompressionNanoseconds)},
+		{"InDecompressionErrors", fmt.Sprintf("%d", stats.InDecompressionErrors)},
 		{"ExpiredDeletions", fmt.Sprintf("%d", stats.ExpiredDeletions)},
 		{"TombstoneDiscardNanoseconds", fmt.Sprintf("%d", stats.TombstoneDiscardNanoseconds)},
 		{"CompactionNanoseconds", fmt.Sprintf("%d", stats.CompactionNanoseconds)},
 		{"Compactions", fmt.Sprintf("%d", stats.Compactions)},
 		{"SmallFileCompactions", fmt.Sprintf("%d", stats.SmallFileCompactions)},
+		{"AuditItemsRemoved", fmt.Sprintf("%d", stats.AuditItemsRemoved)},
+		{"AuditFilesPassed", fmt.Sprintf("%d", stats.AuditFilesPassed)},
+		{"AuditFilesFailed", fmt.Sprintf("%d", stats.AuditFilesFailed)},
+		{"CompactionThrottleHits", fmt.Sprintf("%d", stats.CompactionThrottleHits)},
+		{"AuditThrottleHits", fmt.Sprintf("%d", stats.AuditThrottleHits)},
 		{"DiskFree", fmt.Sprintf("%d", stats.DiskFree)},
 		{"DiskUsed", fmt.Sprintf("%d", stats.DiskUsed)},
 		{"DiskSize", fmt.Sprintf("%d", stats.DiskSize)},
@@ -396,6 +762,22 @@ func (stats *ValueStoreStats) String() string {
 		{"MemUsed", fmt.Sprintf("%d", stats.MemUsed)},
 		{"MemSize", fmt.Sprintf("%d", stats.MemSize)},
 		{"AuditNanoseconds", fmt.Sprintf("%d", stats.AuditNanoseconds)},
+		{"LookupLatency", stats.LookupLatency.String()},
+
+		{"ReadLatency", stats.ReadLatency.String()},
+
+		{"WriteLatency", stats.WriteLatency.String()},
+		{"DeleteLatency", stats.DeleteLatency.String()},
+		{"WriteQueueLatency", stats.WriteQueueLatency.String()},
+		{"FileWriteLatency", stats.FileWriteLatency.String()},
+		{"TOCWriteLatency", stats.TOCWriteLatency.String()},
+		{"OutPushReplicationPassDuration", stats.OutPushReplicationPassDuration.String()},
+		{"HandoffPassDuration", stats.HandoffPassDuration.String()},
+		{"HintedHandoffPassDuration", stats.HintedHandoffPassDuration.String()},
+		{"OutPullReplicationPassDuration", stats.OutPullReplicationPassDuration.String()},
+		{"TombstoneDiscardPassDuration", stats.TombstoneDiscardPassDuration.String()},
+		{"CompactionPassDuration", stats.CompactionPassDuration.String()},
+		{"AuditPassDuration", stats.AuditPassDuration.String()},
 	}
 	if stats.debug {
 		report = append(report, [][]string{
@@ -434,8 +816,14 @@ func (stats *ValueStoreStats) String() string {
 			{"fileReaders", fmt.Sprintf("%d", stats.fileReaders)},
 			{"checksumInterval", fmt.Sprintf("%d", stats.checksumInterval)},
 			{"replicationIgnoreRecent", fmt.Sprintf("%d", stats.replicationIgnoreRecent)},
-			{"locmapDebugInfo", stats.locmapDebugInfo.String()},
+			{"merkleBits", fmt.Sprintf("%d", stats.merkleBits)},
+			{"fileBytesLive", fmt.Sprintf("%d", stats.fileBytesLive)},
+			{"fileBytesTotal", fmt.Sprintf("%d", stats.fileBytesTotal)},
 		}...)
+		for _, f := range stats.fileBytes {
+			report = append(report, []string{"fileBytes " + f.name, fmt.Sprintf("%d/%d", f.live, f.total)})
+		}
+		report = append(report, []string{"locmapDebugInfo", stats.locmapDebugInfo.String()})
 	}
 	return brimtext.Align(report, nil)
 }
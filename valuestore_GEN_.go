@@ -29,24 +29,34 @@ type defaultValueStore struct {
 	runningLock sync.Mutex
 	// 0 = not running, 1 = running, 2 = can't run due to previous error
 	running int
+	// config is the resolved configuration the store was created with, as
+	// since changed by Reconfigure.
+	config *ValueStoreConfig
 
-	logger                  *zap.Logger
-	loggerPrefix            string
-	randMutex               sync.Mutex
-	rand                    *rand.Rand
-	freeableMemBlockChans   []chan *valueMemBlock
-	freeMemBlockChan        chan *valueMemBlock
-	freeWriteReqChans       []chan *valueWriteReq
-	pendingWriteReqChans    []chan *valueWriteReq
-	fileMemBlockChan        chan *valueMemBlock
-	freeTOCBlockChan        chan *valueTOCBlock
-	pendingTOCBlockChan     chan *valueTOCBlock
-	activeTOCA              uint64
-	activeTOCB              uint64
-	flushedChan             chan struct{}
-	shutdownChan            chan struct{}
-	locBlocks               []valueLocBlock
-	locBlockIDer            uint64
+	logger                *zap.Logger
+	loggerPrefix          string
+	tracer                Tracer
+	eventHandler          func(Event)
+	randMutex             sync.Mutex
+	rand                  *rand.Rand
+	freeableMemBlockChans []chan *valueMemBlock
+	freeMemBlockChan      chan *valueMemBlock
+	freeWriteReqChans     []chan *valueWriteReq
+	pendingWriteReqChans  []chan *valueWriteReq
+	fileMemBlockChan      chan *valueMemBlock
+	freeTOCBlockChan      chan *valueTOCBlock
+	pendingTOCBlockChan   chan *valueTOCBlock
+	activeTOCA            uint64
+	activeTOCB            uint64
+	flushedChan           chan struct{}
+	shutdownChan          chan struct{}
+	locBlocks             []valueLocBlock
+	locBlockIDer          uint64
+	// locBlockBytes are the byte counts of the locBlocks, by the same ids,
+	// kept up to date by locmapSet.
+	locBlockBytes []valueLocBlockBytes
+	// locmapSetLocks keep locmapSet calls for the same key from racing.
+	locmapSetLocks          [256]sync.Mutex
 	path                    string
 	pathtoc                 string
 	locmap                  locmap.ValueLocMap
@@ -64,10 +74,18 @@ type defaultValueStore struct {
 	auditState              valueAuditState
 	replicationIgnoreRecent uint64
 	pullReplicationState    valuePullReplicationState
+	merkleState             valueMerkleState
 	pushReplicationState    valuePushReplicationState
+	handoffState            valueHandoffState
+	hintedHandoffState      valueHintedHandoffState
+	replicateState          valueReplicateState
+	replicationStatusState  valueReplicationStatusState
 	compactionState         valueCompactionState
 	bulkSetState            valueBulkSetState
 	bulkSetAckState         valueBulkSetAckState
+	msgAuthState            valueMsgAuthState
+	msgProtocolState        valueMsgProtocolState
+	compressionState        valueCompressionState
 	disableEnableWritesLock sync.Mutex
 	readOnly                bool
 	userDisabled            bool
@@ -75,7 +93,10 @@ type defaultValueStore struct {
 	watcherState            valueWatcherState
 	restartChan             chan error
 
-	statsLock    sync.Mutex
+	statsLock sync.Mutex
+	// statsTotals are the counters already reset by Stats calls, by field
+	// name, for StatsMetrics.
+	statsTotals  map[string]int64
 	lookups      int32
 	lookupErrors int32
 
@@ -93,9 +114,20 @@ type defaultValueStore struct {
 	outBulkSetPushes              int32
 	outBulkSetPushValues          int32
 	outPushReplicationNanoseconds int64
+	outHandoffs                   int32
+	outHandoffValues              int32
+	handoffNanoseconds            int64
+	handoffCompletions            int32
+	outHintedHandoffs             int32
+	outHintedHandoffValues        int32
+	hintedHandoffNanoseconds      int64
+	hintsAcked                    int32
+	hintsDropped                  int32
 	inBulkSets                    int32
 	inBulkSetDrops                int32
 	inBulkSetInvalids             int32
+	inBulkSetOversizes            int32
+	inBulkSetRejects              int32
 	inBulkSetWrites               int32
 	inBulkSetWriteErrors          int32
 	inBulkSetWritesOverridden     int32
@@ -103,20 +135,66 @@ type defaultValueStore struct {
 	inBulkSetAcks                 int32
 	inBulkSetAckDrops             int32
 	inBulkSetAckInvalids          int32
+	inBulkSetAckRejects           int32
 	inBulkSetAckWrites            int32
 	inBulkSetAckWriteErrors       int32
 	inBulkSetAckWritesOverridden  int32
 	outPullReplications           int32
 	outPullReplicationNanoseconds int64
-	inPullReplications            int32
-	inPullReplicationDrops        int32
-	inPullReplicationInvalids     int32
-	expiredDeletions              int32
-	tombstoneDiscardNanoseconds   int64
-	compactionNanoseconds         int64
-	compactions                   int32
-	smallFileCompactions          int32
-	auditNanoseconds              int64
+	outPullReplicationBytes       int64
+	outPullReplicationPassBytes   int64
+	// outPullReplicationBloomFPRate is the math.Float64bits of the last
+	// measured bloom filter false positive rate.
+	outPullReplicationBloomFPRate   uint64
+	outBulkSetBytes                 int64
+	inPullReplications              int32
+	inPullReplicationDrops          int32
+	inPullReplicationInvalids       int32
+	inPullReplicationOversizes      int32
+	inPullReplicationRejects        int32
+	outMerkles                      int32
+	outMerkleBytes                  int64
+	inMerkles                       int32
+	inMerkleBytes                   int64
+	inMerkleDrops                   int32
+	inMerkleInvalids                int32
+	outPullReplicationRateLimitHits int32
+	outBulkSetRateLimitHits         int32
+	inBulkSetRateLimitHits          int32
+	outCompressionBytes             int64
+	outCompressedBytes              int64
+	outCompressionNanoseconds       int64
+	outCompressionSkips             int32
+	inDecompressionNanoseconds      int64
+	inDecompressionErrors           int32
+	expiredDeletions                int32
+	tombstoneDiscardNanoseconds     int64
+	compactionNanoseconds           int64
+	compactions                     int32
+	smallFileCompactions            int32
+	auditItemsRemoved               int32
+	auditFilesPassed                int32
+	auditFilesFailed                int32
+	auditNanoseconds                int64
+	lookupLatency                   latencyHistogram
+
+	readLatency latencyHistogram
+	// backgroundIOBackoff slows compaction and audits while readLatency is
+	// over the BackgroundIOLatencyTarget.
+	backgroundIOBackoff latencyBackoff
+
+	writeLatency                   latencyHistogram
+	deleteLatency                  latencyHistogram
+	writeQueueLatency              latencyHistogram
+	fileWriteLatency               latencyHistogram
+	tocWriteLatency                latencyHistogram
+	outPushReplicationPassDuration latencyHistogram
+	handoffPassDuration            latencyHistogram
+	hintedHandoffPassDuration      latencyHistogram
+	outPullReplicationPassDuration latencyHistogram
+	tombstoneDiscardPassDuration   latencyHistogram
+	compactionPassDuration         latencyHistogram
+	auditPassDuration              latencyHistogram
 
 	// Used by the flusher only
 	modifications int32
@@ -139,6 +217,8 @@ type valueWriteReq struct {
 	value         []byte
 	errChan       chan error
 	internal      bool
+	// queued is when the request was sent to the memWriter.
+	queued time.Time
 }
 
 var enableValueWriteReq *valueWriteReq = &valueWriteReq{}
@@ -160,6 +240,14 @@ type valueLocBlock interface {
 	close() error
 }
 
+// valueLocBlockBytes counts the bytes, values plus toc entries, a loc block
+// holds and how many of those are still live, the rest being waste that
+// compaction can reclaim. Only file blocks track a total.
+type valueLocBlockBytes struct {
+	live  int64
+	total int64
+}
+
 // NewValueStore creates a ValueStore for use in storing []byte values
 // referenced by 128 bit keys; returned are the store and restart channel (chan
 // error), or any error during construction.
@@ -186,8 +274,11 @@ func NewValueStore(c *ValueStoreConfig) (ValueStore, chan error) {
 	}
 	lcmap.SetInactiveMask(_TSB_INACTIVE)
 	store := &defaultValueStore{
+		config:                  cfg,
 		logger:                  cfg.Logger,
 		loggerPrefix:            cfg.LoggerName, // may add "." below
+		tracer:                  cfg.Tracer,
+		eventHandler:            cfg.EventHandler,
 		rand:                    cfg.Rand,
 		path:                    cfg.Path,
 		pathtoc:                 cfg.PathTOC,
@@ -204,6 +295,7 @@ func NewValueStore(c *ValueStoreConfig) (ValueStore, chan error) {
 		checksumInterval:        uint32(cfg.ChecksumInterval),
 		msgRing:                 cfg.MsgRing,
 		restartChan:             make(chan error),
+		statsTotals:             make(map[string]int64),
 		openReadSeeker:          cfg.openReadSeeker,
 		openWriteSeeker:         cfg.openWriteSeeker,
 		readdirnames:            cfg.readdirnames,
@@ -223,23 +315,58 @@ func NewValueStore(c *ValueStoreConfig) (ValueStore, chan error) {
 	if store.loggerPrefix != "" {
 		store.loggerPrefix += "."
 	}
+	if store.tracer == nil {
+		store.tracer = noopTracer{}
+	}
 	store.tombstoneDiscardConfig(cfg)
 	store.compactionConfig(cfg)
 	store.auditConfig(cfg)
+	store.msgAuthConfig(cfg)
+	store.compressionConfig(cfg)
+	store.msgProtocolConfig(cfg)
 	store.pullReplicationConfig(cfg)
+	store.merkleConfig(cfg)
 	store.pushReplicationConfig(cfg)
+	store.handoffConfig(cfg)
+	store.hintedHandoffConfig(cfg)
 	store.bulkSetConfig(cfg)
 	store.bulkSetAckConfig(cfg)
 	store.flusherConfig(cfg)
 	store.watcherConfig(cfg)
+	store.backgroundIOConfig(cfg)
 	return store, store.restartChan
 }
 
 func (store *defaultValueStore) ValueCap(ctx context.Context) (uint32, error) {
+	_, span := store.startSpan(ctx, "ValueCap")
+	defer span.End()
 	return store.valueCap, nil
 }
 
+func (store *defaultValueStore) SetReplicationRateLimits(ctx context.Context, limits *ReplicationRateLimits) error {
+	_, span := store.startSpan(ctx, "SetReplicationRateLimits")
+	defer span.End()
+	if limits == nil {
+		return errors.New("nil ReplicationRateLimits")
+	}
+	store.pullReplicationState.outLimiter.set(limits.OutPullReplicationBytesPerSecond, limits.OutPullReplicationMsgsPerSecond)
+	store.bulkSetState.outLimiter.set(limits.OutBulkSetBytesPerSecond, limits.OutBulkSetMsgsPerSecond)
+	store.bulkSetState.inLimiter.set(limits.InBulkSetBytesPerSecond, limits.InBulkSetMsgsPerSecond)
+	return nil
+}
+
+// backgroundIOConfig sets the budgets compaction and background audit I/O are
+// throttled to and, with a BackgroundIOLatencyTarget, how they back off for
+// slow Reads.
+func (store *defaultValueStore) backgroundIOConfig(cfg *ValueStoreConfig) {
+	store.backgroundIOBackoff.set(time.Duration(cfg.BackgroundIOLatencyTarget)*time.Millisecond, &store.readLatency)
+	store.compactionState.throttle.set(cfg.CompactionBytesPerSecond, &store.backgroundIOBackoff)
+	store.auditState.throttle.set(cfg.AuditBytesPerSecond, &store.backgroundIOBackoff)
+}
+
 func (store *defaultValueStore) Startup(ctx context.Context) error {
+	ctx, span := store.startSpan(ctx, "Startup")
+	defer span.End()
 	store.runningLock.Lock()
 	switch store.running {
 	case 0: // not running
@@ -252,6 +379,7 @@ func (store *defaultValueStore) Startup(ctx context.Context) error {
 	}
 	store.locBlocks = make([]valueLocBlock, math.MaxUint16)
 	store.locBlockIDer = 0
+	store.locBlockBytes = make([]valueLocBlockBytes, len(store.locBlocks))
 	// freeableMemBlockChans is a slice of channels so that the individual
 	// memClearers can be communicated with later (flushes, etc.)
 	store.freeableMemBlockChans = make([]chan *valueMemBlock, store.workers)
@@ -317,8 +445,11 @@ func (store *defaultValueStore) Startup(ctx context.Context) error {
 		store.compactionStartup,
 		store.watcherStartup,
 		store.flusherStartup,
+		store.merkleStartup,
 		store.pullReplicationStartup,
 		store.pushReplicationStartup,
+		store.handoffStartup,
+		store.hintedHandoffStartup,
 		store.tombstoneDiscardStartup,
 	} {
 		wg.Add(1)
@@ -335,6 +466,8 @@ func (store *defaultValueStore) Startup(ctx context.Context) error {
 }
 
 func (store *defaultValueStore) Shutdown(ctx context.Context) error {
+	ctx, span := store.startSpan(ctx, "Shutdown")
+	defer span.End()
 	store.runningLock.Lock()
 	if store.running != 1 { // running
 		store.runningLock.Unlock()
@@ -348,8 +481,11 @@ func (store *defaultValueStore) Shutdown(ctx context.Context) error {
 		store.compactionShutdown,
 		store.watcherShutdown,
 		store.flusherShutdown,
+		store.merkleShutdown,
 		store.pullReplicationShutdown,
 		store.pushReplicationShutdown,
+		store.handoffShutdown,
+		store.hintedHandoffShutdown,
 		store.tombstoneDiscardShutdown,
 	} {
 		wg.Add(1)
@@ -365,7 +501,9 @@ func (store *defaultValueStore) Shutdown(ctx context.Context) error {
 	}
 	<-store.shutdownChan
 	store.locmap.Clear()
+	store.merkleClear()
 	store.locBlocks = nil
+	store.locBlockBytes = nil
 	store.freeableMemBlockChans = nil
 	store.freeMemBlockChan = nil
 	store.freeWriteReqChans = nil
@@ -381,6 +519,8 @@ func (store *defaultValueStore) Shutdown(ctx context.Context) error {
 }
 
 func (store *defaultValueStore) EnableWrites(ctx context.Context) error {
+	_, span := store.startSpan(ctx, "EnableWrites")
+	defer span.End()
 	store.enableWrites(true)
 	return nil
 }
@@ -398,6 +538,8 @@ func (store *defaultValueStore) enableWrites(userCall bool) {
 }
 
 func (store *defaultValueStore) DisableWrites(ctx context.Context) error {
+	_, span := store.startSpan(ctx, "DisableWrites")
+	defer span.End()
 	store.disableWrites(true)
 	return nil
 }
@@ -414,7 +556,55 @@ func (store *defaultValueStore) disableWrites(userCall bool) {
 	store.disableEnableWritesLock.Unlock()
 }
 
+// event gives the Event to the Config.EventHandler, if any, setting its Time.
+func (store *defaultValueStore) event(e Event) {
+	if store.eventHandler == nil {
+		return
+	}
+	e.Time = time.Now()
+	store.eventHandler(e)
+}
+
+// requestRestart sends the err on the restart channel, with an
+// EventRestartRequest first. The send blocks until the channel is read, so
+// this is usually called in its own goroutine.
+func (store *defaultValueStore) requestRestart(err error) {
+	store.event(Event{Kind: EventRestartRequest, Err: err})
+	store.restartChan <- err
+}
+
+// manualPass has the launcher listening on *notifyChan run a pass with the
+// options and result, for the manual pass calls such as CompactionPass, and
+// waits for the pass to finish or the ctx to be done. The lock is the
+// launcher's startupShutdownLock.
+func (store *defaultValueStore) manualPass(ctx context.Context, lock *sync.Mutex, notifyChan *chan *bgNotification, options interface{}, result interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	lock.Lock()
+	if *notifyChan == nil {
+		lock.Unlock()
+		return errors.New("not running")
+	}
+	c := make(chan struct{}, 1)
+	select {
+	case *notifyChan <- &bgNotification{action: _BG_PASS, doneChan: c, options: options, result: result}:
+	case <-ctx.Done():
+		lock.Unlock()
+		return ctx.Err()
+	}
+	lock.Unlock()
+	select {
+	case <-c:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (store *defaultValueStore) Flush(ctx context.Context) error {
+	_, span := store.startSpan(ctx, "Flush")
+	defer span.End()
 	for _, c := range store.pendingWriteReqChans {
 		c <- flushValueWriteReq
 	}
@@ -422,11 +612,34 @@ func (store *defaultValueStore) Flush(ctx context.Context) error {
 	return nil
 }
 
+// startSpan starts the span for a call such as Read, named
+// "ValueStore.Read", with the keys as attributes; the attributes are only
+// built when there is a Tracer to give them to.
+func (store *defaultValueStore) startSpan(ctx context.Context, name string, keys ...uint64) (context.Context, Span) {
+	if _, ok := store.tracer.(noopTracer); ok {
+		return ctx, noopSpan{}
+	}
+	attrs := make([]TraceAttribute, len(keys))
+	for i, key := range keys {
+		attrs[i] = TraceAttribute{Key: valueSpanKeyNames[i], Value: key}
+	}
+	return store.tracer.Start(ctx, "ValueStore."+name, attrs...)
+}
+
+var valueSpanKeyNames = []string{"keyA", "keyB", "childKeyA", "childKeyB"}
+
 func (store *defaultValueStore) Lookup(ctx context.Context, keyA uint64, keyB uint64) (int64, uint32, error) {
+	begin := time.Now()
+	defer store.lookupLatency.observeSince(begin)
+	ctx, span := store.startSpan(ctx, "Lookup", keyA, keyB)
+	defer span.End()
 	atomic.AddInt32(&store.lookups, 1)
+	_, getSpan := store.tracer.Start(ctx, "locmap.Get")
 	timestampbits, _, length, err := store.lookup(keyA, keyB)
+	getSpan.End()
 	if err != nil && err != errNotFound {
 		atomic.AddInt32(&store.lookupErrors, 1)
+		span.RecordError(err)
 	}
 	return int64(timestampbits >> _TSB_UTIL_BITS), length, err
 }
@@ -440,10 +653,15 @@ func (store *defaultValueStore) lookup(keyA uint64, keyB uint64) (uint64, uint32
 }
 
 func (store *defaultValueStore) Read(ctx context.Context, keyA uint64, keyB uint64, value []byte) (int64, []byte, error) {
+	begin := time.Now()
+	defer store.readLatency.observeSince(begin)
+	ctx, span := store.startSpan(ctx, "Read", keyA, keyB)
+	defer span.End()
 	atomic.AddInt32(&store.reads, 1)
-	timestampbits, value, err := store.read(keyA, keyB, value)
+	timestampbits, value, err := store.tracedRead(ctx, keyA, keyB, value)
 	if err != nil && err != errNotFound {
 		atomic.AddInt32(&store.readErrors, 1)
+		span.RecordError(err)
 	}
 	return int64(timestampbits >> _TSB_UTIL_BITS), value, err
 }
@@ -456,19 +674,53 @@ func (store *defaultValueStore) read(keyA uint64, keyB uint64, value []byte) (ui
 	return store.locBlock(id).read(keyA, keyB, timestampbits, offset, length, value)
 }
 
+// tracedRead is read with child spans of the one in ctx for the locmap lookup
+// and for reading from the memBlock or storeFile.
+func (store *defaultValueStore) tracedRead(ctx context.Context, keyA uint64, keyB uint64, value []byte) (uint64, []byte, error) {
+	_, span := store.tracer.Start(ctx, "locmap.Get")
+	timestampbits, id, offset, length := store.locmap.Get(keyA, keyB)
+	span.End()
+	if id == 0 || timestampbits&_TSB_DELETION != 0 || timestampbits&_TSB_LOCAL_REMOVAL != 0 {
+		return timestampbits, value, errNotFound
+	}
+	block := store.locBlock(id)
+	name := "storeFile.read"
+	if _, ok := block.(*valueMemBlock); ok {
+		name = "memBlock.read"
+	}
+	_, span = store.tracer.Start(ctx, name)
+	timestampbits, value, err := block.read(keyA, keyB, timestampbits, offset, length, value)
+	if err != nil && err != errNotFound {
+		span.RecordError(err)
+	}
+	span.End()
+	return timestampbits, value, err
+}
+
 func (store *defaultValueStore) Write(ctx context.Context, keyA uint64, keyB uint64, timestampmicro int64, value []byte) (int64, error) {
+	begin := time.Now()
+	defer store.writeLatency.observeSince(begin)
+	ctx, span := store.startSpan(ctx, "Write", keyA, keyB)
+	defer span.End()
 	atomic.AddInt32(&store.writes, 1)
 	if timestampmicro < TIMESTAMPMICRO_MIN {
 		atomic.AddInt32(&store.writeErrors, 1)
-		return 0, fmt.Errorf("timestamp %d < %d", timestampmicro, TIMESTAMPMICRO_MIN)
+		err := fmt.Errorf("timestamp %d < %d", timestampmicro, TIMESTAMPMICRO_MIN)
+		span.RecordError(err)
+		return 0, err
 	}
 	if timestampmicro > TIMESTAMPMICRO_MAX {
 		atomic.AddInt32(&store.writeErrors, 1)
-		return 0, fmt.Errorf("timestamp %d > %d", timestampmicro, TIMESTAMPMICRO_MAX)
+		err := fmt.Errorf("timestamp %d > %d", timestampmicro, TIMESTAMPMICRO_MAX)
+		span.RecordError(err)
+		return 0, err
 	}
+	_, writeSpan := store.tracer.Start(ctx, "memWriter.write")
 	timestampbits, err := store.write(keyA, keyB, uint64(timestampmicro)<<_TSB_UTIL_BITS, value, false)
+	writeSpan.End()
 	if err != nil {
 		atomic.AddInt32(&store.writeErrors, 1)
+		span.RecordError(err)
 	} else if timestampmicro <= int64(timestampbits>>_TSB_UTIL_BITS) {
 		atomic.AddInt32(&store.writesOverridden, 1)
 	}
@@ -484,6 +736,7 @@ func (store *defaultValueStore) write(keyA uint64, keyB uint64, timestampbits ui
 	writeReq.timestampbits = timestampbits
 	writeReq.value = value
 	writeReq.internal = internal
+	writeReq.queued = time.Now()
 	store.pendingWriteReqChans[i] <- writeReq
 	err := <-writeReq.errChan
 	ptimestampbits := writeReq.timestampbits
@@ -497,18 +750,29 @@ func (store *defaultValueStore) write(keyA uint64, keyB uint64, timestampbits ui
 }
 
 func (store *defaultValueStore) Delete(ctx context.Context, keyA uint64, keyB uint64, timestampmicro int64) (int64, error) {
+	begin := time.Now()
+	defer store.deleteLatency.observeSince(begin)
+	ctx, span := store.startSpan(ctx, "Delete", keyA, keyB)
+	defer span.End()
 	atomic.AddInt32(&store.deletes, 1)
 	if timestampmicro < TIMESTAMPMICRO_MIN {
 		atomic.AddInt32(&store.deleteErrors, 1)
-		return 0, fmt.Errorf("timestamp %d < %d", timestampmicro, TIMESTAMPMICRO_MIN)
+		err := fmt.Errorf("timestamp %d < %d", timestampmicro, TIMESTAMPMICRO_MIN)
+		span.RecordError(err)
+		return 0, err
 	}
 	if timestampmicro > TIMESTAMPMICRO_MAX {
 		atomic.AddInt32(&store.deleteErrors, 1)
-		return 0, fmt.Errorf("timestamp %d > %d", timestampmicro, TIMESTAMPMICRO_MAX)
+		err := fmt.Errorf("timestamp %d > %d", timestampmicro, TIMESTAMPMICRO_MAX)
+		span.RecordError(err)
+		return 0, err
 	}
+	_, writeSpan := store.tracer.Start(ctx, "memWriter.write")
 	ptimestampbits, err := store.write(keyA, keyB, (uint64(timestampmicro)<<_TSB_UTIL_BITS)|_TSB_DELETION, nil, true)
+	writeSpan.End()
 	if err != nil {
 		atomic.AddInt32(&store.deleteErrors, 1)
+		span.RecordError(err)
 	} else if timestampmicro <= int64(ptimestampbits>>_TSB_UTIL_BITS) {
 		atomic.AddInt32(&store.deletesOverridden, 1)
 	}
@@ -548,9 +812,96 @@ func (store *defaultValueStore) locBlockIDFromTimestampnano(tsn int64) uint32 {
 }
 
 func (store *defaultValueStore) closeLocBlock(locBlockID uint32) error {
+	atomic.StoreInt64(&store.locBlockBytes[locBlockID].live, 0)
+	atomic.StoreInt64(&store.locBlockBytes[locBlockID].total, 0)
 	return store.locBlocks[locBlockID].close()
 }
 
+// fileSetSize returns the size of the toc file and its values file, or what
+// could be found of them.
+func (store *defaultValueStore) fileSetSize(nametoc string) int64 {
+	var size int64
+	if fi, err := store.stat(path.Join(store.pathtoc, nametoc)); err == nil {
+		size += fi.Size()
+	}
+	if fi, err := store.stat(path.Join(store.path, nametoc[:len(nametoc)-3])); err == nil {
+		size += fi.Size()
+	}
+	return size
+}
+
+// locBlockItemBytes returns the bytes an item with a value of the length
+// takes up in the loc block's files: the value, its checksum and its toc
+// entry for v1 files, or just the value and its toc entry for v0 files. Mem
+// blocks are always written out as v1 files.
+func (store *defaultValueStore) locBlockItemBytes(locBlockID uint32, length uint32) int64 {
+	if fl, ok := store.locBlock(locBlockID).(*valueStoreFile); ok && fl.version < 1 {
+		return int64(length) + _VALUE_FILE_ENTRY_SIZE
+	}
+	return int64(length) + _VALUE_FILE_VALUE_CHECKSUM_SIZE + _VALUE_FILE_ENTRY_SIZE_V1
+}
+
+// locBlockLiveAndTotal returns the live and total byte counts for the loc
+// block.
+func (store *defaultValueStore) locBlockLiveAndTotal(locBlockID uint32) (int64, int64) {
+	return atomic.LoadInt64(&store.locBlockBytes[locBlockID].live), atomic.LoadInt64(&store.locBlockBytes[locBlockID].total)
+}
+
+// locmapSet is store.locmap.Set that also moves the item's bytes from the
+// live count of the loc block it was in to that of the loc block it is now
+// in, if the set took.
+func (store *defaultValueStore) locmapSet(keyA uint64, keyB uint64, timestampbits uint64, blockID uint32, offset uint32, length uint32, evenIfSameTimestamp bool) uint64 {
+	lock := &store.locmapSetLocks[keyB%uint64(len(store.locmapSetLocks))]
+	lock.Lock()
+	_, pblockID, _, plength := store.locmap.Get(keyA, keyB)
+	ptimestampbits := store.locmap.Set(keyA, keyB, timestampbits, blockID, offset, length, evenIfSameTimestamp)
+	if ptimestampbits < timestampbits || (evenIfSameTimestamp && ptimestampbits == timestampbits) {
+		if pblockID != 0 {
+			atomic.AddInt64(&store.locBlockBytes[pblockID].live, -store.locBlockItemBytes(pblockID, plength))
+		}
+		if blockID != 0 {
+			atomic.AddInt64(&store.locBlockBytes[blockID].live, store.locBlockItemBytes(blockID, length))
+		}
+	}
+	lock.Unlock()
+	return ptimestampbits
+}
+
+// locmapRemove removes the item from the locmap if it's still the one at the
+// timestampbits in the blockID, returning whether it was. The merkle tree is
+// updated too, so replication will notice the item is missing.
+func (store *defaultValueStore) locmapRemove(keyA uint64, keyB uint64, timestampbits uint64, blockID uint32) bool {
+	lock := &store.locmapSetLocks[keyB%uint64(len(store.locmapSetLocks))]
+	lock.Lock()
+	ptimestampbits, pblockID, _, plength := store.locmap.Get(keyA, keyB)
+	if ptimestampbits != timestampbits || pblockID != blockID || blockID == 0 {
+		lock.Unlock()
+		return false
+	}
+	store.locmap.Set(keyA, keyB, timestampbits, 0, 0, 0, true)
+	atomic.AddInt64(&store.locBlockBytes[blockID].live, -store.locBlockItemBytes(blockID, plength))
+	lock.Unlock()
+	store.merkleUpdate(keyA, keyB, timestampbits, _TSB_LOCAL_REMOVAL)
+	return true
+}
+
+// locmapDiscard removes the item from the locmap if it's still at the
+// timestampbits, taking its bytes from the live count of the loc block it was
+// in. This is for discarding _TSB_LOCAL_REMOVAL entries, which replication
+// already treats as missing, so the merkle tree is left as is.
+func (store *defaultValueStore) locmapDiscard(keyA uint64, keyB uint64, timestampbits uint64) {
+	lock := &store.locmapSetLocks[keyB%uint64(len(store.locmapSetLocks))]
+	lock.Lock()
+	ptimestampbits, pblockID, _, plength := store.locmap.Get(keyA, keyB)
+	if ptimestampbits == timestampbits {
+		store.locmap.Set(keyA, keyB, timestampbits, 0, 0, 0, true)
+		if pblockID != 0 {
+			atomic.AddInt64(&store.locBlockBytes[pblockID].live, -store.locBlockItemBytes(pblockID, plength))
+		}
+	}
+	lock.Unlock()
+}
+
 func (store *defaultValueStore) memClearer(freeableMemBlockChan chan *valueMemBlock) {
 	var tb *valueTOCBlock
 	var tbTS int64
@@ -583,17 +934,24 @@ func (store *defaultValueStore) memClearer(freeableMemBlockChan chan *valueMemBl
 			var blockID uint32
 			var offset uint32
 			var length uint32
+			var checksum uint32
 			if timestampbits&_TSB_LOCAL_REMOVAL == 0 {
 				blockID = memBlock.fileID
 
-				offset = memBlock.fileOffset + binary.BigEndian.Uint32(memBlock.toc[memBlockTOCOffset+24:])
+				memOffset := binary.BigEndian.Uint32(memBlock.toc[memBlockTOCOffset+24:])
 				length = binary.BigEndian.Uint32(memBlock.toc[memBlockTOCOffset+28:])
 
+				offset = memBlock.fileOffset + memOffset
+				checksum = binary.BigEndian.Uint32(memBlock.values[memOffset+length:])
 			}
-			if store.locmap.Set(keyA, keyB, timestampbits, blockID, offset, length, true) > timestampbits {
+			if store.locmapSet(keyA, keyB, timestampbits, blockID, offset, length, true) > timestampbits {
+				// Already superseded, so only its value and checksum are in
+				// the file.
+				atomic.AddInt64(&store.locBlockBytes[memBlock.fileID].total, int64(length)+_VALUE_FILE_VALUE_CHECKSUM_SIZE)
 				continue
 			}
-			if tb != nil && tbOffset+_VALUE_FILE_ENTRY_SIZE > cap(tb.data) {
+			atomic.AddInt64(&store.locBlockBytes[memBlock.fileID].total, store.locBlockItemBytes(memBlock.fileID, length))
+			if tb != nil && tbOffset+_VALUE_FILE_ENTRY_SIZE_V1 > cap(tb.data) {
 				store.pendingTOCBlockChan <- tb
 				tb = nil
 			}
@@ -604,8 +962,8 @@ func (store *defaultValueStore) memClearer(freeableMemBlockChan chan *valueMemBl
 				binary.BigEndian.PutUint64(tb.data, uint64(tbTS))
 				tbOffset = 8
 			}
-			tb.data = tb.data[:tbOffset+_VALUE_FILE_ENTRY_SIZE]
-			tbd := tb.data[tbOffset : tbOffset+_VALUE_FILE_ENTRY_SIZE]
+			tb.data = tb.data[:tbOffset+_VALUE_FILE_ENTRY_SIZE_V1]
+			tbd := tb.data[tbOffset : tbOffset+_VALUE_FILE_ENTRY_SIZE_V1]
 
 			binary.BigEndian.PutUint64(tbd, keyA)
 			binary.BigEndian.PutUint64(tbd[8:], keyB)
@@ -613,7 +971,8 @@ func (store *defaultValueStore) memClearer(freeableMemBlockChan chan *valueMemBl
 			binary.BigEndian.PutUint32(tbd[24:], offset)
 			binary.BigEndian.PutUint32(tbd[28:], length)
 
-			tbOffset += _VALUE_FILE_ENTRY_SIZE
+			binary.BigEndian.PutUint32(tbd[_VALUE_FILE_ENTRY_SIZE:], checksum)
+			tbOffset += _VALUE_FILE_ENTRY_SIZE_V1
 		}
 		memBlock.discardLock.Lock()
 		memBlock.fileID = 0
@@ -652,6 +1011,7 @@ func (store *defaultValueStore) memWriter(pendingWriteReqChan chan *valueWriteRe
 			store.fileMemBlockChan <- shutdownValueMemBlock
 			break
 		}
+		store.writeQueueLatency.observeSince(writeReq.queued)
 		if !enabled && !writeReq.internal {
 			writeReq.errChan <- errDisabled
 			continue
@@ -661,7 +1021,8 @@ func (store *defaultValueStore) memWriter(pendingWriteReqChan chan *valueWriteRe
 			writeReq.errChan <- fmt.Errorf("value length of %d > %d", length, store.valueCap)
 			continue
 		}
-		alloc := length
+		// The value is followed by its checksum, as in v1 values files.
+		alloc := length + _VALUE_FILE_VALUE_CHECKSUM_SIZE
 		if alloc < store.minValueAlloc {
 			alloc = store.minValueAlloc
 		}
@@ -678,12 +1039,16 @@ func (store *defaultValueStore) memWriter(pendingWriteReqChan chan *valueWriteRe
 		memBlock.values = memBlock.values[:memBlockMemOffset+alloc]
 		memBlock.discardLock.Unlock()
 		copy(memBlock.values[memBlockMemOffset:], writeReq.value)
-		if alloc > length {
-			for i, j := memBlockMemOffset+length, memBlockMemOffset+alloc; i < j; i++ {
+		binary.BigEndian.PutUint32(memBlock.values[memBlockMemOffset+length:], murmur3.Sum32(writeReq.value))
+		if alloc > length+_VALUE_FILE_VALUE_CHECKSUM_SIZE {
+			for i, j := memBlockMemOffset+length+_VALUE_FILE_VALUE_CHECKSUM_SIZE, memBlockMemOffset+alloc; i < j; i++ {
 				memBlock.values[i] = 0
 			}
 		}
-		ptimestampbits := store.locmap.Set(writeReq.keyA, writeReq.keyB, writeReq.timestampbits & ^uint64(_TSB_COMPACTION_REWRITE), memBlock.id, uint32(memBlockMemOffset), uint32(length), writeReq.timestampbits&_TSB_COMPACTION_REWRITE != 0)
+		ptimestampbits := store.locmapSet(writeReq.keyA, writeReq.keyB, writeReq.timestampbits & ^uint64(_TSB_COMPACTION_REWRITE), memBlock.id, uint32(memBlockMemOffset), uint32(length), writeReq.timestampbits&_TSB_COMPACTION_REWRITE != 0)
+		if ptimestampbits < writeReq.timestampbits & ^uint64(_TSB_COMPACTION_REWRITE) {
+			store.merkleUpdate(writeReq.keyA, writeReq.keyB, ptimestampbits, writeReq.timestampbits & ^uint64(_TSB_COMPACTION_REWRITE))
+		}
 		if ptimestampbits < writeReq.timestampbits {
 			memBlock.toc = memBlock.toc[:memBlockTOCOffset+_VALUE_FILE_ENTRY_SIZE]
 
@@ -778,11 +1143,12 @@ func (store *defaultValueStore) fileWriter() {
 			fl, err = store.createValueReadWriteFile()
 			if err != nil {
 				store.logger.Error("must shutdown because no new files can be opened", zap.String("name", store.loggerPrefix+"fileWriter"), zap.Error(err))
+				store.event(Event{Kind: EventFileWriterError, Err: err})
 				disabledDueToError = err
 				disabledDueToErrorLogTime = time.Now().Add(5 * time.Minute)
 				go func() {
 					store.Shutdown(context.Background())
-					store.restartChan <- errors.New("no new files can be opened")
+					store.requestRestart(errors.New("no new files can be opened"))
 				}()
 			}
 			tocLen = _VALUE_FILE_HEADER_SIZE
@@ -805,20 +1171,17 @@ func (store *defaultValueStore) tocWriter() {
 	var writerB io.WriteCloser
 	var offsetB uint64
 	var err error
-	head := []byte("VALUESTORETOC v0                ")
+	head := []byte("VALUESTORETOC v1                ")
 	binary.BigEndian.PutUint32(head[28:], uint32(store.checksumInterval))
-	// Make sure any trailing data is covered by a checksum by writing an
-	// additional block of zeros (entry offsets of zero are ignored on
-	// recovery).
-	term := make([]byte, store.checksumInterval)
-	copy(term[len(term)-8:], []byte("TERM v0 "))
+	term := valueTermBlock(store.checksumInterval)
 	disabled := false
 	fatal := func(point int, err error) {
 		store.logger.Error("error while writing toc contents", zap.String("name", store.loggerPrefix+"tocWriter"), zap.Int("point", point), zap.Error(err))
+		store.event(Event{Kind: EventTOCWriterError, Message: fmt.Sprintf("point %d", point), Err: err})
 		disabled = true
 		go func() {
 			store.Shutdown(context.Background())
-			store.restartChan <- errors.New("tocWriter encountered a fatal error; restart required")
+			store.requestRestart(errors.New("tocWriter encountered a fatal error; restart required"))
 		}()
 	}
 OuterLoop:
@@ -875,6 +1238,7 @@ OuterLoop:
 			continue OuterLoop
 		}
 		if len(t.data) > 8 {
+			begin := time.Now()
 			bts := binary.BigEndian.Uint64(t.data)
 			switch bts {
 			case atomic.LoadUint64(&store.activeTOCA):
@@ -925,6 +1289,7 @@ OuterLoop:
 				}
 				offsetA = _VALUE_FILE_HEADER_SIZE + uint64(len(t.data)-8)
 			}
+			store.tocWriteLatency.observeSince(begin)
 		}
 		store.freeTOCBlockChan <- t
 	}
@@ -961,16 +1326,20 @@ func (store *defaultValueStore) recovery() error {
 				}
 				for j := 0; j < len(batch); j++ {
 					wr := &batch[j]
+					atomic.AddInt64(&store.locBlockBytes[wr.BlockID].total, store.locBlockItemBytes(wr.BlockID, wr.Length))
 					if wr.TimestampBits&_TSB_LOCAL_REMOVAL != 0 {
 						wr.BlockID = 0
 					}
 					atomic.AddInt64(&encounteredValues, 1)
 					if store.logger.Check(zap.DebugLevel, "debug?") != nil {
-						if store.locmap.Set(wr.KeyA, wr.KeyB, wr.TimestampBits, wr.BlockID, wr.Offset, wr.Length, true) < wr.TimestampBits {
+						if ptimestampbits := store.locmapSet(wr.KeyA, wr.KeyB, wr.TimestampBits, wr.BlockID, wr.Offset, wr.Length, true); ptimestampbits < wr.TimestampBits {
+							store.merkleUpdate(wr.KeyA, wr.KeyB, ptimestampbits, wr.TimestampBits)
 							atomic.AddInt64(&causedChangeCount, 1)
 						}
 					} else {
-						store.locmap.Set(wr.KeyA, wr.KeyB, wr.TimestampBits, wr.BlockID, wr.Offset, wr.Length, true)
+						if ptimestampbits := store.locmapSet(wr.KeyA, wr.KeyB, wr.TimestampBits, wr.BlockID, wr.Offset, wr.Length, true); ptimestampbits < wr.TimestampBits {
+							store.merkleUpdate(wr.KeyA, wr.KeyB, ptimestampbits, wr.TimestampBits)
+						}
 					}
 				}
 				freeBatchChan <- batch
@@ -987,6 +1356,7 @@ func (store *defaultValueStore) recovery() error {
 	names, err := store.readdirnames(store.pathtoc)
 	if err != nil {
 		spindown()
+		store.event(Event{Kind: EventRecovery, Begin: start, Err: err})
 		return err
 	}
 	sort.Strings(names)
@@ -1025,12 +1395,14 @@ func (store *defaultValueStore) recovery() error {
 			// proactive and notify the auditor of the issue here.
 		}
 		if len(errs) != 0 {
+			store.event(Event{Kind: EventRecoveryFileError, File: names[i], Count: int64(fdc), Err: errs[0]})
 			compactNames = append(compactNames, names[i])
 			compactBlockIDs = append(compactBlockIDs, fl.id)
 		}
 		closeIfCloser(fpr)
 	}
 	spindown()
+	store.event(Event{Kind: EventRecovery, Begin: start, Count: int64(fromDiskCount), Changed: atomic.LoadInt64(&causedChangeCount)})
 	if cm := store.logger.Check(zap.DebugLevel, "stats"); cm != nil {
 		dur := time.Now().Sub(start)
 		stringerStats, err := store.Stats(context.Background(), false)
@@ -1044,7 +1416,7 @@ func (store *defaultValueStore) recovery() error {
 	if len(compactNames) > 0 {
 		store.logger.Debug("secondary recovery started", zap.String("name", store.loggerPrefix+"recovery"), zap.Int("fileCount", len(compactNames)))
 		for i, name := range compactNames {
-			store.compactFile(name, compactBlockIDs[i], make(chan struct{}), "recovery")
+			store.compactFile(context.Background(), name, compactBlockIDs[i], make(chan struct{}), "recovery", nil)
 		}
 		store.logger.Debug("secondary recovery completed", zap.String("name", store.loggerPrefix+"recovery"))
 	}
@@ -1,10 +1,17 @@
 package store
 
 import (
+	"errors"
 	"io"
 	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
 
 	"github.com/gholt/locmap"
+	"golang.org/x/net/context"
 )
 
 func newTestValueStore(c *ValueStoreConfig) (*defaultValueStore, chan error) {
@@ -61,3 +68,352 @@ func newTestValueStoreConfig() *ValueStoreConfig {
 		},
 	}
 }
+
+// newTestValueStoreConfigWithFS is newTestValueStoreConfig using the fs, for
+// tests that need to read back the files the store writes.
+func newTestValueStoreConfigWithFS(fs *memFS) *ValueStoreConfig {
+	c := newTestValueStoreConfig()
+	c.openReadSeeker = fs.openReadSeeker
+	c.openWriteSeeker = fs.openWriteSeeker
+	c.readdirnames = fs.readdirnames
+	c.createWriteCloser = fs.createWriteCloser
+	c.stat = fs.stat
+	c.remove = fs.remove
+	c.rename = fs.rename
+	c.isNotExist = fs.isNotExist
+	return c
+}
+
+func TestValueTracer(t *testing.T) {
+	tracer := &testTracer{}
+	cfg := newTestValueStoreConfig()
+	cfg.Tracer = tracer
+	store, _ := newTestValueStore(cfg)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	tracer.started()
+	if _, err := store.Write(context.Background(), 1, 2, 0x500, []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Read(context.Background(), 1, 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Lookup(context.Background(), 5, 6); !IsNotFound(err) {
+		t.Fatal(err)
+	}
+	if _, err := store.Write(context.Background(), 1, 2, 0, []byte("testing")); err == nil {
+		t.Fatal("expected timestamp error")
+	}
+	if _, err := store.ValueCap(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.EnableWrites(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans := tracer.started()
+	expected := []string{
+		"ValueStore.Write",
+		"ValueStore.Write/memWriter.write",
+		"ValueStore.Read",
+		"ValueStore.Read/locmap.Get",
+		"ValueStore.Read/memBlock.read",
+		"ValueStore.Lookup",
+		"ValueStore.Lookup/locmap.Get",
+		"ValueStore.Write",
+		"ValueStore.ValueCap",
+		"ValueStore.EnableWrites",
+	}
+	if !reflect.DeepEqual(spans, expected) {
+		t.Fatal(spans)
+	}
+}
+
+func TestValueEvents(t *testing.T) {
+	events := make(chan Event, 10)
+	cfg := newTestValueStoreConfig()
+	cfg.EventHandler = func(e Event) {
+		events <- e
+	}
+	store, restartChan := newTestValueStore(cfg)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	if e := <-events; e.Kind != EventRecovery || e.Err != nil || e.Time.Before(e.Begin) {
+		t.Fatal(e)
+	}
+	// The test files are empty, so the toc file can't be read.
+	store.compactFile(context.Background(), "12345.valuetoc", 0, make(chan struct{}), "test", nil)
+	if e := <-events; e.Kind != EventCompactionError || e.File != "12345.valuetoc" || e.Err == nil {
+		t.Fatal(e)
+	}
+	go store.requestRestart(errors.New("test restart"))
+	if e := <-events; e.Kind != EventRestartRequest || e.Err.Error() != "test restart" || e.Kind.String() != "RestartRequest" {
+		t.Fatal(e)
+	}
+	if err := <-restartChan; err.Error() != "test restart" {
+		t.Fatal(err)
+	}
+}
+
+func TestValueManualPasses(t *testing.T) {
+	store, _ := newTestValueStore(nil)
+	if _, err := store.CompactionPass(context.Background(), nil); err == nil || err.Error() != "not running" {
+		t.Fatal(err)
+	}
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	// The test store has no files on disk, so there's nothing to compact.
+	compactionResult, err := store.CompactionPass(context.Background(), &CompactionPassOptions{Threshold: 0.5, IgnoreAgeThreshold: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *compactionResult != (CompactionResult{}) {
+		t.Fatal(compactionResult)
+	}
+	if _, err := store.Delete(context.Background(), 1, 2, TIMESTAMPMICRO_MIN); err != nil {
+		t.Fatal(err)
+	}
+	tombstoneDiscardResult, err := store.TombstoneDiscardPass(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tombstoneDiscardResult.TombstonesDiscarded != 1 {
+		t.Fatal(tombstoneDiscardResult.TombstonesDiscarded)
+	}
+	// With no ring there's nowhere to push to.
+	pushReplicationResult, err := store.PushReplicationPass(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *pushReplicationResult != (PushReplicationResult{}) {
+		t.Fatal(pushReplicationResult)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := store.TombstoneDiscardPass(ctx); err != context.Canceled {
+		t.Fatal(err)
+	}
+}
+
+func TestValueLocBlockBytes(t *testing.T) {
+	store, _ := newTestValueStore(nil)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	fileIDs := func() []uint32 {
+		var ids []uint32
+		for id := uint32(1); id <= uint32(store.locBlockIDer); id++ {
+			if _, ok := store.locBlocks[id].(*valueStoreFile); ok {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	if _, err := store.Write(context.Background(), 1, 2, 0x500, []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	entry := int64(len("testing") + _VALUE_FILE_VALUE_CHECKSUM_SIZE + _VALUE_FILE_ENTRY_SIZE_V1)
+	ids := fileIDs()
+	if len(ids) != 1 {
+		t.Fatal(ids)
+	}
+	if live, total := store.locBlockLiveAndTotal(ids[0]); live != entry || total != entry {
+		t.Fatal(live, total)
+	}
+	// Overwriting the item makes its bytes in the first file waste.
+	if _, err := store.Write(context.Background(), 1, 2, 0x600, []byte("testing!")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ids = fileIDs()
+	if len(ids) != 2 {
+		t.Fatal(ids)
+	}
+	if live, total := store.locBlockLiveAndTotal(ids[0]); live != 0 || total != entry {
+		t.Fatal(live, total)
+	}
+	if live, total := store.locBlockLiveAndTotal(ids[1]); live != entry+1 || total != entry+1 {
+		t.Fatal(live, total)
+	}
+	if !store.needsCompaction("first", ids[0], 0.5) || store.needsCompaction("second", ids[1], 0.5) {
+		t.Fatal("wrong files need compaction")
+	}
+	// Discarding a local removal still in a mem block takes its bytes from
+	// the mem block's live count.
+	if _, err := store.write(1, 3, (0x700<<_TSB_UTIL_BITS)|_TSB_LOCAL_REMOVAL, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	_, blockID, _, _ := store.locmap.Get(1, 3)
+	if blockID == 0 {
+		t.Fatal(blockID)
+	}
+	live, _ := store.locBlockLiveAndTotal(blockID)
+	store.tombstoneDiscardPass(make(chan *bgNotification), nil)
+	if ts, _, _, _ := store.locmap.Get(1, 3); ts != 0 {
+		t.Fatal(ts)
+	}
+	if live2, _ := store.locBlockLiveAndTotal(blockID); live2 != live-(_VALUE_FILE_VALUE_CHECKSUM_SIZE+_VALUE_FILE_ENTRY_SIZE_V1) {
+		t.Fatal(live, live2)
+	}
+}
+
+func TestValueAuditRepair(t *testing.T) {
+	fs := newMemFS()
+	events := make(chan Event, 10)
+	cfg := newTestValueStoreConfigWithFS(fs)
+	cfg.EventHandler = func(e Event) {
+		if e.Kind == EventAuditFailure {
+			events <- e
+		}
+	}
+	store, _ := newTestValueStore(cfg)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	// The first value fills most of the first checksum block so the second
+	// lands in the next one.
+	if _, err := store.Write(context.Background(), 1, 2, 0x500, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Write(context.Background(), 1, 3, 0x500, []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	names, _ := fs.readdirnames(store.path)
+	var name string
+	for _, n := range names {
+		if strings.HasSuffix(n, ".value") {
+			name = n
+		}
+	}
+	// Another flush so the first file is no longer the active one.
+	if _, err := store.Write(context.Background(), 1, 4, 0x500, []byte("three")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fs.lock.Lock()
+	fs.files[path.Join(store.path, name)].buf[40] ^= 0xff
+	fs.lock.Unlock()
+	store.auditState.ageThreshold = 0
+	if err := store.AuditPass(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-events; e.File != name+"toc" || e.Count != 1 || e.Changed != 1 || e.Err != nil {
+		t.Fatal(e)
+	}
+	if atomic.LoadInt32(&store.auditItemsRemoved) != 1 {
+		t.Fatal(store.auditItemsRemoved)
+	}
+	// Only the corrupted item is gone; the store stays up and the rest were
+	// rewritten elsewhere.
+	if _, _, err := store.Read(context.Background(), 1, 2, nil); !IsNotFound(err) {
+		t.Fatal(err)
+	}
+	_, value, err := store.Read(context.Background(), 1, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "two" {
+		t.Fatal(string(value))
+	}
+	if _, err := fs.stat(path.Join(store.pathtoc, name+"toc")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	// The outcome is in the audit history, which is kept across restarts.
+	check := func(store *defaultValueStore) {
+		report, err := store.AuditReport(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.FilesFailed != 1 {
+			t.Fatal(report)
+		}
+		for _, record := range report.Records {
+			if record.Action == AuditActionNone {
+				continue
+			}
+			if record.File != name+"toc" || record.Action != AuditActionRepaired || record.AffectedKeys != 1 || !reflect.DeepEqual(record.CorruptRanges, []AuditRange{AuditRange{Start: 0, Stop: 1023}}) || record.BytesVerified < 2048 {
+				t.Fatal(record)
+			}
+		}
+	}
+	check(store)
+	store2, _ := newTestValueStore(newTestValueStoreConfigWithFS(fs))
+	check(store2)
+}
+
+func TestValueAuditHistoryTrim(t *testing.T) {
+	var history []AuditRecord
+	for _, name := range []string{"pass1", "fail1", "pass2", "pass3", "fail2", "pass4"} {
+		record := AuditRecord{File: name}
+		if strings.HasPrefix(name, "fail") {
+			record.Action = AuditActionRepaired
+		}
+		history = append(history, record)
+	}
+	files := func(history []AuditRecord) []string {
+		var names []string
+		for _, record := range history {
+			names = append(names, record.File)
+		}
+		return names
+	}
+	if names := files(valueAuditHistoryTrim(history, 6)); !reflect.DeepEqual(names, []string{"pass1", "fail1", "pass2", "pass3", "fail2", "pass4"}) {
+		t.Fatal(names)
+	}
+	// The passes go first, oldest first, however many there are.
+	if names := files(valueAuditHistoryTrim(history, 3)); !reflect.DeepEqual(names, []string{"fail1", "fail2", "pass4"}) {
+		t.Fatal(names)
+	}
+	// Then the oldest failures.
+	if names := files(valueAuditHistoryTrim(history, 1)); !reflect.DeepEqual(names, []string{"fail2"}) {
+		t.Fatal(names)
+	}
+}
+
+func TestValueAuditInvalidEntries(t *testing.T) {
+	entries := []valueTOCEntry{
+		valueTOCEntry{KeyA: 1, Offset: 32, Length: 10},
+		// Overlaps the entry before it.
+		valueTOCEntry{KeyA: 2, Offset: 40, Length: 10},
+		valueTOCEntry{KeyA: 3, Offset: 50, Length: 10},
+		// Within the header.
+		valueTOCEntry{KeyA: 4, Offset: 16, Length: 4},
+		// Past the end of the data.
+		valueTOCEntry{KeyA: 5, Offset: 95, Length: 10},
+		// Zero length values aren't checked.
+		valueTOCEntry{KeyA: 6, Offset: 55},
+	}
+	var keys []uint64
+	for _, wr := range valueAuditInvalidEntries(entries, 100) {
+		keys = append(keys, wr.KeyA)
+	}
+	if !reflect.DeepEqual(keys, []uint64{4, 1, 2, 5}) {
+		t.Fatal(keys)
+	}
+	// Without a known data length, only the bounds within the file are
+	// checked.
+	keys = nil
+	for _, wr := range valueAuditInvalidEntries(entries, 0) {
+		keys = append(keys, wr.KeyA)
+	}
+	if !reflect.DeepEqual(keys, []uint64{4, 1, 2}) {
+		t.Fatal(keys)
+	}
+}
@@ -18,21 +18,41 @@ import (
 	"go.uber.org/zap"
 )
 
-//    "VALUESTORETOC v0            ":28, checksumInterval:4
-// or "VALUESTORE v0               ":28, checksumInterval:4
+//    "VALUESTORETOC v1            ":28, checksumInterval:4
+// or "VALUESTORE v1               ":28, checksumInterval:4
+// with v0 files still read as well.
 const _VALUE_FILE_HEADER_SIZE = 32
 
 // keyA:8, keyB:8, timestampbits:8, offset:4, length:4
 const _VALUE_FILE_ENTRY_SIZE = 32
 
-// "TERM v0 ":8
+// v1 toc entries add checksum:4, the murmur3 of the value, which v1 values
+// files also have right after each value, so reads can verify the value on
+// its own rather than just its checksum interval block.
+const _VALUE_FILE_ENTRY_SIZE_V1 = _VALUE_FILE_ENTRY_SIZE + _VALUE_FILE_VALUE_CHECKSUM_SIZE
+const _VALUE_FILE_VALUE_CHECKSUM_SIZE = 4
+
+// "TERM v0 ":8, for both v0 and v1 files
 const _VALUE_FILE_TRAILER_SIZE = 8
 
+// valueTermBlock returns a checksum interval's worth of zeros ending with the
+// file trailer. Writing it at the end of a values or toc file makes sure any
+// trailing data is covered by a checksum; the zeros are never referenced, so
+// they're ignored on reading.
+func valueTermBlock(checksumInterval uint32) []byte {
+	term := make([]byte, checksumInterval)
+	copy(term[len(term)-_VALUE_FILE_TRAILER_SIZE:], []byte("TERM v0 "))
+	return term
+}
+
 type valueStoreFile struct {
-	store                     *defaultValueStore
-	fullPath                  string
-	id                        uint32
-	nameTimestamp             int64
+	store         *defaultValueStore
+	fullPath      string
+	id            uint32
+	nameTimestamp int64
+	// version is the file format version; values in v1 files are followed
+	// by their checksums.
+	version                   int
 	readerFPs                 []brimio.ChecksummedReader
 	readerLocks               []sync.Mutex
 	readerLens                [][]byte
@@ -66,9 +86,11 @@ func (store *defaultValueStore) newValueReadFile(nameTimestamp int64) (*valueSto
 			return nil, err
 		}
 		if i == 0 {
-			if _, checksumInterval, err = readValueHeader(fp); err != nil {
+			var header []byte
+			if header, checksumInterval, err = readValueHeader(fp); err != nil {
 				return nil, err
 			}
+			fl.version = valueFileVersion(header)
 		}
 		fl.readerFPs[i] = brimio.NewChecksummedReader(fp, int(checksumInterval), murmur3.New32)
 		fl.readerLens[i] = make([]byte, 4)
@@ -83,7 +105,7 @@ func (store *defaultValueStore) newValueReadFile(nameTimestamp int64) (*valueSto
 }
 
 func (store *defaultValueStore) createValueReadWriteFile() (*valueStoreFile, error) {
-	fl := &valueStoreFile{store: store, nameTimestamp: time.Now().UnixNano()}
+	fl := &valueStoreFile{store: store, nameTimestamp: time.Now().UnixNano(), version: 1}
 	fl.fullPath = path.Join(store.path, fmt.Sprintf("%019d.value", fl.nameTimestamp))
 	fp, err := store.createWriteCloser(fl.fullPath)
 	if err != nil {
@@ -98,7 +120,7 @@ func (store *defaultValueStore) createValueReadWriteFile() (*valueStoreFile, err
 	fl.writerToDiskBufChan = make(chan *valueStoreFileWriteBuf, store.workers)
 	fl.writerDoneChan = make(chan struct{})
 	fl.writerCurrentBuf = <-fl.writerFreeBufChan
-	head := []byte("VALUESTORE v0                   ")
+	head := []byte("VALUESTORE v1                   ")
 	binary.BigEndian.PutUint32(head[28:], store.checksumInterval)
 	fl.writerCurrentBuf.offset = uint32(copy(fl.writerCurrentBuf.buf, head))
 	atomic.StoreUint32(&fl.writerOffset, fl.writerCurrentBuf.offset)
@@ -139,7 +161,14 @@ func (fl *valueStoreFile) read(keyA uint64, keyB uint64, timestampbits uint64, o
 	i := int(keyA>>1) % len(fl.readerFPs)
 	fl.readerLocks[i].Lock()
 	fl.readerFPs[i].Seek(int64(offset), 0)
-	end := len(value) + int(length)
+	// v1 values are read along with their checksums, which are then
+	// trimmed off.
+	readLength := int(length)
+	if fl.version >= 1 {
+		readLength += _VALUE_FILE_VALUE_CHECKSUM_SIZE
+	}
+	start := len(value)
+	end := start + readLength
 	if end <= cap(value) {
 		value = value[:end]
 	} else {
@@ -147,11 +176,17 @@ func (fl *valueStoreFile) read(keyA uint64, keyB uint64, timestampbits uint64, o
 		copy(value2, value)
 		value = value2
 	}
-	if _, err := io.ReadFull(fl.readerFPs[i], value[len(value)-int(length):]); err != nil {
+	if _, err := io.ReadFull(fl.readerFPs[i], value[start:]); err != nil {
 		fl.readerLocks[i].Unlock()
 		return timestampbits, value, err
 	}
 	fl.readerLocks[i].Unlock()
+	if fl.version >= 1 {
+		value = value[:start+int(length)]
+		if murmur3.Sum32(value[start:]) != binary.BigEndian.Uint32(value[len(value):end]) {
+			return timestampbits, value, fmt.Errorf("checksum mismatch for value at offset %d in %s", offset, fl.fullPath)
+		}
+	}
 	return timestampbits, value, nil
 }
 
@@ -204,11 +239,7 @@ func (fl *valueStoreFile) closeWriting() error {
 	}
 	fl.writerToDiskBufChan <- nil
 	<-fl.writerDoneChan
-	// Make sure any trailing data is covered by a checksum by writing an
-	// additional block of zeros (since this is a value file and the TOC won't
-	// reference these additional locations, they are effectively ignored).
-	term := make([]byte, fl.store.checksumInterval)
-	copy(term[len(term)-8:], []byte("TERM v0 "))
+	term := valueTermBlock(fl.store.checksumInterval)
 	left := len(term)
 	for left > 0 {
 		n := copy(fl.writerCurrentBuf.buf[fl.writerCurrentBuf.offset:fl.store.checksumInterval], term[len(term)-left:])
@@ -298,10 +329,12 @@ func (fl *valueStoreFile) writer() {
 			fl.writerToDiskBufChan <- buf
 			continue
 		}
+		begin := time.Now()
 		if _, err := fl.writerFP.Write(buf.buf); err != nil {
 			fl.store.logger.Error("write error", zap.String("name", fl.store.loggerPrefix+"storeFile"), zap.String("path", fl.fullPath), zap.Error(err))
 			break
 		}
+		fl.store.fileWriteLatency.observeSince(begin)
 		if len(buf.memBlocks) > 0 {
 			for _, memBlock := range buf.memBlocks {
 				fl.store.freeableMemBlockChans[fl.freeableMemBlockChanIndex] <- memBlock
@@ -336,13 +369,13 @@ func _readValueHeader(fpr io.Reader, toc bool) ([]byte, uint32, error) {
 	if n, err := io.ReadFull(fpr, buf); err != nil {
 		return buf[:n], 0, err
 	}
-	var cmp []byte
+	var cmp [][]byte
 	if toc {
-		cmp = []byte("VALUESTORETOC v0            ")
+		cmp = [][]byte{[]byte("VALUESTORETOC v0            "), []byte("VALUESTORETOC v1            ")}
 	} else {
-		cmp = []byte("VALUESTORE v0               ")
+		cmp = [][]byte{[]byte("VALUESTORE v0               "), []byte("VALUESTORE v1               ")}
 	}
-	if !bytes.Equal(buf[:28], cmp) {
+	if !bytes.Equal(buf[:28], cmp[0]) && !bytes.Equal(buf[:28], cmp[1]) {
 		return buf, 0, errors.New("unknown file type in header")
 	}
 	checksumInterval := binary.BigEndian.Uint32(buf[28:])
@@ -352,6 +385,15 @@ func _readValueHeader(fpr io.Reader, toc bool) ([]byte, uint32, error) {
 	return buf, checksumInterval, nil
 }
 
+// valueFileVersion returns the format version of a values or toc file from
+// its header.
+func valueFileVersion(header []byte) int {
+	if bytes.HasPrefix(header, []byte("VALUESTORE v1")) || bytes.HasPrefix(header, []byte("VALUESTORETOC v1")) {
+		return 1
+	}
+	return 0
+}
+
 type valueTOCEntry struct {
 	KeyA uint64
 	KeyB uint64
@@ -360,6 +402,8 @@ type valueTOCEntry struct {
 	BlockID       uint32
 	Offset        uint32
 	Length        uint32
+	// Checksum is the murmur3 of the value, from v1 toc files only.
+	Checksum uint32
 }
 
 func valueReadTOCEntriesBatched(fpr io.ReadSeeker, blockID uint32, freeBatchChans []chan []valueTOCEntry, pendingBatchChans []chan []valueTOCEntry, controlChan chan struct{}) (int, []error) {
@@ -368,13 +412,17 @@ func valueReadTOCEntriesBatched(fpr io.ReadSeeker, blockID uint32, freeBatchChan
 	// greater than the _VALUE_FILE_TRAILER_SIZE.
 	var errs []error
 	var checksumInterval int
-	if _, ci, err := readValueHeaderTOC(fpr); err != nil {
+	entrySize := _VALUE_FILE_ENTRY_SIZE
+	if header, ci, err := readValueHeaderTOC(fpr); err != nil {
 		return 0, append(errs, err)
 	} else {
 		checksumInterval = int(ci)
+		if valueFileVersion(header) >= 1 {
+			entrySize = _VALUE_FILE_ENTRY_SIZE_V1
+		}
 	}
 	fpr.Seek(0, 0)
-	buf := make([]byte, checksumInterval+4+_VALUE_FILE_ENTRY_SIZE)
+	buf := make([]byte, checksumInterval+4+entrySize)
 	rpos := 0
 	checksumErrors := 0
 	workers := uint64(len(freeBatchChans))
@@ -406,7 +454,7 @@ L1:
 			if binary.BigEndian.Uint32(cbuf) != murmur3.Sum32(rbuf) {
 				checksumErrors++
 				rbuf = buf[:rpos+len(rbuf)]
-				skipNext = _VALUE_FILE_ENTRY_SIZE - ((skipNext + len(rbuf)) % _VALUE_FILE_ENTRY_SIZE)
+				skipNext = entrySize - ((skipNext + len(rbuf)) % entrySize)
 				rpos = 0
 				continue
 			}
@@ -424,7 +472,7 @@ L1:
 				errs = append(errs, errors.New("no terminator found"))
 			}
 		}
-		for len(rbuf) >= _VALUE_FILE_ENTRY_SIZE {
+		for len(rbuf) >= entrySize {
 
 			offset := binary.BigEndian.Uint32(rbuf[24:])
 
@@ -446,13 +494,17 @@ L1:
 				wr.Offset = offset
 				wr.Length = binary.BigEndian.Uint32(rbuf[28:])
 
+				wr.Checksum = 0
+				if entrySize == _VALUE_FILE_ENTRY_SIZE_V1 {
+					wr.Checksum = binary.BigEndian.Uint32(rbuf[_VALUE_FILE_ENTRY_SIZE:])
+				}
 				batchesPos[k]++
 				if batchesPos[k] >= batchSize {
 					pendingBatchChans[k] <- batches[k]
 					batches[k] = nil
 				}
 			}
-			rbuf = rbuf[_VALUE_FILE_ENTRY_SIZE:]
+			rbuf = rbuf[entrySize:]
 		}
 		rpos = copy(buf, rbuf)
 	}
@@ -477,16 +529,20 @@ func valueTOCStat(fullPath string, statter func(fullPath string) (os.FileInfo, e
 	if err != nil {
 		return 0, err
 	}
-	_, checksumInterval, err := readValueHeaderTOC(fpr)
+	header, checksumInterval, err := readValueHeaderTOC(fpr)
 	closeIfCloser(fpr)
 	if err != nil {
 		return 0, err
 	}
+	entrySize := int64(_VALUE_FILE_ENTRY_SIZE)
+	if valueFileVersion(header) >= 1 {
+		entrySize = _VALUE_FILE_ENTRY_SIZE_V1
+	}
 	size := fileInfo.Size()
 	checksumsRemoved := size - size/(int64(checksumInterval)+4)*4
 	// NOTE: Store always writes the trailer as a full checksum interval block.
 	headerAndTrailerRemoved := checksumsRemoved - _VALUE_FILE_HEADER_SIZE - int64(checksumInterval)
-	return int(headerAndTrailerRemoved / _VALUE_FILE_ENTRY_SIZE), nil
+	return int(headerAndTrailerRemoved / entrySize), nil
 }
 
 type valueCorruptRange struct {
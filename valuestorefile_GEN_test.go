@@ -4,8 +4,13 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"os"
+	"path"
+	"strings"
 	"testing"
 
+	"github.com/gholt/brimio"
+	"github.com/spaolacci/murmur3"
 	"golang.org/x/net/context"
 )
 
@@ -126,7 +131,7 @@ func TestValueValuesFileWritingEmpty(t *testing.T) {
 	if bl != _VALUE_FILE_HEADER_SIZE+cfg.ChecksumInterval+4 {
 		t.Fatal(bl)
 	}
-	if string(buf.buf[:28]) != "VALUESTORE v0               " {
+	if string(buf.buf[:28]) != "VALUESTORE v1               " {
 		t.Fatal(string(buf.buf[:28]))
 	}
 	if binary.BigEndian.Uint32(buf.buf[28:]) != store.checksumInterval {
@@ -170,7 +175,7 @@ func TestValueValuesFileWritingEmpty2(t *testing.T) {
 	if bl != _VALUE_FILE_HEADER_SIZE+cfg.ChecksumInterval+4 {
 		t.Fatal(bl)
 	}
-	if string(buf.buf[:28]) != "VALUESTORE v0               " {
+	if string(buf.buf[:28]) != "VALUESTORE v1               " {
 		t.Fatal(string(buf.buf[:28]))
 	}
 	if binary.BigEndian.Uint32(buf.buf[28:]) != store.checksumInterval {
@@ -214,7 +219,7 @@ func TestValueValuesFileWriting(t *testing.T) {
 	if bl != 1234+_VALUE_FILE_HEADER_SIZE+cfg.ChecksumInterval+4 {
 		t.Fatal(bl)
 	}
-	if string(buf.buf[:28]) != "VALUESTORE v0               " {
+	if string(buf.buf[:28]) != "VALUESTORE v1               " {
 		t.Fatal(string(buf.buf[:28]))
 	}
 	if binary.BigEndian.Uint32(buf.buf[28:]) != store.checksumInterval {
@@ -263,7 +268,7 @@ func TestValueValuesFileWritingMore(t *testing.T) {
 	if bl != el {
 		t.Fatal(bl, el)
 	}
-	if string(buf.buf[:28]) != "VALUESTORE v0               " {
+	if string(buf.buf[:28]) != "VALUESTORE v1               " {
 		t.Fatal(string(buf.buf[:28]))
 	}
 	if binary.BigEndian.Uint32(buf.buf[28:]) != store.checksumInterval {
@@ -319,7 +324,7 @@ func TestValueValuesFileWritingMultiple(t *testing.T) {
 	if bl != el {
 		t.Fatal(bl, el)
 	}
-	if string(buf.buf[:28]) != "VALUESTORE v0               " {
+	if string(buf.buf[:28]) != "VALUESTORE v1               " {
 		t.Fatal(string(buf.buf[:28]))
 	}
 	if binary.BigEndian.Uint32(buf.buf[28:]) != store.checksumInterval {
@@ -329,3 +334,97 @@ func TestValueValuesFileWritingMultiple(t *testing.T) {
 		t.Fatal(string(buf.buf[bl-_VALUE_FILE_TRAILER_SIZE:]))
 	}
 }
+
+func TestValueValuesFileReadingV1(t *testing.T) {
+	cfg := newTestValueStoreConfig()
+	buf := &memBuf{buf: []byte("VALUESTORE v1                   45678....")}
+	binary.BigEndian.PutUint32(buf.buf[28:], 65532)
+	binary.BigEndian.PutUint32(buf.buf[_VALUE_FILE_HEADER_SIZE+5:], murmur3.Sum32([]byte("45678")))
+	cfg.openReadSeeker = func(fullPath string) (io.ReadSeeker, error) {
+		return &memFile{buf: buf}, nil
+	}
+	store, _ := newTestValueStore(cfg)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	fl, err := store.newValueReadFile(12345)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fl.version != 1 {
+		t.Fatal(fl.version)
+	}
+	_, v, err := fl.read(1, 2, 0x300, _VALUE_FILE_HEADER_SIZE, 5, []byte("testing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "testing45678" {
+		t.Fatal(string(v))
+	}
+	// A value that no longer matches its checksum is an error.
+	buf.buf[_VALUE_FILE_HEADER_SIZE+1] = 'X'
+	if _, _, err = fl.read(1, 2, 0x300, _VALUE_FILE_HEADER_SIZE, 5, nil); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatal(err)
+	}
+}
+
+func TestValueFileUpgrade(t *testing.T) {
+	fs := newMemFS()
+	cfg := newTestValueStoreConfigWithFS(fs)
+	store, _ := newTestValueStore(cfg)
+	// A v0 file pair, as written before values had their own checksums.
+	write := func(fullPath string, data ...[]byte) {
+		fp, _ := fs.createWriteCloser(fullPath)
+		w := brimio.NewMultiCoreChecksummedWriter(fp, cfg.ChecksumInterval, murmur3.New32, 1)
+		for _, d := range data {
+			w.Write(d)
+		}
+		w.Write(valueTermBlock(uint32(cfg.ChecksumInterval)))
+		w.Close()
+	}
+	head := []byte("VALUESTORE v0                   ")
+	binary.BigEndian.PutUint32(head[28:], uint32(cfg.ChecksumInterval))
+	write(path.Join(store.path, "0000000000000000001.value"), head, []byte("old"))
+	headtoc := []byte("VALUESTORETOC v0                ")
+	binary.BigEndian.PutUint32(headtoc[28:], uint32(cfg.ChecksumInterval))
+	entry := make([]byte, _VALUE_FILE_ENTRY_SIZE)
+	binary.BigEndian.PutUint64(entry, 1)
+	binary.BigEndian.PutUint64(entry[8:], 2)
+
+	binary.BigEndian.PutUint64(entry[16:], 0x500)
+	binary.BigEndian.PutUint32(entry[24:], _VALUE_FILE_HEADER_SIZE)
+	binary.BigEndian.PutUint32(entry[28:], 3)
+
+	write(path.Join(store.pathtoc, "0000000000000000001.valuetoc"), headtoc, entry)
+	if err := store.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown(context.Background())
+	read := func() {
+		_, value, err := store.Read(context.Background(), 1, 2, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != "old" {
+			t.Fatal(string(value))
+		}
+	}
+	read()
+	// The file has no waste but is rewritten in the current format anyway.
+	result, err := store.CompactionPass(context.Background(), &CompactionPassOptions{IgnoreAgeThreshold: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FilesCompacted != 1 || result.ItemsRewritten != 1 {
+		t.Fatal(result)
+	}
+	if _, err := fs.stat(path.Join(store.pathtoc, "0000000000000000001.valuetoc")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	_, blockID, _, _ := store.locmap.Get(1, 2)
+	if fl, ok := store.locBlock(blockID).(*valueStoreFile); !ok || fl.version != 1 {
+		t.Fatal(blockID)
+	}
+	read()
+}